@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"time"
+)
+
+// backfillDateLayout is the layout of the -since and -until flags
+const backfillDateLayout = "2006-01-02"
+
+// backfillOptions are the flags of the backfill command
+type backfillOptions struct {
+	since time.Time
+	// until is exclusive; zero means up to now
+	until time.Time
+	// interval is the pause between forwarded emails
+	interval time.Duration
+	dryRun   bool
+}
+
+func parseBackfillFlags(args []string) (backfillOptions, error) {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	since := flags.String("since", "", "First day to forward, YYYY-MM-DD")
+	until := flags.String("until", "", "Day to stop before, YYYY-MM-DD; up to now by default")
+	interval := flags.Duration("interval", 2*time.Second, "Pause between forwarded emails")
+	dryRun := flags.Bool("dry-run", false, "List the emails that would be forwarded without sending them")
+
+	if err := flags.Parse(args); err != nil {
+		return backfillOptions{}, err
+	}
+
+	if *since == "" || flags.NArg() > 0 {
+		return backfillOptions{}, fmt.Errorf("usage: backfill -since YYYY-MM-DD [-until YYYY-MM-DD] [-interval 2s] [-dry-run]")
+	}
+
+	opts := backfillOptions{interval: *interval, dryRun: *dryRun}
+
+	var err error
+
+	if opts.since, err = time.ParseInLocation(backfillDateLayout, *since, time.Local); err != nil {
+		return backfillOptions{}, fmt.Errorf("invalid -since date %q: use YYYY-MM-DD", *since)
+	}
+
+	if *until != "" {
+		if opts.until, err = time.ParseInLocation(backfillDateLayout, *until, time.Local); err != nil {
+			return backfillOptions{}, fmt.Errorf("invalid -until date %q: use YYYY-MM-DD", *until)
+		}
+
+		if !opts.until.After(opts.since) {
+			return backfillOptions{}, fmt.Errorf("-until %s is not after -since %s", *until, *since)
+		}
+	}
+
+	if opts.interval < 0 {
+		return backfillOptions{}, fmt.Errorf("-interval must not be negative")
+	}
+
+	return opts, nil
+}
+
+// query selects the emails of the date range in Gmail search syntax
+func (o backfillOptions) query() string {
+	query := fmt.Sprintf("after:%d", o.since.Unix())
+	if !o.until.IsZero() {
+		query += fmt.Sprintf(" before:%d", o.until.Unix())
+	}
+
+	return query
+}
+
+// cursorKey identifies the progress of a date range in the state store
+func (o backfillOptions) cursorKey() string {
+	until := "now"
+	if !o.until.IsZero() {
+		until = o.until.Format(backfillDateLayout)
+	}
+
+	return "backfill|" + o.since.Format(backfillDateLayout) + "|" + until
+}
+
+// runBackfillCommand forwards the Gmail emails of a date range, see parseBackfillFlags
+func runBackfillCommand(ctx context.Context, svc *services, args []string, out io.Writer) error {
+	opts, err := parseBackfillFlags(args)
+	if err != nil {
+		return err
+	}
+
+	source := svc.source
+	if dryRun, ok := source.(*dryRunSource); ok {
+		source = dryRun.MailSource
+	}
+
+	client, ok := source.(*GmailClient)
+	if !ok {
+		return fmt.Errorf("backfill needs the gmail source")
+	}
+
+	return backfill(ctx, svc, client, opts, out)
+}
+
+// backfill forwards the emails of a date range oldest first with processMessage. After every
+// email the last handled ID is saved, so an interrupted run continues where it stopped; dry
+// runs only list the emails to out.
+func backfill(ctx context.Context, svc *services, client *GmailClient, opts backfillOptions, out io.Writer) error {
+	ids, err := client.listMessageIDs(opts.query())
+	if err != nil {
+		return err
+	}
+
+	// Gmail lists newest first
+	slices.Reverse(ids)
+
+	key := opts.cursorKey()
+	start := 0
+
+	if last := svc.state.Cursor(key); last != "" && !opts.dryRun {
+		if i := slices.Index(ids, last); i >= 0 {
+			start = i + 1
+			log.Printf("Resuming backfill after message %s, %d of %d emails done", last, start, len(ids))
+		}
+	}
+
+	log.Printf("Backfilling %d emails...", len(ids)-start)
+
+	// Old emails are posted right away; a hold would skip them as the progress moves past them
+	svc.quiet = nil
+
+	forwarded := 0
+
+	for _, id := range ids[start:] {
+		msg, err := client.fetchMessage(id)
+		if err != nil {
+			return err
+		}
+
+		msg, matches := prepareMessage(client.config, client.config.Gmail.Filter, msg)
+
+		switch {
+		case client.isForwarded(msg) || !matches:
+		case opts.dryRun:
+			fmt.Fprintf(out, "%s\t%s\t%s\t%s\n", msg.Time.Format("2006-01-02 15:04"), routeName(msg.Route), msg.From, msg.Subject)
+			forwarded++
+		default:
+			if forwarded > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(opts.interval):
+				}
+			}
+
+			log.Printf("Backfilling message %s: %s", id, msg.Subject)
+
+			if err := processMessage(ctx, svc, msg); err != nil {
+				return fmt.Errorf("failed to forward message %s, run backfill again to resume: %w", id, err)
+			}
+
+			forwarded++
+		}
+
+		if opts.dryRun {
+			continue
+		}
+
+		if err := svc.state.SetCursor(key, id); err != nil {
+			return fmt.Errorf("failed to save backfill progress: %w", err)
+		}
+	}
+
+	if opts.dryRun {
+		log.Printf("Dry run: %d of %d emails would be forwarded", forwarded, len(ids))
+	} else {
+		log.Printf("Backfill completed: %d emails forwarded", forwarded)
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestParseBackfillFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		wantQuery string
+		wantErr   bool
+	}{
+		{
+			name:      "range",
+			args:      []string{"-since", "2025-01-01", "-until", "2025-03-01"},
+			wantQuery: "after:1735689600 before:1740787200",
+		},
+		{name: "open range", args: []string{"-since", "2025-01-01", "-dry-run"}, wantQuery: "after:1735689600"},
+		{name: "missing since", args: []string{"-until", "2025-03-01"}, wantErr: true},
+		{name: "invalid date", args: []string{"-since", "01.01.2025"}, wantErr: true},
+		{name: "until before since", args: []string{"-since", "2025-03-01", "-until", "2025-01-01"}, wantErr: true},
+	}
+
+	local := time.Local
+	time.Local = time.UTC
+
+	defer func() { time.Local = local }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := parseBackfillFlags(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBackfillFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if !tt.wantErr && opts.query() != tt.wantQuery {
+				t.Errorf("query() = %q, want %q", opts.query(), tt.wantQuery)
+			}
+		})
+	}
+}
+
+// backfillMessage builds a Gmail message for the mock service
+func backfillMessage(id, from string, labels ...string) *gmail.Message {
+	return &gmail.Message{
+		Id:       id,
+		LabelIds: labels,
+		Payload: &gmail.MessagePart{
+			Headers: []*gmail.MessagePartHeader{
+				{Name: "Subject", Value: id},
+				{Name: "From", Value: from},
+				{Name: "Date", Value: "Fri, 28 Mar 2025 14:49:17 +0000"},
+			},
+			Body: &gmail.MessagePartBody{Data: "SGVsbG8gV29ybGQ="},
+		},
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	mock := NewMockGmailService()
+	mock.pageSize = 2
+	// Gmail lists newest first; m3 was forwarded before and m2 does not pass the filter
+	mock.messages = []*gmail.Message{
+		backfillMessage("m5", "school@example.com"),
+		backfillMessage("m4", "school@example.com"),
+		backfillMessage("m3", "school@example.com", "fwd"),
+		backfillMessage("m2", "shop@example.org"),
+		backfillMessage("m1", "school@example.com"),
+	}
+
+	config := &Config{Gmail: GmailConfig{ForwardedLabel: "Forwarded", Filter: FilterConfig{From: []string{"@example.com"}}}}
+	client := &GmailClient{service: mock, config: config, labelID: "fwd"}
+	client.markAsForwarded = client.defaultMarkAsForwarded
+
+	var (
+		sent   []string
+		failAt = "m4"
+	)
+
+	// Quiet hours holding emails all day must not hold back the backfill
+	quiet, err := NewQuietHours(&Config{QuietHours: QuietHoursConfig{Start: "00:00", End: "23:59", Mode: quietHold}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, _ := NewStateStore("")
+	svc := &services{
+		source: client,
+		translation: &TranslationService{config: config, translate: func(ctx context.Context, msg Message) (Translation, error) {
+			return Translation{Content: msg.Content}, nil
+		}},
+		notifiers: Notifiers{sinkTelegram: notifierFunc(func(ctx context.Context, n Notification) error {
+			if n.Message.Subject == failAt {
+				return errors.New("telegram is down")
+			}
+
+			sent = append(sent, n.Message.Subject)
+
+			return nil
+		})},
+		quiet: quiet,
+		state: state,
+	}
+
+	opts := backfillOptions{since: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	var out strings.Builder
+	if err := backfill(context.Background(), svc, client, backfillOptions{since: opts.since, dryRun: true}, &out); err != nil {
+		t.Fatalf("backfill() dry run error = %v", err)
+	}
+
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 3 || !strings.HasSuffix(lines[0], "\tm1") {
+		t.Errorf("dry run listed %q, want m1, m4 and m5", out.String())
+	}
+
+	if len(sent) != 0 || state.Cursor(opts.cursorKey()) != "" {
+		t.Fatalf("dry run sent %v and saved progress", sent)
+	}
+
+	err = backfill(context.Background(), svc, client, opts, &out)
+	if err == nil || !strings.Contains(err.Error(), "message m4") {
+		t.Fatalf("backfill() error = %v, want the failure at m4", err)
+	}
+
+	if cursor := state.Cursor(opts.cursorKey()); cursor != "m3" {
+		t.Errorf("progress = %q, want m3", cursor)
+	}
+
+	// The second run continues after the saved progress
+	failAt = ""
+
+	if err := backfill(context.Background(), svc, client, opts, &out); err != nil {
+		t.Fatalf("backfill() error = %v", err)
+	}
+
+	if got := strings.Join(sent, ","); got != "m1,m4,m5" {
+		t.Errorf("forwarded %s, want m1,m4,m5", got)
+	}
+
+	if len(mock.queries) == 0 || mock.queries[0] != "after:1735689600" {
+		t.Errorf("queries = %v", mock.queries)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheFile       = "translation_cache.json"
+	defaultCacheTTL        = 30 * 24 * time.Hour
+	defaultCacheMaxEntries = 1000
+	defaultCacheMaxSizeMB  = 10
+)
+
+// TranslationCacheConfig keeps translations of identical emails so they are not paid for twice
+type TranslationCacheConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	File    string `yaml:"file"`
+	// TTL is how long a translation is reused, 720h (30 days) by default
+	TTL        string `yaml:"ttl"`
+	MaxEntries int    `yaml:"max_entries"`
+	// MaxSizeMB bounds the cached entries and their keys, 10 MB by default
+	MaxSizeMB int `yaml:"max_size_mb"`
+}
+
+type cacheEntry struct {
+	Value string `json:"value"`
+	// Subject, Sender and Attachments are the translated headers, if the route asked for them
+	Subject     string    `json:"subject,omitempty"`
+	Sender      string    `json:"sender,omitempty"`
+	Attachments []string  `json:"attachments,omitempty"`
+	Model       string    `json:"model,omitempty"`
+	Created     time.Time `json:"created"`
+	Used        time.Time `json:"used"`
+}
+
+// size is the number of bytes the entry's strings take up
+func (e cacheEntry) size() int {
+	size := len(e.Value) + len(e.Subject) + len(e.Sender) + len(e.Model)
+	for _, attachment := range e.Attachments {
+		size += len(attachment)
+	}
+
+	return size
+}
+
+// TranslationCache is a persistent cache of translations with expiry. When it is full the
+// least recently used entries are dropped.
+type TranslationCache struct {
+	path       string
+	ttl        time.Duration
+	maxEntries int
+	maxBytes   int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	hits    int64
+	misses  int64
+	// discard keeps new entries in memory only, for dry runs
+	discard bool
+}
+
+// NewTranslationCache loads the cache file, dropping expired entries
+func NewTranslationCache(config TranslationCacheConfig) (*TranslationCache, error) {
+	ttl := defaultCacheTTL
+	if config.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(config.TTL); err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid translation cache ttl %q", config.TTL)
+		}
+	}
+
+	c := &TranslationCache{
+		path:       config.File,
+		ttl:        ttl,
+		maxEntries: config.MaxEntries,
+		maxBytes:   config.MaxSizeMB << 20,
+		now:        time.Now,
+		entries:    make(map[string]cacheEntry),
+	}
+
+	if c.path == "" {
+		c.path = defaultCacheFile
+	}
+
+	if c.maxEntries <= 0 {
+		c.maxEntries = defaultCacheMaxEntries
+	}
+
+	if c.maxBytes <= 0 {
+		c.maxBytes = defaultCacheMaxSizeMB << 20
+	}
+
+	raw, err := os.ReadFile(c.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read translation cache: %v", err)
+	}
+
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &c.entries); err != nil {
+			return nil, fmt.Errorf("unable to parse translation cache: %v", err)
+		}
+	}
+
+	c.evict("")
+
+	return c, nil
+}
+
+// cacheKey hashes everything a translation depends on
+func cacheKey(parts ...string) string {
+	hash := sha256.New()
+
+	for _, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Get returns the cached translation of key and the model that produced it unless it has expired
+func (c *TranslationCache) Get(key string) (Translation, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || c.expired(entry) {
+		c.misses++
+
+		return Translation{}, "", false
+	}
+
+	c.hits++
+	entry.Used = c.now()
+	c.entries[key] = entry
+
+	translation := Translation{
+		Content:     entry.Value,
+		Subject:     entry.Subject,
+		Sender:      entry.Sender,
+		Attachments: entry.Attachments,
+	}
+
+	return translation, entry.Model, true
+}
+
+// Put stores a translation and the model that produced it under key and writes the cache file
+func (c *TranslationCache) Put(key string, translation Translation, model string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	c.entries[key] = cacheEntry{
+		Value:       translation.Content,
+		Subject:     translation.Subject,
+		Sender:      translation.Sender,
+		Attachments: translation.Attachments,
+		Model:       model,
+		Created:     now,
+		Used:        now,
+	}
+	c.evict(key)
+
+	if c.discard {
+		return nil
+	}
+
+	raw, err := json.Marshal(c.entries)
+	if err != nil {
+		return fmt.Errorf("unable to encode translation cache: %v", err)
+	}
+
+	if err := writeFileAtomic(c.path, raw); err != nil {
+		return fmt.Errorf("unable to write translation cache: %v", err)
+	}
+
+	return nil
+}
+
+// discardChanges stops writing the cache file, for dry runs
+func (c *TranslationCache) discardChanges() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.discard = true
+}
+
+// Stats returns the number of cache hits and misses since startup
+func (c *TranslationCache) Stats() (hits, misses int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hits, c.misses
+}
+
+func (c *TranslationCache) expired(entry cacheEntry) bool {
+	return c.now().Sub(entry.Created) > c.ttl
+}
+
+// evict drops expired entries and then the least recently used ones until the cache fits its
+// limits, never keep. Ties go to the smaller key, so eviction does not depend on map order;
+// callers must hold c.mu
+func (c *TranslationCache) evict(keep string) {
+	size := 0
+
+	for key, entry := range c.entries {
+		if c.expired(entry) {
+			delete(c.entries, key)
+
+			continue
+		}
+
+		size += len(key) + entry.size()
+	}
+
+	for len(c.entries) > c.maxEntries || size > c.maxBytes {
+		var (
+			oldestKey string
+			oldest    cacheEntry
+		)
+
+		for key, entry := range c.entries {
+			if key == keep {
+				continue
+			}
+
+			if oldestKey == "" || entry.Used.Before(oldest.Used) || entry.Used.Equal(oldest.Used) && key < oldestKey {
+				oldestKey, oldest = key, entry
+			}
+		}
+
+		// Only keep is left
+		if oldestKey == "" {
+			break
+		}
+
+		delete(c.entries, oldestKey)
+		size -= len(oldestKey) + oldest.size()
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T, config TranslationCacheConfig) (*TranslationCache, *time.Time) {
+	t.Helper()
+
+	if config.File == "" {
+		config.File = filepath.Join(t.TempDir(), "cache.json")
+	}
+
+	cache, err := NewTranslationCache(config)
+	if err != nil {
+		t.Fatalf("NewTranslationCache() error = %v", err)
+	}
+
+	now := time.Date(2025, 4, 1, 12, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+
+	return cache, &now
+}
+
+func TestTranslationCachePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	cache, _ := newTestCache(t, TranslationCacheConfig{File: path})
+
+	if _, _, ok := cache.Get("k"); ok {
+		t.Fatal("Get() found a value in an empty cache")
+	}
+
+	if err := cache.Put("k", Translation{Content: "translated"}, "gemini-2.0-flash"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	reloaded, err := NewTranslationCache(TranslationCacheConfig{File: path, TTL: "87600h"})
+	if err != nil {
+		t.Fatalf("NewTranslationCache() reload error = %v", err)
+	}
+
+	if got, model, ok := reloaded.Get("k"); !ok || got.Content != "translated" || model != "gemini-2.0-flash" {
+		t.Errorf("Get() after reload = %q, %q, %v", got, model, ok)
+	}
+
+	if hits, misses := cache.Stats(); hits != 0 || misses != 1 {
+		t.Errorf("Stats() = %d hits, %d misses, want 0 and 1", hits, misses)
+	}
+}
+
+func TestTranslationCacheTTL(t *testing.T) {
+	cache, now := newTestCache(t, TranslationCacheConfig{TTL: "24h"})
+
+	_ = cache.Put("k", Translation{Content: "translated"}, "")
+
+	*now = now.Add(23 * time.Hour)
+
+	if _, _, ok := cache.Get("k"); !ok {
+		t.Error("entry expired before its TTL")
+	}
+
+	*now = now.Add(2 * time.Hour)
+
+	if _, _, ok := cache.Get("k"); ok {
+		t.Error("entry is still returned after its TTL")
+	}
+}
+
+func TestTranslationCacheLimits(t *testing.T) {
+	cache, now := newTestCache(t, TranslationCacheConfig{MaxEntries: 2})
+
+	for _, key := range []string{"a", "b"} {
+		_ = cache.Put(key, Translation{Content: key}, "")
+		*now = now.Add(time.Minute)
+	}
+
+	// Reading a makes b the least recently used entry
+	cache.Get("a")
+	*now = now.Add(time.Minute)
+
+	_ = cache.Put("c", Translation{Content: "c"}, "")
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, _, ok := cache.Get(key); ok != want {
+			t.Errorf("Get(%q) found = %v, want %v", key, ok, want)
+		}
+	}
+
+	// Both entries are used at the same time; the one being stored is never the one dropped
+	sized, _ := newTestCache(t, TranslationCacheConfig{MaxSizeMB: 1})
+
+	_ = sized.Put("small", Translation{Content: strings.Repeat("x", 600<<10)}, "")
+	_ = sized.Put("big", Translation{Content: strings.Repeat("y", 600<<10)}, "")
+
+	if _, _, ok := sized.Get("small"); ok {
+		t.Error("cache grew beyond max_size_mb")
+	}
+
+	if _, _, ok := sized.Get("big"); !ok {
+		t.Error("cache dropped the entry it was storing")
+	}
+
+	// Translated headers and attachment names count towards the size too
+	headers, _ := newTestCache(t, TranslationCacheConfig{MaxSizeMB: 1})
+
+	_ = headers.Put("subject", Translation{Content: "x", Subject: strings.Repeat("s", 600<<10)}, "")
+	_ = headers.Put("attachments", Translation{Content: "y", Attachments: []string{strings.Repeat("a", 600<<10)}}, "")
+
+	if _, _, ok := headers.Get("subject"); ok {
+		t.Error("cache ignored the size of translated headers")
+	}
+}
+
+func TestTranslateUsesCache(t *testing.T) {
+	cache, _ := newTestCache(t, TranslationCacheConfig{})
+
+	calls := 0
+	service := &TranslationService{
+		config: &Config{Translation: TranslationConfig{TargetLanguage: "en"}},
+		cache:  cache,
+		translate: func(ctx context.Context, msg Message) (Translation, error) {
+			calls++
+
+			return Translation{Content: "translated " + msg.Content}, nil
+		},
+	}
+
+	ctx := context.Background()
+
+	for range 2 {
+		if got, err := service.Translate(ctx, Message{Content: "Jūsu sūtījums ir ceļā"}); err != nil || got.Content != "translated Jūsu sūtījums ir ceļā" {
+			t.Fatalf("Translate() = %q, %v", got.Content, err)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("translated %d times, want the second call served from the cache", calls)
+	}
+
+	// Another target language is another cache entry
+	service.config.Translation.TargetLanguage = "ru"
+
+	if _, err := service.Translate(ctx, Message{Content: "Jūsu sūtījums ir ceļā"}); err != nil || calls != 2 {
+		t.Errorf("Translate() with another language: calls = %d, err = %v", calls, err)
+	}
+}
+
+func TestNewTranslationCacheInvalidTTL(t *testing.T) {
+	if _, err := NewTranslationCache(TranslationCacheConfig{TTL: "a month"}); err == nil {
+		t.Error("NewTranslationCache() accepted an invalid ttl")
+	}
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+const (
+	defaultEventsPromptTemplate = "Find the appointments, meetings, deadlines and other events with a date in the following email, which was sent on {date}. Resolve relative dates like \"next Friday\" from that date. Write summaries in {target_language}. Use YYYY-MM-DDTHH:MM for events with a time and YYYY-MM-DD for all-day events. Return an empty list when there are none.\n\n{text}"
+
+	icsDateLayout     = "20060102"
+	icsDateTimeLayout = "20060102T150405"
+	icsUTCLayout      = "20060102T150405Z"
+	icsMaxLineOctets  = 75
+
+	// Only the first events of an email get an "Add to calendar" button
+	maxCalendarButtons = 5
+	// Telegram limits document captions to 1024 characters
+	maxCaptionLength = 1024
+)
+
+// CalendarConfig attaches calendar events found in emails to their Telegram posts
+type CalendarConfig struct {
+	// Enabled attaches an .ics file and "Add to calendar" buttons when an email has events
+	Enabled bool `yaml:"enabled"`
+	// Extract also asks Gemini for events in emails without an invitation
+	Extract bool `yaml:"extract"`
+	// Timezone is an IANA name used to show event times and for extracted events; the local
+	// time zone when empty
+	Timezone       string `yaml:"timezone"`
+	PromptTemplate string `yaml:"prompt_template"`
+	PromptFile     string `yaml:"prompt_file"`
+}
+
+// CalendarEvent is an appointment found in an email
+type CalendarEvent struct {
+	UID         string
+	Summary     string
+	Location    string
+	Description string
+	Start       time.Time
+	End         time.Time
+	// AllDay events cover the dates from Start up to, not including, End
+	AllDay bool
+}
+
+// eventsSchema makes Gemini answer with a JSON list of events
+var eventsSchema = &genai.Schema{
+	Type: genai.TypeObject,
+	Properties: map[string]*genai.Schema{
+		"events": {
+			Type: genai.TypeArray,
+			Items: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"summary":     {Type: genai.TypeString},
+					"start":       {Type: genai.TypeString, Description: "YYYY-MM-DDTHH:MM, or YYYY-MM-DD for all-day events"},
+					"end":         {Type: genai.TypeString, Description: "Same format as start, empty when unknown"},
+					"location":    {Type: genai.TypeString},
+					"description": {Type: genai.TypeString},
+				},
+				Required: []string{"summary", "start"},
+			},
+		},
+	},
+	Required: []string{"events"},
+}
+
+type extractedEvent struct {
+	Summary     string `json:"summary"`
+	Start       string `json:"start"`
+	End         string `json:"end"`
+	Location    string `json:"location"`
+	Description string `json:"description"`
+}
+
+// routeCalendar returns the calendar settings of a route, falling back to the top-level ones
+func routeCalendar(config *Config, route *RouteConfig) CalendarConfig {
+	if route != nil && route.Calendar != nil {
+		return *route.Calendar
+	}
+
+	return config.Calendar
+}
+
+func validateCalendar(config *Config) error {
+	calendars := []CalendarConfig{config.Calendar}
+	for _, route := range config.Routes {
+		if route.Calendar != nil {
+			calendars = append(calendars, *route.Calendar)
+		}
+	}
+
+	for _, calendar := range calendars {
+		if _, err := calendarLocation(calendar); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func calendarLocation(config CalendarConfig) (*time.Location, error) {
+	if config.Timezone == "" {
+		return time.Local, nil
+	}
+
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid calendar timezone %q: %v", config.Timezone, err)
+	}
+
+	return location, nil
+}
+
+// CalendarEvents returns the events of msg when its route has calendar attachments enabled.
+// Invitations in the email win over events the model extracts from the text.
+func (s *TranslationService) CalendarEvents(ctx context.Context, msg Message) ([]CalendarEvent, error) {
+	config := routeCalendar(s.config, msg.Route)
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	location, err := calendarLocation(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []CalendarEvent
+
+	// Invitations often come both inline and as an attached file
+	seen := make(map[string]bool)
+
+	for _, calendar := range msg.Calendars {
+		for _, event := range parseICS(calendar) {
+			if event.UID != "" && seen[event.UID] {
+				continue
+			}
+
+			seen[event.UID] = true
+			events = append(events, event)
+		}
+	}
+
+	if len(events) > 0 {
+		// All-day events are dates and stay as they are
+		for i := range events {
+			if !events[i].AllDay {
+				events[i].Start = events[i].Start.In(location)
+				events[i].End = events[i].End.In(location)
+			}
+		}
+
+		return events, nil
+	}
+
+	if !config.Extract || msg.Content == "" {
+		return nil, nil
+	}
+
+	return s.ExtractEvents(ctx, msg, config.PromptTemplate, location)
+}
+
+// ExtractEvents asks the model for the events mentioned in the text of an email. Times
+// without a zone are read in location.
+func (s *TranslationService) ExtractEvents(
+	ctx context.Context,
+	msg Message,
+	promptTemplate string,
+	location *time.Location,
+) ([]CalendarEvent, error) {
+	return s.extractEvents(ctx, msg, promptTemplate, location)
+}
+
+func (s *TranslationService) defaultExtractEvents(
+	ctx context.Context,
+	msg Message,
+	promptTemplate string,
+	location *time.Location,
+) ([]CalendarEvent, error) {
+	if promptTemplate == "" {
+		promptTemplate = defaultEventsPromptTemplate
+	}
+
+	prompt, err := s.prompts.render(promptTemplate, s.promptData(msg))
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := s.generateJSON(ctx, prompt, eventsSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseExtractedEvents(raw, location)
+}
+
+// parseExtractedEvents decodes and validates the model's list of events
+func parseExtractedEvents(raw string, location *time.Location) ([]CalendarEvent, error) {
+	var answer struct {
+		Events []extractedEvent `json:"events"`
+	}
+
+	if err := json.Unmarshal([]byte(strings.TrimSpace(raw)), &answer); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidExtraction, err)
+	}
+
+	events := make([]CalendarEvent, 0, len(answer.Events))
+
+	for _, extracted := range answer.Events {
+		if strings.TrimSpace(extracted.Summary) == "" {
+			return nil, fmt.Errorf("%w: event without a summary", errInvalidExtraction)
+		}
+
+		start, allDay, err := parseEventTime(extracted.Start, location)
+		if err != nil {
+			return nil, fmt.Errorf("%w: event start: %v", errInvalidExtraction, err)
+		}
+
+		event := CalendarEvent{
+			Summary:     extracted.Summary,
+			Location:    extracted.Location,
+			Description: extracted.Description,
+			Start:       start,
+			AllDay:      allDay,
+		}
+
+		event.End = defaultEventEnd(event)
+
+		if extracted.End != "" {
+			end, _, err := parseEventTime(extracted.End, location)
+			if err != nil {
+				return nil, fmt.Errorf("%w: event end: %v", errInvalidExtraction, err)
+			}
+
+			// The end date of an all-day event is inclusive in emails but exclusive in iCalendar
+			if allDay {
+				end = end.AddDate(0, 0, 1)
+			}
+
+			if end.After(start) {
+				event.End = end
+			}
+		}
+
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+func parseEventTime(value string, location *time.Location) (time.Time, bool, error) {
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			return t, false, nil
+		}
+	}
+
+	t, err := time.ParseInLocation(extractionDateLayout, value, location)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%q is neither YYYY-MM-DDTHH:MM nor YYYY-MM-DD", value)
+	}
+
+	return t, true, nil
+}
+
+// defaultEventEnd is one day for all-day events and one hour otherwise
+func defaultEventEnd(event CalendarEvent) time.Time {
+	if event.AllDay {
+		return event.Start.AddDate(0, 0, 1)
+	}
+
+	return event.Start.Add(time.Hour)
+}
+
+// parseICS reads the events of an iCalendar object, skipping cancelled ones
+func parseICS(data string) []CalendarEvent {
+	// Long lines are folded by a line break followed by a space or tab
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\n ", "")
+	data = strings.ReplaceAll(data, "\n\t", "")
+
+	var (
+		events    []CalendarEvent
+		event     *CalendarEvent
+		cancelled bool
+		hasEnd    bool
+	)
+
+	for _, line := range strings.Split(data, "\n") {
+		nameAndParams, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		name, rawParams, _ := strings.Cut(nameAndParams, ";")
+		params := icsParams(rawParams)
+
+		switch strings.ToUpper(name) {
+		case "BEGIN":
+			if strings.EqualFold(value, "VEVENT") {
+				event, cancelled, hasEnd = &CalendarEvent{}, false, false
+			}
+		case "END":
+			if strings.EqualFold(value, "VEVENT") && event != nil {
+				if !event.Start.IsZero() && !cancelled {
+					if !hasEnd {
+						event.End = defaultEventEnd(*event)
+					}
+
+					events = append(events, *event)
+				}
+
+				event = nil
+			}
+		}
+
+		if event == nil {
+			continue
+		}
+
+		switch strings.ToUpper(name) {
+		case "UID":
+			event.UID = value
+		case "SUMMARY":
+			event.Summary = icsUnescape(value)
+		case "LOCATION":
+			event.Location = icsUnescape(value)
+		case "DESCRIPTION":
+			event.Description = icsUnescape(value)
+		case "STATUS":
+			cancelled = strings.EqualFold(value, "CANCELLED")
+		case "DTSTART":
+			if start, allDay, err := parseICSTime(value, params); err == nil {
+				event.Start, event.AllDay = start, allDay
+			}
+		case "DTEND":
+			if end, _, err := parseICSTime(value, params); err == nil {
+				event.End, hasEnd = end, true
+			}
+		}
+	}
+
+	return events
+}
+
+func icsParams(raw string) map[string]string {
+	params := make(map[string]string)
+
+	for _, param := range strings.Split(raw, ";") {
+		if key, value, ok := strings.Cut(param, "="); ok {
+			params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+		}
+	}
+
+	return params
+}
+
+// parseICSTime reads a DATE or DATE-TIME value. Time zones that Go does not know, such as
+// Windows names sent by Outlook, are read as local time.
+func parseICSTime(value string, params map[string]string) (time.Time, bool, error) {
+	if params["VALUE"] == "DATE" || len(value) == len(icsDateLayout) {
+		t, err := time.ParseInLocation(icsDateLayout, value, time.Local)
+
+		return t, true, err
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse(icsUTCLayout, value)
+
+		return t, false, err
+	}
+
+	location := time.Local
+	if tzid := params["TZID"]; tzid != "" {
+		if loaded, err := time.LoadLocation(tzid); err == nil {
+			location = loaded
+		}
+	}
+
+	t, err := time.ParseInLocation(icsDateTimeLayout, value, location)
+
+	return t, false, err
+}
+
+func icsUnescape(value string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
+
+func icsEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(value)
+}
+
+// buildICS writes events as an iCalendar file that calendar apps can import
+func buildICS(events []CalendarEvent, now time.Time) []byte {
+	var b strings.Builder
+
+	line := func(content string) {
+		b.WriteString(foldICSLine(content))
+		b.WriteString("\r\n")
+	}
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//gmail2telegram//EN")
+	line("CALSCALE:GREGORIAN")
+	line("METHOD:PUBLISH")
+
+	for _, event := range events {
+		line("BEGIN:VEVENT")
+		line("UID:" + eventUID(event))
+		line("DTSTAMP:" + now.UTC().Format(icsUTCLayout))
+
+		if event.AllDay {
+			line("DTSTART;VALUE=DATE:" + event.Start.Format(icsDateLayout))
+			line("DTEND;VALUE=DATE:" + event.End.Format(icsDateLayout))
+		} else {
+			line("DTSTART:" + event.Start.UTC().Format(icsUTCLayout))
+			line("DTEND:" + event.End.UTC().Format(icsUTCLayout))
+		}
+
+		line("SUMMARY:" + icsEscape(event.Summary))
+
+		if event.Location != "" {
+			line("LOCATION:" + icsEscape(event.Location))
+		}
+
+		if event.Description != "" {
+			line("DESCRIPTION:" + icsEscape(event.Description))
+		}
+
+		line("END:VEVENT")
+	}
+
+	line("END:VCALENDAR")
+
+	return []byte(b.String())
+}
+
+// eventUID keeps the UID of invitations so that importing one again updates the event
+func eventUID(event CalendarEvent) string {
+	if event.UID != "" {
+		return event.UID
+	}
+
+	sum := sha1.Sum([]byte(event.Summary + "|" + event.Start.UTC().Format(icsUTCLayout)))
+
+	return fmt.Sprintf("%x@gmail2telegram", sum[:8])
+}
+
+// foldICSLine breaks lines longer than 75 octets without splitting UTF-8 sequences
+func foldICSLine(line string) string {
+	var b strings.Builder
+
+	limit := icsMaxLineOctets
+
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+
+		// Continuation lines start with the space
+		limit = icsMaxLineOctets - 1
+	}
+
+	b.WriteString(line)
+
+	return b.String()
+}
+
+// googleCalendarURL opens a prefilled "new event" page in Google Calendar
+func googleCalendarURL(event CalendarEvent) string {
+	var dates string
+	if event.AllDay {
+		dates = event.Start.Format(icsDateLayout) + "/" + event.End.Format(icsDateLayout)
+	} else {
+		dates = event.Start.UTC().Format(icsUTCLayout) + "/" + event.End.UTC().Format(icsUTCLayout)
+	}
+
+	params := url.Values{}
+	params.Set("action", "TEMPLATE")
+	params.Set("text", event.Summary)
+	params.Set("dates", dates)
+
+	if event.Location != "" {
+		params.Set("location", event.Location)
+	}
+
+	if event.Description != "" {
+		params.Set("details", event.Description)
+	}
+
+	return "https://calendar.google.com/calendar/render?" + params.Encode()
+}
+
+// formatEvents lists events in Telegram Markdown for the caption of the .ics file
+func formatEvents(events []CalendarEvent) string {
+	lines := make([]string, 0, len(events))
+
+	for _, event := range events {
+		text := "📅 *" + cardText(event.Summary) + "*\n🕒 " + formatEventTime(event)
+		if event.Location != "" {
+			text += "\n📍 " + cardText(event.Location)
+		}
+
+		lines = append(lines, text)
+	}
+
+	return strings.Join(lines, "\n\n")
+}
+
+func formatEventTime(event CalendarEvent) string {
+	const dayLayout = "Mon, 02 Jan 2006"
+
+	if event.AllDay {
+		last := event.End.AddDate(0, 0, -1)
+		if !last.After(event.Start) {
+			return event.Start.Format(dayLayout)
+		}
+
+		return event.Start.Format(dayLayout) + " – " + last.Format(dayLayout)
+	}
+
+	start := event.Start.Format(dayLayout + " 15:04")
+
+	if event.End.Year() == event.Start.Year() && event.End.YearDay() == event.Start.YearDay() {
+		return start + "–" + event.End.Format("15:04 MST")
+	}
+
+	return start + " – " + event.End.Format(dayLayout+" 15:04 MST")
+}
+
+// calendarKeyboard has an "Add to calendar" button for each of the first events
+func calendarKeyboard(events []CalendarEvent) *InlineKeyboardMarkup {
+	markup := &InlineKeyboardMarkup{}
+
+	for i, event := range events {
+		if i == maxCalendarButtons {
+			break
+		}
+
+		text := "➕ Add to calendar"
+		if len(events) > 1 {
+			text = "➕ " + truncateRunes(event.Summary, 40)
+		}
+
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []InlineKeyboardButton{{Text: text, URL: googleCalendarURL(event)}})
+	}
+
+	return markup
+}
+
+// calendarCaption describes the events of an .ics file, shortened to fit a caption
+func calendarCaption(events []CalendarEvent, links bool) string {
+	caption := formatEvents(events)
+
+	// Accounts without inline keyboards get the links in the text instead
+	if links {
+		for i, event := range events {
+			if i == maxCalendarButtons {
+				break
+			}
+
+			caption += fmt.Sprintf("\n[➕ Add %s to calendar](%s)", cardText(event.Summary), googleCalendarURL(event))
+		}
+	}
+
+	if utf8.RuneCountInString(caption) > maxCaptionLength {
+		return fmt.Sprintf("📅 %d events", len(events))
+	}
+
+	return caption
+}
+
+// calendarFileName names the .ics file after the event when there is only one
+func calendarFileName(events []CalendarEvent) string {
+	if len(events) != 1 {
+		return "events.ics"
+	}
+
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '-'
+		}
+
+		return r
+	}, strings.TrimSpace(events[0].Summary))
+
+	if name == "" {
+		return "event.ics"
+	}
+
+	return truncateRunes(name, 60) + ".ics"
+}
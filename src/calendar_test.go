@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+const testICS = "BEGIN:VCALENDAR\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:trip-1@school.example.com\r\n" +
+	"DTSTART;TZID=Europe/Riga:20250415T083000\r\n" +
+	"DTEND;TZID=Europe/Riga:20250415T160000\r\n" +
+	"SUMMARY:Museum trip\\, class 3B\r\n" +
+	"LOCATION:National Museum\r\n" +
+	"DESCRIPTION:Bring a packed lunch\\nand a raincoat. This line is long enough to be\r\n" +
+	"  folded.\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:holiday@school.example.com\r\n" +
+	"DTSTART;VALUE=DATE:20250418\r\n" +
+	"DTEND;VALUE=DATE:20250422\r\n" +
+	"SUMMARY:Easter holidays\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:cancelled@school.example.com\r\n" +
+	"DTSTART:20250416T070000Z\r\n" +
+	"STATUS:CANCELLED\r\n" +
+	"SUMMARY:Parents meeting\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParseICS(t *testing.T) {
+	riga, _ := time.LoadLocation("Europe/Riga")
+
+	events := parseICS(testICS)
+	if len(events) != 2 {
+		t.Fatalf("parseICS() returned %d events, want the cancelled one skipped: %+v", len(events), events)
+	}
+
+	trip := events[0]
+	if trip.Summary != "Museum trip, class 3B" || trip.Location != "National Museum" ||
+		trip.Description != "Bring a packed lunch\nand a raincoat. This line is long enough to be folded." {
+		t.Errorf("trip = %+v", trip)
+	}
+
+	if want := time.Date(2025, 4, 15, 8, 30, 0, 0, riga); !trip.Start.Equal(want) || trip.AllDay {
+		t.Errorf("trip start = %v, want %v", trip.Start, want)
+	}
+
+	holidays := events[1]
+	if !holidays.AllDay || holidays.Start.Format(icsDateLayout) != "20250418" || holidays.End.Format(icsDateLayout) != "20250422" {
+		t.Errorf("holidays = %+v", holidays)
+	}
+
+	// Events without an end last an hour, or a day when they have no time
+	single := parseICS("BEGIN:VEVENT\nDTSTART:20250416T070000Z\nSUMMARY:Call\nEND:VEVENT\n")
+	if len(single) != 1 || single[0].End.Sub(single[0].Start) != time.Hour {
+		t.Errorf("event without end = %+v", single)
+	}
+}
+
+func TestBuildICS(t *testing.T) {
+	events := parseICS(testICS)
+	events[0].Summary = strings.Repeat("Ekskursija uz muzeju; ", 5)
+
+	data := string(buildICS(events, time.Date(2025, 4, 7, 9, 0, 0, 0, time.UTC)))
+
+	for _, line := range strings.Split(strings.TrimSuffix(data, "\r\n"), "\r\n") {
+		if len(line) > icsMaxLineOctets {
+			t.Errorf("line longer than %d octets: %q", icsMaxLineOctets, line)
+		}
+	}
+
+	for _, want := range []string{
+		"UID:trip-1@school.example.com",
+		"DTSTART:20250415T053000Z",
+		"DTSTART;VALUE=DATE:20250418",
+		"DTSTAMP:20250407T090000Z",
+	} {
+		if !strings.Contains(data, want) {
+			t.Errorf("ics does not contain %q:\n%s", want, data)
+		}
+	}
+
+	// The generated file reads back into the same events
+	reread := parseICS(data)
+	if len(reread) != 2 || reread[0].Summary != events[0].Summary || !reread[0].Start.Equal(events[0].Start) ||
+		reread[1].Description != "" {
+		t.Errorf("parseICS(buildICS()) = %+v", reread)
+	}
+}
+
+func TestParseExtractedEvents(t *testing.T) {
+	riga, _ := time.LoadLocation("Europe/Riga")
+
+	tests := []struct {
+		name      string
+		raw       string
+		wantStart time.Time
+		wantEnd   time.Time
+		wantAll   bool
+		wantErr   bool
+	}{
+		{
+			name:      "timed event without end",
+			raw:       `{"events": [{"summary": "Dentist", "start": "2025-04-15T10:30"}]}`,
+			wantStart: time.Date(2025, 4, 15, 10, 30, 0, 0, riga),
+			wantEnd:   time.Date(2025, 4, 15, 11, 30, 0, 0, riga),
+		},
+		{
+			name:      "all-day event with inclusive end",
+			raw:       `{"events": [{"summary": "Camp", "start": "2025-06-02", "end": "2025-06-06"}]}`,
+			wantStart: time.Date(2025, 6, 2, 0, 0, 0, 0, riga),
+			wantEnd:   time.Date(2025, 6, 7, 0, 0, 0, 0, riga),
+			wantAll:   true,
+		},
+		{name: "no events", raw: `{"events": []}`},
+		{name: "not JSON", raw: "On Tuesday", wantErr: true},
+		{name: "missing summary", raw: `{"events": [{"start": "2025-04-15"}]}`, wantErr: true},
+		{name: "invalid start", raw: `{"events": [{"summary": "x", "start": "Tuesday"}]}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := parseExtractedEvents(tt.raw, riga)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseExtractedEvents() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantStart.IsZero() {
+				return
+			}
+
+			if len(events) != 1 || !events[0].Start.Equal(tt.wantStart) || !events[0].End.Equal(tt.wantEnd) ||
+				events[0].AllDay != tt.wantAll {
+				t.Errorf("parseExtractedEvents() = %+v", events)
+			}
+		})
+	}
+}
+
+func TestGoogleCalendarURL(t *testing.T) {
+	event := CalendarEvent{
+		Summary:  "Dentist",
+		Location: "Clinic",
+		Start:    time.Date(2025, 4, 15, 7, 30, 0, 0, time.UTC),
+		End:      time.Date(2025, 4, 15, 8, 0, 0, 0, time.UTC),
+	}
+
+	link, err := url.Parse(googleCalendarURL(event))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := link.Query()
+	if query.Get("action") != "TEMPLATE" || query.Get("text") != "Dentist" ||
+		query.Get("dates") != "20250415T073000Z/20250415T080000Z" || query.Get("location") != "Clinic" {
+		t.Errorf("googleCalendarURL() = %s", link)
+	}
+}
+
+func TestCalendarEvents(t *testing.T) {
+	raw, err := os.ReadFile(filepath.Join("testdata", "eml", "calendar_invitation.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invitation, err := parseRawMessage(raw)
+	if err != nil {
+		t.Fatalf("parseRawMessage() error = %v", err)
+	}
+
+	extracted := []CalendarEvent{{Summary: "Concert"}}
+
+	tests := []struct {
+		name        string
+		calendar    CalendarConfig
+		msg         Message
+		wantSummary string
+		wantEvents  int
+	}{
+		{name: "disabled", msg: invitation},
+		{
+			name:        "invitation is read once",
+			calendar:    CalendarConfig{Enabled: true, Extract: true},
+			msg:         invitation,
+			wantSummary: "Dentist",
+			wantEvents:  1,
+		},
+		{
+			name:        "extraction from text",
+			calendar:    CalendarConfig{Enabled: true, Extract: true},
+			msg:         Message{Content: "The concert is on Friday at 18:00"},
+			wantSummary: "Concert",
+			wantEvents:  1,
+		},
+		{
+			name:     "no extraction",
+			calendar: CalendarConfig{Enabled: true},
+			msg:      Message{Content: "The concert is on Friday at 18:00"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &TranslationService{
+				config: &Config{Calendar: tt.calendar},
+				extractEvents: func(ctx context.Context, msg Message, promptTemplate string, location *time.Location) ([]CalendarEvent, error) {
+					return extracted, nil
+				},
+			}
+
+			events, err := service.CalendarEvents(context.Background(), tt.msg)
+			if err != nil {
+				t.Fatalf("CalendarEvents() error = %v", err)
+			}
+
+			if len(events) != tt.wantEvents || (tt.wantEvents > 0 && events[0].Summary != tt.wantSummary) {
+				t.Errorf("CalendarEvents() = %+v", events)
+			}
+		})
+	}
+}
+
+func TestExtractTextFromPartCalendar(t *testing.T) {
+	encode := func(s string) string { return base64.URLEncoding.EncodeToString([]byte(s)) }
+
+	text, err := extractTextFromPart(&gmail.MessagePart{
+		MimeType: "multipart/alternative",
+		Parts: []*gmail.MessagePart{
+			{MimeType: "text/calendar", Body: &gmail.MessagePartBody{Data: encode(testICS)}},
+			{MimeType: "text/plain", Body: &gmail.MessagePartBody{Data: encode("Trip on Tuesday")}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("extractTextFromPart() error = %v", err)
+	}
+
+	if text.content() != "Trip on Tuesday" || len(text.calendars) != 1 {
+		t.Errorf("extractTextFromPart() = %+v, want the invitation kept apart from the text", text)
+	}
+}
+
+func TestNotifyWithCalendar(t *testing.T) {
+	var (
+		methods  []string
+		document string
+		query    url.Values
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+
+		if strings.HasSuffix(r.URL.Path, "/sendDocument") {
+			query = r.URL.Query()
+
+			if file, header, err := r.FormFile("document"); err == nil {
+				data, _ := io.ReadAll(file)
+				document = header.Filename + "\n" + string(data)
+			}
+		}
+
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":11,"chat":{"id":-100}}}`))
+	}))
+	defer server.Close()
+
+	bot := &TelegramBot{client: server.Client(), chatID: "-100", baseURL: server.URL, threading: threadingReply}
+
+	err := bot.Notify(context.Background(), Notification{
+		Message: Message{Subject: "Trip", Date: "today"},
+		Content: "Museum trip on Tuesday",
+		Events:  parseICS(testICS),
+	})
+	if err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+
+	if strings.Join(methods, ",") != "sendMessage,sendDocument" {
+		t.Fatalf("methods = %v, want the post followed by the calendar file", methods)
+	}
+
+	if !strings.HasPrefix(document, "events.ics\nBEGIN:VCALENDAR") {
+		t.Errorf("document = %q", document)
+	}
+
+	if !strings.Contains(query.Get("reply_parameters"), `"message_id":11`) ||
+		!strings.Contains(query.Get("reply_markup"), "calendar.google.com") ||
+		!strings.Contains(query.Get("caption"), "*Museum trip, class 3B*") {
+		t.Errorf("sendDocument query = %v", query)
+	}
+}
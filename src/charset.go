@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Header decoder for RFC 2047 encoded words in any charset known to x/text
+var headerDecoder = &mime.WordDecoder{
+	CharsetReader: func(label string, input io.Reader) (io.Reader, error) {
+		return charset.NewReaderLabel(label, input)
+	},
+}
+
+// decodeText converts a MIME part body to UTF-8. The charset comes from the part's
+// Content-Type header, a BOM or an HTML <meta> tag; unlabeled bodies that are valid
+// UTF-8 are kept as they are. The Gmail API has already undone the
+// Content-Transfer-Encoding, so data holds the raw bytes of the part.
+func decodeText(data []byte, contentType string) string {
+	label := ""
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		label = strings.ToLower(strings.TrimSpace(params["charset"]))
+	}
+
+	// Many senders label UTF-8 bodies as us-ascii, which browsers treat as windows-1252
+	switch label {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		if utf8.Valid(data) {
+			return strings.TrimPrefix(string(data), "\ufeff")
+		}
+	}
+
+	enc, name, _ := charset.DetermineEncoding(data, contentType)
+	if name == "utf-8" {
+		return strings.ToValidUTF8(strings.TrimPrefix(string(data), "\ufeff"), "\ufffd")
+	}
+
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return strings.ToValidUTF8(string(data), "\ufffd")
+	}
+
+	return strings.TrimPrefix(string(decoded), "\ufeff")
+}
+
+// decodeHeader decodes RFC 2047 encoded words such as "=?koi8-r?B?...?=" in a header value.
+// Values with unknown charsets or broken encoding are returned unchanged.
+func decodeHeader(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+
+	return decoded
+}
+
+// partHeader returns the value of the named header of a MIME part
+func partHeader(headers []*gmail.MessagePartHeader, name string) string {
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+
+	return ""
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
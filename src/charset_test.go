@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecodeTextFixtures(t *testing.T) {
+	// Content-Type headers as sent by the mailers the fixtures were taken from
+	tests := []struct {
+		name        string
+		contentType string
+	}{
+		{name: "windows1257_lv", contentType: "text/plain; charset=windows-1257"},
+		{name: "iso885913_lv", contentType: "text/plain; charset=\"ISO-8859-13\""},
+		{name: "koi8r_ru", contentType: "text/plain; charset=KOI8-R"},
+		{name: "windows1251_ru", contentType: "text/plain; charset=\"windows-1251\"; format=flowed"},
+		{name: "iso88595_ru", contentType: "text/plain; charset=iso-8859-5"},
+		{name: "iso88591_de", contentType: "text/plain; charset=ISO-8859-1"},
+		{name: "utf8_unlabeled", contentType: ""},
+		{name: "usascii_mislabeled_utf8", contentType: "text/plain; charset=us-ascii"},
+		{name: "html_meta_windows1251", contentType: "text/html"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := os.ReadFile(filepath.Join("testdata", "charset", tt.name+".in"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden, err := os.ReadFile(filepath.Join("testdata", "charset", tt.name+".golden"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := decodeText(raw, tt.contentType); got != string(golden) {
+				t.Errorf("decodeText() = %q, want %q", got, golden)
+			}
+		})
+	}
+}
+
+func TestDecodeTextInvalidUTF8(t *testing.T) {
+	got := decodeText([]byte("ok \xff done"), "text/plain; charset=utf-8")
+	if got != "ok � done" {
+		t.Errorf("decodeText() = %q", got)
+	}
+}
+
+func TestDecodeHeaderFixtures(t *testing.T) {
+	raw, err := os.ReadFile(filepath.Join("testdata", "charset", "headers.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+		encoded, want, ok := strings.Cut(line, "\t")
+		if !ok {
+			t.Fatalf("malformed fixture line %q", line)
+		}
+
+		if got := decodeHeader(encoded); got != want {
+			t.Errorf("decodeHeader(%q) = %q, want %q", encoded, got, want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	defaultMaxChunkTokens   = 4000
+	defaultChunkConcurrency = 3
+)
+
+// maxChunkTokens returns the configured chunk size or the default one
+func (s *TranslationService) maxChunkTokens() int {
+	if s.config.Translation.MaxChunkTokens > 0 {
+		return s.config.Translation.MaxChunkTokens
+	}
+
+	return defaultMaxChunkTokens
+}
+
+// chunkConcurrency returns how many chunks of one email are translated at once
+func (s *TranslationService) chunkConcurrency() int {
+	if s.config.Translation.ChunkConcurrency > 0 {
+		return s.config.Translation.ChunkConcurrency
+	}
+
+	return defaultChunkConcurrency
+}
+
+// defaultCountTokens counts with the models of the chain that can count, in order and each
+// within its timeout. When none of them answers, or the chain cannot count at all, four
+// characters count as a token.
+func (s *TranslationService) defaultCountTokens(ctx context.Context, text string) (int, error) {
+	for _, model := range s.models {
+		if model.countTokens == nil {
+			continue
+		}
+
+		tokens, err := model.count(ctx, text)
+		if err == nil {
+			return tokens, nil
+		}
+
+		// Nothing is left to try once the email itself was cancelled
+		if ctx.Err() != nil {
+			return 0, err
+		}
+
+		log.Printf("Model %s failed to count tokens, trying the next one: %v", model.name, err)
+	}
+
+	return utf8.RuneCountInString(text)/4 + 1, nil
+}
+
+// splitChunks splits text on paragraph boundaries into chunks of about maxTokens tokens.
+// tokens is the token count of the whole text and is spread over its characters to size the
+// paragraphs; paragraphs that do not fit alone are split on lines and, as a last resort, on
+// characters.
+func splitChunks(text string, tokens, maxTokens int) []string {
+	if tokens <= maxTokens {
+		return []string{text}
+	}
+
+	// Characters per chunk, assuming tokens are spread evenly over the text
+	limit := max(utf8.RuneCountInString(text)*maxTokens/tokens, 1)
+
+	var (
+		chunks  []string
+		current strings.Builder
+	)
+
+	flush := func() {
+		if current.Len() > 0 {
+			chunks = append(chunks, current.String())
+			current.Reset()
+		}
+	}
+
+	add := func(piece, separator string) {
+		size := utf8.RuneCountInString(current.String())
+		if size > 0 && size+len(separator)+utf8.RuneCountInString(piece) > limit {
+			flush()
+		}
+
+		if current.Len() > 0 {
+			current.WriteString(separator)
+		}
+
+		current.WriteString(piece)
+	}
+
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		if utf8.RuneCountInString(paragraph) <= limit {
+			add(paragraph, "\n\n")
+
+			continue
+		}
+
+		flush()
+
+		for _, line := range strings.Split(paragraph, "\n") {
+			runes := []rune(line)
+			for len(runes) > limit {
+				flush()
+				chunks = append(chunks, string(runes[:limit]))
+				runes = runes[limit:]
+			}
+
+			add(string(runes), "\n")
+		}
+
+		flush()
+	}
+
+	flush()
+
+	return chunks
+}
+
+// translateChunks runs translate on every chunk with at most limit calls at a time and returns
+// the results in the order of the chunks. The first error cancels the remaining calls.
+func translateChunks(
+	ctx context.Context,
+	chunks []string,
+	limit int,
+	translate func(ctx context.Context, i int, chunk string) (string, error),
+) ([]string, error) {
+	results := make([]string, len(chunks))
+
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(limit)
+
+	for i, chunk := range chunks {
+		group.Go(func() error {
+			translated, err := translate(ctx, i, chunk)
+			if err != nil {
+				return fmt.Errorf("chunk %d of %d: %w", i+1, len(chunks), err)
+			}
+
+			results[i] = translated
+
+			return nil
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
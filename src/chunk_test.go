@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestSplitChunks(t *testing.T) {
+	paragraph := strings.Repeat("word ", 19) + "end"
+
+	tests := []struct {
+		name      string
+		text      string
+		tokens    int
+		maxTokens int
+		want      int
+	}{
+		{name: "fits", text: paragraph, tokens: 20, maxTokens: 100, want: 1},
+		{name: "paragraphs", text: strings.Repeat(paragraph+"\n\n", 5) + paragraph, tokens: 120, maxTokens: 40, want: 3},
+		{name: "long lines", text: strings.Repeat(paragraph+"\n", 3) + paragraph, tokens: 80, maxTokens: 20, want: 4},
+		{name: "one long line", text: strings.Repeat("x", 1000), tokens: 200, maxTokens: 50, want: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := splitChunks(tt.text, tt.tokens, tt.maxTokens)
+			if len(chunks) != tt.want {
+				t.Fatalf("splitChunks() returned %d chunks, want %d: %q", len(chunks), tt.want, chunks)
+			}
+
+			// Nothing is lost or reordered
+			joined := strings.Join(chunks, "")
+			if strings.ReplaceAll(joined, "\n", "") != strings.ReplaceAll(tt.text, "\n", "") {
+				t.Errorf("chunks do not add up to the text: %q", chunks)
+			}
+		})
+	}
+}
+
+func TestTranslateChunks(t *testing.T) {
+	var running, peak atomic.Int32
+
+	chunks := []string{"a", "b", "c", "d", "e"}
+
+	got, err := translateChunks(context.Background(), chunks, 2, func(ctx context.Context, i int, chunk string) (string, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+
+		// Later chunks finish first
+		time.Sleep(time.Duration('f'-chunk[0]) * time.Millisecond)
+
+		return strings.ToUpper(chunk), nil
+	})
+	if err != nil {
+		t.Fatalf("translateChunks() error = %v", err)
+	}
+
+	if strings.Join(got, "") != "ABCDE" {
+		t.Errorf("translateChunks() = %v, want the chunks in order", got)
+	}
+
+	if peak.Load() > 2 {
+		t.Errorf("%d chunks translated at once, want at most 2", peak.Load())
+	}
+
+	_, err = translateChunks(context.Background(), chunks, 2, func(ctx context.Context, i int, chunk string) (string, error) {
+		if chunk == "c" {
+			return "", errResponseTruncated
+		}
+
+		return chunk, nil
+	})
+	if !errors.Is(err, errResponseTruncated) || !strings.Contains(err.Error(), "chunk 3 of 5") {
+		t.Errorf("translateChunks() error = %v, want the truncated chunk reported", err)
+	}
+}
+
+func TestDefaultTranslateChunked(t *testing.T) {
+	paragraphs := make([]string, 6)
+	for i := range paragraphs {
+		paragraphs[i] = fmt.Sprintf("Rindkopa %d. %s", i+1, strings.Repeat("teksts ", 20))
+	}
+
+	text := strings.Join(paragraphs, "\n\n")
+
+	var prompts atomic.Int32
+
+	service := &TranslationService{
+		config: &Config{Translation: TranslationConfig{
+			TargetLanguage: "English",
+			PromptTemplate: "{text}",
+			MaxChunkTokens: 100,
+		}},
+		countTokens: func(ctx context.Context, text string) (int, error) {
+			return len(strings.Fields(text)), nil
+		},
+		generateText: func(ctx context.Context, prompt string) (string, error) {
+			prompts.Add(1)
+
+			return strings.ReplaceAll(prompt, "Rindkopa", "Paragraph"), nil
+		},
+	}
+
+	got, err := service.defaultTranslate(context.Background(), Message{Content: text})
+	if err != nil {
+		t.Fatalf("defaultTranslate() error = %v", err)
+	}
+
+	if prompts.Load() < 2 {
+		t.Errorf("translated in %d prompts, want the email split", prompts.Load())
+	}
+
+	if got.Content != strings.ReplaceAll(text, "Rindkopa", "Paragraph") {
+		t.Errorf("defaultTranslate() =\n%s", got.Content)
+	}
+}
+
+func TestDefaultCountTokensFallback(t *testing.T) {
+	var asked []string
+
+	service := &TranslationService{
+		config: &Config{Translation: TranslationConfig{TargetLanguage: "English", PromptTemplate: "{text}"}},
+		models: []chainModel{
+			{
+				name: "a",
+				generate: func(ctx context.Context, prompt string, schema *genai.Schema) (string, error) {
+					asked = append(asked, "a")
+
+					return "", errTransient
+				},
+				countTokens: func(ctx context.Context, text string) (int, error) {
+					return 0, errTransient
+				},
+			},
+			{
+				name: "b",
+				generate: func(ctx context.Context, prompt string, schema *genai.Schema) (string, error) {
+					asked = append(asked, "b")
+
+					return "Hello", nil
+				},
+			},
+		},
+	}
+	service.countTokens = service.defaultCountTokens
+	service.generateText = service.generate
+
+	// Model a cannot count and b cannot count at all, so the tokens are estimated
+	if tokens, err := service.defaultCountTokens(context.Background(), "Labdien, kā jums klājas?"); err != nil || tokens != 7 {
+		t.Errorf("defaultCountTokens() = %d, %v; want the estimate 7", tokens, err)
+	}
+
+	got, err := service.defaultTranslate(context.Background(), Message{Content: "Labdien"})
+	if err != nil {
+		t.Fatalf("defaultTranslate() error = %v", err)
+	}
+
+	if got.Content != "Hello" || strings.Join(asked, ",") != "a,b" {
+		t.Errorf("defaultTranslate() = %q after asking %v, want the answer of model b", got.Content, asked)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// CleanupConfig selects which noise is removed from plain-text bodies before translation
+type CleanupConfig struct {
+	QuotedReplies    bool `yaml:"quoted_replies"`
+	Signatures       bool `yaml:"signatures"`
+	ForwardedHeaders bool `yaml:"forwarded_headers"`
+}
+
+const attributionVerbs = `(wrote|schrieb|a écrit|escribió|написал|написала|написал\(а\)|rakstīja)\s*:`
+
+var (
+	// Reply attributions of Gmail, Apple Mail and Thunderbird in the languages we receive:
+	// "On <date> <name> wrote:", "<date> <name> <email> rakstīja:" and Russian Gmail's verb-less
+	// "<date> г. в 14:49, <name> <email>:"
+	attributionRe = regexp.MustCompile(
+		`(?i)^((on|am|le|el)\s.*\d.*` + attributionVerbs + `|.*\d.*@.*` + attributionVerbs +
+			`|.*\d{4}.*<[^<>\s]+@[^<>\s]+>\s*:)$`)
+	originalMessageRe  = regexp.MustCompile(`(?i)^-{3,}\s*(original message|исходное сообщение|oriģinālā ziņa)\s*-{3,}$`)
+	outlookSeparatorRe = regexp.MustCompile(`^_{10,}$`)
+	forwardMarkerRe    = regexp.MustCompile(
+		`(?i)^(-{3,}\s*(forwarded message|пересылаемое сообщение|пересланное сообщение|pārsūtīta ziņa)\s*-{3,}` +
+			`|begin forwarded message:)$`)
+	headerLineRe = regexp.MustCompile(
+		`(?i)^\*?(from|sent|date|to|cc|subject|reply-to|от|отправлено|дата|кому|копия|тема|no|nosūtīts|datums|kam|temats)\*?:\s`)
+	signatureDelimiterRe = regexp.MustCompile(`^--\s*$`)
+	signatureLineRe      = regexp.MustCompile(
+		`(?i)^(sent from my \w+|sent from (mail|outlook) for \w+|get outlook for \w+|sent from yahoo mail|` +
+			`отправлено (с|из) .+|nosūtīts no .+|` +
+			`(confidentiality notice|disclaimer)\b.*|` +
+			`this (e-?mail|message)( and any attachments| \(including any attachments\))? (is|are|may be|contains?) ` +
+			`(confidential|intended solely|privileged).*)$`)
+	quotedLineRe = regexp.MustCompile(`^\s*>`)
+)
+
+// cleanContent removes quoted replies, signatures and forwarded-message headers from a
+// plain-text email body. Nothing is cut when it would leave the body empty.
+func cleanContent(text string, config CleanupConfig) string {
+	if !config.QuotedReplies && !config.Signatures && !config.ForwardedHeaders {
+		return text
+	}
+
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	if config.ForwardedHeaders {
+		lines = stripForwardedHeaders(lines)
+	}
+
+	if config.QuotedReplies {
+		lines = stripQuotedReplies(lines)
+	}
+
+	if config.Signatures {
+		lines = stripSignature(lines)
+	}
+
+	result := strings.Join(lines, "\n")
+	result = multiNewlineRe.ReplaceAllString(result, "\n\n")
+
+	return strings.TrimSpace(result)
+}
+
+// stripForwardedHeaders drops forward markers and the header block that follows them,
+// keeping the forwarded body itself
+func stripForwardedHeaders(lines []string) []string {
+	var result []string
+
+	for i := 0; i < len(lines); i++ {
+		if !forwardMarkerRe.MatchString(strings.TrimSpace(lines[i])) {
+			result = append(result, lines[i])
+
+			continue
+		}
+
+		i = skipHeaderBlock(lines, i+1) - 1
+	}
+
+	return result
+}
+
+// skipHeaderBlock returns the index of the first line after a block of header lines
+// starting at start. Blank lines inside the block are skipped, wrapped values are not.
+func skipHeaderBlock(lines []string, start int) int {
+	i := start
+	for i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+		i++
+	}
+
+	for i < len(lines) {
+		line := strings.TrimSpace(lines[i])
+		if !headerLineRe.MatchString(line + " ") {
+			break
+		}
+
+		i++
+	}
+
+	for i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+		i++
+	}
+
+	return i
+}
+
+// stripQuotedReplies cuts the quoted history below a reply and removes ">" quoted lines.
+// A quote header at the very top is treated as a forward: only the header block goes.
+func stripQuotedReplies(lines []string) []string {
+	for i := range lines {
+		end := quoteHeaderEnd(lines, i)
+		if end < 0 {
+			continue
+		}
+
+		if hasReplyContent(lines[:i]) {
+			lines = lines[:i]
+		} else {
+			lines = lines[skipHeaderBlock(lines, end):]
+		}
+
+		break
+	}
+
+	var result []string
+
+	for _, line := range lines {
+		if !quotedLineRe.MatchString(line) {
+			result = append(result, line)
+		}
+	}
+
+	if !hasContent(result) {
+		return lines
+	}
+
+	return result
+}
+
+// quoteHeaderEnd reports whether a reply quote starts at line i and returns the index
+// after its introduction, or -1
+func quoteHeaderEnd(lines []string, i int) int {
+	line := strings.TrimSpace(lines[i])
+
+	switch {
+	case attributionRe.MatchString(line):
+		return i + 1
+	case i+1 < len(lines) && !attributionRe.MatchString(strings.TrimSpace(lines[i+1])) &&
+		attributionRe.MatchString(line+" "+strings.TrimSpace(lines[i+1])):
+		// Long attributions are wrapped over two lines
+		return i + 2
+	case originalMessageRe.MatchString(line):
+		return i + 1
+	case outlookSeparatorRe.MatchString(line) && i+1 < len(lines) && headerLineRe.MatchString(strings.TrimSpace(lines[i+1])+" "):
+		return i + 1
+	case isOutlookHeaderBlock(lines, i):
+		return i
+	}
+
+	return -1
+}
+
+// isOutlookHeaderBlock detects an unseparated "From: / Sent: / To: / Subject:" block
+func isOutlookHeaderBlock(lines []string, i int) bool {
+	if !strings.HasPrefix(strings.ToLower(strings.Trim(strings.TrimSpace(lines[i]), "*")), "from:") {
+		return false
+	}
+
+	headers := 0
+
+	for j := i; j < len(lines) && j < i+6; j++ {
+		if headerLineRe.MatchString(strings.TrimSpace(lines[j]) + " ") {
+			headers++
+		}
+	}
+
+	return headers >= 3
+}
+
+func stripSignature(lines []string) []string {
+	for i, line := range lines {
+		if i == 0 || !hasContent(lines[:i]) {
+			continue
+		}
+
+		if signatureDelimiterRe.MatchString(line) || signatureLineRe.MatchString(strings.TrimSpace(line)) {
+			return lines[:i]
+		}
+	}
+
+	return lines
+}
+
+// hasReplyContent is hasContent that does not count forward markers as written text
+func hasReplyContent(lines []string) bool {
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line != "" && !forwardMarkerRe.MatchString(line) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasContent(lines []string) bool {
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			return true
+		}
+	}
+
+	return false
+}
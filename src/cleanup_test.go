@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCleanContentFixtures(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "cleanup", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inputs) == 0 {
+		t.Fatal("no cleanup fixtures found")
+	}
+
+	config := CleanupConfig{QuotedReplies: true, Signatures: true, ForwardedHeaders: true}
+
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".txt")
+
+		t.Run(name, func(t *testing.T) {
+			raw, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden, err := os.ReadFile(strings.TrimSuffix(input, ".txt") + ".golden")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := cleanContent(string(raw), config)
+			want := strings.TrimSpace(string(golden))
+
+			if got != want {
+				t.Errorf("cleanContent() mismatch\n--- got ---\n%s\n--- want ---\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestCleanContentOptions(t *testing.T) {
+	text := "Thanks!\n\nOn Tue, Mar 25, 2025 at 2:49 PM A <a@example.com> wrote:\n> Question\n\n-- \nSig"
+
+	tests := []struct {
+		name   string
+		config CleanupConfig
+		want   string
+	}{
+		{
+			name:   "disabled",
+			config: CleanupConfig{},
+			want:   text,
+		},
+		{
+			name:   "signatures only",
+			config: CleanupConfig{Signatures: true},
+			want:   "Thanks!\n\nOn Tue, Mar 25, 2025 at 2:49 PM A <a@example.com> wrote:\n> Question",
+		},
+		{
+			name:   "quoted replies only",
+			config: CleanupConfig{QuotedReplies: true},
+			want:   "Thanks!",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cleanContent(text, tt.config); got != tt.want {
+				t.Errorf("cleanContent() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DateConfig sets how the date of an email is shown in Telegram posts
+type DateConfig struct {
+	// Timezone is an IANA name such as "Europe/Riga"; the local timezone by default
+	Timezone string `yaml:"timezone"`
+	// Locale names months and weekdays: "en" (default), "ru", "uk" or "lv"
+	Locale string `yaml:"locale"`
+	// Format is a Go time layout, e.g. "02.01.2006 15:04"; each locale has its own default
+	Format string `yaml:"format"`
+}
+
+// dateLocale holds the names a locale shows for the January, Jan, Monday and Mon layout elements
+type dateLocale struct {
+	layout      string
+	months      [12]string
+	shortMonths [12]string
+	days        [7]string
+	shortDays   [7]string
+}
+
+// dateLocales are the supported locales. Russian and Ukrainian months are in the genitive case
+// they take after a day, as in "28 марта".
+var dateLocales = map[string]*dateLocale{
+	"en": nil,
+	"ru": {
+		layout: "Mon, 2 January 2006, 15:04",
+		months: [12]string{
+			"января", "февраля", "марта", "апреля", "мая", "июня",
+			"июля", "августа", "сентября", "октября", "ноября", "декабря",
+		},
+		shortMonths: [12]string{"янв", "фев", "мар", "апр", "мая", "июн", "июл", "авг", "сен", "окт", "ноя", "дек"},
+		days:        [7]string{"воскресенье", "понедельник", "вторник", "среда", "четверг", "пятница", "суббота"},
+		shortDays:   [7]string{"вс", "пн", "вт", "ср", "чт", "пт", "сб"},
+	},
+	"uk": {
+		layout: "Mon, 2 January 2006, 15:04",
+		months: [12]string{
+			"січня", "лютого", "березня", "квітня", "травня", "червня",
+			"липня", "серпня", "вересня", "жовтня", "листопада", "грудня",
+		},
+		shortMonths: [12]string{"січ", "лют", "бер", "кві", "тра", "чер", "лип", "сер", "вер", "жов", "лис", "гру"},
+		days:        [7]string{"неділя", "понеділок", "вівторок", "середа", "четвер", "пʼятниця", "субота"},
+		shortDays:   [7]string{"нд", "пн", "вт", "ср", "чт", "пт", "сб"},
+	},
+	"lv": {
+		layout: "Mon, 2006. gada 2. January 15:04",
+		months: [12]string{
+			"janvāris", "februāris", "marts", "aprīlis", "maijs", "jūnijs",
+			"jūlijs", "augusts", "septembris", "oktobris", "novembris", "decembris",
+		},
+		shortMonths: [12]string{"janv.", "febr.", "marts", "apr.", "maijs", "jūn.", "jūl.", "aug.", "sept.", "okt.", "nov.", "dec."},
+		days:        [7]string{"svētdiena", "pirmdiena", "otrdiena", "trešdiena", "ceturtdiena", "piektdiena", "sestdiena"},
+		shortDays:   [7]string{"Sv", "Pr", "Ot", "Tr", "Ce", "Pk", "Se"},
+	},
+}
+
+// defaultDateLayout is the layout of the "en" locale
+const defaultDateLayout = "Mon, 2 Jan 2006 15:04"
+
+// dateNameElements are the layout elements a locale replaces, longest first where they overlap
+var dateNameElements = []string{"January", "Jan", "Monday", "Mon"}
+
+// dateComment matches the comment some mailers append to the Date header, e.g. "(UTC)"
+var dateComment = regexp.MustCompile(`\s*\([^()]*\)\s*$`)
+
+// parseDate parses a Date header, returning the zero time when it cannot be read
+func parseDate(header string) time.Time {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return time.Time{}
+	}
+
+	if t, err := mail.ParseDate(header); err == nil {
+		return t
+	}
+
+	if t, err := mail.ParseDate(dateComment.ReplaceAllString(header, "")); err == nil {
+		return t
+	}
+
+	return time.Time{}
+}
+
+// messageTime parses a Date header and falls back to when the mailbox received the email
+func messageTime(header string, received time.Time) time.Time {
+	if t := parseDate(header); !t.IsZero() {
+		return t
+	}
+
+	return received
+}
+
+// dateFormatter shows times in a timezone and locale. The zero value shows the Date header
+// unchanged.
+type dateFormatter struct {
+	location *time.Location
+	layout   string
+	locale   *dateLocale
+}
+
+func newDateFormatter(config DateConfig) (dateFormatter, error) {
+	location := time.Local
+
+	if config.Timezone != "" {
+		var err error
+
+		if location, err = time.LoadLocation(config.Timezone); err != nil {
+			return dateFormatter{}, fmt.Errorf("invalid date timezone %q: %v", config.Timezone, err)
+		}
+	}
+
+	name := config.Locale
+	if name == "" {
+		name = "en"
+	}
+
+	locale, ok := dateLocales[name]
+	if !ok {
+		return dateFormatter{}, fmt.Errorf("unknown date locale %q: use en, ru, uk or lv", config.Locale)
+	}
+
+	layout := config.Format
+	if layout == "" && locale != nil {
+		layout = locale.layout
+	}
+
+	if layout == "" {
+		layout = defaultDateLayout
+	}
+
+	return dateFormatter{location: location, layout: layout, locale: locale}, nil
+}
+
+// format shows the time of msg, or its Date header when the time is unknown
+func (f dateFormatter) format(msg Message) string {
+	if f.location == nil || msg.Time.IsZero() {
+		return msg.Date
+	}
+
+	t := msg.Time.In(f.location)
+	if f.locale == nil {
+		return t.Format(f.layout)
+	}
+
+	// Layout elements are formatted piecewise so localized names are not read as layout
+	var b strings.Builder
+
+	layout := f.layout
+	for layout != "" {
+		i, element := nextDateName(layout)
+		if i < 0 {
+			b.WriteString(t.Format(layout))
+
+			break
+		}
+
+		b.WriteString(t.Format(layout[:i]))
+		b.WriteString(f.locale.name(element, t))
+		layout = layout[i+len(element):]
+	}
+
+	return b.String()
+}
+
+// nextDateName finds the first month or weekday name element in layout
+func nextDateName(layout string) (int, string) {
+	first, element := -1, ""
+
+	for _, name := range dateNameElements {
+		if i := strings.Index(layout, name); i >= 0 && (first < 0 || i < first) {
+			first, element = i, name
+		}
+	}
+
+	return first, element
+}
+
+func (l *dateLocale) name(element string, t time.Time) string {
+	switch element {
+	case "January":
+		return l.months[t.Month()-1]
+	case "Jan":
+		return l.shortMonths[t.Month()-1]
+	case "Monday":
+		return l.days[t.Weekday()]
+	}
+
+	return l.shortDays[t.Weekday()]
+}
+
+// sortByDate orders messages oldest first; messages without a date keep their place
+// relative to each other ahead of the dated ones
+func sortByDate(messages []Message) {
+	slices.SortStableFunc(messages, func(a, b Message) int {
+		return a.Time.Compare(b.Time)
+	})
+}
+
+// tooOld reports whether msg is older than the filter's max_age
+func tooOld(filter FilterConfig, msg Message, now time.Time) bool {
+	if filter.MaxAge == "" || msg.Time.IsZero() {
+		return false
+	}
+
+	maxAge, err := time.ParseDuration(filter.MaxAge)
+	if err != nil {
+		return false
+	}
+
+	return now.Sub(msg.Time) > maxAge
+}
+
+// validateFilters checks the max_age of the source and route filters
+func validateFilters(config *Config) error {
+	filters := map[string]FilterConfig{
+		"gmail.filter": config.Gmail.Filter,
+		"imap.filter":  config.IMAP.Filter,
+		"graph.filter": config.Graph.Filter,
+	}
+
+	for _, route := range config.Routes {
+		filters[fmt.Sprintf("route %q", route.Name)] = route.Filter
+	}
+
+	for name, filter := range filters {
+		if filter.MaxAge == "" {
+			continue
+		}
+
+		if maxAge, err := time.ParseDuration(filter.MaxAge); err != nil || maxAge <= 0 {
+			return fmt.Errorf("invalid max_age %q in %s: use a duration such as \"72h\"", filter.MaxAge, name)
+		}
+	}
+
+	return nil
+}
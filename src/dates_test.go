@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	want := time.Date(2025, 3, 28, 14, 49, 17, 0, time.UTC)
+
+	tests := []struct {
+		header string
+		want   time.Time
+	}{
+		{header: "Fri, 28 Mar 2025 14:49:17 +0000", want: want},
+		{header: "Fri, 28 Mar 2025 14:49:17 +0000 (UTC)", want: want},
+		{header: "28 Mar 2025 16:49:17 +0200", want: want},
+		{header: "  Fri, 28 Mar 2025 14:49:17 GMT  ", want: want},
+		{header: "yesterday"},
+		{header: ""},
+	}
+
+	for _, tt := range tests {
+		if got := parseDate(tt.header); !got.Equal(tt.want) {
+			t.Errorf("parseDate(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+
+	received := time.Date(2025, 3, 29, 8, 0, 0, 0, time.UTC)
+	if got := messageTime("broken", received); !got.Equal(received) {
+		t.Errorf("messageTime() = %v, want the received time %v", got, received)
+	}
+}
+
+func TestDateFormatter(t *testing.T) {
+	msg := Message{
+		Date: "Fri, 28 Mar 2025 14:49:17 +0000 (UTC)",
+		Time: time.Date(2025, 3, 28, 14, 49, 17, 0, time.UTC),
+	}
+
+	tests := []struct {
+		name    string
+		config  DateConfig
+		want    string
+		wantErr bool
+	}{
+		{name: "english", config: DateConfig{Timezone: "UTC"}, want: "Fri, 28 Mar 2025 14:49"},
+		{name: "russian in Riga", config: DateConfig{Timezone: "Europe/Riga", Locale: "ru"}, want: "пт, 28 марта 2025, 16:49"},
+		{name: "latvian", config: DateConfig{Timezone: "Europe/Riga", Locale: "lv"}, want: "Pk, 2025. gada 28. marts 16:49"},
+		{
+			name:   "custom layout",
+			config: DateConfig{Timezone: "Europe/Kyiv", Locale: "uk", Format: "Monday, 2 Jan 15:04 MST"},
+			want:   "пʼятниця, 28 бер 16:49 EET",
+		},
+		{name: "numeric layout", config: DateConfig{Timezone: "UTC", Locale: "lv", Format: "02.01.2006 15:04"}, want: "28.03.2025 14:49"},
+		{name: "unknown timezone", config: DateConfig{Timezone: "Europe/Atlantis"}, wantErr: true},
+		{name: "unknown locale", config: DateConfig{Locale: "fr"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dates, err := newDateFormatter(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newDateFormatter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if got := dates.format(msg); got != tt.want {
+				t.Errorf("format() = %q, want %q", got, tt.want)
+			}
+
+			// Without a parsed time the header is shown as it is
+			if got := dates.format(Message{Date: "yesterday"}); got != "yesterday" {
+				t.Errorf("format() = %q, want the Date header", got)
+			}
+		})
+	}
+}
+
+func TestSortByDate(t *testing.T) {
+	day := time.Date(2025, 3, 28, 0, 0, 0, 0, time.UTC)
+	messages := []Message{
+		{ID: "newest", Time: day.Add(2 * time.Hour)},
+		{ID: "undated"},
+		{ID: "oldest", Time: day},
+		{ID: "middle", Time: day.Add(time.Hour)},
+	}
+
+	sortByDate(messages)
+
+	var ids []string
+	for _, msg := range messages {
+		ids = append(ids, msg.ID)
+	}
+
+	if got := strings.Join(ids, ","); got != "undated,oldest,middle,newest" {
+		t.Errorf("sortByDate() order = %s", got)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	now := time.Now()
+	filter := FilterConfig{MaxAge: "72h"}
+
+	tests := []struct {
+		name string
+		msg  Message
+		want bool
+	}{
+		{name: "recent", msg: Message{Time: now.Add(-time.Hour)}, want: true},
+		{name: "too old", msg: Message{Time: now.Add(-96 * time.Hour)}, want: false},
+		{name: "undated", msg: Message{}, want: true},
+	}
+
+	for _, tt := range tests {
+		if got := matchesFilter(filter, tt.msg); got != tt.want {
+			t.Errorf("%s: matchesFilter() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	config := &Config{Routes: []RouteConfig{{Name: "news", Filter: FilterConfig{MaxAge: "3 days"}}}}
+	if err := validateFilters(config); err == nil || !strings.Contains(err.Error(), `route "news"`) {
+		t.Errorf("validateFilters() error = %v, want the route named", err)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+	// Time zones must resolve in minimal container images without /usr/share/zoneinfo
+	_ "time/tzdata"
+
+	"github.com/robfig/cron/v3"
+)
+
+// How a route delivers its emails, see RouteConfig.Delivery
+const (
+	deliveryImmediate = "immediate"
+	deliveryDigest    = "digest"
+)
+
+const (
+	defaultDigestSchedule = "0 8 * * *"
+	defaultDigestTitle    = "Digest"
+	digestRetryDelay      = 5 * time.Minute
+	digestDateLayout      = "Mon, 02 Jan 2006 15:04"
+
+	// Telegram allows 4096 characters per message; the header and date line need some of them
+	maxDigestPostLength = 3500
+)
+
+// DigestConfig schedules the digest of routes with delivery: digest
+type DigestConfig struct {
+	// Schedule is a cron expression (minute hour day month weekday), daily at 08:00 by default
+	Schedule string `yaml:"schedule"`
+	// Timezone is an IANA name such as "Europe/Riga"; the local time zone when empty
+	Timezone       string `yaml:"timezone"`
+	Title          string `yaml:"title"`
+	PromptTemplate string `yaml:"prompt_template"`
+	PromptFile     string `yaml:"prompt_file"`
+}
+
+type digestRoute struct {
+	route    *RouteConfig
+	config   DigestConfig
+	schedule cron.Schedule
+	location *time.Location
+	next     time.Time
+}
+
+// Digester queues emails of digest routes in the state store and sends each route's queue as
+// one post with a table of contents and a summary per email when its schedule is due
+type Digester struct {
+	svc    *services
+	routes map[string]*digestRoute
+}
+
+// NewDigester validates the delivery settings of all routes. It returns nil when no route
+// uses digest delivery.
+func NewDigester(config *Config, svc *services) (*Digester, error) {
+	d := &Digester{svc: svc, routes: make(map[string]*digestRoute)}
+
+	for i := range config.Routes {
+		route := &config.Routes[i]
+
+		switch route.Delivery {
+		case "", deliveryImmediate:
+			continue
+		case deliveryDigest:
+		default:
+			return nil, fmt.Errorf("unknown delivery %q in route %q: use %q or %q",
+				route.Delivery, route.Name, deliveryImmediate, deliveryDigest)
+		}
+
+		digestConfig := config.Digest
+		if route.Digest != nil {
+			digestConfig = *route.Digest
+		}
+
+		r, err := newDigestRoute(route, digestConfig, svc.state.DigestSent(routeName(route)))
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", route.Name, err)
+		}
+
+		d.routes[routeName(route)] = r
+	}
+
+	if len(d.routes) == 0 {
+		return nil, nil
+	}
+
+	return d, nil
+}
+
+func newDigestRoute(route *RouteConfig, config DigestConfig, lastSent time.Time) (*digestRoute, error) {
+	spec := config.Schedule
+	if spec == "" {
+		spec = defaultDigestSchedule
+	}
+
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest schedule %q: %v", spec, err)
+	}
+
+	location := time.Local
+	if config.Timezone != "" {
+		if location, err = time.LoadLocation(config.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid digest timezone %q: %v", config.Timezone, err)
+		}
+	}
+
+	// A digest that was due while the forwarder was down is sent right after startup
+	from := lastSent
+	if from.IsZero() {
+		from = time.Now()
+	}
+
+	return &digestRoute{
+		route:    route,
+		config:   config,
+		schedule: schedule,
+		location: location,
+		next:     schedule.Next(from.In(location)),
+	}, nil
+}
+
+// routeDelivery returns how a route delivers its emails
+func routeDelivery(route *RouteConfig) string {
+	if route == nil || route.Delivery == "" {
+		return deliveryImmediate
+	}
+
+	return route.Delivery
+}
+
+// Queue summarizes an email and adds it to its route's digest. The email stays unlabelled until
+// the digest is sent, so it is seen again by later polls and skipped then.
+func (d *Digester) Queue(ctx context.Context, msg Message) error {
+	r, ok := d.routes[routeName(msg.Route)]
+	if !ok {
+		return fmt.Errorf("route %q has no digest", routeName(msg.Route))
+	}
+
+	if d.svc.state.DigestQueued(msg.ID) {
+		log.Printf("Message %s is already queued for the next digest", msg.ID)
+
+		return nil
+	}
+
+	log.Printf("Summarizing message for the %s digest...", routeName(msg.Route))
+
+	summary, err := d.svc.translation.Summarize(ctx, msg, r.config.PromptTemplate)
+
+	switch {
+	case untranslatable(err):
+		log.Printf("Queueing message without a summary: %v", err)
+
+		summary = untranslatedContent("", err)
+	case err != nil:
+		return fmt.Errorf("error summarizing message: %w", err)
+	}
+
+	err = d.svc.state.QueueDigest(routeName(msg.Route), DigestEntry{
+		ID:       msg.ID,
+		Subject:  msg.Subject,
+		From:     msg.From,
+		Date:     msg.Date,
+		Summary:  summary,
+		QueuedAt: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("error queueing message for digest: %w", err)
+	}
+
+	log.Printf("Message queued for the next digest at %s", r.next.Format(digestDateLayout))
+
+	return nil
+}
+
+// Next returns when the earliest digest is due
+func (d *Digester) Next() (time.Time, bool) {
+	var next time.Time
+
+	for _, r := range d.routes {
+		if next.IsZero() || r.next.Before(next) {
+			next = r.next
+		}
+	}
+
+	return next, !next.IsZero()
+}
+
+// SendDue sends the digests that are due at now. A failed digest keeps its queue and is
+// retried after digestRetryDelay.
+func (d *Digester) SendDue(ctx context.Context, now time.Time) {
+	for name, r := range d.routes {
+		if now.Before(r.next) {
+			continue
+		}
+
+		if err := d.send(ctx, name, r, now); err != nil {
+			log.Printf("Error sending %s digest: %v", name, err)
+
+			r.next = now.Add(digestRetryDelay)
+
+			continue
+		}
+
+		r.next = r.schedule.Next(now.In(r.location))
+	}
+}
+
+func (d *Digester) send(ctx context.Context, name string, r *digestRoute, now time.Time) error {
+	entries := d.svc.state.Digest(name)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	log.Printf("Sending %s digest with %d messages...", name, len(entries))
+
+	title := r.config.Title
+	if title == "" {
+		title = defaultDigestTitle
+	}
+
+	posts := formatDigest(entries)
+
+	for i, post := range posts {
+		subject := title
+		if len(posts) > 1 {
+			subject = fmt.Sprintf("%s (%d/%d)", title, i+1, len(posts))
+		}
+
+		err := d.svc.notifiers.Notify(ctx, Notification{
+			Message: Message{
+				Subject: subject,
+				Date:    now.In(r.location).Format(digestDateLayout),
+				Route:   r.route,
+			},
+			Content: post,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	ids := make([]string, 0, len(entries))
+
+	for _, entry := range entries {
+		if err := d.svc.source.MarkAsForwarded(ctx, entry.ID); err != nil {
+			log.Printf("Error marking digest message %s as forwarded: %v", entry.ID, err)
+		}
+
+		ids = append(ids, entry.ID)
+	}
+
+	return d.svc.state.CompleteDigest(name, ids, now)
+}
+
+// maxDigestLineLength bounds the subject and sender shown for one email
+const maxDigestLineLength = 200
+
+// formatDigest lays out the queued emails as a numbered table of contents followed by a
+// section per email. Long digests are split into several posts between lines of the table
+// of contents and between sections; a section too long for a post of its own is cut short.
+func formatDigest(entries []DigestEntry) []string {
+	var (
+		posts   []string
+		current string
+	)
+
+	add := func(piece, separator string) {
+		if current != "" && utf8.RuneCountInString(current)+utf8.RuneCountInString(separator+piece) > maxDigestPostLength {
+			posts = append(posts, current)
+			current = ""
+		}
+
+		if current != "" {
+			current += separator
+		}
+
+		current += piece
+	}
+
+	add(fmt.Sprintf("%d emails:", len(entries)), "")
+
+	for i, entry := range entries {
+		add(truncateRunes(fmt.Sprintf("%d. %s — %s", i+1, entry.Subject, senderName(entry.From)), maxDigestLineLength), "\n")
+	}
+
+	for i, entry := range entries {
+		// A star in the subject would end the bold text early and break the whole post
+		subject := truncateRunes(strings.ReplaceAll(entry.Subject, "*", ""), maxDigestLineLength)
+		header := fmt.Sprintf("*%d. %s*\n📧 %s\n", i+1, subject, truncateRunes(entry.From, maxDigestLineLength))
+
+		add(header+digestSummary(entry.Summary, maxDigestPostLength-utf8.RuneCountInString(header)), "\n\n")
+	}
+
+	return append(posts, current)
+}
+
+// digestSummary cuts a summary to limit characters. A cut summary loses its bold text, whose
+// closing star may be gone.
+func digestSummary(summary string, limit int) string {
+	if utf8.RuneCountInString(summary) <= limit {
+		return summary
+	}
+
+	return truncateRunes(strings.ReplaceAll(summary, "*", ""), limit)
+}
+
+// senderName returns the display name of a From header, or the address without one
+func senderName(from string) string {
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return from
+	}
+
+	if addr.Name != "" {
+		return addr.Name
+	}
+
+	return addr.Address
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+type digestTest struct {
+	svc       *services
+	summaries int
+	forwarded []string
+	posts     []Notification
+	failPosts bool
+}
+
+func newDigestTest(t *testing.T, config *Config) *digestTest {
+	t.Helper()
+
+	state, err := NewStateStore("")
+	if err != nil {
+		t.Fatalf("NewStateStore failed: %v", err)
+	}
+
+	dt := &digestTest{}
+	dt.svc = &services{
+		source: &GmailClient{
+			markAsForwarded: func(ctx context.Context, messageID string) error {
+				dt.forwarded = append(dt.forwarded, messageID)
+
+				return nil
+			},
+		},
+		translation: &TranslationService{
+			summarize: func(ctx context.Context, msg Message, promptTemplate string) (string, error) {
+				dt.summaries++
+
+				return "Summary of " + msg.Content, nil
+			},
+		},
+		notifiers: Notifiers{sinkTelegram: notifierFunc(func(ctx context.Context, n Notification) error {
+			if dt.failPosts {
+				return errors.New("unavailable")
+			}
+
+			dt.posts = append(dt.posts, n)
+
+			return nil
+		})},
+		state: state,
+	}
+
+	dt.svc.digests, err = NewDigester(config, dt.svc)
+	if err != nil {
+		t.Fatalf("NewDigester failed: %v", err)
+	}
+
+	return dt
+}
+
+func TestDigesterQueueAndSend(t *testing.T) {
+	config := &Config{
+		Digest: DigestConfig{Schedule: "0 8 * * *", Timezone: "Europe/Riga", Title: "School digest"},
+		Routes: []RouteConfig{{Name: "school", Delivery: deliveryDigest}},
+	}
+	dt := newDigestTest(t, config)
+	route := &config.Routes[0]
+	ctx := context.Background()
+
+	messages := []Message{
+		{ID: "m1", Subject: "Trip", From: "School <office@school.example.com>", Content: "bus at 8", Route: route},
+		{ID: "m2", Subject: "Menu", From: "canteen@school.example.com", Content: "soup", Route: route},
+	}
+
+	// The same email seen again by a later poll is queued once
+	for _, msg := range append(messages, messages[0]) {
+		if err := processMessage(ctx, dt.svc, msg); err != nil {
+			t.Fatalf("processMessage failed: %v", err)
+		}
+	}
+
+	if dt.summaries != 2 || len(dt.posts) != 0 || len(dt.forwarded) != 0 {
+		t.Fatalf("summaries = %d, posts = %d, forwarded = %v after queueing", dt.summaries, len(dt.posts), dt.forwarded)
+	}
+
+	next, ok := dt.svc.digests.Next()
+	if !ok || next.Hour() != 8 || next.Location().String() != "Europe/Riga" {
+		t.Fatalf("Next() = %v, %v, want 08:00 in Europe/Riga", next, ok)
+	}
+
+	// Nothing is sent before the schedule is due
+	dt.svc.digests.SendDue(ctx, next.Add(-time.Minute))
+
+	if len(dt.posts) != 0 {
+		t.Fatalf("digest sent before it was due")
+	}
+
+	dt.svc.digests.SendDue(ctx, next)
+
+	if len(dt.posts) != 1 {
+		t.Fatalf("sent %d posts, want 1", len(dt.posts))
+	}
+
+	post := dt.posts[0]
+	if post.Message.Subject != "School digest" || post.Message.Route != route {
+		t.Errorf("post message = %+v", post.Message)
+	}
+
+	if !strings.HasPrefix(post.Content, "2 emails:\n1. Trip — School\n2. Menu — canteen@school.example.com\n") ||
+		!strings.Contains(post.Content, "*1. Trip*\n📧 School <office@school.example.com>\nSummary of bus at 8") {
+		t.Errorf("post content = %q", post.Content)
+	}
+
+	if strings.Join(dt.forwarded, ",") != "m1,m2" {
+		t.Errorf("forwarded = %v, want both emails", dt.forwarded)
+	}
+
+	if len(dt.svc.state.Digest("school")) != 0 || !dt.svc.state.DigestSent("school").Equal(next) {
+		t.Error("digest queue was not completed")
+	}
+
+	if later, _ := dt.svc.digests.Next(); !later.Equal(next.AddDate(0, 0, 1)) {
+		t.Errorf("Next() after sending = %v, want the next day", later)
+	}
+}
+
+func TestDigesterRetry(t *testing.T) {
+	config := &Config{Routes: []RouteConfig{{Name: "news", Delivery: deliveryDigest}}}
+	dt := newDigestTest(t, config)
+	ctx := context.Background()
+
+	msg := Message{ID: "m1", Subject: "News", Content: "text", Route: &config.Routes[0]}
+	if err := dt.svc.digests.Queue(ctx, msg); err != nil {
+		t.Fatalf("Queue failed: %v", err)
+	}
+
+	now, _ := dt.svc.digests.Next()
+	dt.failPosts = true
+	dt.svc.digests.SendDue(ctx, now)
+
+	if len(dt.svc.state.Digest("news")) != 1 || len(dt.forwarded) != 0 {
+		t.Fatal("failed digest lost its queue")
+	}
+
+	if next, _ := dt.svc.digests.Next(); !next.Equal(now.Add(digestRetryDelay)) {
+		t.Errorf("Next() = %v, want a retry after %v", next, digestRetryDelay)
+	}
+}
+
+func TestNewDigesterCatchUp(t *testing.T) {
+	state, _ := NewStateStore("")
+
+	// The last digest went out two days ago, so the one due since then is sent right away
+	lastSent := time.Now().Add(-48 * time.Hour)
+	if err := state.CompleteDigest("school", nil, lastSent); err != nil {
+		t.Fatalf("CompleteDigest failed: %v", err)
+	}
+
+	config := &Config{Routes: []RouteConfig{{Name: "school", Delivery: deliveryDigest}}}
+
+	d, err := NewDigester(config, &services{state: state})
+	if err != nil {
+		t.Fatalf("NewDigester failed: %v", err)
+	}
+
+	if next, _ := d.Next(); !next.Before(time.Now()) {
+		t.Errorf("Next() = %v, want an overdue digest", next)
+	}
+}
+
+func TestNewDigester(t *testing.T) {
+	tests := []struct {
+		name       string
+		routes     []RouteConfig
+		wantErr    bool
+		wantDigest bool
+	}{
+		{name: "no digest routes", routes: []RouteConfig{{Name: "all"}}},
+		{name: "immediate", routes: []RouteConfig{{Name: "all", Delivery: deliveryImmediate}}},
+		{name: "digest", routes: []RouteConfig{{Name: "all", Delivery: deliveryDigest}}, wantDigest: true},
+		{
+			name: "route schedule",
+			routes: []RouteConfig{{
+				Name: "weekly", Delivery: deliveryDigest,
+				Digest: &DigestConfig{Schedule: "0 18 * * FRI", Timezone: "America/New_York"},
+			}},
+			wantDigest: true,
+		},
+		{name: "unknown delivery", routes: []RouteConfig{{Name: "all", Delivery: "weekly"}}, wantErr: true},
+		{
+			name:    "invalid schedule",
+			routes:  []RouteConfig{{Name: "all", Delivery: deliveryDigest, Digest: &DigestConfig{Schedule: "daily"}}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid timezone",
+			routes:  []RouteConfig{{Name: "all", Delivery: deliveryDigest, Digest: &DigestConfig{Timezone: "Mars/Olympus"}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, _ := NewStateStore("")
+
+			d, err := NewDigester(&Config{Routes: tt.routes}, &services{state: state})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewDigester() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if (d != nil) != tt.wantDigest {
+				t.Errorf("NewDigester() = %v, want digest %v", d, tt.wantDigest)
+			}
+		})
+	}
+}
+
+func TestFormatDigestSplitsLongDigests(t *testing.T) {
+	entries := make([]DigestEntry, 20)
+	for i := range entries {
+		entries[i] = DigestEntry{ID: "m", Subject: "Subject", From: "a@example.com", Summary: strings.Repeat("x", 400)}
+	}
+
+	posts := formatDigest(entries)
+	if len(posts) < 2 {
+		t.Fatalf("formatDigest() returned %d posts, want the digest split", len(posts))
+	}
+
+	for i, post := range posts {
+		if len(post) > maxDigestPostLength {
+			t.Errorf("post %d has %d characters", i, len(post))
+		}
+	}
+
+	if !strings.HasPrefix(posts[0], "20 emails:") || !strings.HasPrefix(posts[1], "*") {
+		t.Errorf("posts do not start with the table of contents and a section")
+	}
+}
+
+func TestFormatDigestLimits(t *testing.T) {
+	// Enough subjects to overflow the table of contents, and a summary too long for a post
+	entries := make([]DigestEntry, 150)
+	for i := range entries {
+		entries[i] = DigestEntry{
+			Subject: "Akcija *tikai* šodien: " + strings.Repeat("ā", 40),
+			From:    "Veikals <shop@example.com>",
+			Summary: "Atlaides",
+		}
+	}
+
+	entries[0].Summary = "*Svarīgi*: " + strings.Repeat("ž", 5000)
+
+	posts := formatDigest(entries)
+
+	toc := 0
+
+	for i, post := range posts {
+		if n := utf8.RuneCountInString(post); n > maxDigestPostLength {
+			t.Errorf("post %d has %d characters", i, n)
+		}
+
+		for _, line := range strings.Split(post, "\n") {
+			if strings.HasSuffix(line, " — Veikals") {
+				toc++
+			}
+
+			// A star left in a bold subject would break the Markdown of the whole post
+			if strings.HasPrefix(line, "*") && strings.Count(line, "*") != 2 {
+				t.Errorf("post %d has the unbalanced line %q", i, line)
+			}
+		}
+	}
+
+	// The table of contents goes on in the second post
+	if toc != len(entries) || !strings.HasSuffix(strings.SplitN(posts[1], "\n", 2)[0], " — Veikals") {
+		t.Errorf("table of contents lists %d emails over the posts, want %d continued in post 2", toc, len(entries))
+	}
+
+	if !strings.Contains(strings.Join(posts, ""), "*1. Akcija tikai šodien: ") {
+		t.Error("the first section is missing")
+	}
+}
+
+func TestDigestToMatrix(t *testing.T) {
+	server, requests := newSinkServer(t, http.StatusOK)
+
+	matrix, err := newSinkNotifier(SinkConfig{Name: "matrix", Type: sinkMatrix, URL: server.URL, Token: "t", RoomID: "!room:example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{Routes: []RouteConfig{{Name: "news", Delivery: deliveryDigest, Destination: DestinationConfig{Sinks: []string{"matrix"}}}}}
+	dt := newDigestTest(t, config)
+	dt.svc.notifiers = Notifiers{"matrix": matrix}
+	ctx := context.Background()
+
+	// Two digests on two days, the second one split into two posts
+	for day, count := range []int{1, 20} {
+		for i := range count {
+			msg := Message{ID: fmt.Sprintf("d%d-%d", day, i), Subject: "News", Content: strings.Repeat("x", 400), Route: &config.Routes[0]}
+			if err := processMessage(ctx, dt.svc, msg); err != nil {
+				t.Fatalf("processMessage failed: %v", err)
+			}
+		}
+
+		next, _ := dt.svc.digests.Next()
+		dt.svc.digests.SendDue(ctx, next)
+	}
+
+	seen := map[string]bool{}
+	for _, req := range *requests {
+		seen[req.path] = true
+	}
+
+	if len(*requests) < 3 || len(seen) != len(*requests) {
+		t.Errorf("sent %d posts with %d transaction IDs, want every post its own", len(*requests), len(seen))
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+)
+
+// DryRunConfig sets where posts of a dry run go
+type DryRunConfig struct {
+	// ChatID receives the posts of dry runs, posted by the bot, instead of printing them
+	ChatID string `yaml:"chat_id"`
+}
+
+// dryRunSource reads mail like its source but leaves every email unmarked. Emails a dry run
+// forwarded once are not returned again by later polls.
+type dryRunSource struct {
+	MailSource
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func newDryRunSource(source MailSource) *dryRunSource {
+	return &dryRunSource{MailSource: source, seen: map[string]bool{}}
+}
+
+func (s *dryRunSource) GetNewMessages(ctx context.Context) ([]Message, error) {
+	messages, err := s.MailSource.GetNewMessages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := messages[:0]
+
+	for _, msg := range messages {
+		if !s.seen[msg.ID] {
+			result = append(result, msg)
+		}
+	}
+
+	return result, nil
+}
+
+func (s *dryRunSource) MarkAsForwarded(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seen[id] = true
+	log.Printf("Dry run: leaving message %s unmarked", id)
+
+	return nil
+}
+
+// Watch passes on new mail announcements of push sources; other sources never announce
+func (s *dryRunSource) Watch(ctx context.Context) <-chan struct{} {
+	if push, ok := s.MailSource.(PushSource); ok {
+		return push.Watch(ctx)
+	}
+
+	return nil
+}
+
+// previewNotifier prints notifications instead of delivering them to their sinks, or posts
+// them to the dry run chat
+type previewNotifier struct {
+	out io.Writer
+	// telegram lays out posts with the message templates; nil without a Telegram bot
+	telegram *TelegramBot
+	chatID   string
+}
+
+func (p *previewNotifier) Notify(ctx context.Context, n Notification) error {
+	route := n.Message.Route
+
+	if p.chatID != "" {
+		_, err := p.telegram.sendTestNotification(ctx, n, p.chatID)
+
+		return err
+	}
+
+	text := formatNotification(n)
+
+	if p.telegram != nil {
+		rendered, err := p.telegram.render(n)
+		if err != nil {
+			return err
+		}
+
+		text = rendered
+	}
+
+	fmt.Fprintf(p.out, "=== %s (route %s → %s)\n%s\n", n.Message.ID, routeName(route),
+		strings.Join(destinationSinks(route), ", "), text)
+
+	for _, event := range n.Events {
+		fmt.Fprintf(p.out, "📅 %s, %s\n", event.Summary, event.Start.Format("2006-01-02 15:04"))
+	}
+
+	fmt.Fprintln(p.out)
+
+	return nil
+}
+
+// enableDryRun makes svc read and process mail as usual while it prints the posts, or sends
+// them to dry_run.chat_id, leaves emails unmarked and keeps state and cache changes in memory
+func enableDryRun(config *Config, svc *services, out io.Writer) error {
+	svc.state.discardChanges()
+
+	if svc.translation != nil && svc.translation.cache != nil {
+		svc.translation.cache.discardChanges()
+	}
+	svc.source = newDryRunSource(svc.source)
+
+	if config.DryRun.ChatID != "" && svc.telegram == nil {
+		var err error
+
+		if svc.telegram, err = initializeTelegram(config, svc.state); err != nil {
+			return err
+		}
+	}
+
+	svc.notifiers = &previewNotifier{out: out, telegram: svc.telegram, chatID: config.DryRun.ChatID}
+
+	return nil
+}
+
+// runPreviewCommand processes one email end to end in a dry run, whether or not the source
+// filter passes it
+func runPreviewCommand(ctx context.Context, config *Config, svc *services, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: preview <message-id>")
+	}
+
+	msg, err := svc.source.GetMessage(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	if !matchesFilter(sourceFilter(config), msg) {
+		log.Printf("The source filter skips message %s, previewing it anyway", msg.ID)
+	}
+
+	msg, ok := prepareMessage(config, FilterConfig{}, msg)
+	if !ok {
+		return fmt.Errorf("no route matches message %s", msg.ID)
+	}
+
+	// A preview shows the post right away, even during quiet hours
+	svc.quiet = nil
+
+	return processMessage(ctx, svc, msg)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// memorySource is a MailSource holding its messages in memory
+type memorySource struct {
+	messages []Message
+	marked   []string
+}
+
+func (s *memorySource) GetNewMessages(ctx context.Context) ([]Message, error) {
+	return append([]Message(nil), s.messages...), nil
+}
+
+func (s *memorySource) GetMessage(ctx context.Context, id string) (Message, error) {
+	for _, msg := range s.messages {
+		if msg.ID == id {
+			return msg, nil
+		}
+	}
+
+	return Message{}, os.ErrNotExist
+}
+
+func (s *memorySource) MarkAsForwarded(ctx context.Context, id string) error {
+	s.marked = append(s.marked, id)
+
+	return nil
+}
+
+func TestDryRun(t *testing.T) {
+	source := &memorySource{messages: []Message{
+		{ID: "m1", Subject: "Invoice", From: "shop@example.com", Date: "today", Content: "Sveiki!"},
+		{ID: "m2", Subject: "Newsletter", From: "news@example.com", Date: "today", Content: "Labdien!"},
+	}}
+
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	state, err := NewStateStore(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{Telegram: TelegramConfig{BotToken: "token", ChatID: "prod"}}
+
+	bot, err := NewTelegramBot(config, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cachePath := filepath.Join(t.TempDir(), "cache.json")
+	cache, _ := newTestCache(t, TranslationCacheConfig{File: cachePath})
+
+	svc := &services{
+		source: source,
+		translation: &TranslationService{config: config, cache: cache, translate: func(ctx context.Context, msg Message) (Translation, error) {
+			return Translation{Content: "Hello!"}, nil
+		}},
+		telegram:  bot,
+		notifiers: Notifiers{sinkTelegram: bot},
+		state:     state,
+	}
+
+	var out strings.Builder
+	if err := enableDryRun(config, svc, &out); err != nil {
+		t.Fatalf("enableDryRun() error = %v", err)
+	}
+
+	messages, _ := svc.source.GetNewMessages(context.Background())
+	processMessages(context.Background(), svc, messages)
+
+	if !strings.Contains(out.String(), "=== m1 (route default → telegram)\n*Invoice*\n\n📅 today\n📧 From: shop@example.com\n\nHello!") {
+		t.Errorf("dry run printed %q", out.String())
+	}
+
+	if len(source.marked) != 0 {
+		t.Errorf("dry run marked %v as forwarded", source.marked)
+	}
+
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote the state file: %v", err)
+	}
+
+	if _, err := os.Stat(cachePath); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote the translation cache: %v", err)
+	}
+
+	// Emails the dry run printed are not returned again
+	if again, _ := svc.source.GetNewMessages(context.Background()); len(again) != 0 {
+		t.Errorf("second poll returned %d messages, want none", len(again))
+	}
+}
+
+func TestRunPreviewCommand(t *testing.T) {
+	source := &memorySource{messages: []Message{
+		{ID: "m1", Subject: "Invoice", From: "shop@example.org", Date: "today", Content: "Sveiki!"},
+	}}
+
+	config := &Config{
+		Gmail:  GmailConfig{Filter: FilterConfig{From: []string{"@example.com"}}},
+		Routes: []RouteConfig{{Name: "shops", Filter: FilterConfig{From: []string{"shop@"}}}},
+	}
+
+	state, _ := NewStateStore("")
+	svc := &services{
+		source: source,
+		translation: &TranslationService{config: config, translate: func(ctx context.Context, msg Message) (Translation, error) {
+			return Translation{Content: "Hello!"}, nil
+		}},
+		state: state,
+	}
+
+	var out strings.Builder
+	if err := enableDryRun(config, svc, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	// The source filter would skip the email, a preview shows it anyway
+	if err := runPreviewCommand(context.Background(), config, svc, []string{"m1"}); err != nil {
+		t.Fatalf("runPreviewCommand() error = %v", err)
+	}
+
+	if !strings.HasPrefix(out.String(), "=== m1 (route shops → telegram)\n*Invoice*") || len(source.marked) != 0 {
+		t.Errorf("preview printed %q and marked %v", out.String(), source.marked)
+	}
+
+	if err := runPreviewCommand(context.Background(), config, svc, []string{"missing"}); err == nil {
+		t.Error("runPreviewCommand() accepted an unknown message")
+	}
+}
+
+func TestSendTestNotification(t *testing.T) {
+	var chatID, threadID string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chatID, threadID = r.URL.Query().Get("chat_id"), r.URL.Query().Get("message_thread_id")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
+	}))
+	defer server.Close()
+
+	bot := &TelegramBot{client: server.Client(), chatID: "prod", baseURL: server.URL, messageThreadID: 7}
+	route := &RouteConfig{Name: "school", Destination: DestinationConfig{ChatID: "school-chat", MessageThreadID: 9}}
+
+	n := Notification{Message: Message{Subject: "Teātra diena", Route: route}, Content: "Hello!"}
+	if _, err := bot.sendTestNotification(context.Background(), n, "test-chat"); err != nil {
+		t.Fatalf("sendTestNotification() error = %v", err)
+	}
+
+	if chatID != "test-chat" || threadID != "" {
+		t.Errorf("posted to chat %q topic %q, want the test chat without a topic", chatID, threadID)
+	}
+
+	if route.Destination.ChatID != "school-chat" {
+		t.Error("sendTestNotification() changed the route")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// How the body of an email is prepared, see TranslationConfig.Processing
+const (
+	processingTranslate = "translate"
+	processingExtract   = "extract"
+)
+
+const (
+	defaultExtractionPromptTemplate = "Read the following email and describe it in {target_language}: a short summary, what the sender wants, deadlines, amounts of money, parcel tracking numbers and the things the reader has to do. Leave lists empty when the email has none. Dates are YYYY-MM-DD.\n\n{text}"
+	extractionDateLayout            = "2006-01-02"
+)
+
+// errInvalidExtraction is returned when the model's answer does not fit the extraction schema
+var errInvalidExtraction = errors.New("invalid extraction")
+
+// Extraction is the structured description of an email returned by the extract processing mode
+type Extraction struct {
+	Summary         string           `json:"summary"`
+	Intent          string           `json:"intent"`
+	Deadlines       []Deadline       `json:"deadlines"`
+	Amounts         []Amount         `json:"amounts"`
+	TrackingNumbers []TrackingNumber `json:"tracking_numbers"`
+	ActionItems     []string         `json:"action_items"`
+}
+
+type Deadline struct {
+	Date        string `json:"date"`
+	Description string `json:"description"`
+}
+
+type Amount struct {
+	Value       string `json:"value"`
+	Currency    string `json:"currency"`
+	Description string `json:"description"`
+}
+
+type TrackingNumber struct {
+	Number  string `json:"number"`
+	Carrier string `json:"carrier"`
+}
+
+// extractionSchema makes Gemini answer with JSON in the shape of Extraction
+var extractionSchema = &genai.Schema{
+	Type: genai.TypeObject,
+	Properties: map[string]*genai.Schema{
+		"summary": {Type: genai.TypeString, Description: "Two or three sentences about the email"},
+		"intent":  {Type: genai.TypeString, Description: "What the sender wants, e.g. payment request or information"},
+		"deadlines": {
+			Type: genai.TypeArray,
+			Items: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"date":        {Type: genai.TypeString, Description: "YYYY-MM-DD"},
+					"description": {Type: genai.TypeString},
+				},
+				Required: []string{"date", "description"},
+			},
+		},
+		"amounts": {
+			Type: genai.TypeArray,
+			Items: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"value":       {Type: genai.TypeString, Description: "The number as written, e.g. 120.50"},
+					"currency":    {Type: genai.TypeString, Description: "ISO 4217 code"},
+					"description": {Type: genai.TypeString},
+				},
+				Required: []string{"value"},
+			},
+		},
+		"tracking_numbers": {
+			Type: genai.TypeArray,
+			Items: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"number":  {Type: genai.TypeString},
+					"carrier": {Type: genai.TypeString},
+				},
+				Required: []string{"number"},
+			},
+		},
+		"action_items": {Type: genai.TypeArray, Items: &genai.Schema{Type: genai.TypeString}},
+	},
+	Required: []string{"summary", "intent", "deadlines", "amounts", "tracking_numbers", "action_items"},
+}
+
+// validProcessing reports whether mode is a known processing mode, empty meaning the default
+func validProcessing(mode string) bool {
+	return mode == "" || mode == processingTranslate || mode == processingExtract
+}
+
+// routeProcessing returns the processing mode of a route, falling back to the translation section
+func routeProcessing(config *Config, route *RouteConfig) string {
+	if route != nil && route.Processing != "" {
+		return route.Processing
+	}
+
+	if config.Translation.Processing != "" {
+		return config.Translation.Processing
+	}
+
+	return processingTranslate
+}
+
+// Extract asks the model for the structured description of an email. It fails with
+// errInvalidExtraction when the answer is not valid JSON of the expected shape.
+func (s *TranslationService) Extract(ctx context.Context, msg Message) (*Extraction, error) {
+	return s.extract(ctx, msg)
+}
+
+func (s *TranslationService) defaultExtract(ctx context.Context, msg Message) (*Extraction, error) {
+	if msg.Content == "" {
+		return nil, errEmptyContent
+	}
+
+	prompt, err := s.prompts.render(routeExtractionPromptTemplate(s.config, msg.Route), s.promptData(msg))
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := s.generateJSON(ctx, prompt, extractionSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseExtraction(raw)
+}
+
+// Process prepares the body of msg for delivery with the processing mode of its route. Extraction
+// falls back to plain translation when the model does not return valid JSON.
+func (s *TranslationService) Process(ctx context.Context, msg Message) (Translation, error) {
+	if routeProcessing(s.config, msg.Route) == processingExtract {
+		extraction, err := s.Extract(ctx, msg)
+		if err == nil {
+			return Translation{Content: formatExtraction(extraction)}, nil
+		}
+
+		if !errors.Is(err, errInvalidExtraction) {
+			return Translation{}, err
+		}
+
+		log.Printf("Structured extraction failed, falling back to translation: %v", err)
+	}
+
+	return s.Translate(ctx, msg)
+}
+
+// parseExtraction decodes and validates the model's JSON answer
+func parseExtraction(raw string) (*Extraction, error) {
+	// Models sometimes wrap JSON in a Markdown code fence despite the response MIME type
+	raw = strings.TrimSpace(raw)
+	raw = strings.TrimPrefix(raw, "```json")
+	raw = strings.TrimSuffix(strings.TrimPrefix(raw, "```"), "```")
+
+	var extraction Extraction
+	if err := json.Unmarshal([]byte(raw), &extraction); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidExtraction, err)
+	}
+
+	if strings.TrimSpace(extraction.Summary) == "" {
+		return nil, fmt.Errorf("%w: empty summary", errInvalidExtraction)
+	}
+
+	for _, deadline := range extraction.Deadlines {
+		if _, err := time.Parse(extractionDateLayout, deadline.Date); err != nil {
+			return nil, fmt.Errorf("%w: deadline date %q is not YYYY-MM-DD", errInvalidExtraction, deadline.Date)
+		}
+	}
+
+	for _, amount := range extraction.Amounts {
+		if strings.TrimSpace(amount.Value) == "" {
+			return nil, fmt.Errorf("%w: amount without a value", errInvalidExtraction)
+		}
+	}
+
+	for _, tracking := range extraction.TrackingNumbers {
+		if strings.TrimSpace(tracking.Number) == "" {
+			return nil, fmt.Errorf("%w: tracking number without a number", errInvalidExtraction)
+		}
+	}
+
+	return &extraction, nil
+}
+
+// formatExtraction renders an extraction as a Telegram Markdown card with a section per
+// non-empty list
+func formatExtraction(e *Extraction) string {
+	var card strings.Builder
+
+	card.WriteString("📝 " + cardText(e.Summary) + "\n")
+
+	if e.Intent != "" {
+		card.WriteString("\n🎯 *Intent:* " + cardText(e.Intent) + "\n")
+	}
+
+	section := func(title string, items []string) {
+		if len(items) == 0 {
+			return
+		}
+
+		card.WriteString("\n" + title + "\n")
+
+		for _, item := range items {
+			card.WriteString("• " + item + "\n")
+		}
+	}
+
+	var deadlines, amounts, tracking, actions []string
+
+	for _, d := range e.Deadlines {
+		deadlines = append(deadlines, joinNonEmpty(" — ", d.Date, cardText(d.Description)))
+	}
+
+	for _, a := range e.Amounts {
+		amounts = append(amounts, joinNonEmpty(" — ", joinNonEmpty(" ", cardText(a.Value), cardText(a.Currency)),
+			cardText(a.Description)))
+	}
+
+	for _, t := range e.TrackingNumbers {
+		number := cardText(t.Number)
+		if t.Carrier != "" {
+			number += " (" + cardText(t.Carrier) + ")"
+		}
+
+		tracking = append(tracking, number)
+	}
+
+	for _, item := range e.ActionItems {
+		actions = append(actions, cardText(item))
+	}
+
+	section("⏰ *Deadlines*", deadlines)
+	section("💶 *Amounts*", amounts)
+	section("📦 *Tracking*", tracking)
+	section("✅ *To do*", actions)
+
+	return strings.TrimSuffix(card.String(), "\n")
+}
+
+// cardText removes the characters that would open Telegram Markdown entities in model output
+func cardText(s string) string {
+	return strings.NewReplacer("*", "", "_", " ", "`", "", "[", "(", "]", ")").Replace(strings.TrimSpace(s))
+}
+
+func joinNonEmpty(sep string, parts ...string) string {
+	var nonEmpty []string
+
+	for _, part := range parts {
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+
+	return strings.Join(nonEmpty, sep)
+}
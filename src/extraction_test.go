@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+const testExtractionJSON = `{
+  "summary": "The April invoice is ready.",
+  "intent": "payment request",
+  "deadlines": [{"date": "2025-04-15", "description": "Pay the *invoice*"}],
+  "amounts": [{"value": "120.50", "currency": "EUR", "description": "April"}],
+  "tracking_numbers": [{"number": "1Z999AA10123456784", "carrier": "UPS"}],
+  "action_items": ["Pay by bank transfer"]
+}`
+
+func TestParseExtraction(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr bool
+	}{
+		{name: "valid", raw: testExtractionJSON},
+		{name: "code fence", raw: "```json\n" + testExtractionJSON + "\n```"},
+		{name: "empty lists", raw: `{"summary": "Newsletter", "intent": "information"}`},
+		{name: "not JSON", raw: "The April invoice is ready.", wantErr: true},
+		{name: "truncated", raw: testExtractionJSON[:40], wantErr: true},
+		{name: "empty summary", raw: `{"summary": " ", "intent": "information"}`, wantErr: true},
+		{name: "invalid deadline", raw: `{"summary": "x", "deadlines": [{"date": "next Friday"}]}`, wantErr: true},
+		{name: "amount without value", raw: `{"summary": "x", "amounts": [{"currency": "EUR"}]}`, wantErr: true},
+		{name: "empty tracking number", raw: `{"summary": "x", "tracking_numbers": [{"carrier": "DHL"}]}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseExtraction(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseExtraction() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil && !errors.Is(err, errInvalidExtraction) {
+				t.Errorf("parseExtraction() error = %v, want errInvalidExtraction", err)
+			}
+		})
+	}
+}
+
+func TestFormatExtraction(t *testing.T) {
+	extraction, err := parseExtraction(testExtractionJSON)
+	if err != nil {
+		t.Fatalf("parseExtraction() error = %v", err)
+	}
+
+	want := "📝 The April invoice is ready.\n\n" +
+		"🎯 *Intent:* payment request\n\n" +
+		"⏰ *Deadlines*\n• 2025-04-15 — Pay the invoice\n\n" +
+		"💶 *Amounts*\n• 120.50 EUR — April\n\n" +
+		"📦 *Tracking*\n• 1Z999AA10123456784 (UPS)\n\n" +
+		"✅ *To do*\n• Pay by bank transfer"
+
+	if got := formatExtraction(extraction); got != want {
+		t.Errorf("formatExtraction() =\n%s\nwant\n%s", got, want)
+	}
+
+	if got := formatExtraction(&Extraction{Summary: "Newsletter"}); got != "📝 Newsletter" {
+		t.Errorf("formatExtraction() without lists = %q", got)
+	}
+}
+
+func TestTranslationServiceProcess(t *testing.T) {
+	extractRoute := &RouteConfig{Name: "bills", Processing: processingExtract}
+
+	tests := []struct {
+		name       string
+		route      *RouteConfig
+		extractErr error
+		want       string
+		wantErr    bool
+	}{
+		{name: "translate by default", want: "translated"},
+		{name: "extract", route: extractRoute, want: "📝 Invoice"},
+		{
+			name:       "invalid JSON falls back to translation",
+			route:      extractRoute,
+			extractErr: errInvalidExtraction,
+			want:       "translated",
+		},
+		{name: "model error", route: extractRoute, extractErr: errors.New("quota exceeded"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &TranslationService{
+				config: &Config{},
+				translate: func(ctx context.Context, msg Message) (Translation, error) {
+					return Translation{Content: "translated"}, nil
+				},
+				extract: func(ctx context.Context, msg Message) (*Extraction, error) {
+					if tt.extractErr != nil {
+						return nil, tt.extractErr
+					}
+
+					return &Extraction{Summary: "Invoice"}, nil
+				},
+			}
+
+			got, err := service.Process(context.Background(), Message{Content: "text", Route: tt.route})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Process() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got.Content != tt.want {
+				t.Errorf("Process() = %q, want %q", got.Content, tt.want)
+			}
+		})
+	}
+}
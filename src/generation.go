@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/googleapis/gax-go/v2/apierror"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors of the model calls, telling the pipeline what to do with the email
+var (
+	// errQuotaExhausted is returned when the API key ran out of requests or tokens
+	errQuotaExhausted = errors.New("quota exhausted")
+	// errTransient is returned for overloaded servers, timeouts and other errors worth retrying
+	errTransient = errors.New("temporary model error")
+	// errResponseBlocked is returned when the prompt or the answer was blocked by safety filters
+	errResponseBlocked = errors.New("response blocked by safety filters")
+	// errEmptyResponse is returned when the model answered without any text
+	errEmptyResponse = errors.New("empty response from model")
+	// errResponseTruncated is returned when the model stopped at its output token limit
+	errResponseTruncated = errors.New("response truncated at the output token limit")
+	// errEmptyContent is returned for emails without any text, e.g. with only attachments
+	errEmptyContent = errors.New("email has no text")
+)
+
+// untranslatable reports errors that are caused by the email itself, so trying again will not help
+func untranslatable(err error) bool {
+	return errors.Is(err, errResponseBlocked) || errors.Is(err, errEmptyResponse) ||
+		errors.Is(err, errResponseTruncated) || errors.Is(err, errEmptyContent)
+}
+
+var harmCategories = map[string]genai.HarmCategory{
+	"harassment":        genai.HarmCategoryHarassment,
+	"hate_speech":       genai.HarmCategoryHateSpeech,
+	"sexually_explicit": genai.HarmCategorySexuallyExplicit,
+	"dangerous_content": genai.HarmCategoryDangerousContent,
+}
+
+var harmThresholds = map[string]genai.HarmBlockThreshold{
+	"block_none":             genai.HarmBlockNone,
+	"block_only_high":        genai.HarmBlockOnlyHigh,
+	"block_medium_and_above": genai.HarmBlockMediumAndAbove,
+	"block_low_and_above":    genai.HarmBlockLowAndAbove,
+}
+
+// safetySettings converts translation.safety_settings into the settings of the Gemini API
+func safetySettings(config map[string]string) ([]*genai.SafetySetting, error) {
+	var settings []*genai.SafetySetting
+
+	for name, value := range config {
+		category, ok := harmCategories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown safety category %q", name)
+		}
+
+		threshold, ok := harmThresholds[strings.ToLower(value)]
+		if !ok {
+			return nil, fmt.Errorf("unknown safety threshold %q for %s", value, name)
+		}
+
+		settings = append(settings, &genai.SafetySetting{Category: category, Threshold: threshold})
+	}
+
+	return settings, nil
+}
+
+// generationError wraps an error of the Gemini API into errQuotaExhausted or errTransient
+// when it is one of those
+func generationError(action string, err error) error {
+	var blocked *genai.BlockedError
+	if errors.As(err, &blocked) {
+		return fmt.Errorf("%w: %v", errResponseBlocked, blocked)
+	}
+
+	code := status.Code(err)
+
+	var apiErr *apierror.APIError
+	if errors.As(err, &apiErr) && apiErr.HTTPCode() > 0 {
+		switch apiErr.HTTPCode() {
+		case http.StatusTooManyRequests:
+			code = codes.ResourceExhausted
+		case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			code = codes.Unavailable
+		}
+	}
+
+	switch {
+	case code == codes.ResourceExhausted:
+		return fmt.Errorf("%s: %w: %v", action, errQuotaExhausted, err)
+	case code == codes.Unavailable || code == codes.Internal || code == codes.DeadlineExceeded ||
+		errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("%s: %w: %v", action, errTransient, err)
+	}
+
+	return fmt.Errorf("%s: %v", action, err)
+}
+
+// responseText joins the text parts of the first candidate, reporting answers cut off at the
+// output limit, stopped by safety filters or without any text
+func responseText(resp *genai.GenerateContentResponse) (string, error) {
+	if resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != genai.BlockReasonUnspecified {
+		return "", fmt.Errorf("%w: prompt: %v", errResponseBlocked, resp.PromptFeedback.BlockReason)
+	}
+
+	if len(resp.Candidates) == 0 {
+		return "", errEmptyResponse
+	}
+
+	candidate := resp.Candidates[0]
+
+	switch candidate.FinishReason {
+	case genai.FinishReasonMaxTokens:
+		return "", errResponseTruncated
+	case genai.FinishReasonSafety, genai.FinishReasonRecitation:
+		return "", fmt.Errorf("%w: %v", errResponseBlocked, candidate.FinishReason)
+	}
+
+	var text strings.Builder
+
+	if candidate.Content != nil {
+		for _, part := range candidate.Content.Parts {
+			if t, ok := part.(genai.Text); ok {
+				text.WriteString(string(t))
+			}
+		}
+	}
+
+	if strings.TrimSpace(text.String()) == "" {
+		return "", errEmptyResponse
+	}
+
+	return strings.TrimSpace(text.String()), nil
+}
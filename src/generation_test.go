@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/googleapis/gax-go/v2/apierror"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestResponseText(t *testing.T) {
+	candidate := func(reason genai.FinishReason, parts ...genai.Part) *genai.Candidate {
+		return &genai.Candidate{FinishReason: reason, Content: &genai.Content{Parts: parts}}
+	}
+
+	tests := []struct {
+		name    string
+		resp    *genai.GenerateContentResponse
+		want    string
+		wantErr error
+	}{
+		{
+			name: "all parts",
+			resp: &genai.GenerateContentResponse{Candidates: []*genai.Candidate{
+				candidate(genai.FinishReasonStop, genai.Text("Hello, "), genai.Text("world\n")),
+			}},
+			want: "Hello, world",
+		},
+		{
+			name: "truncated",
+			resp: &genai.GenerateContentResponse{Candidates: []*genai.Candidate{
+				candidate(genai.FinishReasonMaxTokens, genai.Text("Hello")),
+			}},
+			wantErr: errResponseTruncated,
+		},
+		{
+			name:    "answer blocked",
+			resp:    &genai.GenerateContentResponse{Candidates: []*genai.Candidate{candidate(genai.FinishReasonSafety)}},
+			wantErr: errResponseBlocked,
+		},
+		{
+			name: "prompt blocked",
+			resp: &genai.GenerateContentResponse{
+				PromptFeedback: &genai.PromptFeedback{BlockReason: genai.BlockReasonSafety},
+			},
+			wantErr: errResponseBlocked,
+		},
+		{name: "no candidates", resp: &genai.GenerateContentResponse{}, wantErr: errEmptyResponse},
+		{
+			name:    "blank answer",
+			resp:    &genai.GenerateContentResponse{Candidates: []*genai.Candidate{candidate(genai.FinishReasonStop, genai.Text(" \n"))}},
+			wantErr: errEmptyResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := responseText(tt.resp)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("responseText() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("responseText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerationError(t *testing.T) {
+	httpError := func(code int) error {
+		apiErr, _ := apierror.FromError(&googleapi.Error{Code: code, Message: "error"})
+
+		return apiErr
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "grpc quota", err: status.Error(codes.ResourceExhausted, "quota"), want: errQuotaExhausted},
+		{name: "http quota", err: httpError(429), want: errQuotaExhausted},
+		{name: "overloaded", err: status.Error(codes.Unavailable, "overloaded"), want: errTransient},
+		{name: "http overloaded", err: httpError(503), want: errTransient},
+		{name: "timeout", err: fmt.Errorf("request: %w", context.DeadlineExceeded), want: errTransient},
+		{name: "blocked", err: &genai.BlockedError{Candidate: &genai.Candidate{}}, want: errResponseBlocked},
+		{name: "invalid key", err: status.Error(codes.PermissionDenied, "invalid key")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := generationError("failed to generate content", tt.err)
+
+			for _, kind := range []error{errQuotaExhausted, errTransient, errResponseBlocked} {
+				if errors.Is(err, kind) != (kind == tt.want) {
+					t.Errorf("generationError() = %v, want %v", err, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSafetySettings(t *testing.T) {
+	settings, err := safetySettings(map[string]string{"harassment": "block_none", "dangerous_content": "BLOCK_ONLY_HIGH"})
+	if err != nil {
+		t.Fatalf("safetySettings() error = %v", err)
+	}
+
+	if len(settings) != 2 {
+		t.Errorf("safetySettings() = %v", settings)
+	}
+
+	for _, config := range []map[string]string{{"violence": "block_none"}, {"harassment": "sometimes"}} {
+		if _, err := safetySettings(config); err == nil {
+			t.Errorf("safetySettings(%v) accepted an invalid setting", config)
+		}
+	}
+}
@@ -6,9 +6,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
 	"os"
-	"regexp"
+	"slices"
 	"strings"
 	"time"
 
@@ -19,11 +23,40 @@ import (
 )
 
 type Message struct {
-	ID      string
-	Subject string
-	Content string
-	From    string
-	Date    string
+	ID         string
+	ThreadID   string
+	MessageID  string
+	InReplyTo  string
+	References string
+	ReplyTo    string
+	Subject    string
+	Content    string
+	From       string
+	To         string
+	Date       string
+	// Time is the parsed Date header, or when the mailbox received the message if the header
+	// is missing or broken; zero when neither is known
+	Time time.Time
+	// SMIME is "signed" or "encrypted" for S/MIME messages
+	SMIME string
+	// Header holds every header of the message; only set when fetched in raw format
+	Header mail.Header
+	// Calendars holds the iCalendar parts of the message, e.g. meeting invitations
+	Calendars []string
+	// Attachments are the file names of the attachments
+	Attachments []string
+	// OriginalSubject and OriginalFrom are the headers before translation, empty when they
+	// were not translated
+	OriginalSubject string
+	OriginalFrom    string
+	// Labels are the Gmail labels, the Outlook categories or the IMAP mailbox of the message
+	Labels []string
+	// Account is the address the email was delivered to
+	Account string
+	// Link opens the email in Gmail or Outlook on the web; empty for IMAP
+	Link string
+	// Route is the matched route; nil means the default destination from the telegram section
+	Route *RouteConfig
 }
 
 // GmailServiceInterface defines the interface for Gmail service operations
@@ -45,9 +78,12 @@ type GmailLabelsInterface interface {
 
 // GmailMessagesInterface defines the interface for Gmail messages operations
 type GmailMessagesInterface interface {
-	List(userId string, q string) ([]*gmail.Message, error)
+	// ListPage returns one page of messages matching q, starting at pageToken
+	ListPage(userId string, q string, pageToken string) (*gmail.ListMessagesResponse, error)
 	Get(userId string, id string) (*gmail.Message, error)
+	GetRaw(userId string, id string) (*gmail.Message, error)
 	Modify(userId string, id string, mods *gmail.ModifyMessageRequest) (*gmail.Message, error)
+	Send(userId string, msg *gmail.Message) (*gmail.Message, error)
 }
 
 // GmailServiceWrapper wraps the Gmail service for easier mocking in tests
@@ -99,32 +135,44 @@ func (w *GmailLabelsWrapper) Create(userId string, label *gmail.Label) (*gmail.L
 	return w.service.Users.Labels.Create(userId, label).Do()
 }
 
-func (w *GmailMessagesWrapper) List(userId string, q string) ([]*gmail.Message, error) {
-	resp, err := w.service.Users.Messages.List(userId).Q(q).Do()
-	if err != nil {
-		return nil, err
-	}
-	return resp.Messages, nil
+func (w *GmailMessagesWrapper) ListPage(userId string, q string, pageToken string) (*gmail.ListMessagesResponse, error) {
+	return w.service.Users.Messages.List(userId).Q(q).PageToken(pageToken).MaxResults(500).Do()
 }
 
 func (w *GmailMessagesWrapper) Get(userId string, id string) (*gmail.Message, error) {
 	return w.service.Users.Messages.Get(userId, id).Do()
 }
 
+func (w *GmailMessagesWrapper) GetRaw(userId string, id string) (*gmail.Message, error) {
+	return w.service.Users.Messages.Get(userId, id).Format("raw").Do()
+}
+
 func (w *GmailMessagesWrapper) Modify(userId string, id string, mods *gmail.ModifyMessageRequest) (*gmail.Message, error) {
 	return w.service.Users.Messages.Modify(userId, id, mods).Do()
 }
 
+func (w *GmailMessagesWrapper) Send(userId string, msg *gmail.Message) (*gmail.Message, error) {
+	return w.service.Users.Messages.Send(userId, msg).Do()
+}
+
 // GmailClient struct
 type GmailClient struct {
-	service         GmailServiceInterface
-	config          *Config
-	labelID         string
+	service GmailServiceInterface
+	config  *Config
+	labelID string
+	// labelNames maps label IDs to names, for the {{.Labels}} prompt variable
+	labelNames      map[string]string
 	getNewMessages  func(ctx context.Context) ([]Message, error)
 	markAsForwarded func(ctx context.Context, messageID string) error
 }
 
 func NewGmailClient(ctx context.Context, config *Config) (*GmailClient, error) {
+	switch config.Gmail.Format {
+	case "", gmailFormatFull, gmailFormatRaw:
+	default:
+		return nil, fmt.Errorf("invalid gmail format %q: use %q or %q", config.Gmail.Format, gmailFormatFull, gmailFormatRaw)
+	}
+
 	credentials, err := os.ReadFile(config.Gmail.CredentialsFile)
 	if err != nil {
 		return nil, fmt.Errorf("unable to read client secret file: %v", err)
@@ -183,6 +231,11 @@ func (c *GmailClient) ensureLabelExists(ctx context.Context) (string, error) {
 		return "", fmt.Errorf("failed to list labels: %v", err)
 	}
 
+	c.labelNames = make(map[string]string, len(labels))
+	for _, label := range labels {
+		c.labelNames[label.Id] = label.Name
+	}
+
 	// Check if the label already exists
 	for _, label := range labels {
 		if label.Name == c.config.Gmail.ForwardedLabel {
@@ -203,28 +256,23 @@ func (c *GmailClient) ensureLabelExists(ctx context.Context) (string, error) {
 }
 
 func (c *GmailClient) GetNewMessages(ctx context.Context) ([]Message, error) {
-	// Get messages that don't have the forwarded label
+	// Get messages that don't have the forwarded label, from every result page
 	query := fmt.Sprintf("-label:%s", c.config.Gmail.ForwardedLabel)
-	messages, err := c.service.Users().Messages().List("me", query)
+	ids, err := c.listMessageIDs(query)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list messages: %v", err)
+		return nil, err
 	}
 
 	var result []Message
-	for _, msg := range messages {
-		// Get the full message details
-		fullMsg, err := c.service.Users().Messages().Get("me", msg.Id)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get message %s: %v", msg.Id, err)
-		}
-
-		// Parse the message
-		parsedMsg, err := c.parseMessage(fullMsg)
+	for _, id := range ids {
+		// Get and parse the full message details
+		parsedMsg, err := c.fetchMessage(id)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse message %s: %v", msg.Id, err)
+			return nil, err
 		}
 
-		if !c.shouldProcessMessage(parsedMsg) {
+		parsedMsg, ok := prepareMessage(c.config, c.config.Gmail.Filter, parsedMsg)
+		if !ok {
 			continue
 		}
 
@@ -234,6 +282,38 @@ func (c *GmailClient) GetNewMessages(ctx context.Context) ([]Message, error) {
 	return result, nil
 }
 
+// listMessageIDs returns the IDs of every message matching query, newest first, following
+// the result pages
+func (c *GmailClient) listMessageIDs(query string) ([]string, error) {
+	var (
+		ids       []string
+		pageToken string
+	)
+
+	for {
+		page, err := c.service.Users().Messages().ListPage("me", query, pageToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list messages: %v", err)
+		}
+
+		for _, msg := range page.Messages {
+			ids = append(ids, msg.Id)
+		}
+
+		if page.NextPageToken == "" {
+			return ids, nil
+		}
+
+		pageToken = page.NextPageToken
+	}
+}
+
+// isForwarded reports whether msg already carries the forwarded label
+func (c *GmailClient) isForwarded(msg Message) bool {
+	return slices.Contains(msg.Labels, c.config.Gmail.ForwardedLabel) ||
+		(c.labelID != "" && slices.Contains(msg.Labels, c.labelID))
+}
+
 func (c *GmailClient) defaultGetNewMessages(ctx context.Context) ([]Message, error) {
 	return c.GetNewMessages(ctx)
 }
@@ -250,159 +330,331 @@ func (c *GmailClient) defaultMarkAsForwarded(ctx context.Context, messageID stri
 	return err
 }
 
+// GetMessage fetches and parses a single message by its Gmail ID
+func (c *GmailClient) GetMessage(ctx context.Context, messageID string) (Message, error) {
+	return c.fetchMessage(messageID)
+}
+
+// fetchMessage gets a message in the configured format and parses it
+func (c *GmailClient) fetchMessage(messageID string) (Message, error) {
+	if c.config.Gmail.Format == gmailFormatRaw {
+		rawMsg, err := c.service.Users().Messages().GetRaw("me", messageID)
+		if err != nil {
+			return Message{}, fmt.Errorf("failed to get message %s: %v", messageID, err)
+		}
+
+		raw, err := decodeRawData(rawMsg.Raw)
+		if err != nil {
+			return Message{}, fmt.Errorf("failed to decode message %s: %v", messageID, err)
+		}
+
+		parsedMsg, err := parseRawMessage(raw)
+		if err != nil {
+			return Message{}, fmt.Errorf("failed to parse message %s: %v", messageID, err)
+		}
+
+		parsedMsg.ID = rawMsg.Id
+		parsedMsg.ThreadID = rawMsg.ThreadId
+		parsedMsg.Labels = c.labels(rawMsg.LabelIds)
+		parsedMsg.Time = messageTime(parsedMsg.Date, gmailInternalDate(rawMsg.InternalDate))
+		parsedMsg.Link = gmailLink(parsedMsg.Account, rawMsg.Id)
+
+		return parsedMsg, nil
+	}
+
+	fullMsg, err := c.service.Users().Messages().Get("me", messageID)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to get message %s: %v", messageID, err)
+	}
+
+	parsedMsg, err := c.parseMessage(fullMsg)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to parse message %s: %v", messageID, err)
+	}
+
+	parsedMsg.Link = gmailLink(parsedMsg.Account, fullMsg.Id)
+
+	return parsedMsg, nil
+}
+
+// SendReply sends body as a reply to a forwarded message, keeping it in the same Gmail thread
+func (c *GmailClient) SendReply(ctx context.Context, fwd ForwardedMessage, body string) error {
+	to := fwd.ReplyTo
+	if to == "" {
+		to = fwd.From
+	}
+
+	if to == "" {
+		return fmt.Errorf("original message has no sender to reply to")
+	}
+
+	raw := buildReply(to, fwd.Subject, fwd.MessageID, fwd.References, body)
+
+	_, err := c.service.Users().Messages().Send("me", &gmail.Message{
+		Raw:      base64.URLEncoding.EncodeToString([]byte(raw)),
+		ThreadId: fwd.ThreadID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+
+	return nil
+}
+
+// buildReply renders an RFC 822 reply with threading headers
+func buildReply(to, subject, inReplyTo, references, body string) string {
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+
+	if inReplyTo != "" {
+		references = strings.TrimSpace(references + " " + inReplyTo)
+	}
+
+	// Display names were decoded from RFC 2047 when the message was parsed; encode them again
+	if addr, err := mail.ParseAddress(to); err == nil && !isASCII(addr.Name) {
+		to = addr.String()
+	}
+
+	var b strings.Builder
+
+	b.WriteString("To: " + to + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+
+	if inReplyTo != "" {
+		b.WriteString("In-Reply-To: " + inReplyTo + "\r\n")
+	}
+
+	if references != "" {
+		b.WriteString("References: " + references + "\r\n")
+	}
+
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=\"UTF-8\"\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	return b.String()
+}
+
+// gmailInternalDate converts Gmail's internalDate, in milliseconds since the epoch
+func gmailInternalDate(ms int64) time.Time {
+	if ms <= 0 {
+		return time.Time{}
+	}
+
+	return time.UnixMilli(ms)
+}
+
+// gmailLink opens a message in Gmail, signed in as account when it is known
+func gmailLink(account, id string) string {
+	if account == "" {
+		return "https://mail.google.com/mail/#all/" + id
+	}
+
+	return "https://mail.google.com/mail/?authuser=" + url.QueryEscape(account) + "#all/" + id
+}
+
+// labels returns the names of label IDs, or the IDs of labels created since startup
+func (c *GmailClient) labels(ids []string) []string {
+	var names []string
+
+	for _, id := range ids {
+		if name, ok := c.labelNames[id]; ok {
+			id = name
+		}
+
+		names = append(names, id)
+	}
+
+	return names
+}
+
 func (c *GmailClient) parseMessage(msg *gmail.Message) (Message, error) {
 	var result Message
 	result.ID = msg.Id
+	result.ThreadID = msg.ThreadId
+	result.Labels = c.labels(msg.LabelIds)
 
 	for _, header := range msg.Payload.Headers {
-		switch header.Name {
+		switch textproto.CanonicalMIMEHeaderKey(header.Name) {
 		case "Subject":
-			result.Subject = header.Value
+			result.Subject = decodeHeader(header.Value)
 		case "From":
-			result.From = header.Value
+			result.From = decodeHeader(header.Value)
+		case "To":
+			result.To = decodeHeader(header.Value)
 		case "Date":
 			result.Date = header.Value
+		case "Message-Id":
+			result.MessageID = header.Value
+		case "In-Reply-To":
+			result.InReplyTo = header.Value
+		case "References":
+			result.References = header.Value
+		case "Reply-To":
+			result.ReplyTo = decodeHeader(header.Value)
+		case "Delivered-To":
+			if result.Account == "" {
+				result.Account = header.Value
+			}
 		}
 	}
 
+	result.Account = deliveredTo(result.Account, result.To)
+	result.Time = messageTime(result.Date, gmailInternalDate(msg.InternalDate))
+
+	result.SMIME = smimeType(partHeader(msg.Payload.Headers, "Content-Type"))
+
 	// Get message content
-	content, err := c.getMessageContent(msg)
+	text, err := c.getMessageContent(msg)
 	if err != nil {
 		return result, fmt.Errorf("failed to get message content: %v", err)
 	}
-	result.Content = content
+	result.Content = text.content()
+	result.Calendars = text.calendars
+	result.Attachments = text.attachments
 
 	return result, nil
 }
 
-func (c *GmailClient) getMessageContent(msg *gmail.Message) (string, error) {
+func (c *GmailClient) getMessageContent(msg *gmail.Message) (mimeText, error) {
 	if msg == nil || msg.Payload == nil {
-		return "", fmt.Errorf("invalid message: payload is nil")
+		return mimeText{}, fmt.Errorf("invalid message: payload is nil")
 	}
 
-	// Try to find plain text first (preferred), then fall back to HTML
-	plain, html, err := extractTextFromPart(msg.Payload)
-	if err != nil {
-		return "", err
+	return extractTextFromPart(msg.Payload)
+}
+
+// mimeText is the readable content found in a MIME tree
+type mimeText struct {
+	plain, html string
+	// calendars are text/calendar parts such as meeting invitations
+	calendars []string
+	// attachments are the file names of other attachments
+	attachments []string
+}
+
+// add merges the content of a sub-part, keeping the first plain and HTML body
+func (t *mimeText) add(sub mimeText) {
+	if sub.plain != "" && t.plain == "" {
+		t.plain = sub.plain
 	}
 
-	if plain != "" {
-		return plain, nil
+	if sub.html != "" && t.html == "" {
+		t.html = sub.html
 	}
 
-	if html != "" {
-		return stripHTML(html), nil
+	t.calendars = append(t.calendars, sub.calendars...)
+	t.attachments = append(t.attachments, sub.attachments...)
+}
+
+// content prefers the plain text body and falls back to the converted HTML one
+func (t mimeText) content() string {
+	if t.plain != "" {
+		return t.plain
 	}
 
-	return "", nil
+	if t.html != "" {
+		return htmlToText(t.html)
+	}
+
+	return ""
 }
 
 // extractTextFromPart recursively walks MIME parts to find text/plain and text/html content.
-func extractTextFromPart(part *gmail.MessagePart) (plain, html string, err error) {
+func extractTextFromPart(part *gmail.MessagePart) (mimeText, error) {
+	var result mimeText
+
 	if part == nil {
-		return "", "", nil
+		return result, nil
+	}
+
+	// Attached .ics files are read like inline invitations, other attachments are only listed by name
+	disposition, _, _ := mime.ParseMediaType(partHeader(part.Headers, "Content-Disposition"))
+	if disposition == "attachment" && part.MimeType != "text/calendar" && part.MimeType != "application/ics" {
+		if name := attachmentName(part.MimeType, map[string]string{"filename": part.Filename}, nil); name != "" {
+			result.attachments = append(result.attachments, name)
+		}
+
+		return result, nil
 	}
 
 	switch part.MimeType {
 	case "text/plain":
 		if part.Body != nil && part.Body.Data != "" {
-			data, decErr := base64.URLEncoding.DecodeString(part.Body.Data)
+			text, decErr := decodePartBody(part)
 			if decErr != nil {
-				return "", "", decErr
+				return result, decErr
 			}
-			return string(data), "", nil
+			result.plain = text
 		}
 	case "text/html":
 		if part.Body != nil && part.Body.Data != "" {
-			data, decErr := base64.URLEncoding.DecodeString(part.Body.Data)
+			text, decErr := decodePartBody(part)
+			if decErr != nil {
+				return result, decErr
+			}
+			result.html = text
+		}
+	case "text/calendar", "application/ics":
+		// Invitations are kept for calendar events instead of being shown as text
+		if part.Body != nil && part.Body.Data != "" {
+			text, decErr := decodePartBody(part)
 			if decErr != nil {
-				return "", "", decErr
+				return result, decErr
 			}
-			return "", string(data), nil
+			result.calendars = append(result.calendars, text)
 		}
 	default:
 		// For multipart/* and other containers, recurse into sub-parts
 		if part.Body != nil && part.Body.Data != "" {
-			data, decErr := base64.URLEncoding.DecodeString(part.Body.Data)
+			text, decErr := decodePartBody(part)
 			if decErr != nil {
-				return "", "", decErr
+				return result, decErr
 			}
-			return string(data), "", nil
+			result.plain = text
+
+			return result, nil
 		}
 
 		for _, sub := range part.Parts {
-			p, h, subErr := extractTextFromPart(sub)
+			subText, subErr := extractTextFromPart(sub)
 			if subErr != nil {
-				return "", "", subErr
-			}
-			if p != "" && plain == "" {
-				plain = p
-			}
-			if h != "" && html == "" {
-				html = h
+				return result, subErr
 			}
+			result.add(subText)
 		}
 	}
 
-	return plain, html, nil
+	return result, nil
 }
 
-var (
-	htmlTagRe      = regexp.MustCompile(`<[^>]+>`)
-	htmlEntityRe   = regexp.MustCompile(`&[a-zA-Z]+;|&#[0-9]+;`)
-	multiSpaceRe   = regexp.MustCompile(`[ \t]+`)
-	multiNewlineRe = regexp.MustCompile(`\n{3,}`)
-)
-
-// stripHTML removes HTML tags and decodes common entities to produce readable plain text.
-func stripHTML(html string) string {
-	// Replace block-level tags with newlines before stripping
-	for _, tag := range []string{"</p>", "</div>", "</br>", "<br>", "<br/>", "<br />"} {
-		html = strings.ReplaceAll(html, tag, "\n")
-	}
-
-	text := htmlTagRe.ReplaceAllString(html, "")
-	text = htmlEntityRe.ReplaceAllStringFunc(text, decodeHTMLEntity)
-	text = multiSpaceRe.ReplaceAllString(text, " ")
-
-	lines := strings.Split(text, "\n")
-	var cleaned []string
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		cleaned = append(cleaned, line)
+// decodePartBody decodes the base64url body of a part and converts it to UTF-8
+func decodePartBody(part *gmail.MessagePart) (string, error) {
+	data, err := base64.URLEncoding.DecodeString(part.Body.Data)
+	if err != nil {
+		return "", err
 	}
 
-	text = strings.Join(cleaned, "\n")
-	text = multiNewlineRe.ReplaceAllString(text, "\n\n")
+	return decodeText(data, partHeader(part.Headers, "Content-Type")), nil
+}
 
-	return strings.TrimSpace(text)
+func (c *GmailClient) shouldProcessMessage(msg Message) bool {
+	return matchesFilter(c.config.Gmail.Filter, msg)
 }
 
-func decodeHTMLEntity(entity string) string {
-	switch entity {
-	case "&amp;":
-		return "&"
-	case "&lt;":
-		return "<"
-	case "&gt;":
-		return ">"
-	case "&quot;":
-		return "\""
-	case "&apos;", "&#39;":
-		return "'"
-	case "&nbsp;":
-		return " "
-	default:
-		return ""
+// matchesFilter reports whether msg passes every non-empty part of filter
+func matchesFilter(filter FilterConfig, msg Message) bool {
+	if tooOld(filter, msg, time.Now()) {
+		return false
 	}
-}
 
-func (c *GmailClient) shouldProcessMessage(msg Message) bool {
 	// Check From filter
-	if len(c.config.Gmail.Filter.From) > 0 {
+	if len(filter.From) > 0 {
 		fromMatched := false
-		for _, from := range c.config.Gmail.Filter.From {
+		for _, from := range filter.From {
 			if strings.Contains(strings.ToLower(msg.From), strings.ToLower(from)) {
 				fromMatched = true
 				break
@@ -414,9 +666,9 @@ func (c *GmailClient) shouldProcessMessage(msg Message) bool {
 	}
 
 	// Check Subject keywords
-	if len(c.config.Gmail.Filter.SubjectKeywords) > 0 {
+	if len(filter.SubjectKeywords) > 0 {
 		subjectMatched := false
-		for _, keyword := range c.config.Gmail.Filter.SubjectKeywords {
+		for _, keyword := range filter.SubjectKeywords {
 			if strings.Contains(strings.ToLower(msg.Subject), strings.ToLower(keyword)) {
 				subjectMatched = true
 				break
@@ -428,9 +680,9 @@ func (c *GmailClient) shouldProcessMessage(msg Message) bool {
 	}
 
 	// Check Content keywords
-	if len(c.config.Gmail.Filter.ContentKeywords) > 0 {
+	if len(filter.ContentKeywords) > 0 {
 		contentMatched := false
-		for _, keyword := range c.config.Gmail.Filter.ContentKeywords {
+		for _, keyword := range filter.ContentKeywords {
 			if strings.Contains(strings.ToLower(msg.Content), strings.ToLower(keyword)) {
 				contentMatched = true
 				break
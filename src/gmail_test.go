@@ -3,7 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"google.golang.org/api/gmail/v1"
 )
@@ -27,7 +31,11 @@ func (s *TestGmailService) Users() *gmail.UsersService {
 type MockGmailService struct {
 	labels   []*gmail.Label
 	messages []*gmail.Message
+	sent     []*gmail.Message
 	err      error
+	// pageSize splits ListPage results into pages, all messages on one page when zero
+	pageSize int
+	queries  []string
 }
 
 // MockUsersService implements the necessary Users methods for testing
@@ -80,11 +88,26 @@ func (s *MockLabelsService) Create(userId string, label *gmail.Label) (*gmail.La
 	return newLabel, nil
 }
 
-func (s *MockMessagesService) List(userId string, q string) ([]*gmail.Message, error) {
+func (s *MockMessagesService) ListPage(userId string, q string, pageToken string) (*gmail.ListMessagesResponse, error) {
 	if s.service.err != nil {
 		return nil, s.service.err
 	}
-	return s.service.messages, nil
+
+	s.service.queries = append(s.service.queries, q)
+
+	start, _ := strconv.Atoi(pageToken)
+	end := len(s.service.messages)
+
+	if s.service.pageSize > 0 && start+s.service.pageSize < end {
+		end = start + s.service.pageSize
+	}
+
+	resp := &gmail.ListMessagesResponse{Messages: s.service.messages[start:end]}
+	if end < len(s.service.messages) {
+		resp.NextPageToken = strconv.Itoa(end)
+	}
+
+	return resp, nil
 }
 
 func (s *MockMessagesService) Get(userId string, id string) (*gmail.Message, error) {
@@ -99,6 +122,10 @@ func (s *MockMessagesService) Get(userId string, id string) (*gmail.Message, err
 	return nil, fmt.Errorf("message not found")
 }
 
+func (s *MockMessagesService) GetRaw(userId string, id string) (*gmail.Message, error) {
+	return s.Get(userId, id)
+}
+
 func (s *MockMessagesService) Modify(userId string, id string, mods *gmail.ModifyMessageRequest) (*gmail.Message, error) {
 	if s.service.err != nil {
 		return nil, s.service.err
@@ -113,6 +140,14 @@ func (s *MockMessagesService) Modify(userId string, id string, mods *gmail.Modif
 	return nil, fmt.Errorf("message not found")
 }
 
+func (s *MockMessagesService) Send(userId string, msg *gmail.Message) (*gmail.Message, error) {
+	if s.service.err != nil {
+		return nil, s.service.err
+	}
+	s.service.sent = append(s.service.sent, msg)
+	return msg, nil
+}
+
 func TestShouldProcessMessage(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -127,17 +162,7 @@ func TestShouldProcessMessage(t *testing.T) {
 				Content: "Test Content",
 			},
 			config: &Config{
-				Gmail: struct {
-					CredentialsFile string `yaml:"credentials_file"`
-					TokenFile       string `yaml:"token_file"`
-					PollInterval    string `yaml:"poll_interval"`
-					ForwardedLabel  string `yaml:"forwarded_label"`
-					Filter          struct {
-						From            []string `yaml:"from"`
-						SubjectKeywords []string `yaml:"subject_keywords"`
-						ContentKeywords []string `yaml:"content_keywords"`
-					} `yaml:"filter"`
-				}{},
+				Gmail: GmailConfig{},
 			},
 			expectedResult: true,
 		},
@@ -148,22 +173,8 @@ func TestShouldProcessMessage(t *testing.T) {
 				Content: "Test Content",
 			},
 			config: &Config{
-				Gmail: struct {
-					CredentialsFile string `yaml:"credentials_file"`
-					TokenFile       string `yaml:"token_file"`
-					PollInterval    string `yaml:"poll_interval"`
-					ForwardedLabel  string `yaml:"forwarded_label"`
-					Filter          struct {
-						From            []string `yaml:"from"`
-						SubjectKeywords []string `yaml:"subject_keywords"`
-						ContentKeywords []string `yaml:"content_keywords"`
-					} `yaml:"filter"`
-				}{
-					Filter: struct {
-						From            []string `yaml:"from"`
-						SubjectKeywords []string `yaml:"subject_keywords"`
-						ContentKeywords []string `yaml:"content_keywords"`
-					}{
+				Gmail: GmailConfig{
+					Filter: FilterConfig{
 						SubjectKeywords: []string{"test"},
 					},
 				},
@@ -177,22 +188,8 @@ func TestShouldProcessMessage(t *testing.T) {
 				Content: "Test Content",
 			},
 			config: &Config{
-				Gmail: struct {
-					CredentialsFile string `yaml:"credentials_file"`
-					TokenFile       string `yaml:"token_file"`
-					PollInterval    string `yaml:"poll_interval"`
-					ForwardedLabel  string `yaml:"forwarded_label"`
-					Filter          struct {
-						From            []string `yaml:"from"`
-						SubjectKeywords []string `yaml:"subject_keywords"`
-						ContentKeywords []string `yaml:"content_keywords"`
-					} `yaml:"filter"`
-				}{
-					Filter: struct {
-						From            []string `yaml:"from"`
-						SubjectKeywords []string `yaml:"subject_keywords"`
-						ContentKeywords []string `yaml:"content_keywords"`
-					}{
+				Gmail: GmailConfig{
+					Filter: FilterConfig{
 						ContentKeywords: []string{"test"},
 					},
 				},
@@ -206,22 +203,8 @@ func TestShouldProcessMessage(t *testing.T) {
 				Content: "Different Content",
 			},
 			config: &Config{
-				Gmail: struct {
-					CredentialsFile string `yaml:"credentials_file"`
-					TokenFile       string `yaml:"token_file"`
-					PollInterval    string `yaml:"poll_interval"`
-					ForwardedLabel  string `yaml:"forwarded_label"`
-					Filter          struct {
-						From            []string `yaml:"from"`
-						SubjectKeywords []string `yaml:"subject_keywords"`
-						ContentKeywords []string `yaml:"content_keywords"`
-					} `yaml:"filter"`
-				}{
-					Filter: struct {
-						From            []string `yaml:"from"`
-						SubjectKeywords []string `yaml:"subject_keywords"`
-						ContentKeywords []string `yaml:"content_keywords"`
-					}{
+				Gmail: GmailConfig{
+					Filter: FilterConfig{
 						SubjectKeywords: []string{"test"},
 						ContentKeywords: []string{"test"},
 					},
@@ -252,6 +235,27 @@ func TestParseMessage(t *testing.T) {
 		expected Message
 		wantErr  bool
 	}{
+		{
+			name: "unreadable date falls back to internalDate",
+			msg: &gmail.Message{
+				Id:           "124",
+				InternalDate: 1743173357000,
+				Payload: &gmail.MessagePart{
+					Headers: []*gmail.MessagePartHeader{
+						{Name: "Subject", Value: "Test Subject"},
+						{Name: "Date", Value: "yesterday"},
+					},
+					Body: &gmail.MessagePartBody{Data: "SGVsbG8gV29ybGQ="},
+				},
+			},
+			expected: Message{
+				ID:      "124",
+				Subject: "Test Subject",
+				Date:    "yesterday",
+				Time:    time.UnixMilli(1743173357000),
+				Content: "Hello World",
+			},
+		},
 		{
 			name: "simple message with plain text",
 			msg: &gmail.Message{
@@ -369,6 +373,40 @@ func TestParseMessage(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "threading headers",
+			msg: &gmail.Message{
+				Id:       "321",
+				ThreadId: "thread-1",
+				Payload: &gmail.MessagePart{
+					Headers: []*gmail.MessagePartHeader{
+						{Name: "Subject", Value: "Re: Test Subject"},
+						{Name: "From", Value: "test@example.com"},
+						{Name: "Date", Value: "2024-03-28"},
+						{Name: "Message-ID", Value: "<b@example.com>"},
+						{Name: "In-Reply-To", Value: "<a@example.com>"},
+						{Name: "References", Value: "<a@example.com>"},
+						{Name: "Reply-To", Value: "office@example.com"},
+					},
+					Body: &gmail.MessagePartBody{
+						Data: "SGVsbG8gV29ybGQ=",
+					},
+				},
+			},
+			expected: Message{
+				ID:         "321",
+				ThreadID:   "thread-1",
+				MessageID:  "<b@example.com>",
+				InReplyTo:  "<a@example.com>",
+				References: "<a@example.com>",
+				ReplyTo:    "office@example.com",
+				Subject:    "Re: Test Subject",
+				From:       "test@example.com",
+				Date:       "2024-03-28",
+				Content:    "Hello World",
+			},
+			wantErr: false,
+		},
 		{
 			name: "nested multipart message",
 			msg: &gmail.Message{
@@ -404,6 +442,41 @@ func TestParseMessage(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "encoded headers and koi8-r body",
+			msg: &gmail.Message{
+				Id: "321",
+				Payload: &gmail.MessagePart{
+					Headers: []*gmail.MessagePartHeader{
+						{Name: "Subject", Value: "=?koi8-r?B?897F1CDawSDB0NLFzNg=?="},
+						{Name: "From", Value: "=?UTF-8?Q?Veikals_=C4=AApa=C5=A1s?= <shop@example.com>"},
+						{Name: "To", Value: "=?iso-8859-1?Q?J=FCrgen?= <j@example.com>"},
+						{Name: "Date", Value: "2024-03-28"},
+					},
+					Parts: []*gmail.MessagePart{
+						{
+							MimeType: "text/plain",
+							Headers: []*gmail.MessagePartHeader{
+								{Name: "Content-Type", Value: "text/plain; charset=\"KOI8-R\""},
+							},
+							Body: &gmail.MessagePartBody{
+								Data: "98HbINrBy8HaINDF0sXEwc4g1yDEz9PUwdfL1Q==",
+							},
+						},
+					},
+				},
+			},
+			expected: Message{
+				ID:      "321",
+				Subject: "Счет за апрель",
+				From:    "Veikals Īpašs <shop@example.com>",
+				To:      "Jürgen <j@example.com>",
+				Account: "j@example.com",
+				Date:    "2024-03-28",
+				Content: "Ваш заказ передан в доставку",
+			},
+			wantErr: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -417,7 +490,7 @@ func TestParseMessage(t *testing.T) {
 				t.Errorf("parseMessage() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if !tt.wantErr && got != tt.expected {
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.expected) {
 				t.Errorf("parseMessage() = %+v, want %+v", got, tt.expected)
 			}
 		})
@@ -436,17 +509,7 @@ func TestEnsureLabelExists(t *testing.T) {
 		{
 			name: "label exists",
 			config: &Config{
-				Gmail: struct {
-					CredentialsFile string `yaml:"credentials_file"`
-					TokenFile       string `yaml:"token_file"`
-					PollInterval    string `yaml:"poll_interval"`
-					ForwardedLabel  string `yaml:"forwarded_label"`
-					Filter          struct {
-						From            []string `yaml:"from"`
-						SubjectKeywords []string `yaml:"subject_keywords"`
-						ContentKeywords []string `yaml:"content_keywords"`
-					} `yaml:"filter"`
-				}{
+				Gmail: GmailConfig{
 					ForwardedLabel: "Forwarded",
 				},
 			},
@@ -459,17 +522,7 @@ func TestEnsureLabelExists(t *testing.T) {
 		{
 			name: "label needs to be created",
 			config: &Config{
-				Gmail: struct {
-					CredentialsFile string `yaml:"credentials_file"`
-					TokenFile       string `yaml:"token_file"`
-					PollInterval    string `yaml:"poll_interval"`
-					ForwardedLabel  string `yaml:"forwarded_label"`
-					Filter          struct {
-						From            []string `yaml:"from"`
-						SubjectKeywords []string `yaml:"subject_keywords"`
-						ContentKeywords []string `yaml:"content_keywords"`
-					} `yaml:"filter"`
-				}{
+				Gmail: GmailConfig{
 					ForwardedLabel: "Forwarded",
 				},
 			},
@@ -480,17 +533,7 @@ func TestEnsureLabelExists(t *testing.T) {
 		{
 			name: "list labels error",
 			config: &Config{
-				Gmail: struct {
-					CredentialsFile string `yaml:"credentials_file"`
-					TokenFile       string `yaml:"token_file"`
-					PollInterval    string `yaml:"poll_interval"`
-					ForwardedLabel  string `yaml:"forwarded_label"`
-					Filter          struct {
-						From            []string `yaml:"from"`
-						SubjectKeywords []string `yaml:"subject_keywords"`
-						ContentKeywords []string `yaml:"content_keywords"`
-					} `yaml:"filter"`
-				}{
+				Gmail: GmailConfig{
 					ForwardedLabel: "Forwarded",
 				},
 			},
@@ -527,6 +570,7 @@ func TestGetNewMessages(t *testing.T) {
 		name          string
 		config        *Config
 		messages      []*gmail.Message
+		pageSize      int
 		err           error
 		expectedCount int
 		wantErr       bool
@@ -534,17 +578,7 @@ func TestGetNewMessages(t *testing.T) {
 		{
 			name: "successful message retrieval",
 			config: &Config{
-				Gmail: struct {
-					CredentialsFile string `yaml:"credentials_file"`
-					TokenFile       string `yaml:"token_file"`
-					PollInterval    string `yaml:"poll_interval"`
-					ForwardedLabel  string `yaml:"forwarded_label"`
-					Filter          struct {
-						From            []string `yaml:"from"`
-						SubjectKeywords []string `yaml:"subject_keywords"`
-						ContentKeywords []string `yaml:"content_keywords"`
-					} `yaml:"filter"`
-				}{
+				Gmail: GmailConfig{
 					ForwardedLabel: "Forwarded",
 				},
 			},
@@ -566,20 +600,21 @@ func TestGetNewMessages(t *testing.T) {
 			expectedCount: 1,
 			wantErr:       false,
 		},
+		{
+			name:   "messages on several pages",
+			config: &Config{Gmail: GmailConfig{ForwardedLabel: "Forwarded"}},
+			messages: []*gmail.Message{
+				backfillMessage("m3", "a@example.com"),
+				backfillMessage("m2", "a@example.com"),
+				backfillMessage("m1", "a@example.com"),
+			},
+			pageSize:      2,
+			expectedCount: 3,
+		},
 		{
 			name: "list messages error",
 			config: &Config{
-				Gmail: struct {
-					CredentialsFile string `yaml:"credentials_file"`
-					TokenFile       string `yaml:"token_file"`
-					PollInterval    string `yaml:"poll_interval"`
-					ForwardedLabel  string `yaml:"forwarded_label"`
-					Filter          struct {
-						From            []string `yaml:"from"`
-						SubjectKeywords []string `yaml:"subject_keywords"`
-						ContentKeywords []string `yaml:"content_keywords"`
-					} `yaml:"filter"`
-				}{
+				Gmail: GmailConfig{
 					ForwardedLabel: "Forwarded",
 				},
 			},
@@ -596,6 +631,7 @@ func TestGetNewMessages(t *testing.T) {
 
 			mockService := NewMockGmailService()
 			mockService.messages = tt.messages
+			mockService.pageSize = tt.pageSize
 			mockService.err = tt.err
 			client.service = mockService
 
@@ -610,3 +646,29 @@ func TestGetNewMessages(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildReply(t *testing.T) {
+	raw := buildReply("a@example.com", "Aprīļa rēķins", "<b@example.com>", "<a@example.com>", "line1\nline2")
+
+	for _, want := range []string{
+		"To: a@example.com\r\n",
+		"Subject: =?utf-8?q?Re:_Apr=C4=AB=C4=BCa_r=C4=93=C4=B7ins?=\r\n",
+		"In-Reply-To: <b@example.com>\r\n",
+		"References: <a@example.com> <b@example.com>\r\n",
+		"\r\n\r\nline1\r\nline2",
+	} {
+		if !strings.Contains(raw, want) {
+			t.Errorf("buildReply() missing %q in:\n%s", want, raw)
+		}
+	}
+
+	// Decoded display names are encoded again for the header
+	if raw := buildReply("Jürgen <j@example.com>", "Hi", "", "", "x"); !strings.Contains(raw, "To: =?utf-8?q?J=C3=BCrgen?= <j@example.com>\r\n") {
+		t.Errorf("buildReply() did not encode the display name:\n%s", raw)
+	}
+
+	// Subjects that already carry a reply prefix are not prefixed again
+	if raw := buildReply("a@example.com", "RE: Hello", "", "", "x"); !strings.Contains(raw, "Subject: RE: Hello\r\n") {
+		t.Errorf("buildReply() re-prefixed subject:\n%s", raw)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/microsoft"
+)
+
+const (
+	defaultGraphBaseURL           = "https://graph.microsoft.com/v1.0"
+	defaultGraphFolder            = "inbox"
+	defaultGraphTokenFile         = "graph_token.json"
+	defaultGraphForwardedCategory = "Forwarded to Telegram"
+)
+
+// graphMessageFields are the message properties listed by delta queries; sender and subject
+// let the filter skip emails before their MIME source is downloaded
+const graphMessageFields = "categories,conversationId,webLink,receivedDateTime,from,subject"
+
+// Delegated permissions the forwarder needs; offline_access yields a refresh token
+var graphScopes = []string{"offline_access", "Mail.ReadWrite"}
+
+// GraphConfig configures a Microsoft 365 / Outlook mailbox read through Microsoft Graph
+type GraphConfig struct {
+	// TenantID is the Entra ID tenant; "organizations" or "common" work for most accounts
+	TenantID  string `yaml:"tenant_id"`
+	ClientID  string `yaml:"client_id"`
+	TokenFile string `yaml:"token_file"`
+	// Folder is a well-known folder name such as "inbox" or a folder ID
+	Folder       string `yaml:"folder"`
+	PollInterval string `yaml:"poll_interval"`
+	// ForwardedCategory is the Outlook category put on forwarded messages
+	ForwardedCategory string       `yaml:"forwarded_category"`
+	Filter            FilterConfig `yaml:"filter"`
+}
+
+// GraphClient reads messages from an Exchange Online mailbox with delta queries,
+// so each poll only transfers what changed since the previous one
+type GraphClient struct {
+	client  *http.Client
+	baseURL string
+	config  *Config
+	state   *StateStore
+
+	// The delta link is saved after every round. Messages of a round that are not forwarded
+	// yet are kept in the state as pending and fetched again by the next round, even after a
+	// restart; mu guards that list.
+	mu sync.Mutex
+}
+
+type graphMessage struct {
+	ID             string          `json:"id"`
+	ConversationID string          `json:"conversationId"`
+	Categories     []string        `json:"categories"`
+	WebLink        string          `json:"webLink"`
+	Received       time.Time       `json:"receivedDateTime"`
+	From           *graphRecipient `json:"from"`
+	Subject        string          `json:"subject"`
+	Removed        json.RawMessage `json:"@removed,omitempty"`
+}
+
+type graphRecipient struct {
+	EmailAddress struct {
+		Name    string `json:"name"`
+		Address string `json:"address"`
+	} `json:"emailAddress"`
+}
+
+type graphDeltaPage struct {
+	Value     []graphMessage `json:"value"`
+	NextLink  string         `json:"@odata.nextLink"`
+	DeltaLink string         `json:"@odata.deltaLink"`
+}
+
+type graphErrorResponse struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// graphAPIError is an error answer of the Graph API
+type graphAPIError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *graphAPIError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("graph API error %d", e.status)
+	}
+
+	return fmt.Sprintf("graph API error %d: %s: %s", e.status, e.code, e.message)
+}
+
+// graphNotFound reports whether err says the message was deleted or moved away
+func graphNotFound(err error) bool {
+	var apiErr *graphAPIError
+
+	return errors.As(err, &apiErr) && (apiErr.status == http.StatusNotFound || apiErr.code == "ErrorItemNotFound")
+}
+
+func NewGraphClient(ctx context.Context, config *Config, state *StateStore) (*GraphClient, error) {
+	if config.Graph.ClientID == "" {
+		return nil, fmt.Errorf("graph client_id is required")
+	}
+
+	tokenFile := config.Graph.TokenFile
+	if tokenFile == "" {
+		tokenFile = defaultGraphTokenFile
+	}
+
+	endpoint := microsoft.AzureADEndpoint(config.Graph.TenantID)
+	endpoint.AuthStyle = oauth2.AuthStyleInParams
+
+	oauthConfig := &oauth2.Config{
+		ClientID: config.Graph.ClientID,
+		Endpoint: endpoint,
+		Scopes:   graphScopes,
+	}
+
+	tokenSource, err := graphTokenSource(ctx, oauthConfig, tokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return newGraphClient(oauth2.NewClient(ctx, tokenSource), defaultGraphBaseURL, config, state), nil
+}
+
+func newGraphClient(client *http.Client, baseURL string, config *Config, state *StateStore) *GraphClient {
+	return &GraphClient{
+		client:  client,
+		baseURL: baseURL,
+		config:  config,
+		state:   state,
+	}
+}
+
+// graphTokenSource loads the cached token or signs in with the device code flow.
+// Refreshed tokens are written back to tokenFile.
+func graphTokenSource(ctx context.Context, oauthConfig *oauth2.Config, tokenFile string) (oauth2.TokenSource, error) {
+	tok, err := tokenFromFile(tokenFile)
+	if err != nil {
+		deviceAuth, err := oauthConfig.DeviceAuth(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to start device code sign-in: %v", err)
+		}
+
+		log.Printf("To sign in to Microsoft 365, open %s and enter the code %s",
+			deviceAuth.VerificationURI, deviceAuth.UserCode)
+
+		tok, err = oauthConfig.DeviceAccessToken(ctx, deviceAuth)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get token: %v", err)
+		}
+
+		if err := saveToken(tokenFile, tok); err != nil {
+			return nil, fmt.Errorf("unable to save token: %v", err)
+		}
+	}
+
+	return &savingTokenSource{
+		source: oauthConfig.TokenSource(ctx, tok),
+		path:   tokenFile,
+		last:   tok.AccessToken,
+	}, nil
+}
+
+// savingTokenSource persists tokens whenever they are refreshed
+type savingTokenSource struct {
+	mu     sync.Mutex
+	source oauth2.TokenSource
+	path   string
+	last   string
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tok, err := s.source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok.AccessToken != s.last {
+		if err := saveToken(s.path, tok); err != nil {
+			log.Printf("Error saving refreshed Graph token: %v", err)
+		}
+
+		s.last = tok.AccessToken
+	}
+
+	return tok, nil
+}
+
+func (c *GraphClient) folder() string {
+	if c.config.Graph.Folder != "" {
+		return c.config.Graph.Folder
+	}
+
+	return defaultGraphFolder
+}
+
+func (c *GraphClient) forwardedCategory() string {
+	if c.config.Graph.ForwardedCategory != "" {
+		return c.config.Graph.ForwardedCategory
+	}
+
+	return defaultGraphForwardedCategory
+}
+
+func (c *GraphClient) cursorKey() string {
+	return "graph:" + c.folder()
+}
+
+func (c *GraphClient) GetNewMessages(ctx context.Context) ([]Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	link := c.state.Cursor(c.cursorKey())
+	if link == "" {
+		link = c.baseURL + "/me/mailFolders/" + url.PathEscape(c.folder()) + "/messages/delta?$select=" + graphMessageFields
+	}
+
+	var (
+		changed   []graphMessage
+		deltaLink string
+	)
+
+	for link != "" {
+		var page graphDeltaPage
+		if err := c.do(ctx, http.MethodGet, link, nil, &page); err != nil {
+			return nil, fmt.Errorf("failed to list messages: %v", err)
+		}
+
+		changed = append(changed, page.Value...)
+		link = page.NextLink
+
+		if page.DeltaLink != "" {
+			deltaLink = page.DeltaLink
+		}
+	}
+
+	// Messages left pending by earlier rounds come first, unless the delta lists them again
+	var items []graphMessage
+
+	for _, id := range c.state.Pending(c.cursorKey()) {
+		if slices.ContainsFunc(changed, func(item graphMessage) bool { return item.ID == id }) {
+			continue
+		}
+
+		item, err := c.getItem(ctx, id)
+		// A message deleted or moved to another folder is no longer pending
+		if graphNotFound(err) {
+			log.Printf("Pending message %s is gone from the folder, dropping it", id)
+
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, item)
+	}
+
+	items = append(items, changed...)
+
+	var (
+		result  []Message
+		pending []string
+	)
+
+	for _, item := range items {
+		// Deleted messages and ones we already flagged show up in the delta as well
+		if item.Removed != nil || slices.Contains(item.Categories, c.forwardedCategory()) {
+			continue
+		}
+
+		if !matchesFilter(headerFilter(c.config.Graph.Filter), headerMessage(item)) {
+			continue
+		}
+
+		msg, err := c.fetchMessage(ctx, item)
+		if err != nil {
+			return nil, err
+		}
+
+		msg, ok := prepareMessage(c.config, c.config.Graph.Filter, msg)
+		if !ok {
+			continue
+		}
+
+		pending = append(pending, msg.ID)
+		result = append(result, msg)
+	}
+
+	// The pending list is saved first, so a crash in between replays the delta instead of
+	// losing messages
+	if err := c.state.SetPending(c.cursorKey(), pending); err != nil {
+		return nil, fmt.Errorf("failed to save pending Graph messages: %v", err)
+	}
+
+	if deltaLink != "" {
+		if err := c.state.SetCursor(c.cursorKey(), deltaLink); err != nil {
+			return nil, fmt.Errorf("failed to save Graph delta link: %v", err)
+		}
+	}
+
+	return result, nil
+}
+
+// headerFilter is the part of filter the delta fields can answer
+func headerFilter(filter FilterConfig) FilterConfig {
+	filter.ContentKeywords = nil
+
+	return filter
+}
+
+// headerMessage fills the fields of a message that a delta query lists
+func headerMessage(item graphMessage) Message {
+	msg := Message{ID: item.ID, Subject: item.Subject, Time: item.Received}
+
+	if item.From != nil {
+		msg.From = item.From.EmailAddress.Address
+		if name := item.From.EmailAddress.Name; name != "" {
+			msg.From = name + " <" + msg.From + ">"
+		}
+	}
+
+	return msg
+}
+
+// getItem reads the properties of a single message
+func (c *GraphClient) getItem(ctx context.Context, id string) (graphMessage, error) {
+	var item graphMessage
+	if err := c.do(ctx, http.MethodGet, c.messageURL(id)+"?$select="+graphMessageFields, nil, &item); err != nil {
+		return graphMessage{}, fmt.Errorf("failed to get message %s: %w", id, err)
+	}
+
+	return item, nil
+}
+
+func (c *GraphClient) GetMessage(ctx context.Context, id string) (Message, error) {
+	item, err := c.getItem(ctx, id)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return c.fetchMessage(ctx, item)
+}
+
+// fetchMessage downloads the MIME source of a message and parses it
+func (c *GraphClient) fetchMessage(ctx context.Context, item graphMessage) (Message, error) {
+	var raw []byte
+	if err := c.do(ctx, http.MethodGet, c.messageURL(item.ID)+"/$value", nil, &raw); err != nil {
+		return Message{}, fmt.Errorf("failed to get message %s: %v", item.ID, err)
+	}
+
+	msg, err := parseRawMessage(raw)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to parse message %s: %v", item.ID, err)
+	}
+
+	msg.ID = item.ID
+	msg.ThreadID = item.ConversationID
+	msg.Labels = item.Categories
+	msg.Link = item.WebLink
+	msg.Time = messageTime(msg.Date, item.Received)
+
+	return msg, nil
+}
+
+func (c *GraphClient) MarkAsForwarded(ctx context.Context, id string) error {
+	var item graphMessage
+	if err := c.do(ctx, http.MethodGet, c.messageURL(id)+"?$select=categories", nil, &item); err != nil {
+		return fmt.Errorf("failed to get message %s: %v", id, err)
+	}
+
+	if !slices.Contains(item.Categories, c.forwardedCategory()) {
+		update := map[string][]string{"categories": append(item.Categories, c.forwardedCategory())}
+		if err := c.do(ctx, http.MethodPatch, c.messageURL(id), update, nil); err != nil {
+			return fmt.Errorf("failed to categorize message %s: %v", id, err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pending := c.state.Pending(c.cursorKey())
+	if i := slices.Index(pending, id); i >= 0 {
+		if err := c.state.SetPending(c.cursorKey(), slices.Delete(pending, i, i+1)); err != nil {
+			return fmt.Errorf("failed to save pending Graph messages: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (c *GraphClient) messageURL(id string) string {
+	return c.baseURL + "/me/messages/" + url.PathEscape(id)
+}
+
+// do sends a Graph request. A *[]byte result receives the raw body, anything else is
+// decoded from JSON.
+func (c *GraphClient) do(ctx context.Context, method, rawURL string, body, result interface{}) error {
+	var reqBody io.Reader
+
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, reqBody)
+	if err != nil {
+		return err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		apiErr := &graphAPIError{status: resp.StatusCode}
+
+		var graphErr graphErrorResponse
+		if json.Unmarshal(data, &graphErr) == nil && graphErr.Error.Message != "" {
+			apiErr.code, apiErr.message = graphErr.Error.Code, graphErr.Error.Message
+		}
+
+		return apiErr
+	}
+
+	switch result := result.(type) {
+	case nil:
+		return nil
+	case *[]byte:
+		*result = data
+
+		return nil
+	default:
+		return json.Unmarshal(data, result)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+type fakeGraphMessage struct {
+	raw            string
+	from           string
+	subject        string
+	conversationID string
+	categories     []string
+	version        int
+	removed        bool
+}
+
+// fakeGraphServer stands in for the Graph mail endpoints: delta queries split into two
+// pages, $value downloads and category updates
+type fakeGraphServer struct {
+	mu        sync.Mutex
+	version   int
+	messages  map[string]*fakeGraphMessage
+	order     []string
+	patches   int
+	downloads []string
+}
+
+func newFakeGraphServer() *fakeGraphServer {
+	return &fakeGraphServer{messages: make(map[string]*fakeGraphMessage)}
+}
+
+func (f *fakeGraphServer) add(id, conversationID, from, subject string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.version++
+	f.messages[id] = &fakeGraphMessage{
+		raw: "From: " + from + "\r\nSubject: " + subject + "\r\nMessage-ID: <" + id + "@example.com>\r\n" +
+			"Content-Type: text/plain; charset=utf-8\r\n\r\nBody of " + subject + "\r\n",
+		from:           from,
+		subject:        subject,
+		conversationID: conversationID,
+		version:        f.version,
+	}
+	f.order = append(f.order, id)
+}
+
+func (f *fakeGraphServer) remove(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.version++
+	f.messages[id].removed = true
+	f.messages[id].version = f.version
+}
+
+func (f *fakeGraphServer) handler(t *testing.T) http.Handler {
+	mux := http.NewServeMux()
+
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+
+	item := func(id string, msg *fakeGraphMessage) map[string]interface{} {
+		if msg.removed {
+			return map[string]interface{}{"id": id, "@removed": map[string]string{"reason": "deleted"}}
+		}
+
+		return map[string]interface{}{
+			"id":             id,
+			"conversationId": msg.conversationID,
+			"categories":     msg.categories,
+			"from":           map[string]interface{}{"emailAddress": map[string]string{"address": msg.from}},
+			"subject":        msg.subject,
+		}
+	}
+
+	mux.HandleFunc("GET /me/mailFolders/inbox/messages/delta", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		since, _ := strconv.Atoi(r.URL.Query().Get("token"))
+		page := r.URL.Query().Get("page")
+
+		var changed []map[string]interface{}
+
+		for _, id := range f.order {
+			if msg := f.messages[id]; msg.version > since {
+				changed = append(changed, item(id, msg))
+			}
+		}
+
+		// The first page holds one change and links to the rest
+		base := "http://" + r.Host + r.URL.Path
+		if page == "" && len(changed) > 1 {
+			writeJSON(w, map[string]interface{}{
+				"value":           changed[:1],
+				"@odata.nextLink": fmt.Sprintf("%s?token=%d&page=2", base, since),
+			})
+
+			return
+		}
+
+		if page == "2" {
+			changed = changed[1:]
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"value":            changed,
+			"@odata.deltaLink": fmt.Sprintf("%s?token=%d", base, f.version),
+		})
+	})
+
+	mux.HandleFunc("GET /me/messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		msg, ok := f.messages[r.PathValue("id")]
+		if !ok || msg.removed {
+			w.WriteHeader(http.StatusNotFound)
+			writeJSON(w, map[string]interface{}{"error": map[string]string{"code": "ErrorItemNotFound", "message": "not found"}})
+
+			return
+		}
+
+		writeJSON(w, item(r.PathValue("id"), msg))
+	})
+
+	mux.HandleFunc("GET /me/messages/{id}/$value", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		f.downloads = append(f.downloads, r.PathValue("id"))
+		io.WriteString(w, f.messages[r.PathValue("id")].raw)
+	})
+
+	mux.HandleFunc("PATCH /me/messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		var update struct {
+			Categories []string `json:"categories"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			t.Errorf("invalid PATCH body: %v", err)
+		}
+
+		f.version++
+		msg := f.messages[r.PathValue("id")]
+		msg.categories = update.Categories
+		msg.version = f.version
+		f.patches++
+
+		writeJSON(w, item(r.PathValue("id"), msg))
+	})
+
+	return mux
+}
+
+func newTestGraphClient(t *testing.T, fake *fakeGraphServer, state *StateStore) *GraphClient {
+	t.Helper()
+
+	server := httptest.NewServer(fake.handler(t))
+	t.Cleanup(server.Close)
+
+	config := &Config{
+		Source: sourceGraph,
+		Graph:  GraphConfig{Filter: FilterConfig{From: []string{"@school.example.com"}}},
+	}
+
+	return newGraphClient(server.Client(), server.URL, config, state)
+}
+
+func subjects(messages []Message) []string {
+	var result []string
+	for _, msg := range messages {
+		result = append(result, msg.Subject)
+	}
+
+	return result
+}
+
+func TestGraphClientDelta(t *testing.T) {
+	fake := newFakeGraphServer()
+	fake.add("m1", "conv1", "office@school.example.com", "Trip")
+	fake.add("m2", "conv2", "news@shop.example.com", "Sale")
+	fake.add("m3", "conv1", "office@school.example.com", "Re: Trip")
+	fake.add("m4", "conv3", "office@school.example.com", "Deleted")
+	fake.remove("m4")
+
+	state, _ := NewStateStore("")
+	client := newTestGraphClient(t, fake, state)
+	ctx := context.Background()
+
+	messages, err := client.GetNewMessages(ctx)
+	if err != nil {
+		t.Fatalf("GetNewMessages() error = %v", err)
+	}
+
+	if got := strings.Join(subjects(messages), ","); got != "Trip,Re: Trip" {
+		t.Fatalf("GetNewMessages() subjects = %q", got)
+	}
+
+	if messages[0].ID != "m1" || messages[0].ThreadID != "conv1" || strings.TrimSpace(messages[0].Content) != "Body of Trip" {
+		t.Errorf("GetNewMessages()[0] = %+v", messages[0])
+	}
+
+	// The sender of m2 does not pass the filter, so it is never downloaded
+	if got := strings.Join(fake.downloads, ","); got != "m1,m3" {
+		t.Errorf("downloaded %s, want m1,m3", got)
+	}
+
+	if err := client.MarkAsForwarded(ctx, "m1"); err != nil {
+		t.Fatalf("MarkAsForwarded() error = %v", err)
+	}
+
+	// The delta link is saved right away and m3, which was not forwarded, is kept as pending
+	if cursor := state.Cursor(client.cursorKey()); !strings.Contains(cursor, "token=") {
+		t.Errorf("cursor not saved after the first round: %q", cursor)
+	}
+
+	if pending := state.Pending(client.cursorKey()); len(pending) != 1 || pending[0] != "m3" {
+		t.Errorf("pending = %v, want m3", pending)
+	}
+
+	// A restarted client returns only the pending message
+	client = newTestGraphClient(t, fake, state)
+	fake.downloads = nil
+
+	messages, err = client.GetNewMessages(ctx)
+	if err != nil {
+		t.Fatalf("GetNewMessages() error = %v", err)
+	}
+
+	if got := strings.Join(subjects(messages), ","); got != "Re: Trip" || len(fake.downloads) != 1 {
+		t.Fatalf("GetNewMessages() after partial forward = %q, downloaded %v", got, fake.downloads)
+	}
+
+	if err := client.MarkAsForwarded(ctx, "m3"); err != nil {
+		t.Fatalf("MarkAsForwarded() error = %v", err)
+	}
+
+	if pending := state.Pending(client.cursorKey()); len(pending) != 0 {
+		t.Errorf("pending = %v after all messages were forwarded", pending)
+	}
+
+	// Only changes after the saved delta link are listed
+	fake.add("m5", "conv4", "office@school.example.com", "Lunch")
+
+	messages, err = client.GetNewMessages(ctx)
+	if err != nil {
+		t.Fatalf("GetNewMessages() error = %v", err)
+	}
+
+	if got := strings.Join(subjects(messages), ","); got != "Lunch" {
+		t.Errorf("GetNewMessages() after delta = %q", got)
+	}
+}
+
+func TestGraphClientDeletedPendingMessage(t *testing.T) {
+	fake := newFakeGraphServer()
+	fake.add("m1", "conv1", "office@school.example.com", "Trip")
+
+	state, _ := NewStateStore("")
+	client := newTestGraphClient(t, fake, state)
+	ctx := context.Background()
+
+	if _, err := client.GetNewMessages(ctx); err != nil {
+		t.Fatalf("GetNewMessages() error = %v", err)
+	}
+
+	// m1 is deleted while pending, without a delta change that says so
+	fake.mu.Lock()
+	delete(fake.messages, "m1")
+	fake.order = nil
+	fake.mu.Unlock()
+
+	fake.add("m2", "conv2", "office@school.example.com", "Lunch")
+
+	messages, err := client.GetNewMessages(ctx)
+	if err != nil {
+		t.Fatalf("GetNewMessages() error = %v, want the deleted message dropped", err)
+	}
+
+	if got := strings.Join(subjects(messages), ","); got != "Lunch" {
+		t.Errorf("GetNewMessages() = %q, want the new message", got)
+	}
+
+	if pending := state.Pending(client.cursorKey()); len(pending) != 1 || pending[0] != "m2" {
+		t.Errorf("pending = %v, want only m2", pending)
+	}
+}
+
+func TestGraphClientMarkAsForwardedKeepsCategories(t *testing.T) {
+	fake := newFakeGraphServer()
+	fake.add("m1", "conv1", "office@school.example.com", "Trip")
+	fake.messages["m1"].categories = []string{"School"}
+
+	state, _ := NewStateStore("")
+	client := newTestGraphClient(t, fake, state)
+
+	for range 2 {
+		if err := client.MarkAsForwarded(context.Background(), "m1"); err != nil {
+			t.Fatalf("MarkAsForwarded() error = %v", err)
+		}
+	}
+
+	if got := strings.Join(fake.messages["m1"].categories, ","); got != "School,"+defaultGraphForwardedCategory {
+		t.Errorf("categories = %q", got)
+	}
+
+	if fake.patches != 1 {
+		t.Errorf("PATCH sent %d times, want 1", fake.patches)
+	}
+}
+
+func TestGraphClientErrors(t *testing.T) {
+	fake := newFakeGraphServer()
+	state, _ := NewStateStore("")
+	client := newTestGraphClient(t, fake, state)
+
+	_, err := client.GetMessage(context.Background(), "missing")
+	if err == nil || !strings.Contains(err.Error(), "ErrorItemNotFound") {
+		t.Errorf("GetMessage() error = %v, want Graph error details", err)
+	}
+}
+
+func TestGraphTokenSourceDeviceCode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/devicecode":
+			if r.Form.Get("client_id") != "app-id" {
+				t.Errorf("devicecode client_id = %q", r.Form.Get("client_id"))
+			}
+
+			io.WriteString(w, `{"device_code":"dev","user_code":"ABCD-EFGH",`+
+				`"verification_uri":"https://microsoft.com/devicelogin","expires_in":60,"interval":1}`)
+		case "/token":
+			if r.Form.Get("device_code") != "dev" {
+				t.Errorf("token device_code = %q", r.Form.Get("device_code"))
+			}
+
+			io.WriteString(w, `{"access_token":"access","refresh_token":"refresh","token_type":"Bearer","expires_in":3600}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	oauthConfig := &oauth2.Config{
+		ClientID: "app-id",
+		Scopes:   graphScopes,
+		Endpoint: oauth2.Endpoint{
+			DeviceAuthURL: server.URL + "/devicecode",
+			TokenURL:      server.URL + "/token",
+			AuthStyle:     oauth2.AuthStyleInParams,
+		},
+	}
+
+	tokenFile := filepath.Join(t.TempDir(), "graph_token.json")
+
+	source, err := graphTokenSource(context.Background(), oauthConfig, tokenFile)
+	if err != nil {
+		t.Fatalf("graphTokenSource() error = %v", err)
+	}
+
+	tok, err := source.Token()
+	if err != nil || tok.AccessToken != "access" {
+		t.Fatalf("Token() = %+v, %v", tok, err)
+	}
+
+	// The token is cached, so the next start does not ask for a device code again
+	if _, err := os.Stat(tokenFile); err != nil {
+		t.Fatalf("token file not written: %v", err)
+	}
+
+	server.Close()
+
+	if _, err := graphTokenSource(context.Background(), oauthConfig, tokenFile); err != nil {
+		t.Errorf("graphTokenSource() with cached token error = %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// errInvalidHeaders is returned when the model's answer does not fit the header schema
+var errInvalidHeaders = errors.New("invalid header translation")
+
+// HeaderTranslationConfig selects the headers translated in the same model call as the body
+type HeaderTranslationConfig struct {
+	// Subject replaces the subject with its translation and keeps the original below it
+	Subject bool `yaml:"subject"`
+	// Sender translates the display name of the sender, the address is kept
+	Sender bool `yaml:"sender"`
+	// Attachments lists the attachments below the body with translated file names
+	Attachments bool `yaml:"attachments"`
+}
+
+// Translation is an email body in the target language and, when the route asks for them, its
+// headers translated in the same call
+type Translation struct {
+	Content     string   `json:"text"`
+	Subject     string   `json:"subject,omitempty"`
+	Sender      string   `json:"sender,omitempty"`
+	Attachments []string `json:"attachments,omitempty"`
+}
+
+// headerRequest holds the headers of one email to translate, empty ones are left out
+type headerRequest struct {
+	Subject     string
+	Sender      string
+	Attachments []string
+}
+
+// routeHeaders returns the header settings of a route, or the translation section's ones
+func routeHeaders(config *Config, route *RouteConfig) HeaderTranslationConfig {
+	if route != nil && route.Headers != nil {
+		return *route.Headers
+	}
+
+	return config.Translation.Headers
+}
+
+// headerRequest collects the headers of msg its route translates
+func (s *TranslationService) headerRequest(msg Message) headerRequest {
+	headers := routeHeaders(s.config, msg.Route)
+
+	var request headerRequest
+
+	if headers.Subject {
+		request.Subject = msg.Subject
+	}
+
+	if headers.Sender {
+		if addr, err := mail.ParseAddress(msg.From); err == nil {
+			request.Sender = addr.Name
+		}
+	}
+
+	if headers.Attachments {
+		request.Attachments = msg.Attachments
+	}
+
+	return request
+}
+
+func (r headerRequest) empty() bool {
+	return r.Subject == "" && r.Sender == "" && len(r.Attachments) == 0
+}
+
+// key identifies the request in the translation cache
+func (r headerRequest) key() string {
+	return strings.Join([]string{r.Subject, r.Sender, strings.Join(r.Attachments, "\n")}, "\x00")
+}
+
+// prompt extends the body prompt with the headers and asks for a JSON answer of schema
+func (r headerRequest) prompt(bodyPrompt, targetLanguage string) (string, *genai.Schema) {
+	schema := &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"text": {Type: genai.TypeString, Description: "The result for the email text"},
+		},
+		Required: []string{"text"},
+	}
+
+	var b strings.Builder
+
+	b.WriteString(bodyPrompt)
+	fmt.Fprintf(&b, "\n\nAnswer in JSON. Put the result for the email text in \"text\" and translate these headers "+
+		"of the email to %s as well:\n", targetLanguage)
+
+	if r.Subject != "" {
+		fmt.Fprintf(&b, "\nSubject, in \"subject\": %s\n", r.Subject)
+		schema.Properties["subject"] = &genai.Schema{Type: genai.TypeString, Description: "The translated subject"}
+		schema.Required = append(schema.Required, "subject")
+	}
+
+	if r.Sender != "" {
+		fmt.Fprintf(&b, "\nSender name, in \"sender\" (keep names of people as they are): %s\n", r.Sender)
+		schema.Properties["sender"] = &genai.Schema{Type: genai.TypeString, Description: "The translated sender name"}
+		schema.Required = append(schema.Required, "sender")
+	}
+
+	if len(r.Attachments) > 0 {
+		b.WriteString("\nAttachment file names, in \"attachments\" in the same order, keeping the extensions:\n")
+
+		for _, name := range r.Attachments {
+			fmt.Fprintf(&b, "- %s\n", name)
+		}
+
+		schema.Properties["attachments"] = &genai.Schema{
+			Type:        genai.TypeArray,
+			Items:       &genai.Schema{Type: genai.TypeString},
+			Description: "The translated file names",
+		}
+		schema.Required = append(schema.Required, "attachments")
+	}
+
+	return b.String(), schema
+}
+
+// parseHeaderTranslation decodes the model's JSON answer to a header request
+func parseHeaderTranslation(raw string, request headerRequest) (Translation, error) {
+	// Models sometimes wrap JSON in a Markdown code fence despite the response MIME type
+	raw = strings.TrimSpace(raw)
+	raw = strings.TrimPrefix(raw, "```json")
+	raw = strings.TrimSuffix(strings.TrimPrefix(raw, "```"), "```")
+
+	var translation Translation
+	if err := json.Unmarshal([]byte(raw), &translation); err != nil {
+		return Translation{}, fmt.Errorf("%w: %v", errInvalidHeaders, err)
+	}
+
+	translation.Content = strings.TrimSpace(translation.Content)
+	if translation.Content == "" {
+		return Translation{}, fmt.Errorf("%w: empty text", errInvalidHeaders)
+	}
+
+	// Names that cannot be matched with the originals are shown untranslated
+	if len(translation.Attachments) != len(request.Attachments) {
+		translation.Attachments = nil
+	}
+
+	return translation, nil
+}
+
+// apply shows the translated headers in place of the original ones, which are kept for replies
+// and the original subject line
+func (t Translation) apply(msg Message) Message {
+	if subject := strings.TrimSpace(t.Subject); subject != "" && subject != msg.Subject {
+		msg.OriginalSubject = msg.Subject
+		msg.Subject = subject
+	}
+
+	if sender := strings.TrimSpace(t.Sender); sender != "" {
+		if addr, err := mail.ParseAddress(msg.From); err == nil && addr.Name != sender {
+			msg.OriginalFrom = msg.From
+			msg.From = fmt.Sprintf("%s <%s>", sender, addr.Address)
+		}
+	}
+
+	return msg
+}
+
+// formatContent adds the original subject above the body and the attachments below it
+func (t Translation) formatContent(msg Message) string {
+	content := t.Content
+
+	if msg.OriginalSubject != "" {
+		content = fmt.Sprintf("🔤 %s\n\n%s", msg.OriginalSubject, content)
+	}
+
+	if len(t.Attachments) > 0 {
+		lines := make([]string, 0, len(t.Attachments))
+
+		for i, name := range t.Attachments {
+			if original := msg.Attachments[i]; original != name {
+				name = fmt.Sprintf("%s (%s)", name, original)
+			}
+
+			lines = append(lines, "📎 "+name)
+		}
+
+		content += "\n\n" + strings.Join(lines, "\n")
+	}
+
+	return content
+}
+
+// originalSubject returns the subject of the email before translation
+func (m Message) originalSubject() string {
+	if m.OriginalSubject != "" {
+		return m.OriginalSubject
+	}
+
+	return m.Subject
+}
+
+// originalFrom returns the sender of the email before translation
+func (m Message) originalFrom() string {
+	if m.OriginalFrom != "" {
+		return m.OriginalFrom
+	}
+
+	return m.From
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestTranslateHeaders(t *testing.T) {
+	msg := Message{
+		Subject:     "Aprīļa rēķins",
+		From:        "Rīgas Ūdens <info@example.com>",
+		Content:     "Sveiki!",
+		Attachments: []string{"rekins.pdf"},
+	}
+
+	tests := []struct {
+		name       string
+		headers    *HeaderTranslationConfig
+		answer     string
+		want       Translation
+		wantFields []string
+	}{
+		{
+			name:       "subject only",
+			headers:    &HeaderTranslationConfig{Subject: true},
+			answer:     `{"text": "Hello!", "subject": "April invoice"}`,
+			want:       Translation{Content: "Hello!", Subject: "April invoice"},
+			wantFields: []string{"text", "subject"},
+		},
+		{
+			name:    "every header",
+			headers: &HeaderTranslationConfig{Subject: true, Sender: true, Attachments: true},
+			answer:  "```json\n" + `{"text": "Hello!", "subject": "April invoice", "sender": "Riga Water", "attachments": ["invoice.pdf"]}` + "\n```",
+			want: Translation{
+				Content:     "Hello!",
+				Subject:     "April invoice",
+				Sender:      "Riga Water",
+				Attachments: []string{"invoice.pdf"},
+			},
+			wantFields: []string{"text", "subject", "sender", "attachments"},
+		},
+		{
+			name:       "invalid answer falls back to the body alone",
+			headers:    &HeaderTranslationConfig{Subject: true},
+			answer:     "April invoice",
+			want:       Translation{Content: "Hello (text)"},
+			wantFields: []string{"text", "subject"},
+		},
+		{name: "no headers", want: Translation{Content: "Hello (text)"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fields []string
+
+			service := &TranslationService{
+				config: &Config{Translation: TranslationConfig{TargetLanguage: "English"}},
+				models: []chainModel{{
+					name: "gemini",
+					generate: func(ctx context.Context, prompt string, schema *genai.Schema) (string, error) {
+						fields = schema.Required
+
+						if !strings.Contains(prompt, "Aprīļa rēķins") {
+							t.Errorf("prompt without the subject: %q", prompt)
+						}
+
+						return tt.answer, nil
+					},
+				}},
+				countTokens: func(ctx context.Context, text string) (int, error) { return 1, nil },
+				generateText: func(ctx context.Context, prompt string) (string, error) {
+					return "Hello (text)", nil
+				},
+			}
+
+			routed := msg
+			routed.Route = &RouteConfig{Name: "bills", Headers: tt.headers}
+
+			got, err := service.defaultTranslate(context.Background(), routed)
+			if err != nil {
+				t.Fatalf("defaultTranslate() error = %v", err)
+			}
+
+			if got.Content != tt.want.Content || got.Subject != tt.want.Subject || got.Sender != tt.want.Sender ||
+				strings.Join(got.Attachments, ",") != strings.Join(tt.want.Attachments, ",") {
+				t.Errorf("defaultTranslate() = %+v, want %+v", got, tt.want)
+			}
+
+			if strings.Join(fields, ",") != strings.Join(tt.wantFields, ",") {
+				t.Errorf("asked for %v, want %v", fields, tt.wantFields)
+			}
+		})
+	}
+}
+
+func TestProcessMessageTranslatedHeaders(t *testing.T) {
+	var sent Notification
+
+	svc := &services{
+		source: &GmailClient{markAsForwarded: func(ctx context.Context, messageID string) error { return nil }},
+		translation: &TranslationService{config: &Config{}, translate: func(ctx context.Context, msg Message) (Translation, error) {
+			return Translation{
+				Content:     "Hello!",
+				Subject:     "April invoice",
+				Sender:      "Riga Water",
+				Attachments: []string{"invoice.pdf", "terms.pdf"},
+			}, nil
+		}},
+		notifiers: Notifiers{sinkTelegram: notifierFunc(func(ctx context.Context, n Notification) error {
+			sent = n
+
+			return nil
+		})},
+	}
+
+	msg := Message{
+		ID:          "m1",
+		Subject:     "Aprīļa rēķins",
+		From:        "Rīgas Ūdens <info@example.com>",
+		Content:     "Sveiki!",
+		Attachments: []string{"rekins.pdf", "terms.pdf"},
+	}
+
+	if err := processMessage(context.Background(), svc, msg); err != nil {
+		t.Fatalf("processMessage() error = %v", err)
+	}
+
+	got := sent.Message
+	if got.Subject != "April invoice" || got.originalSubject() != "Aprīļa rēķins" ||
+		got.From != "Riga Water <info@example.com>" || got.originalFrom() != msg.From {
+		t.Errorf("sent message = %+v", got)
+	}
+
+	want := "🔤 Aprīļa rēķins\n\nHello!\n\n📎 invoice.pdf (rekins.pdf)\n📎 terms.pdf"
+	if sent.Content != want {
+		t.Errorf("sent content = %q, want %q", sent.Content, want)
+	}
+}
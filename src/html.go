@@ -0,0 +1,415 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	multiNewlineRe = regexp.MustCompile(`\n{3,}`)
+	// Inline styles that hide an element, as used for preheaders and tracking blocks
+	hiddenStyleRe = regexp.MustCompile(
+		`(^|;)\s*(display\s*:\s*none|visibility\s*:\s*hidden|mso-hide\s*:\s*all|opacity\s*:\s*0(\.0+)?` +
+			`|max-height\s*:\s*0(px)?|font-size\s*:\s*0(px)?)\s*(!important)?\s*(;|$)`)
+	pixelStyleRe = regexp.MustCompile(`(^|;)\s*(width|height)\s*:\s*[01](px)?\s*(!important)?\s*(;|$)`)
+	// Zero-width and filler characters that pad preheaders
+	invisibleCharsReplacer = strings.NewReplacer(
+		"\u200b", "", "\u200c", "", "\u200d", "", "\ufeff", "", "\u034f", "", "\u00ad", "",
+	)
+)
+
+// Elements whose content is never shown to the reader
+var skippedElements = map[atom.Atom]bool{
+	atom.Head:     true,
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Title:    true,
+	atom.Noscript: true,
+	atom.Template: true,
+	atom.Iframe:   true,
+	atom.Object:   true,
+	atom.Svg:      true,
+	atom.Input:    true,
+}
+
+var blockElements = map[atom.Atom]bool{
+	atom.P:          true,
+	atom.Div:        true,
+	atom.Section:    true,
+	atom.Article:    true,
+	atom.Header:     true,
+	atom.Footer:     true,
+	atom.Main:       true,
+	atom.Nav:        true,
+	atom.Aside:      true,
+	atom.Blockquote: true,
+	atom.Center:     true,
+	atom.Address:    true,
+	atom.Hr:         true,
+	atom.Tr:         true,
+	atom.Td:         true,
+	atom.Th:         true,
+	atom.Dl:         true,
+	atom.Dt:         true,
+	atom.Dd:         true,
+	atom.Figure:     true,
+}
+
+// htmlToText converts an HTML body into plain text with Telegram Markdown links and headings.
+// It walks the node tree built by x/net/html, so entities are fully decoded and broken markup
+// is repaired the way browsers do it.
+func htmlToText(src string) string {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return ""
+	}
+
+	r := &htmlRenderer{atLineStart: true}
+	r.render(doc)
+
+	lines := strings.Split(r.b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " ")
+	}
+
+	text := strings.Join(lines, "\n")
+	text = multiNewlineRe.ReplaceAllString(text, "\n\n")
+
+	return strings.TrimSpace(text)
+}
+
+type htmlList struct {
+	ordered bool
+	n       int
+}
+
+type htmlRenderer struct {
+	b           strings.Builder
+	atLineStart bool
+	lists       []htmlList
+	inPre       bool
+	inLink      bool
+}
+
+func (r *htmlRenderer) write(s string) {
+	if r.atLineStart && !r.inPre {
+		s = strings.TrimLeft(s, " ")
+	}
+
+	if s == "" {
+		return
+	}
+
+	r.b.WriteString(s)
+	r.atLineStart = strings.HasSuffix(s, "\n")
+}
+
+func (r *htmlRenderer) newline() {
+	if !r.atLineStart {
+		r.b.WriteString("\n")
+		r.atLineStart = true
+	}
+}
+
+func (r *htmlRenderer) renderChildren(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.render(c)
+	}
+}
+
+// inline renders the children of n on their own and returns them as a single line
+func (r *htmlRenderer) inline(n *html.Node) string {
+	sub := &htmlRenderer{atLineStart: true, inLink: r.inLink}
+	sub.renderChildren(n)
+
+	return strings.Join(strings.Fields(sub.b.String()), " ")
+}
+
+func (r *htmlRenderer) render(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		r.renderText(n.Data)
+
+		return
+	case html.DocumentNode:
+		r.renderChildren(n)
+
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	if skippedElements[n.DataAtom] || isHiddenElement(n) {
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Br:
+		r.b.WriteString("\n")
+		r.atLineStart = true
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		if text := r.inline(n); text != "" {
+			r.newline()
+			r.write("*" + strings.ReplaceAll(text, "*", "") + "*")
+			r.newline()
+		}
+	case atom.Ul, atom.Ol:
+		r.lists = append(r.lists, htmlList{ordered: n.DataAtom == atom.Ol})
+		r.newline()
+		r.renderChildren(n)
+		r.lists = r.lists[:len(r.lists)-1]
+		r.newline()
+	case atom.Li:
+		r.renderListItem(n)
+	case atom.A:
+		r.renderLink(n)
+	case atom.Img:
+		// Images only matter as the text of a link; tracking pixels never do
+		if r.inLink && !isTrackingPixel(n) {
+			r.write(attr(n, "alt"))
+		}
+	case atom.Table:
+		if isDataTable(n) {
+			r.renderTable(n)
+		} else {
+			r.newline()
+			r.renderChildren(n)
+			r.newline()
+		}
+	case atom.Pre:
+		r.newline()
+		r.inPre = true
+		r.renderChildren(n)
+		r.inPre = false
+		r.newline()
+	default:
+		if blockElements[n.DataAtom] {
+			r.newline()
+			r.renderChildren(n)
+			r.newline()
+		} else {
+			r.renderChildren(n)
+		}
+	}
+}
+
+func (r *htmlRenderer) renderText(text string) {
+	text = invisibleCharsReplacer.Replace(text)
+
+	if r.inPre {
+		r.write(text)
+
+		return
+	}
+
+	// Collapse whitespace (including non-breaking spaces) like a browser would
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		if text != "" && !r.atLineStart {
+			r.write(" ")
+		}
+
+		return
+	}
+
+	collapsed := strings.Join(fields, " ")
+
+	if strings.TrimLeftFunc(text, isSpace) != text && !strings.HasSuffix(r.b.String(), " ") {
+		collapsed = " " + collapsed
+	}
+
+	if strings.TrimRightFunc(text, isSpace) != text {
+		collapsed += " "
+	}
+
+	r.write(collapsed)
+}
+
+func isSpace(c rune) bool {
+	return strings.ContainsRune(" \t\n\r\f\u00a0", c)
+}
+
+func (r *htmlRenderer) renderListItem(n *html.Node) {
+	r.newline()
+
+	depth := len(r.lists)
+	if depth == 0 {
+		r.write("• ")
+	} else {
+		list := &r.lists[depth-1]
+		indent := strings.Repeat("  ", depth-1)
+
+		if list.ordered {
+			list.n++
+			r.b.WriteString(indent + strconv.Itoa(list.n) + ". ")
+		} else {
+			r.b.WriteString(indent + "• ")
+		}
+
+		r.atLineStart = false
+	}
+
+	r.renderChildren(n)
+	r.newline()
+}
+
+func (r *htmlRenderer) renderLink(n *html.Node) {
+	href := strings.TrimSpace(attr(n, "href"))
+
+	wasInLink := r.inLink
+	r.inLink = true
+	text := r.inline(n)
+	r.inLink = wasInLink
+
+	// Telegram Markdown cannot nest brackets inside link text
+	text = strings.NewReplacer("[", "(", "]", ")").Replace(text)
+
+	switch {
+	case !strings.HasPrefix(href, "http://") && !strings.HasPrefix(href, "https://"):
+		r.write(text)
+	case text == "" || text == href:
+		r.write(href)
+	default:
+		r.write("[" + text + "](" + strings.ReplaceAll(href, ")", "%29") + ")")
+	}
+}
+
+// renderTable renders a data table one row per line with cells separated by " | "
+func (r *htmlRenderer) renderTable(table *html.Node) {
+	r.newline()
+
+	for _, row := range tableRows(table) {
+		var cells []string
+
+		for c := row.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || (c.DataAtom != atom.Td && c.DataAtom != atom.Th) || isHiddenElement(c) {
+				continue
+			}
+
+			cells = append(cells, r.inline(c))
+		}
+
+		if line := strings.Join(cells, " | "); strings.Trim(line, " |") != "" {
+			r.write(line)
+			r.newline()
+		}
+	}
+
+	r.newline()
+}
+
+// tableRows returns the rows of a table, looking through thead/tbody/tfoot
+func tableRows(table *html.Node) []*html.Node {
+	var rows []*html.Node
+
+	for c := table.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || isHiddenElement(c) {
+			continue
+		}
+
+		switch c.DataAtom {
+		case atom.Tr:
+			rows = append(rows, c)
+		case atom.Thead, atom.Tbody, atom.Tfoot:
+			rows = append(rows, tableRows(c)...)
+		}
+	}
+
+	return rows
+}
+
+// isDataTable tells simple data tables from the nested layout tables used by newsletters:
+// a data table has no nested tables or block content and at least one row with several cells
+func isDataTable(table *html.Node) bool {
+	var hasBlocks func(n *html.Node) bool
+
+	hasBlocks = func(n *html.Node) bool {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+
+			switch c.DataAtom {
+			case atom.Table, atom.Div, atom.P, atom.Ul, atom.Ol,
+				atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+				return true
+			}
+
+			if hasBlocks(c) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if hasBlocks(table) {
+		return false
+	}
+
+	for _, row := range tableRows(table) {
+		cells := 0
+
+		for c := row.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode && (c.DataAtom == atom.Td || c.DataAtom == atom.Th) {
+				cells++
+			}
+		}
+
+		if cells > 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isHiddenElement(n *html.Node) bool {
+	for _, a := range n.Attr {
+		switch strings.ToLower(a.Key) {
+		case "hidden":
+			return true
+		case "aria-hidden":
+			if strings.EqualFold(a.Val, "true") {
+				return true
+			}
+		case "style":
+			if hiddenStyleRe.MatchString(strings.ToLower(a.Val)) {
+				return true
+			}
+		case "class":
+			for _, class := range strings.Fields(strings.ToLower(a.Val)) {
+				if class == "preheader" || class == "preview-text" {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// isTrackingPixel detects 0x0 and 1x1 images used to track opens
+func isTrackingPixel(n *html.Node) bool {
+	width, height := attr(n, "width"), attr(n, "height")
+	if width == "0" || width == "1" || height == "0" || height == "1" {
+		return true
+	}
+
+	return pixelStyleRe.MatchString(strings.ToLower(attr(n, "style")))
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+
+	return ""
+}
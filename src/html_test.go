@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			name: "paragraphs and line breaks",
+			html: "<p>Hello</p><p>World<br>again</p>",
+			want: "Hello\nWorld\nagain",
+		},
+		{
+			name: "script, style and head are dropped",
+			html: `<html><head><title>T</title><style>p{color:red}</style></head>` +
+				`<body><script>alert(1)</script><p>Body</p></body></html>`,
+			want: "Body",
+		},
+		{
+			name: "all entities are decoded",
+			html: "<p>Fish &amp; chips &ndash; &euro;5 &#8364;5 &#x20AC;5 &lt;ok&gt; caf&eacute;&nbsp;bar</p>",
+			want: "Fish & chips – €5 €5 €5 <ok> café bar",
+		},
+		{
+			name: "links become Telegram links",
+			html: `<p>See <a href="https://example.com/a">the schedule</a> or <a href="https://example.com/b">https://example.com/b</a>` +
+				` or <a href="mailto:x@example.com">write us</a></p>`,
+			want: "See [the schedule](https://example.com/a) or https://example.com/b or write us",
+		},
+		{
+			name: "image links use alt text",
+			html: `<a href="https://example.com/order"><img src="b.png" alt="View order"></a>`,
+			want: "[View order](https://example.com/order)",
+		},
+		{
+			name: "lists and nesting",
+			html: "<ul><li>Milk</li><li>Bread<ol><li>White</li><li>Rye</li></ol></li></ul>",
+			want: "• Milk\n• Bread\n  1. White\n  2. Rye",
+		},
+		{
+			name: "headings",
+			html: "<h1>April *invoice*</h1><p>Amount due</p>",
+			want: "*April invoice*\nAmount due",
+		},
+		{
+			name: "simple data table",
+			html: "<table><thead><tr><th>Item</th><th>Price</th></tr></thead>" +
+				"<tbody><tr><td>Lunch</td><td>3.50</td></tr></tbody></table>",
+			want: "Item | Price\nLunch | 3.50",
+		},
+		{
+			name: "layout tables render as blocks",
+			html: "<table><tr><td><table><tr><td><p>Header</p></td></tr></table></td></tr>" +
+				"<tr><td><p>Body text</p></td></tr></table>",
+			want: "Header\nBody text",
+		},
+		{
+			name: "hidden preheader and tracking pixel",
+			html: `<div style="display:none;max-height:0;overflow:hidden">Preview text &zwnj;&nbsp;&zwnj;</div>` +
+				`<span class="preheader">More preview</span><div hidden>gone</div>` +
+				`<p>Visible</p><img src="https://t.example.com/open.gif" width="1" height="1">` +
+				`<a href="https://example.com"><img src="p.gif" style="width:1px;height:1px" alt="pixel"></a>`,
+			want: "Visible\nhttps://example.com",
+		},
+		{
+			name: "whitespace is collapsed",
+			html: "<div>\n   Dear   parents,\n\t<b>tomorrow</b>  is a\n holiday.  </div>",
+			want: "Dear parents, tomorrow is a holiday.",
+		},
+		{
+			name: "preformatted text keeps spacing",
+			html: "<pre>a   b\n  c</pre>",
+			want: "a   b\n  c",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := htmlToText(tt.html); got != tt.want {
+				t.Errorf("htmlToText() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
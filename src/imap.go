@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// Connection security of an IMAP server, see IMAPConfig.Security
+const (
+	imapSecurityTLS      = "tls"
+	imapSecurityStartTLS = "starttls"
+	imapSecurityNone     = "none"
+)
+
+const (
+	defaultIMAPMailbox          = "INBOX"
+	defaultIMAPForwardedKeyword = "$TelegramForwarded"
+	imapReconnectDelay          = 30 * time.Second
+)
+
+// IMAPConfig configures a generic IMAP mailbox such as Fastmail or Dovecot
+type IMAPConfig struct {
+	Address  string `yaml:"address"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Security is "tls" (default), "starttls" or "none"
+	Security     string `yaml:"security"`
+	Mailbox      string `yaml:"mailbox"`
+	PollInterval string `yaml:"poll_interval"`
+	// ForwardedKeyword is the keyword flag set on forwarded messages
+	ForwardedKeyword string `yaml:"forwarded_keyword"`
+	// MoveTo moves forwarded messages into this folder instead of flagging them
+	MoveTo string `yaml:"move_to"`
+	// Idle waits for new mail with IMAP IDLE in addition to polling
+	Idle   bool         `yaml:"idle"`
+	Filter FilterConfig `yaml:"filter"`
+}
+
+// IMAPClient reads messages from an IMAP mailbox. Message IDs are IMAP UIDs.
+type IMAPClient struct {
+	config *Config
+	dial   func(options *imapclient.Options) (*imapclient.Client, error)
+
+	// mu guards client, the connection used for commands; IDLE runs on its own connection
+	mu     sync.Mutex
+	client *imapclient.Client
+}
+
+func NewIMAPClient(config *Config) (*IMAPClient, error) {
+	if config.IMAP.Address == "" {
+		return nil, fmt.Errorf("imap address is required")
+	}
+
+	switch config.IMAP.Security {
+	case "", imapSecurityTLS, imapSecurityStartTLS, imapSecurityNone:
+	default:
+		return nil, fmt.Errorf("invalid imap security %q: use %q, %q or %q",
+			config.IMAP.Security, imapSecurityTLS, imapSecurityStartTLS, imapSecurityNone)
+	}
+
+	c := &IMAPClient{config: config}
+	c.dial = c.defaultDial
+
+	// Connect right away so wrong credentials are reported on startup
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.conn(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *IMAPClient) mailbox() string {
+	if c.config.IMAP.Mailbox != "" {
+		return c.config.IMAP.Mailbox
+	}
+
+	return defaultIMAPMailbox
+}
+
+func (c *IMAPClient) forwardedKeyword() imap.Flag {
+	if c.config.IMAP.ForwardedKeyword != "" {
+		return imap.Flag(c.config.IMAP.ForwardedKeyword)
+	}
+
+	return defaultIMAPForwardedKeyword
+}
+
+// defaultDial connects, logs in and selects the configured mailbox
+func (c *IMAPClient) defaultDial(options *imapclient.Options) (*imapclient.Client, error) {
+	var (
+		client *imapclient.Client
+		err    error
+	)
+
+	switch c.config.IMAP.Security {
+	case imapSecurityStartTLS:
+		client, err = imapclient.DialStartTLS(c.config.IMAP.Address, options)
+	case imapSecurityNone:
+		client, err = imapclient.DialInsecure(c.config.IMAP.Address, options)
+	default:
+		client, err = imapclient.DialTLS(c.config.IMAP.Address, options)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to IMAP server: %v", err)
+	}
+
+	if err := client.Login(c.config.IMAP.Username, c.config.IMAP.Password).Wait(); err != nil {
+		client.Close()
+
+		return nil, fmt.Errorf("unable to log in to IMAP server: %v", err)
+	}
+
+	if _, err := client.Select(c.mailbox(), nil).Wait(); err != nil {
+		client.Close()
+
+		return nil, fmt.Errorf("unable to select mailbox %s: %v", c.mailbox(), err)
+	}
+
+	return client, nil
+}
+
+// conn returns the command connection, reconnecting when it was closed; callers must hold c.mu
+func (c *IMAPClient) conn() (*imapclient.Client, error) {
+	if c.client != nil {
+		select {
+		case <-c.client.Closed():
+			c.client = nil
+		default:
+			return c.client, nil
+		}
+	}
+
+	client, err := c.dial(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.client = client
+
+	return client, nil
+}
+
+// reset drops the command connection after an error so the next call reconnects
+func (c *IMAPClient) reset() {
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+}
+
+func (c *IMAPClient) GetNewMessages(ctx context.Context) ([]Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	client, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	// Forwarded messages either carry the keyword or have been moved out of the mailbox
+	criteria := &imap.SearchCriteria{}
+	if c.config.IMAP.MoveTo == "" {
+		criteria.NotFlag = []imap.Flag{c.forwardedKeyword()}
+	}
+
+	data, err := client.UIDSearch(criteria, nil).Wait()
+	if err != nil {
+		c.reset()
+
+		return nil, fmt.Errorf("failed to search messages: %v", err)
+	}
+
+	uids := data.AllUIDs()
+	if len(uids) == 0 {
+		return nil, nil
+	}
+
+	messages, err := c.fetch(client, imap.UIDSetNum(uids...))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Message
+
+	for _, msg := range messages {
+		msg, ok := prepareMessage(c.config, c.config.IMAP.Filter, msg)
+		if !ok {
+			continue
+		}
+
+		result = append(result, msg)
+	}
+
+	return result, nil
+}
+
+func (c *IMAPClient) GetMessage(ctx context.Context, id string) (Message, error) {
+	uid, err := parseUID(id)
+	if err != nil {
+		return Message{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	client, err := c.conn()
+	if err != nil {
+		return Message{}, err
+	}
+
+	messages, err := c.fetch(client, imap.UIDSetNum(uid))
+	if err != nil {
+		return Message{}, err
+	}
+
+	if len(messages) == 0 {
+		return Message{}, fmt.Errorf("message %s not found", id)
+	}
+
+	return messages[0], nil
+}
+
+// fetch downloads and parses messages without marking them as seen
+func (c *IMAPClient) fetch(client *imapclient.Client, uids imap.UIDSet) ([]Message, error) {
+	section := &imap.FetchItemBodySection{Peek: true}
+
+	buffers, err := client.Fetch(uids, &imap.FetchOptions{
+		UID:          true,
+		InternalDate: true,
+		BodySection:  []*imap.FetchItemBodySection{section},
+	}).Collect()
+	if err != nil {
+		c.reset()
+
+		return nil, fmt.Errorf("failed to fetch messages: %v", err)
+	}
+
+	result := make([]Message, 0, len(buffers))
+
+	for _, buf := range buffers {
+		id := strconv.FormatUint(uint64(buf.UID), 10)
+
+		msg, err := parseRawMessage(buf.FindBodySection(section))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse message %s: %v", id, err)
+		}
+
+		msg.ID = id
+		msg.ThreadID = threadIDFromHeaders(msg)
+		msg.Labels = []string{c.mailbox()}
+		msg.Time = messageTime(msg.Date, buf.InternalDate)
+
+		result = append(result, msg)
+	}
+
+	return result, nil
+}
+
+func (c *IMAPClient) MarkAsForwarded(ctx context.Context, id string) error {
+	uid, err := parseUID(id)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	client, err := c.conn()
+	if err != nil {
+		return err
+	}
+
+	if c.config.IMAP.MoveTo != "" {
+		if _, err := client.Move(imap.UIDSetNum(uid), c.config.IMAP.MoveTo).Wait(); err != nil {
+			return fmt.Errorf("failed to move message %s to %s: %v", id, c.config.IMAP.MoveTo, err)
+		}
+
+		return nil
+	}
+
+	err = client.Store(imap.UIDSetNum(uid), &imap.StoreFlags{
+		Op:     imap.StoreFlagsAdd,
+		Silent: true,
+		Flags:  []imap.Flag{c.forwardedKeyword()},
+	}, nil).Close()
+	if err != nil {
+		return fmt.Errorf("failed to flag message %s: %v", id, err)
+	}
+
+	return nil
+}
+
+// Watch keeps a second connection in IMAP IDLE and signals when the mailbox grows.
+// It returns nil when idle is disabled, which leaves the caller with polling only.
+func (c *IMAPClient) Watch(ctx context.Context) <-chan struct{} {
+	if !c.config.IMAP.Idle {
+		return nil
+	}
+
+	updates := make(chan struct{}, 1)
+
+	go func() {
+		for {
+			if err := c.idle(ctx, updates); err != nil {
+				log.Printf("IMAP IDLE error: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(imapReconnectDelay):
+			}
+		}
+	}()
+
+	return updates
+}
+
+// idle runs IDLE until ctx is done or the connection drops
+func (c *IMAPClient) idle(ctx context.Context, updates chan<- struct{}) error {
+	client, err := c.dial(&imapclient.Options{
+		UnilateralDataHandler: &imapclient.UnilateralDataHandler{
+			Mailbox: func(data *imapclient.UnilateralDataMailbox) {
+				if data.NumMessages == nil {
+					return
+				}
+
+				select {
+				case updates <- struct{}{}:
+				default:
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	defer client.Close()
+
+	if !client.Caps().Has(imap.CapIdle) {
+		return errors.New("server does not support IDLE")
+	}
+
+	cmd, err := client.Idle()
+	if err != nil {
+		return fmt.Errorf("failed to start IDLE: %v", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return cmd.Close()
+	case <-client.Closed():
+		return errors.New("connection closed")
+	}
+}
+
+func parseUID(id string) (imap.UID, error) {
+	uid, err := strconv.ParseUint(id, 10, 32)
+	if err != nil || uid == 0 {
+		return 0, fmt.Errorf("invalid IMAP message ID %q", id)
+	}
+
+	return imap.UID(uid), nil
+}
+
+// threadIDFromHeaders stands in for Gmail's thread ID on sources without one:
+// the root of the References chain, else the parent, else the message itself
+func threadIDFromHeaders(msg Message) string {
+	if refs := strings.Fields(msg.References); len(refs) > 0 {
+		return refs[0]
+	}
+
+	if msg.InReplyTo != "" {
+		return strings.TrimSpace(msg.InReplyTo)
+	}
+
+	return msg.MessageID
+}
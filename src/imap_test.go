@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-imap/v2/imapserver/imapmemserver"
+)
+
+const (
+	testIMAPUser     = "parent@example.com"
+	testIMAPPassword = "secret"
+)
+
+// newTestIMAPServer starts an in-process IMAP server with an INBOX and a Forwarded folder
+func newTestIMAPServer(t *testing.T) (string, *imapmemserver.User) {
+	t.Helper()
+
+	memServer := imapmemserver.New()
+	user := imapmemserver.NewUser(testIMAPUser, testIMAPPassword)
+
+	for _, name := range []string{"INBOX", "Forwarded"} {
+		if err := user.Create(name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	memServer.AddUser(user)
+
+	server := imapserver.New(&imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return memServer.NewSession(), nil, nil
+		},
+		InsecureAuth: true,
+		Caps:         imap.CapSet{imap.CapIMAP4rev1: {}, imap.CapIMAP4rev2: {}},
+		Logger:       discardLogger{},
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Serve(ln)
+
+	t.Cleanup(func() { server.Close() })
+
+	return ln.Addr().String(), user
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Printf(format string, args ...interface{}) {}
+
+func appendTestMessage(t *testing.T, user *imapmemserver.User, from, subject, body string) {
+	t.Helper()
+
+	raw := "From: " + from + "\r\nTo: " + testIMAPUser + "\r\nSubject: " + subject +
+		"\r\nMessage-ID: <" + strings.ReplaceAll(subject, " ", ".") + "@example.com>" +
+		"\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n" + body + "\r\n"
+
+	if _, err := user.Append("INBOX", bytes.NewReader([]byte(raw)), &imap.AppendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestIMAPClient(t *testing.T, addr string, imapConfig IMAPConfig) *IMAPClient {
+	t.Helper()
+
+	imapConfig.Address = addr
+	imapConfig.Username = testIMAPUser
+	imapConfig.Password = testIMAPPassword
+	imapConfig.Security = imapSecurityNone
+
+	client, err := NewIMAPClient(&Config{Source: sourceIMAP, IMAP: imapConfig})
+	if err != nil {
+		t.Fatalf("NewIMAPClient() error = %v", err)
+	}
+
+	t.Cleanup(func() {
+		client.mu.Lock()
+		client.reset()
+		client.mu.Unlock()
+	})
+
+	return client
+}
+
+func TestIMAPClientKeyword(t *testing.T) {
+	addr, user := newTestIMAPServer(t)
+	appendTestMessage(t, user, "School <office@school.example.com>", "Trip", "Bus leaves at 8")
+	appendTestMessage(t, user, "Shop <news@shop.example.com>", "Sale", "Everything -50%")
+
+	client := newTestIMAPClient(t, addr, IMAPConfig{
+		Filter: FilterConfig{From: []string{"@school.example.com"}},
+	})
+
+	ctx := context.Background()
+
+	messages, err := client.GetNewMessages(ctx)
+	if err != nil {
+		t.Fatalf("GetNewMessages() error = %v", err)
+	}
+
+	if len(messages) != 1 {
+		t.Fatalf("GetNewMessages() returned %d messages, want 1", len(messages))
+	}
+
+	msg := messages[0]
+	if msg.Subject != "Trip" || strings.TrimSpace(msg.Content) != "Bus leaves at 8" || msg.ThreadID != "<Trip@example.com>" {
+		t.Errorf("GetNewMessages() = %+v", msg)
+	}
+
+	fetched, err := client.GetMessage(ctx, msg.ID)
+	if err != nil || fetched.Subject != "Trip" {
+		t.Errorf("GetMessage() = %+v, %v", fetched, err)
+	}
+
+	if err := client.MarkAsForwarded(ctx, msg.ID); err != nil {
+		t.Fatalf("MarkAsForwarded() error = %v", err)
+	}
+
+	messages, err = client.GetNewMessages(ctx)
+	if err != nil {
+		t.Fatalf("GetNewMessages() error = %v", err)
+	}
+
+	if len(messages) != 0 {
+		t.Errorf("GetNewMessages() after MarkAsForwarded returned %d messages", len(messages))
+	}
+
+	// The keyword lives on the server, so a fresh connection does not see the message either
+	other := newTestIMAPClient(t, addr, IMAPConfig{})
+
+	messages, err = other.GetNewMessages(ctx)
+	if err != nil || len(messages) != 1 || messages[0].Subject != "Sale" {
+		t.Errorf("GetNewMessages() on a new connection = %+v, %v", messages, err)
+	}
+}
+
+func TestIMAPClientMoveTo(t *testing.T) {
+	addr, user := newTestIMAPServer(t)
+	appendTestMessage(t, user, "office@school.example.com", "Trip", "Bus leaves at 8")
+
+	client := newTestIMAPClient(t, addr, IMAPConfig{MoveTo: "Forwarded"})
+	ctx := context.Background()
+
+	messages, err := client.GetNewMessages(ctx)
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("GetNewMessages() = %d messages, %v", len(messages), err)
+	}
+
+	if err := client.MarkAsForwarded(ctx, messages[0].ID); err != nil {
+		t.Fatalf("MarkAsForwarded() error = %v", err)
+	}
+
+	inbox, _ := user.Status("INBOX", &imap.StatusOptions{NumMessages: true})
+	moved, _ := user.Status("Forwarded", &imap.StatusOptions{NumMessages: true})
+
+	if *inbox.NumMessages != 0 || *moved.NumMessages != 1 {
+		t.Errorf("after move INBOX has %d messages, Forwarded %d", *inbox.NumMessages, *moved.NumMessages)
+	}
+}
+
+func TestIMAPClientWatch(t *testing.T) {
+	addr, user := newTestIMAPServer(t)
+	client := newTestIMAPClient(t, addr, IMAPConfig{Idle: true})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updates := client.Watch(ctx)
+
+	// Give the IDLE connection time to start before new mail arrives
+	time.Sleep(200 * time.Millisecond)
+	appendTestMessage(t, user, "office@school.example.com", "Trip", "Bus leaves at 8")
+
+	select {
+	case <-updates:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch() did not announce new mail")
+	}
+}
+
+func TestIMAPClientWatchDisabled(t *testing.T) {
+	addr, _ := newTestIMAPServer(t)
+	client := newTestIMAPClient(t, addr, IMAPConfig{})
+
+	if updates := client.Watch(context.Background()); updates != nil {
+		t.Error("Watch() without idle should return nil")
+	}
+}
+
+func TestNewIMAPClientErrors(t *testing.T) {
+	addr, _ := newTestIMAPServer(t)
+
+	tests := []struct {
+		name   string
+		config IMAPConfig
+	}{
+		{name: "missing address", config: IMAPConfig{}},
+		{name: "invalid security", config: IMAPConfig{Address: addr, Security: "ssl"}},
+		{
+			name:   "wrong password",
+			config: IMAPConfig{Address: addr, Security: imapSecurityNone, Username: testIMAPUser, Password: "wrong"},
+		},
+		{
+			name: "missing mailbox",
+			config: IMAPConfig{
+				Address: addr, Security: imapSecurityNone, Username: testIMAPUser, Password: testIMAPPassword,
+				Mailbox: "Archive",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewIMAPClient(&Config{IMAP: tt.config}); err == nil {
+				t.Error("NewIMAPClient() expected an error")
+			}
+		})
+	}
+}
+
+func TestThreadIDFromHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		want string
+	}{
+		{name: "first message", msg: Message{MessageID: "<a@x>"}, want: "<a@x>"},
+		{name: "reply without references", msg: Message{MessageID: "<b@x>", InReplyTo: "<a@x>"}, want: "<a@x>"},
+		{
+			name: "deep reply",
+			msg:  Message{MessageID: "<c@x>", InReplyTo: "<b@x>", References: "<a@x> <b@x>"},
+			want: "<a@x>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := threadIDFromHeaders(tt.msg); got != tt.want {
+				t.Errorf("threadIDFromHeaders() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
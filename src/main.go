@@ -2,40 +2,116 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+type FilterConfig struct {
+	From            []string `yaml:"from"`
+	SubjectKeywords []string `yaml:"subject_keywords"`
+	ContentKeywords []string `yaml:"content_keywords"`
+	// MaxAge skips emails older than a duration such as "72h"
+	MaxAge string `yaml:"max_age"`
+}
+
+type GmailConfig struct {
+	CredentialsFile string       `yaml:"credentials_file"`
+	TokenFile       string       `yaml:"token_file"`
+	PollInterval    string       `yaml:"poll_interval"`
+	ForwardedLabel  string       `yaml:"forwarded_label"`
+	Filter          FilterConfig `yaml:"filter"`
+	// Format is "full" (Gmail's parsed MIME tree, default) or "raw" (RFC 822 source)
+	Format string `yaml:"format"`
+}
+
+type TelegramConfig struct {
+	BotToken  string `yaml:"bot_token"`
+	ChannelID string `yaml:"channel_id"`
+	ChatID    string `yaml:"chat_id"`
+	// Threading groups emails of one Gmail thread: "reply" (default), "topic" or "off"
+	Threading       string `yaml:"threading"`
+	MessageThreadID int64  `yaml:"message_thread_id"`
+	Topics          string `yaml:"topics"`
+	// Via posts as the bot ("bot", default) or as the user account below ("user")
+	Via  string             `yaml:"via"`
+	User TelegramUserConfig `yaml:"user"`
+	// Template is a text/template with the fields of TelegramTemplateData, written in
+	// ParseMode: "Markdown" (default), "MarkdownV2" or "HTML"
+	Template  string `yaml:"template"`
+	ParseMode string `yaml:"parse_mode"`
+	// Date sets the timezone, locale and layout of {{.Date}}
+	Date DateConfig `yaml:"date"`
+}
+
+type TranslationConfig struct {
+	GeminiAPIKey   string `yaml:"gemini_api_key"`
+	TargetLanguage string `yaml:"target_language"`
+	ModelName      string `yaml:"model_name"`
+	// Models is a fallback chain tried in order, replacing model_name
+	Models []ModelConfig `yaml:"models"`
+	// PromptTemplate is a text/template with the fields of PromptData, e.g. {{.Subject}};
+	// PromptFile reads it from a file instead
+	PromptTemplate string `yaml:"prompt_template"`
+	PromptFile     string `yaml:"prompt_file"`
+	// Processing is "translate" (default) or "extract" for a card with summary, deadlines and action items
+	Processing               string                 `yaml:"processing"`
+	ExtractionPromptTemplate string                 `yaml:"extraction_prompt_template"`
+	ExtractionPromptFile     string                 `yaml:"extraction_prompt_file"`
+	Cache                    TranslationCacheConfig `yaml:"cache"`
+	// Headers selects the headers translated in the same call as the body
+	Headers HeaderTranslationConfig `yaml:"headers"`
+	// MaxChunkTokens is the size above which an email is translated in parts, 4000 tokens by default
+	MaxChunkTokens int `yaml:"max_chunk_tokens"`
+	// ChunkConcurrency is how many parts of one email are translated at once, 3 by default
+	ChunkConcurrency int `yaml:"chunk_concurrency"`
+	// Temperature and MaxOutputTokens are left to the model when not set
+	Temperature     *float32 `yaml:"temperature"`
+	MaxOutputTokens int32    `yaml:"max_output_tokens"`
+	// SafetySettings maps a harm category (harassment, hate_speech, sexually_explicit,
+	// dangerous_content) to a threshold (block_none, block_only_high, block_medium_and_above,
+	// block_low_and_above)
+	SafetySettings map[string]string `yaml:"safety_settings"`
+}
+
+type StateConfig struct {
+	File string `yaml:"file"`
+}
+
+type ReplyConfig struct {
+	Enabled        bool    `yaml:"enabled"`
+	Translate      bool    `yaml:"translate"`
+	PromptTemplate string  `yaml:"prompt_template"`
+	PromptFile     string  `yaml:"prompt_file"`
+	AllowedUserIDs []int64 `yaml:"allowed_user_ids"`
+}
+
 type Config struct {
-	Gmail struct {
-		CredentialsFile string `yaml:"credentials_file"`
-		TokenFile       string `yaml:"token_file"`
-		PollInterval    string `yaml:"poll_interval"`
-		ForwardedLabel  string `yaml:"forwarded_label"`
-		Filter          struct {
-			From            []string `yaml:"from"`
-			SubjectKeywords []string `yaml:"subject_keywords"`
-			ContentKeywords []string `yaml:"content_keywords"`
-		} `yaml:"filter"`
-	} `yaml:"gmail"`
-	Telegram struct {
-		BotToken  string `yaml:"bot_token"`
-		ChannelID string `yaml:"channel_id"`
-		ChatID    string `yaml:"chat_id"`
-	} `yaml:"telegram"`
-	Translation struct {
-		GeminiAPIKey   string `yaml:"gemini_api_key"`
-		TargetLanguage string `yaml:"target_language"`
-		ModelName      string `yaml:"model_name"`
-		PromptTemplate string `yaml:"prompt_template"`
-	} `yaml:"translation"`
+	// Source is the mailbox to read: "gmail" (default), "imap" or "graph"
+	Source      string            `yaml:"source"`
+	Gmail       GmailConfig       `yaml:"gmail"`
+	IMAP        IMAPConfig        `yaml:"imap"`
+	Graph       GraphConfig       `yaml:"graph"`
+	Telegram    TelegramConfig    `yaml:"telegram"`
+	Translation TranslationConfig `yaml:"translation"`
+	State       StateConfig       `yaml:"state"`
+	Reply       ReplyConfig       `yaml:"reply"`
+	Sinks       []SinkConfig      `yaml:"sinks"`
+	Routes      []RouteConfig     `yaml:"routes"`
+	Cleanup     CleanupConfig     `yaml:"cleanup"`
+	Digest      DigestConfig      `yaml:"digest"`
+	QuietHours  QuietHoursConfig  `yaml:"quiet_hours"`
+	Calendar    CalendarConfig    `yaml:"calendar"`
+	Retry       RetryConfig       `yaml:"retry"`
+	DryRun      DryRunConfig      `yaml:"dry_run"`
 }
 
 func loadConfig(path string) (*Config, error) {
@@ -49,58 +125,167 @@ func loadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	if err := loadPromptFiles(&config); err != nil {
+		return nil, err
+	}
+
+	if err := validateFilters(&config); err != nil {
+		return nil, err
+	}
+
+	if err := validateReply(&config); err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
 
-func processMessage(
-	ctx context.Context,
-	msg Message,
-	translationService *TranslationService,
-	telegramBot *TelegramBot,
-	gmailClient *GmailClient,
-) error {
+func processMessage(ctx context.Context, svc *services, msg Message) error {
+	// Digest routes collect emails and send them together on their schedule
+	if routeDelivery(msg.Route) == deliveryDigest {
+		return svc.digests.Queue(ctx, msg)
+	}
+
+	// During quiet hours emails are posted without a sound or left for the end of the window
+	var silent bool
+
+	if svc.quiet != nil {
+		switch mode, until := svc.quiet.Check(msg, time.Now()); mode {
+		case quietHold:
+			log.Printf("Quiet hours: holding message until %s", until.Format(time.RFC1123))
+
+			return nil
+		case quietSilent:
+			log.Printf("Quiet hours: sending message without notification")
+
+			silent = true
+		}
+	}
+
 	// Process message content
 	log.Printf("Processing message content...")
 
-	translatedContent, err := translationService.Translate(ctx, msg.Content)
+	// The models that answered are shown below the content and kept in the state
+	contentCtx, usage := withModelUsage(ctx)
+
+	translation, deadLettered, err := processContent(contentCtx, svc, msg)
 	if err != nil {
 		return fmt.Errorf("error processing message content: %w", err)
 	}
 
-	// Send to Telegram
-	log.Printf("Sending message to Telegram...")
+	// A dead-lettered email is only marked so it is not fetched again
+	if deadLettered {
+		if err := svc.source.MarkAsForwarded(ctx, msg.ID); err != nil {
+			return fmt.Errorf("error marking dead-lettered message: %w", err)
+		}
+
+		return nil
+	}
+
+	// Calendar events are optional, the email is forwarded without them
+	events, err := svc.translation.CalendarEvents(ctx, msg)
+	if err != nil {
+		log.Printf("Error finding calendar events: %v", err)
+	}
+
+	// Translated headers replace the original ones in the post
+	msg = translation.apply(msg)
+	translatedContent := translation.formatContent(msg)
+
+	model := strings.Join(usage.Models(), ", ")
+	if model != "" {
+		translatedContent += "\n\n🤖 " + model
+	}
 
-	err = telegramBot.SendMessage(ctx, msg.Subject, translatedContent, msg.From, msg.Date, "")
+	log.Printf("Sending message...")
+
+	err = svc.notifiers.Notify(ctx, Notification{
+		Message: msg,
+		Content: translatedContent,
+		Silent:  silent,
+		Events:  events,
+		Model:   model,
+	})
 	if err != nil {
-		return fmt.Errorf("error sending message to Telegram: %w", err)
+		return fmt.Errorf("error sending message: %w", err)
 	}
 
 	log.Printf("Message processing completed successfully")
 
 	// Mark message as forwarded
-	log.Printf("Marking message as forwarded in Gmail...")
+	log.Printf("Marking message as forwarded in the mailbox...")
 
-	err = gmailClient.MarkAsForwarded(ctx, msg.ID)
+	err = svc.source.MarkAsForwarded(ctx, msg.ID)
 	if err != nil {
 		return fmt.Errorf("error marking message as forwarded: %w", err)
 	}
 
 	log.Println("Message marked as forwarded successfully")
 
+	if svc.retry != nil {
+		if err := svc.retry.Done(msg.ID); err != nil {
+			log.Printf("Error clearing failed attempts: %v", err)
+		}
+	}
+
 	return nil
 }
 
-func processMessages(
-	ctx context.Context,
-	messages []Message,
-	translationService *TranslationService,
-	telegramBot *TelegramBot,
-	gmailClient *GmailClient,
-) {
+// processContent translates or extracts the email content. Emails the model cannot handle are
+// forwarded untranslated with a warning, a quota error pauses processing, and other errors are
+// retried until the email is given up on and reported as dead-lettered.
+func processContent(ctx context.Context, svc *services, msg Message) (Translation, bool, error) {
+	translation, err := svc.translation.Process(ctx, msg)
+
+	switch {
+	case err == nil:
+		if svc.retry != nil {
+			svc.retry.Resume()
+		}
+
+		return translation, false, nil
+	case untranslatable(err):
+		log.Printf("Forwarding message untranslated: %v", err)
+
+		return Translation{Content: untranslatedContent(msg.Content, err)}, false, nil
+	case svc.retry == nil:
+		return Translation{}, false, err
+	case errors.Is(err, errQuotaExhausted):
+		until := svc.retry.Pause(time.Now())
+
+		return Translation{}, false, fmt.Errorf("%w, pausing until %s", err, until.Format(time.RFC1123))
+	}
+
+	deadLettered, stateErr := svc.retry.Failed(msg, err, time.Now())
+	if stateErr != nil {
+		log.Printf("Error recording failed attempt: %v", stateErr)
+	}
+
+	if !deadLettered {
+		return Translation{}, false, err
+	}
+
+	log.Printf("Giving up on message after %d attempts, moved to dead letters: %v", svc.retry.maxAttempts, err)
+
+	return Translation{}, true, nil
+}
+
+func processMessages(ctx context.Context, svc *services, messages []Message) {
+	sortByDate(messages)
+
 	for i, msg := range messages {
+		// The remaining emails wait for the quota to recover
+		if svc.retry != nil {
+			if until, paused := svc.retry.Paused(time.Now()); paused {
+				log.Printf("Model quota exhausted, leaving %d messages until %s", len(messages)-i, until.Format(time.RFC1123))
+
+				return
+			}
+		}
+
 		log.Printf("Processing message %d/%d: %s", i+1, len(messages), msg.Subject)
 
-		err := processMessage(ctx, msg, translationService, telegramBot, gmailClient)
+		err := processMessage(ctx, svc, msg)
 		if err != nil {
 			log.Printf("Error processing message: %v", err)
 
@@ -111,26 +296,57 @@ func processMessages(
 	}
 }
 
-func startMessageProcessing(
-	ctx context.Context,
-	pollInterval time.Duration,
-	gmailClient *GmailClient,
-	translationService *TranslationService,
-	telegramBot *TelegramBot,
-) {
+func startMessageProcessing(ctx context.Context, pollInterval time.Duration, svc *services) {
+	checkMessages := func() {
+		messages, err := svc.source.GetNewMessages(ctx)
+		if err != nil {
+			log.Printf("Error getting new messages: %v", err)
+
+			return
+		}
+
+		if len(messages) > 0 {
+			log.Printf("Found %d new messages to process", len(messages))
+			processMessages(ctx, svc, messages)
+		}
+	}
+
 	// Process messages immediately on startup
-	messages, err := gmailClient.GetNewMessages(ctx)
-	if err != nil {
-		log.Printf("Error getting new messages: %v", err)
-	} else if len(messages) > 0 {
-		log.Printf("Found %d new messages to process", len(messages))
-		processMessages(ctx, messages, translationService, telegramBot, gmailClient)
+	checkMessages()
+
+	// Sources with push support announce new mail between polls
+	var updates <-chan struct{}
+	if push, ok := svc.source.(PushSource); ok {
+		updates = push.Watch(ctx)
 	}
 
 	// Start regular polling with ticker
 	ticker := time.NewTicker(pollInterval)
 	defer ticker.Stop()
 
+	// Digests and the end of quiet hours run on their own schedules
+	var jobs []scheduledJob
+
+	if svc.digests != nil {
+		jobs = append(jobs, scheduledJob{
+			next: func(time.Time) (time.Time, bool) { return svc.digests.Next() },
+			run:  svc.digests.SendDue,
+		})
+	}
+
+	if svc.quiet != nil {
+		jobs = append(jobs, scheduledJob{
+			next: svc.quiet.NextRelease,
+			run: func(ctx context.Context, now time.Time) {
+				log.Println("Quiet hours ended, checking for held messages...")
+				checkMessages()
+			},
+		})
+	}
+
+	schedule := newScheduler(time.Now(), jobs...)
+	defer schedule.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -140,54 +356,185 @@ func startMessageProcessing(
 
 		case <-ticker.C:
 			log.Println("Checking for new messages...")
+			checkMessages()
 
-			messages, err = gmailClient.GetNewMessages(ctx)
-			if err != nil {
-				log.Printf("Error getting new messages: %v", err)
+		case <-updates:
+			log.Println("New mail announced, checking for new messages...")
+			checkMessages()
 
-				continue
-			}
+		case now := <-schedule.C():
+			schedule.RunDue(ctx, now)
+		}
+	}
+}
 
-			if len(messages) > 0 {
-				log.Printf("Found %d new messages to process", len(messages))
-				processMessages(ctx, messages, translationService, telegramBot, gmailClient)
-			}
+// initializeSource connects to the mailbox selected by config.Source
+func initializeSource(config *Config, state *StateStore) (MailSource, error) {
+	if config.Reply.Enabled && config.Source != "" && config.Source != sourceGmail {
+		return nil, fmt.Errorf("replies from Telegram need the %q source", sourceGmail)
+	}
+
+	switch config.Source {
+	case "", sourceGmail:
+		log.Println("Initializing Gmail client...")
+
+		gmailClient, err := NewGmailClient(context.Background(), config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Gmail client: %w", err)
 		}
+
+		log.Println("Gmail client initialized successfully")
+
+		return gmailClient, nil
+	case sourceIMAP:
+		log.Println("Initializing IMAP client...")
+
+		imapClient, err := NewIMAPClient(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create IMAP client: %w", err)
+		}
+
+		log.Println("IMAP client initialized successfully")
+
+		return imapClient, nil
+	case sourceGraph:
+		log.Println("Initializing Microsoft Graph client...")
+
+		graphClient, err := NewGraphClient(context.Background(), config, state)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Graph client: %w", err)
+		}
+
+		log.Println("Microsoft Graph client initialized successfully")
+
+		return graphClient, nil
+	default:
+		return nil, fmt.Errorf("invalid source %q: use %q, %q or %q", config.Source, sourceGmail, sourceIMAP, sourceGraph)
 	}
 }
 
-func initializeServices(config *Config) (*GmailClient, *TranslationService, *TelegramBot, error) {
-	// Initialize Gmail client
-	log.Println("Initializing Gmail client...")
+// pollIntervalSetting returns the poll interval of the configured source
+func pollIntervalSetting(config *Config) string {
+	switch config.Source {
+	case sourceIMAP:
+		return config.IMAP.PollInterval
+	case sourceGraph:
+		return config.Graph.PollInterval
+	default:
+		return config.Gmail.PollInterval
+	}
+}
+
+// initializeTelegram creates the bot and, when a destination posts as a user, signs in the user account
+func initializeTelegram(config *Config, state *StateStore) (*TelegramBot, error) {
+	log.Println("Initializing Telegram bot...")
 
-	gmailClient, err := NewGmailClient(context.Background(), config)
+	telegramBot, err := NewTelegramBot(config, state)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to create Gmail client: %w", err)
+		return nil, fmt.Errorf("failed to create Telegram bot: %w", err)
 	}
 
-	log.Println("Gmail client initialized successfully")
+	log.Println("Telegram bot initialized successfully")
+
+	if !usesTelegramVia(config, viaUser) {
+		return telegramBot, nil
+	}
+
+	log.Println("Initializing Telegram user client...")
+
+	telegramBot.user, err = NewTelegramUserClient(context.Background(), config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Telegram user client: %w", err)
+	}
+
+	log.Println("Telegram user client initialized successfully")
+
+	return telegramBot, nil
+}
+
+// services are the long-lived clients the forwarder runs with
+type services struct {
+	source      MailSource
+	translation *TranslationService
+	// telegram is nil when neither a route nor replies use the Telegram bot
+	telegram  *TelegramBot
+	notifiers Notifier
+	// digests is nil when no route uses digest delivery
+	digests *Digester
+	// quiet is nil when no route has quiet hours
+	quiet *QuietHours
+	// retry is nil in tests, failing emails are then retried on every poll
+	retry *Retry
+	state *StateStore
+}
+
+func initializeServices(config *Config) (*services, error) {
+	// Load persisted state first, mail sources keep their sync position in it
+	log.Println("Loading state...")
+
+	state, err := NewStateStore(config.State.File)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load state: %w", err)
+	}
+
+	log.Println("State loaded successfully")
+
+	// Initialize mail source
+	source, err := initializeSource(config, state)
+	if err != nil {
+		return nil, err
+	}
 
 	// Initialize translation service
 	log.Println("Initializing translation service...")
 
 	translationService, err := NewTranslationService(config)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to create translation service: %w", err)
+		return nil, fmt.Errorf("failed to create translation service: %w", err)
 	}
 
 	log.Println("Translation service initialized successfully")
 
 	// Initialize Telegram bot
-	log.Println("Initializing Telegram bot...")
+	var telegramBot *TelegramBot
+
+	if needsTelegram(config) || config.Reply.Enabled {
+		telegramBot, err = initializeTelegram(config, state)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	telegramBot, err := NewTelegramBot(config)
+	// Initialize the other delivery sinks
+	notifiers, err := NewNotifiers(config, telegramBot)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to create Telegram bot: %w", err)
+		return nil, fmt.Errorf("failed to create sinks: %w", err)
 	}
 
-	log.Println("Telegram bot initialized successfully")
+	svc := &services{
+		source:      source,
+		translation: translationService,
+		telegram:    telegramBot,
+		notifiers:   notifiers,
+		state:       state,
+	}
+
+	svc.digests, err = NewDigester(config, svc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up digests: %w", err)
+	}
+
+	svc.quiet, err = NewQuietHours(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up quiet hours: %w", err)
+	}
+
+	svc.retry, err = NewRetry(config.Retry, state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up retries: %w", err)
+	}
 
-	return gmailClient, translationService, telegramBot, nil
+	return svc, nil
 }
 
 func main() {
@@ -195,6 +542,7 @@ func main() {
 
 	configPath := flag.String("config", "config.yaml", "Path to configuration file")
 	generateToken := flag.Bool("generate-token", false, "Generate Gmail OAuth token")
+	dryRun := flag.Bool("dry-run", false, "Print posts instead of delivering them and leave emails unmarked")
 	flag.Parse()
 
 	log.Printf("Loading configuration from %s...", *configPath)
@@ -206,8 +554,16 @@ func main() {
 
 	log.Println("Configuration loaded successfully")
 
+	if flag.Arg(0) == "prompt" {
+		if err := runPromptCommand(config, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("Failed to render prompt: %v", err)
+		}
+
+		return
+	}
+
 	// Parse poll interval
-	pollInterval, err := time.ParseDuration(config.Gmail.PollInterval)
+	pollInterval, err := time.ParseDuration(pollIntervalSetting(config))
 	if err != nil {
 		log.Fatalf("Invalid poll interval: %v", err)
 	}
@@ -226,19 +582,59 @@ func main() {
 	defer cancel()
 
 	// Initialize all services
-	gmailClient, translationService, telegramBot, err := initializeServices(config)
+	svc, err := initializeServices(config)
 	if err != nil {
 		cancel()
 		// nolint: gocritic
 		log.Fatalf("Failed to initialize services: %v", err)
 	}
 
+	// A preview is always a dry run
+	if *dryRun || flag.Arg(0) == "preview" {
+		log.Println("Dry run: posts are not delivered and emails are left unmarked")
+
+		if err := enableDryRun(config, svc, os.Stdout); err != nil {
+			cancel()
+			// nolint: gocritic
+			log.Fatalf("Failed to set up dry run: %v", err)
+		}
+	}
+
+	if flag.Arg(0) == "preview" {
+		if err := runPreviewCommand(ctx, config, svc, flag.Args()[1:]); err != nil {
+			cancel()
+			// nolint: gocritic
+			log.Fatalf("Preview failed: %v", err)
+		}
+
+		return
+	}
+
+	if flag.Arg(0) == "backfill" {
+		if err := runBackfillCommand(ctx, svc, flag.Args()[1:], os.Stdout); err != nil {
+			cancel()
+			// nolint: gocritic
+			log.Fatalf("Backfill failed: %v", err)
+		}
+
+		return
+	}
+
 	// Start message processing
 	log.Println("Starting message processing loop...")
 
 	messageProcessor := startMessageProcessing
 
-	go messageProcessor(ctx, pollInterval, gmailClient, translationService, telegramBot)
+	go messageProcessor(ctx, pollInterval, svc)
+
+	// Replies are sent through the Gmail API, initializeServices rejects them for other sources
+	if gmailClient, ok := svc.source.(*GmailClient); ok && config.Reply.Enabled && !*dryRun {
+		log.Println("Starting Telegram reply handler...")
+
+		replyHandler := NewReplyHandler(config, gmailClient, svc.translation, svc.telegram, svc.state)
+
+		go replyHandler.Run(ctx)
+	}
 
 	// Wait for interrupt signal
 	sigChan := make(chan os.Signal, 1)
@@ -90,24 +90,20 @@ func TestProcessMessage(t *testing.T) {
 	// Create test HTTP server
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
 	}))
 	defer server.Close()
 
 	// Create mock services
 	mockTranslationService := &TranslationService{
 		config: &Config{
-			Translation: struct {
-				GeminiAPIKey   string `yaml:"gemini_api_key"`
-				TargetLanguage string `yaml:"target_language"`
-				ModelName      string `yaml:"model_name"`
-				PromptTemplate string `yaml:"prompt_template"`
-			}{
+			Translation: TranslationConfig{
 				TargetLanguage: "en",
 				PromptTemplate: "Translate to {target_language}: {text}",
 			},
 		},
-		translate: func(ctx context.Context, text string) (string, error) {
-			return "Translated: " + text, nil
+		translate: func(ctx context.Context, msg Message) (Translation, error) {
+			return Translation{Content: "Translated: " + msg.Content}, nil
 		},
 	}
 
@@ -129,10 +125,25 @@ func TestProcessMessage(t *testing.T) {
 	// Test processing message
 	ctx := context.Background()
 
-	err := processMessage(ctx, msg, mockTranslationService, mockTelegramBot, mockGmailClient)
+	state, _ := NewStateStore("")
+
+	mockTelegramBot.state = state
+
+	svc := &services{
+		source:      mockGmailClient,
+		translation: mockTranslationService,
+		notifiers:   Notifiers{sinkTelegram: mockTelegramBot},
+		state:       state,
+	}
+
+	err := processMessage(ctx, svc, msg)
 	if err != nil {
 		t.Errorf("processMessage failed: %v", err)
 	}
+
+	if fwd, ok := state.Forwarded(telegramKey(1, 1)); !ok || fwd.GmailID != msg.ID {
+		t.Errorf("Expected forwarded message to be recorded for %s, got %+v", msg.ID, fwd)
+	}
 }
 
 func TestProcessMessages(_ *testing.T) {
@@ -157,24 +168,20 @@ func TestProcessMessages(_ *testing.T) {
 	// Create test HTTP server
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
 	}))
 	defer server.Close()
 
 	// Create mock services
 	mockTranslationService := &TranslationService{
 		config: &Config{
-			Translation: struct {
-				GeminiAPIKey   string `yaml:"gemini_api_key"`
-				TargetLanguage string `yaml:"target_language"`
-				ModelName      string `yaml:"model_name"`
-				PromptTemplate string `yaml:"prompt_template"`
-			}{
+			Translation: TranslationConfig{
 				TargetLanguage: "en",
 				PromptTemplate: "Translate to {target_language}: {text}",
 			},
 		},
-		translate: func(ctx context.Context, text string) (string, error) {
-			return "Translated: " + text, nil
+		translate: func(ctx context.Context, msg Message) (Translation, error) {
+			return Translation{Content: "Translated: " + msg.Content}, nil
 		},
 	}
 
@@ -195,7 +202,13 @@ func TestProcessMessages(_ *testing.T) {
 
 	// Test processing messages
 	ctx := context.Background()
-	processMessages(ctx, messages, mockTranslationService, mockTelegramBot, mockGmailClient)
+	svc := &services{
+		source:      mockGmailClient,
+		translation: mockTranslationService,
+		notifiers:   Notifiers{sinkTelegram: mockTelegramBot},
+	}
+
+	processMessages(ctx, svc, messages)
 }
 
 func TestStartMessageProcessing(_ *testing.T) {
@@ -215,6 +228,7 @@ func TestStartMessageProcessing(_ *testing.T) {
 		// Simulate a small delay to test timeout handling
 		time.Sleep(10 * time.Millisecond)
 		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
 	}))
 	defer server.Close()
 
@@ -231,17 +245,7 @@ func TestStartMessageProcessing(_ *testing.T) {
 		service: mockService,
 		labelID: "test-label",
 		config: &Config{
-			Gmail: struct {
-				CredentialsFile string `yaml:"credentials_file"`
-				TokenFile       string `yaml:"token_file"`
-				PollInterval    string `yaml:"poll_interval"`
-				ForwardedLabel  string `yaml:"forwarded_label"`
-				Filter          struct {
-					From            []string `yaml:"from"`
-					SubjectKeywords []string `yaml:"subject_keywords"`
-					ContentKeywords []string `yaml:"content_keywords"`
-				} `yaml:"filter"`
-			}{
+			Gmail: GmailConfig{
 				ForwardedLabel: "test-label",
 			},
 		},
@@ -259,18 +263,13 @@ func TestStartMessageProcessing(_ *testing.T) {
 
 	mockTranslationService := &TranslationService{
 		config: &Config{
-			Translation: struct {
-				GeminiAPIKey   string `yaml:"gemini_api_key"`
-				TargetLanguage string `yaml:"target_language"`
-				ModelName      string `yaml:"model_name"`
-				PromptTemplate string `yaml:"prompt_template"`
-			}{
+			Translation: TranslationConfig{
 				TargetLanguage: "en",
 				PromptTemplate: "Translate to {target_language}: {text}",
 			},
 		},
-		translate: func(ctx context.Context, text string) (string, error) {
-			return "Translated: " + text, nil
+		translate: func(ctx context.Context, msg Message) (Translation, error) {
+			return Translation{Content: "Translated: " + msg.Content}, nil
 		},
 	}
 
@@ -287,5 +286,9 @@ func TestStartMessageProcessing(_ *testing.T) {
 	defer cancel()
 
 	// Start message processing with a short poll interval
-	startMessageProcessing(ctx, 50*time.Millisecond, mockGmailClient, mockTranslationService, mockTelegramBot)
+	startMessageProcessing(ctx, 50*time.Millisecond, &services{
+		source:      mockGmailClient,
+		translation: mockTranslationService,
+		notifiers:   Notifiers{sinkTelegram: mockTelegramBot},
+	})
 }
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+const (
+	providerGemini       = "gemini"
+	providerOpenAI       = "openai"
+	defaultOpenAIBaseURL = "https://api.openai.com/v1"
+	maxModelErrorBodyLen = 200
+)
+
+// ModelConfig is one model of the translation fallback chain
+type ModelConfig struct {
+	Name string `yaml:"name"`
+	// Provider is "gemini" (default) or "openai" for any OpenAI compatible chat completions API
+	Provider string `yaml:"provider"`
+	// Timeout bounds every request to this model, e.g. "30s"; none by default
+	Timeout string `yaml:"timeout"`
+	// BaseURL and APIKey are used by the openai provider, BaseURL defaults to the OpenAI API
+	BaseURL string `yaml:"base_url"`
+	APIKey  string `yaml:"api_key"`
+}
+
+// chainModel is a model of the fallback chain ready to be asked
+type chainModel struct {
+	name     string
+	timeout  time.Duration
+	generate func(ctx context.Context, prompt string, schema *genai.Schema) (string, error)
+	// countTokens is nil for models that cannot count tokens
+	countTokens func(ctx context.Context, text string) (int, error)
+}
+
+// modelConfigs returns translation.models, or model_name alone when there is no chain
+func modelConfigs(config TranslationConfig) []ModelConfig {
+	if len(config.Models) > 0 {
+		return config.Models
+	}
+
+	name := config.ModelName
+	if name == "" {
+		name = defaultModelName
+	}
+
+	return []ModelConfig{{Name: name}}
+}
+
+// newModels sets up the fallback chain; the Gemini client must exist when a model uses it
+func (s *TranslationService) newModels() ([]chainModel, error) {
+	var models []chainModel
+
+	for _, config := range modelConfigs(s.config.Translation) {
+		if config.Name == "" {
+			return nil, fmt.Errorf("translation model without a name")
+		}
+
+		model := chainModel{name: config.Name}
+
+		if config.Timeout != "" {
+			timeout, err := time.ParseDuration(config.Timeout)
+			if err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("invalid timeout %q of model %s", config.Timeout, config.Name)
+			}
+
+			model.timeout = timeout
+		}
+
+		switch config.Provider {
+		case "", providerGemini:
+			model.generate = s.geminiGenerate(config.Name)
+			model.countTokens = s.geminiCountTokens(config.Name)
+		case providerOpenAI:
+			if config.APIKey == "" {
+				return nil, fmt.Errorf("model %s needs an api_key", config.Name)
+			}
+
+			client := &openAIClient{
+				client:  &http.Client{},
+				baseURL: strings.TrimSuffix(config.BaseURL, "/"),
+				apiKey:  config.APIKey,
+				model:   config.Name,
+				config:  s.config.Translation,
+			}
+			if client.baseURL == "" {
+				client.baseURL = defaultOpenAIBaseURL
+			}
+
+			model.generate = client.generate
+		default:
+			return nil, fmt.Errorf("unknown provider %q of model %s: use %q or %q",
+				config.Provider, config.Name, providerGemini, providerOpenAI)
+		}
+
+		models = append(models, model)
+	}
+
+	return models, nil
+}
+
+// usesGemini reports whether a model of the chain runs on Gemini
+func usesGemini(config TranslationConfig) bool {
+	return slices.ContainsFunc(modelConfigs(config), func(model ModelConfig) bool {
+		return model.Provider == "" || model.Provider == providerGemini
+	})
+}
+
+// generateWith asks the models of the chain in order until one answers. schema asks for JSON of
+// that shape; nil asks for text.
+func (s *TranslationService) generateWith(ctx context.Context, prompt string, schema *genai.Schema) (string, error) {
+	var err error
+
+	for i, model := range s.models {
+		var text string
+
+		text, err = model.call(ctx, prompt, schema)
+		if err == nil {
+			recordModel(ctx, model.name)
+
+			return text, nil
+		}
+
+		// Nothing is left to try once the email itself was cancelled
+		if ctx.Err() != nil {
+			return "", err
+		}
+
+		if i < len(s.models)-1 {
+			log.Printf("Model %s failed, falling back to %s: %v", model.name, s.models[i+1].name, err)
+		}
+	}
+
+	if err == nil {
+		return "", fmt.Errorf("no translation model configured")
+	}
+
+	return "", err
+}
+
+func (m chainModel) call(ctx context.Context, prompt string, schema *genai.Schema) (string, error) {
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+
+	text, err := m.generate(ctx, prompt, schema)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", m.name, err)
+	}
+
+	return text, nil
+}
+
+// count counts the tokens of text within the model's timeout
+func (m chainModel) count(ctx context.Context, text string) (int, error) {
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+
+	tokens, err := m.countTokens(ctx, text)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", m.name, err)
+	}
+
+	return tokens, nil
+}
+
+// geminiCountTokens counts tokens with the Gemini model name
+func (s *TranslationService) geminiCountTokens(name string) func(ctx context.Context, text string) (int, error) {
+	return func(ctx context.Context, text string) (int, error) {
+		resp, err := s.client.GenerativeModel(name).CountTokens(ctx, genai.Text(text))
+		if err != nil {
+			return 0, generationError("failed to count tokens", err)
+		}
+
+		return int(resp.TotalTokens), nil
+	}
+}
+
+// geminiGenerate asks the Gemini model name with the generation and safety settings applied
+func (s *TranslationService) geminiGenerate(name string) func(ctx context.Context, prompt string, schema *genai.Schema) (string, error) {
+	return func(ctx context.Context, prompt string, schema *genai.Schema) (string, error) {
+		model := s.client.GenerativeModel(name)
+		model.SafetySettings = s.safety
+
+		if s.config.Translation.Temperature != nil {
+			model.SetTemperature(*s.config.Translation.Temperature)
+		}
+
+		if s.config.Translation.MaxOutputTokens > 0 {
+			model.SetMaxOutputTokens(s.config.Translation.MaxOutputTokens)
+		}
+
+		if schema != nil {
+			model.ResponseMIMEType = "application/json"
+			model.ResponseSchema = schema
+		}
+
+		resp, err := model.GenerateContent(ctx, genai.Text(prompt))
+		if err != nil {
+			return "", generationError("failed to generate content", err)
+		}
+
+		return responseText(resp)
+	}
+}
+
+// openAIClient talks to an OpenAI compatible chat completions API
+type openAIClient struct {
+	client  *http.Client
+	baseURL string
+	apiKey  string
+	model   string
+	config  TranslationConfig
+}
+
+type openAIRequest struct {
+	Model          string          `json:"model"`
+	Messages       []openAIMessage `json:"messages"`
+	Temperature    *float32        `json:"temperature,omitempty"`
+	MaxTokens      int32           `json:"max_tokens,omitempty"`
+	ResponseFormat map[string]any  `json:"response_format,omitempty"`
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIResponse struct {
+	Choices []struct {
+		Message      openAIMessage `json:"message"`
+		FinishReason string        `json:"finish_reason"`
+	} `json:"choices"`
+}
+
+func (c *openAIClient) generate(ctx context.Context, prompt string, schema *genai.Schema) (string, error) {
+	payload := openAIRequest{
+		Model:       c.model,
+		Messages:    []openAIMessage{{Role: "user", Content: prompt}},
+		Temperature: c.config.Temperature,
+		MaxTokens:   c.config.MaxOutputTokens,
+	}
+
+	if schema != nil {
+		payload.ResponseFormat = map[string]any{
+			"type":        "json_schema",
+			"json_schema": map[string]any{"name": "answer", "schema": jsonSchema(schema)},
+		}
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/chat/completions", bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("%w: %v", errTransient, err)
+		}
+
+		return "", fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %v", err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return "", fmt.Errorf("%w: %s", errQuotaExhausted, truncateBody(body))
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return "", fmt.Errorf("%w: status %d: %s", errTransient, resp.StatusCode, truncateBody(body))
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("status %d: %s", resp.StatusCode, truncateBody(body))
+	}
+
+	var result openAIResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	if len(result.Choices) == 0 {
+		return "", errEmptyResponse
+	}
+
+	choice := result.Choices[0]
+
+	switch choice.FinishReason {
+	case "length":
+		return "", errResponseTruncated
+	case "content_filter":
+		return "", errResponseBlocked
+	}
+
+	text := strings.TrimSpace(choice.Message.Content)
+	if text == "" {
+		return "", errEmptyResponse
+	}
+
+	return text, nil
+}
+
+func truncateBody(body []byte) string {
+	if len(body) > maxModelErrorBodyLen {
+		return string(body[:maxModelErrorBodyLen]) + "..."
+	}
+
+	return string(body)
+}
+
+// jsonSchema converts a Gemini schema into JSON Schema
+func jsonSchema(schema *genai.Schema) map[string]any {
+	types := map[genai.Type]string{
+		genai.TypeString:  "string",
+		genai.TypeNumber:  "number",
+		genai.TypeInteger: "integer",
+		genai.TypeBoolean: "boolean",
+		genai.TypeArray:   "array",
+		genai.TypeObject:  "object",
+	}
+
+	result := map[string]any{"type": types[schema.Type]}
+
+	if schema.Description != "" {
+		result["description"] = schema.Description
+	}
+
+	if len(schema.Enum) > 0 {
+		result["enum"] = schema.Enum
+	}
+
+	if schema.Items != nil {
+		result["items"] = jsonSchema(schema.Items)
+	}
+
+	if len(schema.Properties) > 0 {
+		properties := make(map[string]any, len(schema.Properties))
+		for name, property := range schema.Properties {
+			properties[name] = jsonSchema(property)
+		}
+
+		result["properties"] = properties
+	}
+
+	if len(schema.Required) > 0 {
+		result["required"] = schema.Required
+	}
+
+	return result
+}
+
+type modelUsageKey struct{}
+
+// modelUsage collects the models that answered while one email was processed
+type modelUsage struct {
+	mu     sync.Mutex
+	models []string
+}
+
+// withModelUsage returns a context whose model calls are recorded in the returned usage
+func withModelUsage(ctx context.Context) (context.Context, *modelUsage) {
+	usage := &modelUsage{}
+
+	return context.WithValue(ctx, modelUsageKey{}, usage), usage
+}
+
+// recordModel notes that the model name answered a call made with ctx
+func recordModel(ctx context.Context, names ...string) {
+	usage, ok := ctx.Value(modelUsageKey{}).(*modelUsage)
+	if !ok {
+		return
+	}
+
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+
+	for _, name := range names {
+		if name != "" && !slices.Contains(usage.models, name) {
+			usage.models = append(usage.models, name)
+		}
+	}
+}
+
+// Models returns the models that answered, in the order they were first used
+func (u *modelUsage) Models() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return slices.Clone(u.models)
+}
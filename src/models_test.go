@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestGenerateWithFallback(t *testing.T) {
+	var asked []string
+
+	model := func(name string, err error, delay time.Duration) chainModel {
+		return chainModel{
+			name:    name,
+			timeout: 20 * time.Millisecond,
+			generate: func(ctx context.Context, prompt string, schema *genai.Schema) (string, error) {
+				asked = append(asked, name)
+
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return "", ctx.Err()
+				}
+
+				if err != nil {
+					return "", err
+				}
+
+				return name + ": " + prompt, nil
+			},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		models    []chainModel
+		want      string
+		wantAsked string
+		wantErr   error
+	}{
+		{
+			name:      "first model answers",
+			models:    []chainModel{model("a", nil, 0), model("b", nil, 0)},
+			want:      "a: hi",
+			wantAsked: "a",
+		},
+		{
+			name:      "quota falls back",
+			models:    []chainModel{model("a", errQuotaExhausted, 0), model("b", nil, 0)},
+			want:      "b: hi",
+			wantAsked: "a,b",
+		},
+		{
+			name:      "timeout falls back",
+			models:    []chainModel{model("a", nil, time.Second), model("b", nil, 0)},
+			want:      "b: hi",
+			wantAsked: "a,b",
+		},
+		{
+			name:      "last error is returned",
+			models:    []chainModel{model("a", errQuotaExhausted, 0), model("b", errTransient, 0)},
+			wantAsked: "a,b",
+			wantErr:   errTransient,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asked = nil
+			service := &TranslationService{config: &Config{}, models: tt.models}
+
+			ctx, usage := withModelUsage(context.Background())
+
+			got, err := service.generate(ctx, "hi")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("generate() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if got != tt.want || strings.Join(asked, ",") != tt.wantAsked {
+				t.Errorf("generate() = %q after asking %v", got, asked)
+			}
+
+			if tt.want != "" && strings.Join(usage.Models(), ",") != tt.want[:1] {
+				t.Errorf("recorded models = %v", usage.Models())
+			}
+		})
+	}
+}
+
+func TestOpenAIClient(t *testing.T) {
+	var request openAIRequest
+
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    string
+		wantErr error
+	}{
+		{name: "answer", status: 200, body: `{"choices":[{"message":{"content":" Hello "},"finish_reason":"stop"}]}`, want: "Hello"},
+		{name: "rate limited", status: 429, body: `{"error":{}}`, wantErr: errQuotaExhausted},
+		{name: "overloaded", status: 503, wantErr: errTransient},
+		{name: "cut off", status: 200, body: `{"choices":[{"message":{"content":"Hel"},"finish_reason":"length"}]}`, wantErr: errResponseTruncated},
+		{name: "filtered", status: 200, body: `{"choices":[{"finish_reason":"content_filter"}]}`, wantErr: errResponseBlocked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/chat/completions" || r.Header.Get("Authorization") != "Bearer key" {
+					t.Errorf("request to %s with %q", r.URL.Path, r.Header.Get("Authorization"))
+				}
+
+				_ = json.NewDecoder(r.Body).Decode(&request)
+
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			client := &openAIClient{client: server.Client(), baseURL: server.URL + "/v1", apiKey: "key", model: "gpt-4o-mini"}
+
+			got, err := client.generate(context.Background(), "Sveiki", extractionSchema)
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Fatalf("generate() = %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+
+			if request.Model != "gpt-4o-mini" || request.Messages[0].Content != "Sveiki" ||
+				request.ResponseFormat["type"] != "json_schema" {
+				t.Errorf("request = %+v", request)
+			}
+		})
+	}
+}
+
+func TestNewModels(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TranslationConfig
+		want    string
+		wantErr bool
+	}{
+		{name: "default", want: defaultModelName},
+		{name: "model_name", config: TranslationConfig{ModelName: "gemini-1.5-pro"}, want: "gemini-1.5-pro"},
+		{
+			name: "chain",
+			config: TranslationConfig{Models: []ModelConfig{
+				{Name: "gemini-2.0-flash", Timeout: "30s"},
+				{Name: "gpt-4o-mini", Provider: providerOpenAI, APIKey: "key"},
+			}},
+			want: "gemini-2.0-flash,gpt-4o-mini",
+		},
+		{name: "invalid timeout", config: TranslationConfig{Models: []ModelConfig{{Name: "a", Timeout: "soon"}}}, wantErr: true},
+		{name: "unknown provider", config: TranslationConfig{Models: []ModelConfig{{Name: "a", Provider: "x"}}}, wantErr: true},
+		{name: "openai without key", config: TranslationConfig{Models: []ModelConfig{{Name: "a", Provider: providerOpenAI}}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &TranslationService{config: &Config{Translation: tt.config}}
+
+			models, err := service.newModels()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newModels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var names []string
+			for _, model := range models {
+				names = append(names, model.name)
+			}
+
+			if strings.Join(names, ",") != tt.want {
+				t.Errorf("newModels() = %v, want %s", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessMessageModelFooter(t *testing.T) {
+	var sent Notification
+
+	svc := &services{
+		source: &GmailClient{markAsForwarded: func(ctx context.Context, messageID string) error { return nil }},
+		translation: &TranslationService{config: &Config{}, translate: func(ctx context.Context, msg Message) (Translation, error) {
+			recordModel(ctx, "gemini-2.0-flash")
+
+			return Translation{Content: "Hello"}, nil
+		}},
+		notifiers: Notifiers{sinkTelegram: notifierFunc(func(ctx context.Context, n Notification) error {
+			sent = n
+
+			return nil
+		})},
+	}
+
+	if err := processMessage(context.Background(), svc, Message{ID: "m1", Content: "Sveiki"}); err != nil {
+		t.Fatalf("processMessage() error = %v", err)
+	}
+
+	if sent.Content != "Hello\n\n🤖 gemini-2.0-flash" || sent.Model != "gemini-2.0-flash" {
+		t.Errorf("sent = %q, model %q", sent.Content, sent.Model)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Sink types of the sinks section; the telegram section is always available as "telegram"
+const (
+	sinkTelegram = "telegram"
+	sinkSlack    = "slack"
+	sinkDiscord  = "discord"
+	sinkMatrix   = "matrix"
+	sinkNtfy     = "ntfy"
+	sinkWebhook  = "webhook"
+)
+
+// markdownRe matches the Telegram Markdown the forwarder produces: [text](url) links and *bold* text
+var markdownRe = regexp.MustCompile(`\[([^\]\n]*)\]\(([^)\s]*)\)|\*([^*\n]+)\*`)
+
+// SinkConfig configures a delivery target other than the Telegram bot
+type SinkConfig struct {
+	Name string `yaml:"name"`
+	// Type is "slack", "discord", "matrix", "ntfy" or "webhook"
+	Type string `yaml:"type"`
+	// URL is the webhook URL for slack, discord and webhook, the homeserver for matrix
+	// and the server for ntfy (https://ntfy.sh when empty)
+	URL string `yaml:"url"`
+	// Token is the Matrix access token or an optional ntfy access token
+	Token string `yaml:"token"`
+	// RoomID is the Matrix room, e.g. "!abc:matrix.org"
+	RoomID string `yaml:"room_id"`
+	// Topic is the ntfy topic
+	Topic string `yaml:"topic"`
+	// Headers are added to every request, e.g. for webhook authentication
+	Headers map[string]string `yaml:"headers"`
+}
+
+// Notification is one email ready for delivery, formatted the same way for every sink
+type Notification struct {
+	// Message is the email; its Route selects the sinks
+	Message Message
+	// Content is the translated body in Telegram Markdown
+	Content string
+	// Original is the untranslated body shown next to the translation, if any
+	Original string
+	// Silent asks sinks that support it to deliver without a notification sound
+	Silent bool
+	// Events are the calendar events found in the email, attached as an .ics file on Telegram
+	Events []CalendarEvent
+	// Model names the models that produced Content, empty when it was not translated
+	Model string
+}
+
+// Notifier delivers notifications to one chat or push service
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// Notifiers maps sink names to their notifier
+type Notifiers map[string]Notifier
+
+// NewNotifiers creates the sinks of the sinks section next to the Telegram bot, which may be
+// nil when no route delivers to Telegram
+func NewNotifiers(config *Config, telegramBot *TelegramBot) (Notifiers, error) {
+	notifiers := Notifiers{}
+	if telegramBot != nil {
+		notifiers[sinkTelegram] = telegramBot
+	}
+
+	for _, sink := range config.Sinks {
+		if sink.Name == "" || sink.Name == sinkTelegram {
+			return nil, fmt.Errorf("invalid sink name %q", sink.Name)
+		}
+
+		if _, ok := notifiers[sink.Name]; ok {
+			return nil, fmt.Errorf("duplicate sink name %q", sink.Name)
+		}
+
+		notifier, err := newSinkNotifier(sink)
+		if err != nil {
+			return nil, fmt.Errorf("sink %q: %w", sink.Name, err)
+		}
+
+		notifiers[sink.Name] = notifier
+	}
+
+	for _, route := range routeSinkLists(config) {
+		for _, name := range route.sinks {
+			if _, ok := notifiers[name]; !ok {
+				return nil, fmt.Errorf("route %q delivers to unknown sink %q", route.name, name)
+			}
+		}
+	}
+
+	return notifiers, nil
+}
+
+// needsTelegram reports whether the default destination or a route delivers to Telegram
+func needsTelegram(config *Config) bool {
+	for _, route := range routeSinkLists(config) {
+		if slices.Contains(route.sinks, sinkTelegram) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type routeSinks struct {
+	name  string
+	sinks []string
+}
+
+// routeSinkLists lists the sinks of every route, or of the default destination without routes
+func routeSinkLists(config *Config) []routeSinks {
+	if len(config.Routes) == 0 {
+		return []routeSinks{{name: defaultRouteName, sinks: destinationSinks(nil)}}
+	}
+
+	result := make([]routeSinks, 0, len(config.Routes))
+	for i := range config.Routes {
+		result = append(result, routeSinks{name: routeName(&config.Routes[i]), sinks: destinationSinks(&config.Routes[i])})
+	}
+
+	return result
+}
+
+// destinationSinks returns the sinks a route delivers to; Telegram unless the route says otherwise
+func destinationSinks(route *RouteConfig) []string {
+	if route == nil || len(route.Destination.Sinks) == 0 {
+		return []string{sinkTelegram}
+	}
+
+	return route.Destination.Sinks
+}
+
+// Notify delivers n to every sink of its route. Failing sinks are logged; an error is only
+// returned when no sink accepted the notification, so the email is retried without
+// duplicating it in the sinks that worked.
+func (n Notifiers) Notify(ctx context.Context, notification Notification) error {
+	var errs []error
+
+	sinks := destinationSinks(notification.Message.Route)
+
+	for _, name := range sinks {
+		notifier, ok := n[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown sink %q", name))
+
+			continue
+		}
+
+		if err := notifier.Notify(ctx, notification); err != nil {
+			if len(sinks) > 1 {
+				log.Printf("Error sending message to %s: %v", name, err)
+			}
+
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	if len(errs) == len(sinks) {
+		return errors.Join(errs...)
+	}
+
+	return nil
+}
+
+// formatBody lays out the date, sender and content of an email in Telegram Markdown.
+// Every sink renders the same layout below its own title.
+func formatBody(date, from, content, originalContent string) string {
+	body := fmt.Sprintf("📅 %s\n", date)
+
+	// Digests have no single sender
+	if from != "" {
+		body += fmt.Sprintf("📧 From: %s\n", from)
+	}
+
+	body += "\n"
+
+	if originalContent != "" {
+		body += fmt.Sprintf("🇷🇺 Translation:\n%s\n\n", content)
+		body += fmt.Sprintf("🇬🇧 Original:\n%s", originalContent)
+	} else {
+		body += content
+	}
+
+	return body
+}
+
+// formatNotification renders the bold subject and the body of n in Telegram Markdown
+func formatNotification(n Notification) string {
+	msg := n.Message
+
+	return fmt.Sprintf("*%s*\n\n", strings.ReplaceAll(msg.Subject, "*", "")) +
+		formatBody(msg.Date, msg.From, n.Content, n.Original)
+}
+
+// markdownRenderer converts Telegram Markdown into the markup of another service
+type markdownRenderer struct {
+	text func(s string) string
+	bold func(s string) string
+	link func(text, url string) string
+}
+
+func (r markdownRenderer) render(markdown string) string {
+	var b strings.Builder
+
+	last := 0
+	for _, m := range markdownRe.FindAllStringSubmatchIndex(markdown, -1) {
+		b.WriteString(r.text(markdown[last:m[0]]))
+
+		if m[2] >= 0 {
+			b.WriteString(r.link(markdown[m[2]:m[3]], markdown[m[4]:m[5]]))
+		} else {
+			b.WriteString(r.bold(markdown[m[6]:m[7]]))
+		}
+
+		last = m[1]
+	}
+
+	b.WriteString(r.text(markdown[last:]))
+
+	return b.String()
+}
+
+// plainRenderer drops the markup and keeps link targets readable
+var plainRenderer = markdownRenderer{
+	text: func(s string) string { return s },
+	bold: func(s string) string { return s },
+	link: func(text, url string) string {
+		if text == "" || text == url {
+			return url
+		}
+
+		return text + " (" + url + ")"
+	},
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type notifierFunc func(ctx context.Context, n Notification) error
+
+func (f notifierFunc) Notify(ctx context.Context, n Notification) error {
+	return f(ctx, n)
+}
+
+var testNotification = Notification{
+	Message: Message{
+		ID:        "m1",
+		ThreadID:  "t1",
+		MessageID: "<m1@example.com>",
+		Subject:   "Trip *tomorrow*",
+		From:      "School <office@school.example.com>",
+		Date:      "Fri, 28 Mar 2025 14:49:17 +0000",
+		Route:     &RouteConfig{Name: "school"},
+	},
+	Content: "*Bus* leaves at 8 & returns <5pm>\nSee [the plan](https://school.example.com/plan)",
+}
+
+func TestMarkdownRenderers(t *testing.T) {
+	input := "*Bus* at 8 & <5pm>\n[plan](https://x.example/p?a=1&b=2) [](https://x.example)"
+
+	tests := []struct {
+		name     string
+		renderer markdownRenderer
+		want     string
+	}{
+		{
+			name:     "plain",
+			renderer: plainRenderer,
+			want:     "Bus at 8 & <5pm>\nplan (https://x.example/p?a=1&b=2) https://x.example",
+		},
+		{
+			name:     "slack",
+			renderer: slackRenderer,
+			want:     "*Bus* at 8 &amp; &lt;5pm&gt;\n<https://x.example/p?a=1&b=2|plan> <https://x.example>",
+		},
+		{
+			name:     "commonmark",
+			renderer: commonMarkRenderer,
+			want:     "**Bus** at 8 & <5pm>\n[plan](https://x.example/p?a=1&b=2) https://x.example",
+		},
+		{
+			name:     "matrix html",
+			renderer: matrixHTMLRenderer,
+			want: "<b>Bus</b> at 8 &amp; &lt;5pm&gt;<br>" +
+				`<a href="https://x.example/p?a=1&amp;b=2">plan</a> <a href="https://x.example">https://x.example</a>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.renderer.render(input); got != tt.want {
+				t.Errorf("render() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+type sinkRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   map[string]any
+}
+
+// newSinkServer stands in for a chat service and records the requests it receives
+func newSinkServer(t *testing.T, status int) (*httptest.Server, *[]sinkRequest) {
+	t.Helper()
+
+	var requests []sinkRequest
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+
+		var body map[string]any
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("request body is not JSON: %v", err)
+		}
+
+		requests = append(requests, sinkRequest{method: r.Method, path: r.URL.EscapedPath(), header: r.Header, body: body})
+
+		w.WriteHeader(status)
+
+		if status >= http.StatusBadRequest {
+			io.WriteString(w, `{"error":"invalid token"}`)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func TestSinkNotifiers(t *testing.T) {
+	tests := []struct {
+		name  string
+		sink  SinkConfig
+		check func(t *testing.T, req sinkRequest)
+	}{
+		{
+			name: "slack",
+			sink: SinkConfig{Type: sinkSlack},
+			check: func(t *testing.T, req sinkRequest) {
+				text, _ := req.body["text"].(string)
+				if !strings.HasPrefix(text, "*Trip tomorrow*\n\n📅 Fri, 28 Mar 2025") ||
+					!strings.Contains(text, "School &lt;office@school.example.com&gt;") ||
+					!strings.Contains(text, "<https://school.example.com/plan|the plan>") {
+					t.Errorf("slack text = %q", text)
+				}
+			},
+		},
+		{
+			name: "discord",
+			sink: SinkConfig{Type: sinkDiscord},
+			check: func(t *testing.T, req sinkRequest) {
+				content, _ := req.body["content"].(string)
+				if !strings.HasPrefix(content, "**Trip tomorrow**") || !strings.Contains(content, "**Bus** leaves") {
+					t.Errorf("discord content = %q", content)
+				}
+
+				if mentions, _ := req.body["allowed_mentions"].(map[string]any); mentions == nil {
+					t.Error("discord request does not restrict mentions")
+				}
+			},
+		},
+		{
+			name: "matrix",
+			sink: SinkConfig{Type: sinkMatrix, Token: "matrix-token", RoomID: "!room:example.org"},
+			check: func(t *testing.T, req sinkRequest) {
+				if req.method != http.MethodPut || req.path != "/_matrix/client/v3/rooms/%21room:example.org/send/m.room.message/mail-m1" {
+					t.Errorf("matrix request = %s %s", req.method, req.path)
+				}
+
+				if got := req.header.Get("Authorization"); got != "Bearer matrix-token" {
+					t.Errorf("matrix Authorization = %q", got)
+				}
+
+				body, _ := req.body["body"].(string)
+				formatted, _ := req.body["formatted_body"].(string)
+
+				if !strings.Contains(body, "the plan (https://school.example.com/plan)") ||
+					!strings.HasPrefix(formatted, "<b>Trip tomorrow</b><br><br>") {
+					t.Errorf("matrix body = %q, formatted_body = %q", body, formatted)
+				}
+			},
+		},
+		{
+			name: "ntfy",
+			sink: SinkConfig{Type: sinkNtfy, Topic: "family-mail", Token: "tk_123"},
+			check: func(t *testing.T, req sinkRequest) {
+				if req.body["topic"] != "family-mail" || req.body["title"] != "Trip *tomorrow*" || req.body["markdown"] != true {
+					t.Errorf("ntfy body = %v", req.body)
+				}
+
+				if got := req.header.Get("Authorization"); got != "Bearer tk_123" {
+					t.Errorf("ntfy Authorization = %q", got)
+				}
+			},
+		},
+		{
+			name: "webhook",
+			sink: SinkConfig{Type: sinkWebhook, Headers: map[string]string{"X-Api-Key": "secret"}},
+			check: func(t *testing.T, req sinkRequest) {
+				if req.body["id"] != "m1" || req.body["route"] != "school" || req.body["content"] != testNotification.Content {
+					t.Errorf("webhook body = %v", req.body)
+				}
+
+				if got := req.header.Get("X-Api-Key"); got != "secret" {
+					t.Errorf("webhook X-Api-Key = %q", got)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newSinkServer(t, http.StatusOK)
+
+			tt.sink.Name = tt.name
+			tt.sink.URL = server.URL
+
+			notifier, err := newSinkNotifier(tt.sink)
+			if err != nil {
+				t.Fatalf("newSinkNotifier() error = %v", err)
+			}
+
+			if err := notifier.Notify(context.Background(), testNotification); err != nil {
+				t.Fatalf("Notify() error = %v", err)
+			}
+
+			if len(*requests) != 1 {
+				t.Fatalf("server got %d requests, want 1", len(*requests))
+			}
+
+			tt.check(t, (*requests)[0])
+		})
+	}
+}
+
+func TestSinkNotifierError(t *testing.T) {
+	server, _ := newSinkServer(t, http.StatusForbidden)
+
+	notifier, err := newSinkNotifier(SinkConfig{Name: "hook", Type: sinkWebhook, URL: server.URL})
+	if err != nil {
+		t.Fatalf("newSinkNotifier() error = %v", err)
+	}
+
+	err = notifier.Notify(context.Background(), testNotification)
+	if err == nil || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "invalid token") {
+		t.Errorf("Notify() error = %v, want status and response body", err)
+	}
+}
+
+func TestNotifiersNotify(t *testing.T) {
+	var delivered []string
+
+	working := func(name string) Notifier {
+		return notifierFunc(func(ctx context.Context, n Notification) error {
+			delivered = append(delivered, name)
+
+			return nil
+		})
+	}
+
+	failing := notifierFunc(func(ctx context.Context, n Notification) error {
+		return errors.New("unavailable")
+	})
+
+	notifiers := Notifiers{sinkTelegram: working(sinkTelegram), "slack": working("slack"), "down": failing}
+
+	tests := []struct {
+		name          string
+		route         *RouteConfig
+		wantDelivered string
+		wantErr       bool
+	}{
+		{name: "default route", route: nil, wantDelivered: "telegram"},
+		{
+			name:          "several sinks",
+			route:         &RouteConfig{Destination: DestinationConfig{Sinks: []string{"slack", sinkTelegram}}},
+			wantDelivered: "slack,telegram",
+		},
+		{
+			name:          "one sink fails",
+			route:         &RouteConfig{Destination: DestinationConfig{Sinks: []string{"down", "slack"}}},
+			wantDelivered: "slack",
+		},
+		{
+			name:    "all sinks fail",
+			route:   &RouteConfig{Destination: DestinationConfig{Sinks: []string{"down", "missing"}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delivered = nil
+
+			err := notifiers.Notify(context.Background(), Notification{Message: Message{Route: tt.route}})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Notify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got := strings.Join(delivered, ","); got != tt.wantDelivered {
+				t.Errorf("delivered to %q, want %q", got, tt.wantDelivered)
+			}
+		})
+	}
+}
+
+func TestNewNotifiers(t *testing.T) {
+	slack := SinkConfig{Name: "team", Type: sinkSlack, URL: "https://hooks.slack.com/services/x"}
+
+	tests := []struct {
+		name     string
+		config   *Config
+		telegram bool
+		wantErr  bool
+	}{
+		{name: "telegram only", config: &Config{}, telegram: true},
+		{
+			name: "route to a sink without telegram",
+			config: &Config{
+				Sinks:  []SinkConfig{slack},
+				Routes: []RouteConfig{{Name: "all", Destination: DestinationConfig{Sinks: []string{"team"}}}},
+			},
+		},
+		{name: "default route needs telegram", config: &Config{Sinks: []SinkConfig{slack}}, wantErr: true},
+		{
+			name: "unknown sink",
+			config: &Config{
+				Routes: []RouteConfig{{Name: "all", Destination: DestinationConfig{Sinks: []string{"team"}}}},
+			},
+			telegram: true,
+			wantErr:  true,
+		},
+		{name: "duplicate name", config: &Config{Sinks: []SinkConfig{slack, slack}}, telegram: true, wantErr: true},
+		{
+			name:     "reserved name",
+			config:   &Config{Sinks: []SinkConfig{{Name: sinkTelegram, Type: sinkSlack, URL: "https://x"}}},
+			telegram: true,
+			wantErr:  true,
+		},
+		{
+			name:     "unknown type",
+			config:   &Config{Sinks: []SinkConfig{{Name: "sms", Type: "sms"}}},
+			telegram: true,
+			wantErr:  true,
+		},
+		{
+			name:     "matrix without room",
+			config:   &Config{Sinks: []SinkConfig{{Name: "m", Type: sinkMatrix, URL: "https://matrix.org", Token: "t"}}},
+			telegram: true,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var bot *TelegramBot
+			if tt.telegram {
+				bot = &TelegramBot{}
+			}
+
+			if _, err := NewNotifiers(tt.config, bot); (err != nil) != tt.wantErr {
+				t.Errorf("NewNotifiers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
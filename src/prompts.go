@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"unicode"
+)
+
+// PromptData holds the variables of prompt templates, e.g. {{.Subject}}
+type PromptData struct {
+	TargetLanguage string
+	// Text is the email body, or the part of it being translated, or the reply for the reply prompt
+	Text    string
+	Subject string
+	From    string
+	Date    string
+	// Language is the language the email seems to be written in, empty when unsure
+	Language string
+	Route    string
+	Labels   []string
+	// Original is the email a reply answers, only set for the reply prompt
+	Original string
+}
+
+// legacyPlaceholders turns the {variables} of earlier configs into template actions
+var legacyPlaceholders = strings.NewReplacer(
+	"{target_language}", "{{.TargetLanguage}}",
+	"{text}", "{{.Text}}",
+	"{original}", "{{.Original}}",
+	"{date}", "{{.Date}}",
+)
+
+// samplePromptData is used to try prompts at startup
+var samplePromptData = PromptData{
+	TargetLanguage: "English",
+	Text:           "Sveiki!",
+	Subject:        "Aprīļa rēķins",
+	From:           "Rīgas Ūdens <info@example.com>",
+	Date:           "Tue, 1 Apr 2025 06:22:56 +0000",
+	Language:       "Latvian",
+	Route:          defaultRouteName,
+	Labels:         []string{"INBOX"},
+	Original:       "Sveiki!",
+}
+
+// parsePrompt parses a prompt template and renders it with sample data, so a misspelt variable
+// fails when the config is loaded rather than when the first email arrives
+func parsePrompt(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(legacyPlaceholders.Replace(text))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+
+	if err := tmpl.Execute(io.Discard, samplePromptData); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+
+	return tmpl, nil
+}
+
+// promptTemplates caches parsed prompt templates by their text
+type promptTemplates struct {
+	mu        sync.Mutex
+	templates map[string]*template.Template
+}
+
+// render fills in a prompt template, parsing it on first use
+func (p *promptTemplates) render(text string, data PromptData) (string, error) {
+	p.mu.Lock()
+
+	tmpl, ok := p.templates[text]
+	if !ok {
+		var err error
+		if tmpl, err = parsePrompt("prompt", text); err != nil {
+			p.mu.Unlock()
+
+			return "", err
+		}
+
+		if p.templates == nil {
+			p.templates = make(map[string]*template.Template)
+		}
+
+		p.templates[text] = tmpl
+	}
+
+	p.mu.Unlock()
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render prompt: %v", err)
+	}
+
+	return b.String(), nil
+}
+
+// promptData collects the template variables of msg
+func (s *TranslationService) promptData(msg Message) PromptData {
+	return PromptData{
+		TargetLanguage: s.config.Translation.TargetLanguage,
+		Text:           msg.Content,
+		Subject:        msg.Subject,
+		From:           msg.From,
+		Date:           msg.Date,
+		Language:       detectLanguage(msg.Content),
+		Route:          routeName(msg.Route),
+		Labels:         msg.Labels,
+	}
+}
+
+// routePromptTemplate returns the translation prompt of a route, the configured one or the default one
+func routePromptTemplate(config *Config, route *RouteConfig) string {
+	switch {
+	case route != nil && route.PromptTemplate != "":
+		return route.PromptTemplate
+	case config.Translation.PromptTemplate != "":
+		return config.Translation.PromptTemplate
+	}
+
+	return defaultPromptTemplate
+}
+
+// routeExtractionPromptTemplate returns the extraction prompt of a route, the configured one or
+// the default one
+func routeExtractionPromptTemplate(config *Config, route *RouteConfig) string {
+	switch {
+	case route != nil && route.ExtractionPromptTemplate != "":
+		return route.ExtractionPromptTemplate
+	case config.Translation.ExtractionPromptTemplate != "":
+		return config.Translation.ExtractionPromptTemplate
+	}
+
+	return defaultExtractionPromptTemplate
+}
+
+// loadPromptFiles reads the prompt_file settings into the prompt templates next to them
+func loadPromptFiles(config *Config) error {
+	type promptFile struct {
+		file     string
+		template *string
+	}
+
+	files := []promptFile{
+		{config.Translation.PromptFile, &config.Translation.PromptTemplate},
+		{config.Translation.ExtractionPromptFile, &config.Translation.ExtractionPromptTemplate},
+		{config.Reply.PromptFile, &config.Reply.PromptTemplate},
+		{config.Digest.PromptFile, &config.Digest.PromptTemplate},
+		{config.Calendar.PromptFile, &config.Calendar.PromptTemplate},
+	}
+
+	for i := range config.Routes {
+		route := &config.Routes[i]
+
+		files = append(files,
+			promptFile{route.PromptFile, &route.PromptTemplate},
+			promptFile{route.ExtractionPromptFile, &route.ExtractionPromptTemplate},
+		)
+
+		if route.Digest != nil {
+			files = append(files, promptFile{route.Digest.PromptFile, &route.Digest.PromptTemplate})
+		}
+
+		if route.Calendar != nil {
+			files = append(files, promptFile{route.Calendar.PromptFile, &route.Calendar.PromptTemplate})
+		}
+	}
+
+	for _, f := range files {
+		if f.file == "" {
+			continue
+		}
+
+		data, err := os.ReadFile(f.file)
+		if err != nil {
+			return fmt.Errorf("unable to read prompt file: %v", err)
+		}
+
+		*f.template = string(data)
+	}
+
+	return nil
+}
+
+// validatePrompts parses every configured prompt
+func validatePrompts(config *Config) error {
+	prompts := map[string]string{
+		"reply prompt":      config.Reply.PromptTemplate,
+		"digest prompt":     config.Digest.PromptTemplate,
+		"events prompt":     config.Calendar.PromptTemplate,
+		"prompt":            routePromptTemplate(config, nil),
+		"extraction prompt": routeExtractionPromptTemplate(config, nil),
+	}
+
+	for i := range config.Routes {
+		route := &config.Routes[i]
+		name := routeName(route)
+
+		prompts["prompt of route "+name] = routePromptTemplate(config, route)
+		prompts["extraction prompt of route "+name] = routeExtractionPromptTemplate(config, route)
+
+		if route.Digest != nil {
+			prompts["digest prompt of route "+name] = route.Digest.PromptTemplate
+		}
+
+		if route.Calendar != nil {
+			prompts["events prompt of route "+name] = route.Calendar.PromptTemplate
+		}
+	}
+
+	for name, text := range prompts {
+		if text == "" {
+			continue
+		}
+
+		if _, err := parsePrompt(name, text); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// languageHints are letters that point to a language when they appear in a text
+var languageHints = []struct {
+	language string
+	letters  string
+}{
+	{"Latvian", "āēīģķļņĀĒĪĢĶĻŅ"},
+	{"Lithuanian", "ąęėįųĄĘĖĮŲ"},
+	{"Estonian", "õÕ"},
+	{"Polish", "łńśźżŁŃŚŹŻ"},
+	{"German", "ßäöüÄÖÜ"},
+	{"French", "éèêàçœÉÈÊÀÇ"},
+	{"Spanish", "ñ¿¡Ñ"},
+	{"Ukrainian", "іїєґІЇЄҐ"},
+	{"Russian", "ыэъёЫЭЪЁ"},
+}
+
+// detectLanguage guesses the language of text from its letters. Cyrillic without letters of
+// another language is read as Russian, Latin letters with common English words as English.
+func detectLanguage(text string) string {
+	var (
+		best      string
+		bestCount int
+		cyrillic  int
+		letters   int
+	)
+
+	for _, hint := range languageHints {
+		count := 0
+
+		for _, r := range text {
+			if strings.ContainsRune(hint.letters, r) {
+				count++
+			}
+		}
+
+		if count > bestCount {
+			best, bestCount = hint.language, count
+		}
+	}
+
+	if best != "" {
+		return best
+	}
+
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters++
+
+			if unicode.Is(unicode.Cyrillic, r) {
+				cyrillic++
+			}
+		}
+	}
+
+	if letters > 0 && cyrillic*2 > letters {
+		return "Russian"
+	}
+
+	englishWords := 0
+
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		switch strings.Trim(word, ".,!?:;\"'()") {
+		case "the", "and", "you", "your", "is", "are", "to", "of":
+			englishWords++
+		}
+	}
+
+	if englishWords >= 2 {
+		return "English"
+	}
+
+	return ""
+}
+
+// runPromptCommand renders the prompt an .eml file would be sent with, without calling the model:
+//
+//	gmail2telegram -config config.yaml prompt [-kind translation|extraction|digest|events] message.eml
+func runPromptCommand(config *Config, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("prompt", flag.ContinueOnError)
+	kind := flags.String("kind", "", "Prompt to render: translation, extraction, digest or events; the route's processing by default")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: prompt [-kind translation|extraction|digest|events] message.eml")
+	}
+
+	raw, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("unable to read message: %v", err)
+	}
+
+	msg, err := parseRawMessage(raw)
+	if err != nil {
+		return fmt.Errorf("unable to parse message: %v", err)
+	}
+
+	msg, ok := prepareMessage(config, FilterConfig{}, msg)
+	if !ok {
+		return fmt.Errorf("no route matches the message")
+	}
+
+	route := msg.Route
+
+	if *kind == "" {
+		*kind = "translation"
+		if routeProcessing(config, route) == processingExtract {
+			*kind = "extraction"
+		}
+	}
+
+	var text string
+
+	switch *kind {
+	case "translation":
+		text = routePromptTemplate(config, route)
+	case "extraction":
+		text = routeExtractionPromptTemplate(config, route)
+	case "digest":
+		text = config.Digest.PromptTemplate
+		if route != nil && route.Digest != nil {
+			text = route.Digest.PromptTemplate
+		}
+
+		if text == "" {
+			text = defaultDigestPromptTemplate
+		}
+	case "events":
+		text = routeCalendar(config, route).PromptTemplate
+
+		if text == "" {
+			text = defaultEventsPromptTemplate
+		}
+	default:
+		return fmt.Errorf("unknown prompt kind %q", *kind)
+	}
+
+	service := &TranslationService{config: config}
+
+	prompt, err := service.prompts.render(text, service.promptData(msg))
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "Route: %s\nPrompt (%s):\n\n%s\n", routeName(route), *kind, prompt)
+
+	return err
+}
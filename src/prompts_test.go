@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePrompt(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    string
+		wantErr bool
+	}{
+		{name: "legacy placeholders", text: "Translate to {target_language}:\n\n{text}", want: "Translate to English:\n\nSveiki!"},
+		{name: "template", text: "{{.Subject}} from {{.From}} in {{.Language}}", want: "Aprīļa rēķins from Rīgas Ūdens <info@example.com> in Latvian"},
+		{name: "unknown function", text: `{{join .Labels ","}}`, wantErr: true},
+		{name: "range labels", text: "{{range .Labels}}[{{.}}]{{end}}", want: "[INBOX]"},
+		{name: "misspelt variable", text: "{{.Subjcet}}", wantErr: true},
+		{name: "syntax error", text: "{{.Subject", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePrompt("prompt", tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePrompt() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			var prompts promptTemplates
+
+			got, err := prompts.render(tt.text, samplePromptData)
+			if err != nil {
+				t.Fatalf("render() error = %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("render() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: "Rīt skolā notiks teātra diena", want: "Latvian"},
+		{text: "Ваша посылка уже в пути", want: "Russian"},
+		{text: "Ваше замовлення відправлено, дякуємо і до зустрічі", want: "Ukrainian"},
+		{text: "Your parcel is on the way to the pickup point", want: "English"},
+		{text: "12345", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := detectLanguage(tt.text); got != tt.want {
+			t.Errorf("detectLanguage(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestRoutePromptTemplate(t *testing.T) {
+	config := &Config{Translation: TranslationConfig{PromptTemplate: "global {text}"}}
+
+	tests := []struct {
+		name  string
+		route *RouteConfig
+		want  string
+	}{
+		{name: "no route", want: "global {text}"},
+		{name: "route without prompt", route: &RouteConfig{Name: "bills"}, want: "global {text}"},
+		{name: "route prompt", route: &RouteConfig{Name: "school", PromptTemplate: "school {{.Text}}"}, want: "school {{.Text}}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := routePromptTemplate(config, tt.route); got != tt.want {
+				t.Errorf("routePromptTemplate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := routePromptTemplate(&Config{}, nil); got != defaultPromptTemplate {
+		t.Errorf("routePromptTemplate() = %q, want the default prompt", got)
+	}
+}
+
+func TestLoadPromptFiles(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "school.tmpl")
+
+	if err := os.WriteFile(file, []byte("School email from {{.From}}:\n\n{{.Text}}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		Translation: TranslationConfig{PromptTemplate: "inline {text}"},
+		Routes:      []RouteConfig{{Name: "school", PromptFile: file}},
+	}
+
+	if err := loadPromptFiles(config); err != nil {
+		t.Fatalf("loadPromptFiles() error = %v", err)
+	}
+
+	if !strings.HasPrefix(config.Routes[0].PromptTemplate, "School email") || config.Translation.PromptTemplate != "inline {text}" {
+		t.Errorf("prompts = %q, %q", config.Translation.PromptTemplate, config.Routes[0].PromptTemplate)
+	}
+
+	config.Digest.PromptFile = filepath.Join(dir, "missing.tmpl")
+	if err := loadPromptFiles(config); err == nil {
+		t.Error("loadPromptFiles() accepted a missing file")
+	}
+}
+
+func TestValidatePrompts(t *testing.T) {
+	config := &Config{Routes: []RouteConfig{{Name: "school", PromptTemplate: "{{.Sender}}"}}}
+
+	err := validatePrompts(config)
+	if err == nil || !strings.Contains(err.Error(), "route school") {
+		t.Errorf("validatePrompts() error = %v, want the route named", err)
+	}
+}
+
+func TestRunPromptCommand(t *testing.T) {
+	config := &Config{
+		Translation: TranslationConfig{TargetLanguage: "English"},
+		Routes: []RouteConfig{{
+			Name:           "school",
+			Filter:         FilterConfig{From: []string{"prosum.lv"}},
+			PromptTemplate: "{{.Language}} email from {{.From}} about {{.Subject}} on route {{.Route}}:\n{{.Text}}",
+		}},
+	}
+
+	var out strings.Builder
+	if err := runPromptCommand(config, []string{"testdata/eml/plain_qp_utf8.eml"}, &out); err != nil {
+		t.Fatalf("runPromptCommand() error = %v", err)
+	}
+
+	want := "Latvian email from Skola Prosum <office@prosum.lv> about Teātra diena on route school:\nLabdien!"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("runPromptCommand() = %q, want it to contain %q", out.String(), want)
+	}
+
+	if err := runPromptCommand(config, []string{"-kind", "poem", "testdata/eml/plain_qp_utf8.eml"}, &out); err == nil {
+		t.Error("runPromptCommand() accepted an unknown kind")
+	}
+}
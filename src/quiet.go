@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// What happens to emails during quiet hours, see QuietHoursConfig.Mode
+const (
+	quietSilent = "silent"
+	quietHold   = "hold"
+)
+
+const quietTimeLayout = "15:04"
+
+// QuietHoursConfig is a daily window in which emails are delivered without a sound or held back
+type QuietHoursConfig struct {
+	// Start and End are times of day like "22:00" and "07:00"; the window may span midnight
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	// Timezone is an IANA name such as "Europe/Riga"; the local time zone when empty
+	Timezone string `yaml:"timezone"`
+	// Mode is "silent" (default) to post without a notification sound or "hold" to post
+	// when the window ends
+	Mode string `yaml:"mode"`
+	// UrgentKeywords in the subject or body deliver an email normally even in quiet hours
+	UrgentKeywords []string `yaml:"urgent_keywords"`
+}
+
+type quietWindow struct {
+	start, end time.Duration
+	location   *time.Location
+	mode       string
+	urgent     []string
+}
+
+// QuietHours knows the quiet window of every route
+type QuietHours struct {
+	windows map[string]*quietWindow
+}
+
+// NewQuietHours validates the quiet hours of all routes. It returns nil when no route has any.
+func NewQuietHours(config *Config) (*QuietHours, error) {
+	q := &QuietHours{windows: make(map[string]*quietWindow)}
+
+	// Without routes every email uses the default route
+	routes := []*RouteConfig{nil}
+	if len(config.Routes) > 0 {
+		routes = routes[:0]
+		for i := range config.Routes {
+			routes = append(routes, &config.Routes[i])
+		}
+	}
+
+	for _, route := range routes {
+		quietConfig := config.QuietHours
+		if route != nil && route.QuietHours != nil {
+			quietConfig = *route.QuietHours
+		}
+
+		if quietConfig.Start == "" && quietConfig.End == "" {
+			continue
+		}
+
+		window, err := newQuietWindow(quietConfig)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", routeName(route), err)
+		}
+
+		q.windows[routeName(route)] = window
+	}
+
+	if len(q.windows) == 0 {
+		return nil, nil
+	}
+
+	return q, nil
+}
+
+func newQuietWindow(config QuietHoursConfig) (*quietWindow, error) {
+	start, err := parseTimeOfDay(config.Start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid quiet hours start: %v", err)
+	}
+
+	end, err := parseTimeOfDay(config.End)
+	if err != nil {
+		return nil, fmt.Errorf("invalid quiet hours end: %v", err)
+	}
+
+	if start == end {
+		return nil, fmt.Errorf("quiet hours start and end are both %s", config.Start)
+	}
+
+	mode := config.Mode
+	switch mode {
+	case "":
+		mode = quietSilent
+	case quietSilent, quietHold:
+	default:
+		return nil, fmt.Errorf("invalid quiet hours mode %q: use %q or %q", mode, quietSilent, quietHold)
+	}
+
+	location := time.Local
+	if config.Timezone != "" {
+		if location, err = time.LoadLocation(config.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid quiet hours timezone %q: %v", config.Timezone, err)
+		}
+	}
+
+	return &quietWindow{
+		start:    start,
+		end:      end,
+		location: location,
+		mode:     mode,
+		urgent:   config.UrgentKeywords,
+	}, nil
+}
+
+// parseTimeOfDay turns "HH:MM" into the duration since midnight
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse(quietTimeLayout, value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a HH:MM time", value)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Check returns the quiet hours mode that applies to msg at now, and when the window ends.
+// The mode is empty outside quiet hours and for urgent emails.
+func (q *QuietHours) Check(msg Message, now time.Time) (string, time.Time) {
+	window, ok := q.windows[routeName(msg.Route)]
+	if !ok || !window.active(now) || window.isUrgent(msg) {
+		return "", time.Time{}
+	}
+
+	return window.mode, window.nextEnd(now)
+}
+
+// NextRelease returns when the earliest hold window ends after now, the time held emails go out
+func (q *QuietHours) NextRelease(now time.Time) (time.Time, bool) {
+	var next time.Time
+
+	for _, window := range q.windows {
+		if window.mode != quietHold {
+			continue
+		}
+
+		if end := window.nextEnd(now); next.IsZero() || end.Before(next) {
+			next = end
+		}
+	}
+
+	return next, !next.IsZero()
+}
+
+func (w *quietWindow) active(now time.Time) bool {
+	local := now.In(w.location)
+	sinceMidnight := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute
+
+	// A window like 22:00-07:00 spans midnight
+	if w.start > w.end {
+		return sinceMidnight >= w.start || sinceMidnight < w.end
+	}
+
+	return sinceMidnight >= w.start && sinceMidnight < w.end
+}
+
+// nextEnd returns the first end of the window after now
+func (w *quietWindow) nextEnd(now time.Time) time.Time {
+	local := now.In(w.location)
+	end := time.Date(local.Year(), local.Month(), local.Day(),
+		int(w.end/time.Hour), int(w.end%time.Hour/time.Minute), 0, 0, w.location)
+
+	if !end.After(local) {
+		end = time.Date(local.Year(), local.Month(), local.Day()+1,
+			int(w.end/time.Hour), int(w.end%time.Hour/time.Minute), 0, 0, w.location)
+	}
+
+	return end
+}
+
+func (w *quietWindow) isUrgent(msg Message) bool {
+	subject := strings.ToLower(msg.Subject)
+	content := strings.ToLower(msg.Content)
+
+	for _, keyword := range w.urgent {
+		keyword = strings.ToLower(keyword)
+		if strings.Contains(subject, keyword) || strings.Contains(content, keyword) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestQuietHoursCheck(t *testing.T) {
+	riga, _ := time.LoadLocation("Europe/Riga")
+
+	quiet, err := NewQuietHours(&Config{
+		QuietHours: QuietHoursConfig{Start: "22:00", End: "07:00", Timezone: "Europe/Riga", UrgentKeywords: []string{"FRAUD"}},
+		Routes: []RouteConfig{
+			{Name: "bank", QuietHours: &QuietHoursConfig{Start: "23:30", End: "06:00", Timezone: "Europe/Riga", Mode: quietHold}},
+			{Name: "school"},
+			{Name: "day", QuietHours: &QuietHoursConfig{Start: "12:00", End: "13:00", Timezone: "Europe/Riga"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewQuietHours() error = %v", err)
+	}
+
+	bank, school, day := &RouteConfig{Name: "bank"}, &RouteConfig{Name: "school"}, &RouteConfig{Name: "day"}
+
+	tests := []struct {
+		name      string
+		msg       Message
+		now       time.Time
+		wantMode  string
+		wantUntil time.Time
+	}{
+		{
+			name:      "hold after midnight",
+			msg:       Message{Route: bank},
+			now:       time.Date(2025, 3, 28, 3, 0, 0, 0, riga),
+			wantMode:  quietHold,
+			wantUntil: time.Date(2025, 3, 28, 6, 0, 0, 0, riga),
+		},
+		{
+			name:      "hold before midnight ends the next day",
+			msg:       Message{Route: bank},
+			now:       time.Date(2025, 3, 28, 23, 45, 0, 0, riga),
+			wantMode:  quietHold,
+			wantUntil: time.Date(2025, 3, 29, 6, 0, 0, 0, riga),
+		},
+		{name: "outside the window", msg: Message{Route: bank}, now: time.Date(2025, 3, 28, 23, 0, 0, 0, riga)},
+		{
+			name:      "top-level window is silent",
+			msg:       Message{Route: school},
+			now:       time.Date(2025, 3, 28, 22, 0, 0, 0, riga),
+			wantMode:  quietSilent,
+			wantUntil: time.Date(2025, 3, 29, 7, 0, 0, 0, riga),
+		},
+		{
+			name: "window is in the configured time zone",
+			msg:  Message{Route: school},
+			now:  time.Date(2025, 3, 28, 19, 30, 0, 0, time.UTC),
+		},
+		{
+			name: "urgent keyword",
+			msg:  Message{Route: school, Subject: "Possible fraud on your card"},
+			now:  time.Date(2025, 3, 28, 23, 0, 0, 0, riga),
+		},
+		{
+			name:      "window within one day",
+			msg:       Message{Route: day},
+			now:       time.Date(2025, 3, 28, 12, 30, 0, 0, riga),
+			wantMode:  quietSilent,
+			wantUntil: time.Date(2025, 3, 28, 13, 0, 0, 0, riga),
+		},
+		{name: "end of a window", msg: Message{Route: day}, now: time.Date(2025, 3, 28, 13, 0, 0, 0, riga)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mode, until := quiet.Check(tt.msg, tt.now)
+			if mode != tt.wantMode || !until.Equal(tt.wantUntil) {
+				t.Errorf("Check() = %q, %v, want %q, %v", mode, until, tt.wantMode, tt.wantUntil)
+			}
+		})
+	}
+
+	// Only hold windows release emails
+	release, ok := quiet.NextRelease(time.Date(2025, 3, 28, 12, 0, 0, 0, riga))
+	if want := time.Date(2025, 3, 29, 6, 0, 0, 0, riga); !ok || !release.Equal(want) {
+		t.Errorf("NextRelease() = %v, %v, want %v", release, ok, want)
+	}
+}
+
+func TestNewQuietHours(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    *Config
+		wantQuiet bool
+		wantErr   bool
+	}{
+		{name: "none", config: &Config{}},
+		{name: "default route", config: &Config{QuietHours: QuietHoursConfig{Start: "22:00", End: "07:00"}}, wantQuiet: true},
+		{
+			name: "one route",
+			config: &Config{Routes: []RouteConfig{
+				{Name: "a"},
+				{Name: "b", QuietHours: &QuietHoursConfig{Start: "22:00", End: "07:00"}},
+			}},
+			wantQuiet: true,
+		},
+		{name: "missing end", config: &Config{QuietHours: QuietHoursConfig{Start: "22:00"}}, wantErr: true},
+		{name: "invalid time", config: &Config{QuietHours: QuietHoursConfig{Start: "10pm", End: "07:00"}}, wantErr: true},
+		{name: "empty window", config: &Config{QuietHours: QuietHoursConfig{Start: "07:00", End: "07:00"}}, wantErr: true},
+		{
+			name:    "invalid mode",
+			config:  &Config{QuietHours: QuietHoursConfig{Start: "22:00", End: "07:00", Mode: "mute"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid timezone",
+			config:  &Config{QuietHours: QuietHoursConfig{Start: "22:00", End: "07:00", Timezone: "Mars/Olympus"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quiet, err := NewQuietHours(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewQuietHours() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if (quiet != nil) != tt.wantQuiet {
+				t.Errorf("NewQuietHours() = %v, want quiet hours %v", quiet, tt.wantQuiet)
+			}
+		})
+	}
+}
+
+func TestProcessMessageQuietHours(t *testing.T) {
+	// The window covers the whole day apart from one minute before midnight
+	allDay := func(mode string) *Config {
+		return &Config{QuietHours: QuietHoursConfig{Start: "00:00", End: "23:59", Mode: mode, UrgentKeywords: []string{"urgent"}}}
+	}
+
+	tests := []struct {
+		name          string
+		config        *Config
+		subject       string
+		wantSent      bool
+		wantSilent    bool
+		wantForwarded bool
+	}{
+		{name: "silent", config: allDay(quietSilent), wantSent: true, wantSilent: true, wantForwarded: true},
+		{name: "hold", config: allDay(quietHold)},
+		{name: "urgent", config: allDay(quietHold), subject: "URGENT: call us", wantSent: true, wantForwarded: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if time.Now().Format(quietTimeLayout) == "23:59" {
+				t.Skip("outside the test window")
+			}
+
+			quiet, err := NewQuietHours(tt.config)
+			if err != nil {
+				t.Fatalf("NewQuietHours() error = %v", err)
+			}
+
+			var (
+				sent      []Notification
+				forwarded bool
+			)
+
+			svc := &services{
+				source: &GmailClient{markAsForwarded: func(ctx context.Context, messageID string) error {
+					forwarded = true
+
+					return nil
+				}},
+				translation: &TranslationService{config: &Config{}, translate: func(ctx context.Context, msg Message) (Translation, error) {
+					return Translation{Content: msg.Content}, nil
+				}},
+				notifiers: Notifiers{sinkTelegram: notifierFunc(func(ctx context.Context, n Notification) error {
+					sent = append(sent, n)
+
+					return nil
+				})},
+				quiet: quiet,
+			}
+
+			msg := Message{ID: "m1", Subject: tt.subject, Content: "Your card was charged"}
+			if err := processMessage(context.Background(), svc, msg); err != nil {
+				t.Fatalf("processMessage() error = %v", err)
+			}
+
+			if (len(sent) == 1) != tt.wantSent || forwarded != tt.wantForwarded {
+				t.Fatalf("sent = %d, forwarded = %v", len(sent), forwarded)
+			}
+
+			if tt.wantSent && sent[0].Silent != tt.wantSilent {
+				t.Errorf("Silent = %v, want %v", sent[0].Silent, tt.wantSilent)
+			}
+		})
+	}
+}
+
+func TestSendMessageSilent(t *testing.T) {
+	var query url.Values
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":11,"chat":{"id":1}}}`))
+	}))
+	defer server.Close()
+
+	bot := &TelegramBot{client: server.Client(), chatID: "test-chat", baseURL: server.URL, threading: threadingReply}
+
+	n := Notification{Message: Message{Subject: "Subject", From: "from", Date: "date"}, Content: "Content", Silent: true}
+	if _, err := bot.sendNotification(context.Background(), n, TelegramThread{}); err != nil {
+		t.Fatalf("sendNotification() error = %v", err)
+	}
+
+	if query.Get("disable_notification") != "true" {
+		t.Errorf("disable_notification = %q, want true", query.Get("disable_notification"))
+	}
+}
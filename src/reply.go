@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	replyCallbackSend   = "reply:send"
+	replyCallbackCancel = "reply:cancel"
+	updatesPollTimeout  = 30
+	updatesRetryDelay   = 5 * time.Second
+)
+
+// ReplyHandler turns Telegram replies to forwarded messages into Gmail replies.
+// Every reply is echoed back with Send/Cancel buttons and only goes out once confirmed.
+type ReplyHandler struct {
+	config             *Config
+	gmailClient        *GmailClient
+	translationService *TranslationService
+	telegramBot        *TelegramBot
+	state              *StateStore
+}
+
+func NewReplyHandler(
+	config *Config,
+	gmailClient *GmailClient,
+	translationService *TranslationService,
+	telegramBot *TelegramBot,
+	state *StateStore,
+) *ReplyHandler {
+	return &ReplyHandler{
+		config:             config,
+		gmailClient:        gmailClient,
+		translationService: translationService,
+		telegramBot:        telegramBot,
+		state:              state,
+	}
+}
+
+// Run polls Telegram for updates until ctx is cancelled
+func (h *ReplyHandler) Run(ctx context.Context) {
+	for {
+		updates, err := h.telegramBot.GetUpdates(ctx, h.state.UpdateOffset(), updatesPollTimeout)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Println("Reply handler stopped")
+
+				return
+			}
+
+			log.Printf("Error getting Telegram updates: %v", err)
+
+			select {
+			case <-ctx.Done():
+				log.Println("Reply handler stopped")
+
+				return
+			case <-time.After(updatesRetryDelay):
+			}
+
+			continue
+		}
+
+		for _, update := range updates {
+			h.handleUpdate(ctx, update)
+
+			if err := h.state.SetUpdateOffset(update.UpdateID + 1); err != nil {
+				log.Printf("Error saving Telegram update offset: %v", err)
+			}
+		}
+	}
+}
+
+func (h *ReplyHandler) handleUpdate(ctx context.Context, update Update) {
+	var err error
+
+	switch {
+	case update.CallbackQuery != nil:
+		err = h.handleCallback(ctx, update.CallbackQuery)
+	case update.Message != nil && update.Message.ReplyToMessage != nil:
+		err = h.handleReply(ctx, update.Message)
+	}
+
+	if err != nil {
+		log.Printf("Error handling Telegram update %d: %v", update.UpdateID, err)
+	}
+}
+
+// validateReply makes sure replies are limited to known users, anyone in the chat could
+// send email from the mailbox otherwise
+func validateReply(config *Config) error {
+	if config.Reply.Enabled && len(config.Reply.AllowedUserIDs) == 0 {
+		return fmt.Errorf("reply.enabled needs reply.allowed_user_ids")
+	}
+
+	return nil
+}
+
+// isAllowed denies everyone when allowed_user_ids is empty
+func (h *ReplyHandler) isAllowed(userID int64) bool {
+	return slices.Contains(h.config.Reply.AllowedUserIDs, userID)
+}
+
+func (h *ReplyHandler) handleReply(ctx context.Context, msg *TelegramMessage) error {
+	fwdKey := telegramKey(msg.Chat.ID, msg.ReplyToMessage.MessageID)
+
+	fwd, ok := h.state.Forwarded(fwdKey)
+	if !ok || strings.TrimSpace(msg.Text) == "" {
+		// Not a reply to a forwarded email
+		return nil
+	}
+
+	if msg.From == nil || !h.isAllowed(msg.From.ID) {
+		log.Printf("Ignoring reply from user not in allowed_user_ids")
+
+		return nil
+	}
+
+	body := msg.Text
+
+	if h.config.Reply.Translate {
+		original, err := h.gmailClient.GetMessage(ctx, fwd.GmailID)
+		if err != nil {
+			return fmt.Errorf("failed to load original email: %w", err)
+		}
+
+		body, err = h.translationService.TranslateReply(ctx, msg.Text, original.Content)
+		if err != nil {
+			return fmt.Errorf("failed to translate reply: %w", err)
+		}
+	}
+
+	to := fwd.ReplyTo
+	if to == "" {
+		to = fwd.From
+	}
+
+	prompt := fmt.Sprintf("✉️ Reply to %s\nSubject: Re: %s\n\n%s\n\nSend this reply?", to, fwd.Subject, body)
+	markup := &InlineKeyboardMarkup{
+		InlineKeyboard: [][]InlineKeyboardButton{{
+			{Text: "✅ Send", CallbackData: replyCallbackSend},
+			{Text: "❌ Cancel", CallbackData: replyCallbackCancel},
+		}},
+	}
+
+	sent, err := h.telegramBot.SendPlainMessage(ctx, msg.Chat.ID, msg.MessageID, prompt, markup)
+	if err != nil {
+		return fmt.Errorf("failed to send confirmation: %w", err)
+	}
+
+	return h.state.SavePendingReply(telegramKey(sent.ChatID, sent.MessageID), PendingReply{
+		ForwardedKey: fwdKey,
+		Body:         body,
+		UserID:       msg.From.ID,
+	})
+}
+
+func (h *ReplyHandler) handleCallback(ctx context.Context, query *CallbackQuery) error {
+	if query.Message == nil {
+		return nil
+	}
+
+	key := telegramKey(query.Message.Chat.ID, query.Message.MessageID)
+
+	pending, ok := h.state.PendingReply(key)
+	if !ok {
+		return h.telegramBot.AnswerCallbackQuery(ctx, query.ID, "This reply is no longer pending")
+	}
+
+	// Only the author of the reply may confirm or cancel it
+	if query.From.ID != pending.UserID {
+		return h.telegramBot.AnswerCallbackQuery(ctx, query.ID, "Only the author of the reply can do this")
+	}
+
+	var status string
+
+	switch query.Data {
+	case replyCallbackSend:
+		fwd, ok := h.state.Forwarded(pending.ForwardedKey)
+		if !ok {
+			return fmt.Errorf("forwarded message %s not found", pending.ForwardedKey)
+		}
+
+		if err := h.gmailClient.SendReply(ctx, fwd, pending.Body); err != nil {
+			_ = h.telegramBot.AnswerCallbackQuery(ctx, query.ID, "Failed to send reply")
+
+			return err
+		}
+
+		status = "✅ Reply sent:\n\n" + pending.Body
+	case replyCallbackCancel:
+		status = "❌ Reply cancelled"
+	default:
+		return h.telegramBot.AnswerCallbackQuery(ctx, query.ID, "")
+	}
+
+	if err := h.state.DeletePendingReply(key); err != nil {
+		log.Printf("Error deleting pending reply: %v", err)
+	}
+
+	if err := h.telegramBot.EditMessageText(ctx, query.Message.Chat.ID, query.Message.MessageID, status); err != nil {
+		log.Printf("Error updating confirmation message: %v", err)
+	}
+
+	return h.telegramBot.AnswerCallbackQuery(ctx, query.ID, "")
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// fakeTelegramServer records Bot API calls and answers them successfully
+type fakeTelegramServer struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *fakeTelegramServer) handler(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.calls = append(f.calls, strings.TrimPrefix(r.URL.Path, "/")+"?"+r.URL.RawQuery)
+	f.mu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+
+	if strings.HasSuffix(r.URL.Path, "/sendMessage") {
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":100,"chat":{"id":-1}}}`))
+
+		return
+	}
+
+	_, _ = w.Write([]byte(`{"ok":true,"result":true}`))
+}
+
+func newTestReplyHandler(t *testing.T, translate bool) (*ReplyHandler, *MockGmailService, *fakeTelegramServer) {
+	t.Helper()
+
+	fake := &fakeTelegramServer{}
+	server := httptest.NewServer(http.HandlerFunc(fake.handler))
+	t.Cleanup(server.Close)
+
+	config := &Config{}
+	config.Reply.Enabled = true
+	config.Reply.Translate = translate
+	config.Reply.AllowedUserIDs = []int64{5}
+
+	mockService := NewMockGmailService()
+	mockService.messages = []*gmail.Message{
+		{
+			Id: "gmail-1",
+			Payload: &gmail.MessagePart{
+				Body: &gmail.MessagePartBody{Data: "SGVsbG8gV29ybGQ="},
+			},
+		},
+	}
+
+	state, err := NewStateStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = state.SaveForwarded(telegramKey(-1, 10), ForwardedMessage{
+		GmailID:   "gmail-1",
+		ThreadID:  "thread-1",
+		MessageID: "<orig@example.com>",
+		Subject:   "Question",
+		From:      "Teacher <teacher@example.com>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewReplyHandler(
+		config,
+		&GmailClient{service: mockService, config: config},
+		&TranslationService{
+			config: config,
+			translateReply: func(ctx context.Context, reply, original string) (string, error) {
+				return "translated(" + reply + "|" + original + ")", nil
+			},
+		},
+		&TelegramBot{client: server.Client(), baseURL: server.URL},
+		state,
+	)
+
+	return handler, mockService, fake
+}
+
+func TestReplyHandlerConfirmAndSend(t *testing.T) {
+	handler, mockService, fake := newTestReplyHandler(t, true)
+	ctx := context.Background()
+
+	handler.handleUpdate(ctx, Update{
+		UpdateID: 1,
+		Message: &TelegramMessage{
+			MessageID:      11,
+			From:           &TelegramUser{ID: 5},
+			Chat:           TelegramChat{ID: -1},
+			Text:           "Thank you",
+			ReplyToMessage: &TelegramMessage{MessageID: 10, Chat: TelegramChat{ID: -1}},
+		},
+	})
+
+	pending, ok := handler.state.PendingReply(telegramKey(-1, 100))
+	if !ok {
+		t.Fatal("expected a pending reply after replying to a forwarded message")
+	}
+
+	if pending.Body != "translated(Thank you|Hello World)" {
+		t.Errorf("pending body = %q", pending.Body)
+	}
+
+	if len(mockService.sent) != 0 {
+		t.Fatal("reply was sent before confirmation")
+	}
+
+	// The confirmation answers the user's reply even if it is deleted meanwhile
+	_, rawQuery, _ := strings.Cut(fake.calls[0], "?")
+	if query, _ := url.ParseQuery(rawQuery); query.Get("reply_parameters") != `{"message_id":11,"allow_sending_without_reply":true}` {
+		t.Errorf("confirmation query = %v", query)
+	}
+
+	// Another user must not be able to confirm
+	handler.handleUpdate(ctx, Update{
+		UpdateID: 2,
+		CallbackQuery: &CallbackQuery{
+			ID:      "cb-1",
+			From:    TelegramUser{ID: 6},
+			Message: &TelegramMessage{MessageID: 100, Chat: TelegramChat{ID: -1}},
+			Data:    replyCallbackSend,
+		},
+	})
+
+	if len(mockService.sent) != 0 {
+		t.Fatal("reply was sent after confirmation by another user")
+	}
+
+	handler.handleUpdate(ctx, Update{
+		UpdateID: 3,
+		CallbackQuery: &CallbackQuery{
+			ID:      "cb-2",
+			From:    TelegramUser{ID: 5},
+			Message: &TelegramMessage{MessageID: 100, Chat: TelegramChat{ID: -1}},
+			Data:    replyCallbackSend,
+		},
+	})
+
+	if len(mockService.sent) != 1 {
+		t.Fatalf("expected 1 sent reply, got %d", len(mockService.sent))
+	}
+
+	sent := mockService.sent[0]
+	if sent.ThreadId != "thread-1" {
+		t.Errorf("sent ThreadId = %q, want thread-1", sent.ThreadId)
+	}
+
+	raw, err := base64.URLEncoding.DecodeString(sent.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"To: Teacher <teacher@example.com>\r\n",
+		"In-Reply-To: <orig@example.com>\r\n",
+		"References: <orig@example.com>\r\n",
+		"translated(Thank you|Hello World)",
+	} {
+		if !strings.Contains(string(raw), want) {
+			t.Errorf("raw reply does not contain %q:\n%s", want, raw)
+		}
+	}
+
+	if _, ok := handler.state.PendingReply(telegramKey(-1, 100)); ok {
+		t.Error("pending reply not removed after sending")
+	}
+
+	if len(fake.calls) == 0 || !strings.HasPrefix(fake.calls[0], "sendMessage?") {
+		t.Errorf("expected confirmation to be sent first, got calls %v", fake.calls)
+	}
+}
+
+func TestReplyHandlerIgnoresUnknownAndDisallowed(t *testing.T) {
+	handler, _, fake := newTestReplyHandler(t, false)
+	ctx := context.Background()
+
+	// Reply to a message that was not forwarded by the bot
+	handler.handleUpdate(ctx, Update{
+		Message: &TelegramMessage{
+			MessageID:      12,
+			From:           &TelegramUser{ID: 5},
+			Chat:           TelegramChat{ID: -1},
+			Text:           "Hi",
+			ReplyToMessage: &TelegramMessage{MessageID: 99},
+		},
+	})
+
+	// Reply from a user that is not allowed
+	handler.handleUpdate(ctx, Update{
+		Message: &TelegramMessage{
+			MessageID:      13,
+			From:           &TelegramUser{ID: 6},
+			Chat:           TelegramChat{ID: -1},
+			Text:           "Hi",
+			ReplyToMessage: &TelegramMessage{MessageID: 10},
+		},
+	})
+
+	// Nobody may reply when no users are allowed
+	handler.config.Reply.AllowedUserIDs = nil
+	handler.handleUpdate(ctx, Update{
+		Message: &TelegramMessage{
+			MessageID:      14,
+			From:           &TelegramUser{ID: 5},
+			Chat:           TelegramChat{ID: -1},
+			Text:           "Hi",
+			ReplyToMessage: &TelegramMessage{MessageID: 10},
+		},
+	})
+
+	if len(fake.calls) != 0 {
+		t.Errorf("expected no Telegram calls, got %v", fake.calls)
+	}
+}
+
+func TestValidateReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   ReplyConfig
+		wantErr bool
+	}{
+		{name: "disabled", reply: ReplyConfig{}},
+		{name: "allowed users", reply: ReplyConfig{Enabled: true, AllowedUserIDs: []int64{5}}},
+		{name: "no allowed users", reply: ReplyConfig{Enabled: true}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := validateReply(&Config{Reply: tt.reply}); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateReply() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestReplyHandlerCancel(t *testing.T) {
+	handler, mockService, _ := newTestReplyHandler(t, false)
+	ctx := context.Background()
+
+	handler.handleUpdate(ctx, Update{
+		Message: &TelegramMessage{
+			MessageID:      11,
+			From:           &TelegramUser{ID: 5},
+			Chat:           TelegramChat{ID: -1},
+			Text:           "Thank you",
+			ReplyToMessage: &TelegramMessage{MessageID: 10},
+		},
+	})
+
+	pending, ok := handler.state.PendingReply(telegramKey(-1, 100))
+	if !ok || pending.Body != "Thank you" {
+		t.Fatalf("pending reply = %+v, %v; want untranslated body", pending, ok)
+	}
+
+	handler.handleUpdate(ctx, Update{
+		CallbackQuery: &CallbackQuery{
+			ID:      "cb-1",
+			From:    TelegramUser{ID: 5},
+			Message: &TelegramMessage{MessageID: 100, Chat: TelegramChat{ID: -1}},
+			Data:    replyCallbackCancel,
+		},
+	})
+
+	if len(mockService.sent) != 0 {
+		t.Error("cancelled reply was sent")
+	}
+
+	if _, ok := handler.state.PendingReply(telegramKey(-1, 100)); ok {
+		t.Error("pending reply not removed after cancel")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultMaxAttempts = 5
+	defaultBackoff     = time.Minute
+	defaultMaxBackoff  = time.Hour
+)
+
+// RetryConfig decides how long failing emails are retried
+type RetryConfig struct {
+	// MaxAttempts is how often an email is tried before it is dead-lettered, 5 by default
+	MaxAttempts int `yaml:"max_attempts"`
+	// Backoff is the first pause after the Gemini quota ran out, doubled on every further
+	// exhausted quota up to MaxBackoff; 1m and 1h by default
+	Backoff    string `yaml:"backoff"`
+	MaxBackoff string `yaml:"max_backoff"`
+}
+
+// Retry counts failed attempts per email and pauses processing while the model quota is exhausted
+type Retry struct {
+	state       *StateStore
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+
+	delay       time.Duration
+	pausedUntil time.Time
+}
+
+func NewRetry(config RetryConfig, state *StateStore) (*Retry, error) {
+	r := &Retry{
+		state:       state,
+		maxAttempts: config.MaxAttempts,
+		backoff:     defaultBackoff,
+		maxBackoff:  defaultMaxBackoff,
+	}
+
+	if r.maxAttempts <= 0 {
+		r.maxAttempts = defaultMaxAttempts
+	}
+
+	var err error
+
+	if config.Backoff != "" {
+		if r.backoff, err = time.ParseDuration(config.Backoff); err != nil || r.backoff <= 0 {
+			return nil, fmt.Errorf("invalid retry backoff %q", config.Backoff)
+		}
+	}
+
+	if config.MaxBackoff != "" {
+		if r.maxBackoff, err = time.ParseDuration(config.MaxBackoff); err != nil || r.maxBackoff < r.backoff {
+			return nil, fmt.Errorf("invalid retry max_backoff %q", config.MaxBackoff)
+		}
+	}
+
+	return r, nil
+}
+
+// Paused reports whether processing waits for the quota to recover, and until when
+func (r *Retry) Paused(now time.Time) (time.Time, bool) {
+	return r.pausedUntil, now.Before(r.pausedUntil)
+}
+
+// Pause stops processing after the quota ran out, each time twice as long as before
+func (r *Retry) Pause(now time.Time) time.Time {
+	if r.delay == 0 {
+		r.delay = r.backoff
+	} else {
+		r.delay = min(2*r.delay, r.maxBackoff)
+	}
+
+	r.pausedUntil = now.Add(r.delay)
+
+	return r.pausedUntil
+}
+
+// Resume resets the pause after the model answered again
+func (r *Retry) Resume() {
+	r.delay = 0
+	r.pausedUntil = time.Time{}
+}
+
+// Failed records a failed attempt to process msg and reports whether the email was given up on
+// and moved to the dead letters
+func (r *Retry) Failed(msg Message, cause error, now time.Time) (bool, error) {
+	attempts, err := r.state.RecordFailure(msg.ID, msg.Subject, cause.Error(), now)
+	if err != nil {
+		return false, err
+	}
+
+	if attempts < r.maxAttempts {
+		return false, nil
+	}
+
+	return true, r.state.SaveDeadLetter(msg.ID, DeadLetter{
+		Subject:  msg.Subject,
+		From:     msg.From,
+		Error:    cause.Error(),
+		Attempts: attempts,
+		At:       now,
+	})
+}
+
+// Done forgets the failed attempts of an email that went through
+func (r *Retry) Done(id string) error {
+	return r.state.ClearFailure(id)
+}
+
+// untranslatedContent puts a warning banner above an email that is forwarded as it is
+func untranslatedContent(content string, cause error) string {
+	reason := "the model could not process it"
+
+	switch {
+	case errors.Is(cause, errResponseBlocked):
+		reason = "blocked by the safety filters"
+	case errors.Is(cause, errResponseTruncated):
+		reason = "the translation was too long and got cut off"
+	case errors.Is(cause, errEmptyResponse):
+		reason = "the model returned no text"
+	case errors.Is(cause, errEmptyContent):
+		reason = "the email has no text"
+	}
+
+	banner := "⚠️ Not translated: " + reason
+	if content == "" {
+		return banner
+	}
+
+	return banner + "\n\n" + content
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryPause(t *testing.T) {
+	state, _ := NewStateStore("")
+
+	retry, err := NewRetry(RetryConfig{Backoff: "1m", MaxBackoff: "3m"}, state)
+	if err != nil {
+		t.Fatalf("NewRetry() error = %v", err)
+	}
+
+	now := time.Date(2025, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		if until := retry.Pause(now); until.Sub(now) != want {
+			t.Errorf("Pause() = %v, want a pause of %v", until.Sub(now), want)
+		}
+	}
+
+	if _, paused := retry.Paused(now.Add(2 * time.Minute)); !paused {
+		t.Error("Paused() = false during the pause")
+	}
+
+	retry.Resume()
+
+	if _, paused := retry.Paused(now); paused {
+		t.Error("Paused() = true after Resume()")
+	}
+
+	if until := retry.Pause(now); until.Sub(now) != time.Minute {
+		t.Errorf("Pause() after Resume() = %v, want the first backoff again", until.Sub(now))
+	}
+
+	if _, err := NewRetry(RetryConfig{Backoff: "1h", MaxBackoff: "1m"}, state); err == nil {
+		t.Error("NewRetry() accepted max_backoff below backoff")
+	}
+}
+
+func TestProcessMessageFailures(t *testing.T) {
+	tests := []struct {
+		name           string
+		errs           []error
+		wantContent    string
+		wantErr        error
+		wantForwarded  bool
+		wantDeadLetter bool
+		wantPaused     bool
+	}{
+		{
+			name:          "blocked email is forwarded untranslated",
+			errs:          []error{errResponseBlocked},
+			wantContent:   "⚠️ Not translated: blocked by the safety filters\n\nSveiki",
+			wantForwarded: true,
+		},
+		{
+			name:       "quota pauses processing",
+			errs:       []error{errQuotaExhausted},
+			wantErr:    errQuotaExhausted,
+			wantPaused: true,
+		},
+		{
+			name:    "transient error is retried",
+			errs:    []error{errTransient},
+			wantErr: errTransient,
+		},
+		{
+			name:           "dead letter after the last attempt",
+			errs:           []error{errTransient, errTransient, errors.New("invalid argument")},
+			wantForwarded:  true,
+			wantDeadLetter: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, _ := NewStateStore("")
+			retry, _ := NewRetry(RetryConfig{MaxAttempts: 3}, state)
+
+			var (
+				sent      []Notification
+				forwarded bool
+				attempt   int
+			)
+
+			svc := &services{
+				source: &GmailClient{markAsForwarded: func(ctx context.Context, messageID string) error {
+					forwarded = true
+
+					return nil
+				}},
+				translation: &TranslationService{config: &Config{}, translate: func(ctx context.Context, msg Message) (Translation, error) {
+					err := tt.errs[attempt]
+					attempt++
+
+					return Translation{}, err
+				}},
+				notifiers: Notifiers{sinkTelegram: notifierFunc(func(ctx context.Context, n Notification) error {
+					sent = append(sent, n)
+
+					return nil
+				})},
+				retry: retry,
+				state: state,
+			}
+
+			msg := Message{ID: "m1", Subject: "Sveiki", Content: "Sveiki"}
+
+			var err error
+			for range tt.errs {
+				err = processMessage(context.Background(), svc, msg)
+			}
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("processMessage() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if forwarded != tt.wantForwarded {
+				t.Errorf("forwarded = %v, want %v", forwarded, tt.wantForwarded)
+			}
+
+			if tt.wantContent != "" && (len(sent) != 1 || sent[0].Content != tt.wantContent) {
+				t.Errorf("sent = %+v, want %q", sent, tt.wantContent)
+			}
+
+			if letter, ok := state.DeadLetters()["m1"]; ok != tt.wantDeadLetter ||
+				(ok && (letter.Attempts != 3 || !strings.Contains(letter.Error, "invalid argument"))) {
+				t.Errorf("dead letter = %+v, %v", letter, ok)
+			}
+
+			if tt.wantDeadLetter && len(sent) != 0 {
+				t.Errorf("dead-lettered email was sent: %+v", sent)
+			}
+
+			if _, paused := retry.Paused(time.Now()); paused != tt.wantPaused {
+				t.Errorf("Paused() = %v, want %v", paused, tt.wantPaused)
+			}
+		})
+	}
+}
+
+func TestProcessMessageEmptyContent(t *testing.T) {
+	state, _ := NewStateStore("")
+	retry, _ := NewRetry(RetryConfig{MaxAttempts: 3}, state)
+
+	var (
+		sent      []Notification
+		forwarded bool
+	)
+
+	translation := &TranslationService{config: &Config{}}
+	translation.translate = translation.defaultTranslate
+
+	svc := &services{
+		source: &GmailClient{markAsForwarded: func(ctx context.Context, messageID string) error {
+			forwarded = true
+
+			return nil
+		}},
+		translation: translation,
+		notifiers: Notifiers{sinkTelegram: notifierFunc(func(ctx context.Context, n Notification) error {
+			sent = append(sent, n)
+
+			return nil
+		})},
+		retry: retry,
+		state: state,
+	}
+
+	// An email with only attachments is forwarded with a banner instead of being retried
+	if err := processMessage(context.Background(), svc, Message{ID: "m1", Subject: "Scan"}); err != nil {
+		t.Fatalf("processMessage() error = %v", err)
+	}
+
+	if !forwarded || len(sent) != 1 || sent[0].Content != "⚠️ Not translated: the email has no text" {
+		t.Errorf("forwarded = %v, sent = %+v", forwarded, sent)
+	}
+
+	if len(state.DeadLetters()) != 0 {
+		t.Errorf("dead letters = %+v, want none", state.DeadLetters())
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Ways GmailClient fetches messages, see GmailConfig.Format
+const (
+	gmailFormatFull = "full"
+	gmailFormatRaw  = "raw"
+)
+
+// S/MIME protection detected on a message
+const (
+	smimeSigned    = "signed"
+	smimeEncrypted = "encrypted"
+)
+
+// maxMIMEDepth bounds the recursion into nested multipart bodies
+const maxMIMEDepth = 10
+
+// parseRawMessage parses an RFC 822 message, as fetched with format=raw or read from an
+// .eml file, into a Message. Unlike parseMessage it sees every header and the body exactly
+// as it was sent, including its Content-Transfer-Encoding.
+func parseRawMessage(raw []byte) (Message, error) {
+	var result Message
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return result, fmt.Errorf("failed to read message: %v", err)
+	}
+
+	result.Header = msg.Header
+	result.Subject = decodeHeader(msg.Header.Get("Subject"))
+	result.From = decodeHeader(msg.Header.Get("From"))
+	result.To = decodeHeader(msg.Header.Get("To"))
+	result.Date = msg.Header.Get("Date")
+	result.Time = parseDate(result.Date)
+	result.MessageID = msg.Header.Get("Message-Id")
+	result.InReplyTo = msg.Header.Get("In-Reply-To")
+	result.References = msg.Header.Get("References")
+	result.ReplyTo = decodeHeader(msg.Header.Get("Reply-To"))
+	result.SMIME = smimeType(msg.Header.Get("Content-Type"))
+	// The first Delivered-To is the one added last, by the receiving mailbox
+	result.Account = deliveredTo(msg.Header.Get("Delivered-To"), result.To)
+
+	text, err := extractTextFromEntity(textproto.MIMEHeader(msg.Header), msg.Body, 0)
+	if err != nil {
+		return result, fmt.Errorf("failed to get message content: %v", err)
+	}
+
+	result.Content = text.content()
+	result.Calendars = text.calendars
+	result.Attachments = text.attachments
+
+	return result, nil
+}
+
+// extractTextFromEntity is extractTextFromPart for a raw MIME entity
+func extractTextFromEntity(header textproto.MIMEHeader, body io.Reader, depth int) (mimeText, error) {
+	var result mimeText
+
+	contentType := header.Get("Content-Type")
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// RFC 2045 defaults a missing or broken Content-Type to plain text
+		mediaType, params = "text/plain", nil
+	}
+
+	isCalendar := mediaType == "text/calendar" || mediaType == "application/ics"
+
+	// Attached .ics files are read like inline invitations, other attachments are only listed by name
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if disposition == "attachment" && !isCalendar {
+		if name := attachmentName(mediaType, dispositionParams, params); name != "" {
+			result.attachments = append(result.attachments, name)
+		}
+
+		return result, nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxMIMEDepth || params["boundary"] == "" {
+			return result, nil
+		}
+
+		reader := multipart.NewReader(body, params["boundary"])
+
+		for {
+			part, partErr := reader.NextPart()
+			if partErr == io.EOF {
+				break
+			}
+
+			if partErr != nil {
+				return result, fmt.Errorf("failed to read MIME part: %v", partErr)
+			}
+
+			subText, subErr := extractTextFromEntity(part.Header, part, depth+1)
+			if subErr != nil {
+				return result, subErr
+			}
+
+			result.add(subText)
+		}
+
+		return result, nil
+	}
+
+	if mediaType != "text/plain" && mediaType != "text/html" && !isCalendar {
+		return result, nil
+	}
+
+	data, err := io.ReadAll(decodeTransferEncoding(body, header.Get("Content-Transfer-Encoding")))
+	if err != nil {
+		return result, fmt.Errorf("failed to decode %s body: %v", mediaType, err)
+	}
+
+	text := decodeText(data, contentType)
+
+	switch {
+	case isCalendar:
+		result.calendars = append(result.calendars, text)
+	case mediaType == "text/html":
+		result.html = text
+	default:
+		result.plain = text
+	}
+
+	return result, nil
+}
+
+// decodeTransferEncoding undoes a Content-Transfer-Encoding. multipart.Reader already
+// decodes quoted-printable parts and removes the header, top-level bodies are left to us.
+func decodeTransferEncoding(body io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+// deliveredTo returns the address of the receiving account: the Delivered-To header, or the
+// first To address for servers that do not add it
+func deliveredTo(header, to string) string {
+	if addr, err := mail.ParseAddress(strings.TrimSpace(header)); err == nil {
+		return addr.Address
+	}
+
+	if addrs, err := mail.ParseAddressList(to); err == nil && len(addrs) > 0 {
+		return addrs[0].Address
+	}
+
+	return ""
+}
+
+// smimeType detects S/MIME signed or encrypted messages from their top-level Content-Type
+func smimeType(contentType string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+
+	switch mediaType {
+	case "multipart/signed":
+		if strings.Contains(strings.ToLower(params["protocol"]), "pkcs7-signature") {
+			return smimeSigned
+		}
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		if strings.EqualFold(params["smime-type"], "signed-data") {
+			return smimeSigned
+		}
+
+		return smimeEncrypted
+	}
+
+	return ""
+}
+
+// decodeRawData decodes the base64url "raw" field of a Gmail message, padded or not
+func decodeRawData(data string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "="))
+}
+
+// attachmentName returns the file name of an attachment from its Content-Disposition or, for
+// older mailers, its Content-Type parameters. S/MIME signatures and envelopes are not listed.
+func attachmentName(mediaType string, dispositionParams, typeParams map[string]string) string {
+	if strings.Contains(mediaType, "pkcs7") {
+		return ""
+	}
+
+	name := dispositionParams["filename"]
+	if name == "" {
+		name = typeParams["name"]
+	}
+
+	return decodeHeader(name)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// emlExpectation is the expected parse result stored next to each .eml fixture
+type emlExpectation struct {
+	Subject    string `json:"subject"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Date       string `json:"date"`
+	MessageID  string `json:"message_id"`
+	InReplyTo  string `json:"in_reply_to"`
+	References string `json:"references"`
+	Content    string `json:"content"`
+	SMIME      string `json:"smime"`
+	Calendars  int    `json:"calendars"`
+	// Attachments are the comma separated file names of the attachments
+	Attachments string `json:"attachments"`
+}
+
+func TestParseRawMessageFixtures(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "eml", "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inputs) == 0 {
+		t.Fatal("no eml fixtures found")
+	}
+
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".eml")
+
+		t.Run(name, func(t *testing.T) {
+			raw, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected, err := os.ReadFile(strings.TrimSuffix(input, ".eml") + ".json")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var want emlExpectation
+			if err := json.Unmarshal(expected, &want); err != nil {
+				t.Fatal(err)
+			}
+
+			msg, err := parseRawMessage(raw)
+			if err != nil {
+				t.Fatalf("parseRawMessage() error = %v", err)
+			}
+
+			got := emlExpectation{
+				Subject:     msg.Subject,
+				From:        msg.From,
+				To:          msg.To,
+				Date:        msg.Date,
+				MessageID:   msg.MessageID,
+				InReplyTo:   msg.InReplyTo,
+				References:  msg.References,
+				Content:     strings.ReplaceAll(msg.Content, "\r\n", "\n"),
+				SMIME:       msg.SMIME,
+				Calendars:   len(msg.Calendars),
+				Attachments: strings.Join(msg.Attachments, ","),
+			}
+
+			if got != want {
+				t.Errorf("parseRawMessage() = %+v, want %+v", got, want)
+			}
+
+			if msg.Header.Get("Message-Id") != want.MessageID {
+				t.Errorf("Header not populated: %v", msg.Header)
+			}
+		})
+	}
+}
+
+func TestFetchMessageRaw(t *testing.T) {
+	raw, err := os.ReadFile(filepath.Join("testdata", "eml", "plain_qp_utf8.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockService := NewMockGmailService()
+	mockService.messages = []*gmail.Message{
+		{Id: "raw1", ThreadId: "thread1", Raw: base64.RawURLEncoding.EncodeToString(raw)},
+	}
+
+	client := &GmailClient{
+		service: mockService,
+		config:  &Config{Gmail: GmailConfig{Format: gmailFormatRaw}},
+	}
+
+	msg, err := client.GetMessage(t.Context(), "raw1")
+	if err != nil {
+		t.Fatalf("GetMessage() error = %v", err)
+	}
+
+	if msg.ID != "raw1" || msg.ThreadID != "thread1" || msg.Subject != "Teātra diena" {
+		t.Errorf("GetMessage() = %+v", msg)
+	}
+}
+
+func TestDecodeRawData(t *testing.T) {
+	for _, data := range []string{
+		base64.URLEncoding.EncodeToString([]byte("Subject: ??\r\n\r\nx")),
+		base64.RawURLEncoding.EncodeToString([]byte("Subject: ??\r\n\r\nx")),
+	} {
+		got, err := decodeRawData(data)
+		if err != nil || string(got) != "Subject: ??\r\n\r\nx" {
+			t.Errorf("decodeRawData(%q) = %q, %v", data, got, err)
+		}
+	}
+}
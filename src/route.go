@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// Automatic forum topic modes for a destination
+const (
+	topicsBySender = "sender"
+	topicsByRoute  = "route"
+)
+
+const defaultRouteName = "default"
+
+// DestinationConfig is where a route delivers messages. Empty chat IDs fall back to the telegram section.
+type DestinationConfig struct {
+	// Sinks names the sinks section entries to deliver to, "telegram" for the bot; default ["telegram"]
+	Sinks           []string `yaml:"sinks"`
+	ChannelID       string   `yaml:"channel_id"`
+	ChatID          string   `yaml:"chat_id"`
+	MessageThreadID int64    `yaml:"message_thread_id"`
+	// Topics creates a forum topic per sender domain ("sender") or per route ("route")
+	Topics string `yaml:"topics"`
+	// Via overrides telegram.via for this destination
+	Via string `yaml:"via"`
+	// Template and ParseMode override telegram.template and telegram.parse_mode
+	Template  string `yaml:"template"`
+	ParseMode string `yaml:"parse_mode"`
+}
+
+type RouteConfig struct {
+	Name        string            `yaml:"name"`
+	Filter      FilterConfig      `yaml:"filter"`
+	Destination DestinationConfig `yaml:"destination"`
+	// Cleanup replaces the top-level cleanup settings for this route when set
+	Cleanup *CleanupConfig `yaml:"cleanup"`
+	// Delivery is "immediate" (default) or "digest" to collect emails into periodic summaries
+	Delivery string `yaml:"delivery"`
+	// Digest replaces the top-level digest settings for this route when set
+	Digest *DigestConfig `yaml:"digest"`
+	// Processing replaces translation.processing for this route when set
+	Processing string `yaml:"processing"`
+	// PromptTemplate and ExtractionPromptTemplate replace the prompts of the translation
+	// section for this route, inline or read from the *_file settings
+	PromptTemplate           string `yaml:"prompt_template"`
+	PromptFile               string `yaml:"prompt_file"`
+	ExtractionPromptTemplate string `yaml:"extraction_prompt_template"`
+	ExtractionPromptFile     string `yaml:"extraction_prompt_file"`
+	// Headers replaces translation.headers for this route when set
+	Headers *HeaderTranslationConfig `yaml:"headers"`
+	// Calendar replaces the top-level calendar settings for this route when set
+	Calendar *CalendarConfig `yaml:"calendar"`
+	// QuietHours replaces the top-level quiet hours for this route when set
+	QuietHours *QuietHoursConfig `yaml:"quiet_hours"`
+}
+
+// selectRoute returns the first route whose filter matches msg. Without configured
+// routes every message goes to the default destination, reported as a nil route.
+func selectRoute(config *Config, msg Message) (*RouteConfig, bool) {
+	if len(config.Routes) == 0 {
+		return nil, true
+	}
+
+	for i := range config.Routes {
+		if matchesFilter(config.Routes[i].Filter, msg) {
+			return &config.Routes[i], true
+		}
+	}
+
+	return nil, false
+}
+
+func routeCleanup(config *Config, route *RouteConfig) CleanupConfig {
+	if route != nil && route.Cleanup != nil {
+		return *route.Cleanup
+	}
+
+	return config.Cleanup
+}
+
+func routeName(route *RouteConfig) string {
+	if route == nil || route.Name == "" {
+		return defaultRouteName
+	}
+
+	return route.Name
+}
+
+// senderDomain extracts the lower-cased domain of a From header
+func senderDomain(from string) string {
+	address := from
+	if addr, err := mail.ParseAddress(from); err == nil {
+		address = addr.Address
+	}
+
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		address = address[at+1:]
+	}
+
+	return strings.ToLower(strings.Trim(strings.TrimSpace(address), "<>"))
+}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestSelectRoute(t *testing.T) {
+	config := &Config{
+		Routes: []RouteConfig{
+			{Name: "school", Filter: FilterConfig{From: []string{"@school.lv"}}},
+			{Name: "bank", Filter: FilterConfig{SubjectKeywords: []string{"invoice"}}},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		msg       Message
+		wantRoute string
+		wantOK    bool
+	}{
+		{"first matching route", Message{From: "Teacher <teacher@school.lv>", Subject: "invoice"}, "school", true},
+		{"second route", Message{From: "bank@example.com", Subject: "Your invoice"}, "bank", true},
+		{"no route matches", Message{From: "shop@example.com", Subject: "Sale"}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route, ok := selectRoute(config, tt.msg)
+			if ok != tt.wantOK {
+				t.Fatalf("selectRoute() ok = %v, want %v", ok, tt.wantOK)
+			}
+
+			if ok && route.Name != tt.wantRoute {
+				t.Errorf("selectRoute() = %q, want %q", route.Name, tt.wantRoute)
+			}
+		})
+	}
+
+	// Without routes every message goes to the default destination
+	route, ok := selectRoute(&Config{}, Message{})
+	if !ok || route != nil || routeName(route) != defaultRouteName {
+		t.Errorf("selectRoute() without routes = %v, %v; want default route", route, ok)
+	}
+}
+
+func TestSenderDomain(t *testing.T) {
+	tests := map[string]string{
+		"Prosum <notifications@TransparentClassroom.com>": "transparentclassroom.com",
+		"user@gmail.com":              "gmail.com",
+		"\"Broken <header\" <a@b.lv>": "b.lv",
+		"no-address":                  "no-address",
+	}
+
+	for from, want := range tests {
+		if got := senderDomain(from); got != want {
+			t.Errorf("senderDomain(%q) = %q, want %q", from, got, want)
+		}
+	}
+}
+
+func TestRouteCleanup(t *testing.T) {
+	config := &Config{Cleanup: CleanupConfig{QuotedReplies: true, Signatures: true}}
+	override := &RouteConfig{Name: "raw", Cleanup: &CleanupConfig{}}
+
+	if got := routeCleanup(config, nil); got != config.Cleanup {
+		t.Errorf("routeCleanup() for default route = %+v, want %+v", got, config.Cleanup)
+	}
+
+	if got := routeCleanup(config, &RouteConfig{Name: "inherit"}); got != config.Cleanup {
+		t.Errorf("routeCleanup() without override = %+v, want %+v", got, config.Cleanup)
+	}
+
+	if got := routeCleanup(config, override); got != (CleanupConfig{}) {
+		t.Errorf("routeCleanup() with override = %+v, want disabled", got)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// scheduledJob is work the processing loop runs at times of its own choosing
+type scheduledJob struct {
+	// next returns the first run after now, false when nothing is scheduled
+	next func(now time.Time) (time.Time, bool)
+	run  func(ctx context.Context, now time.Time)
+}
+
+// scheduler runs jobs from the processing loop with one timer set to the earliest due job
+type scheduler struct {
+	jobs  []scheduledJob
+	due   []time.Time
+	timer *time.Timer
+}
+
+func newScheduler(now time.Time, jobs ...scheduledJob) *scheduler {
+	s := &scheduler{jobs: jobs, due: make([]time.Time, len(jobs))}
+
+	for i, job := range jobs {
+		s.due[i], _ = job.next(now)
+	}
+
+	s.arm(now)
+
+	return s
+}
+
+// C fires when a job is due; it never fires without jobs
+func (s *scheduler) C() <-chan time.Time {
+	if s.timer == nil {
+		return nil
+	}
+
+	return s.timer.C
+}
+
+// RunDue runs every job that is due at now and rearms the timer
+func (s *scheduler) RunDue(ctx context.Context, now time.Time) {
+	for i, job := range s.jobs {
+		if s.due[i].IsZero() || now.Before(s.due[i]) {
+			continue
+		}
+
+		job.run(ctx, now)
+
+		s.due[i], _ = job.next(now)
+	}
+
+	s.arm(now)
+}
+
+func (s *scheduler) Stop() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+func (s *scheduler) arm(now time.Time) {
+	var earliest time.Time
+
+	for _, due := range s.due {
+		if !due.IsZero() && (earliest.IsZero() || due.Before(earliest)) {
+			earliest = due
+		}
+	}
+
+	if earliest.IsZero() {
+		s.Stop()
+
+		return
+	}
+
+	if s.timer == nil {
+		s.timer = time.NewTimer(earliest.Sub(now))
+	} else {
+		s.timer.Reset(earliest.Sub(now))
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	start := time.Now()
+
+	var runs []string
+
+	every := func(name string, interval time.Duration) scheduledJob {
+		return scheduledJob{
+			next: func(now time.Time) (time.Time, bool) { return now.Add(interval), true },
+			run: func(ctx context.Context, now time.Time) {
+				runs = append(runs, name)
+			},
+		}
+	}
+
+	idle := scheduledJob{
+		next: func(time.Time) (time.Time, bool) { return time.Time{}, false },
+		run: func(ctx context.Context, now time.Time) {
+			t.Error("job without a schedule ran")
+		},
+	}
+
+	s := newScheduler(start, every("often", time.Millisecond), every("rarely", time.Hour), idle)
+	defer s.Stop()
+
+	select {
+	case now := <-s.C():
+		s.RunDue(context.Background(), now)
+	case <-time.After(time.Second):
+		t.Fatal("scheduler did not fire")
+	}
+
+	if len(runs) != 1 || runs[0] != "often" {
+		t.Errorf("runs = %v, want only the due job", runs)
+	}
+
+	// The job that is due in an hour runs when its time has come
+	s.RunDue(context.Background(), start.Add(time.Hour))
+
+	if len(runs) != 3 || runs[2] != "rarely" {
+		t.Errorf("runs = %v, want both jobs", runs)
+	}
+}
+
+func TestSchedulerWithoutJobs(t *testing.T) {
+	s := newScheduler(time.Now())
+	defer s.Stop()
+
+	if s.C() != nil {
+		t.Error("C() of a scheduler without jobs is not nil")
+	}
+}
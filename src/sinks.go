@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	defaultNtfyServer    = "https://ntfy.sh"
+	maxDiscordContentLen = 2000
+	maxSinkErrorBodyLen  = 200
+
+	// Discord's SUPPRESS_NOTIFICATIONS message flag, the "@silent" of its clients
+	discordSuppressNotifications = 1 << 12
+	ntfyPriorityLow              = 2
+)
+
+func newSinkNotifier(sink SinkConfig) (Notifier, error) {
+	client := sinkClient{client: &http.Client{}, headers: sink.Headers}
+
+	switch sink.Type {
+	case sinkSlack, sinkDiscord, sinkWebhook:
+		if sink.URL == "" {
+			return nil, fmt.Errorf("%s sink needs a url", sink.Type)
+		}
+
+		switch sink.Type {
+		case sinkSlack:
+			return &SlackNotifier{sinkClient: client, url: sink.URL}, nil
+		case sinkDiscord:
+			return &DiscordNotifier{sinkClient: client, url: sink.URL}, nil
+		default:
+			return &WebhookNotifier{sinkClient: client, url: sink.URL}, nil
+		}
+	case sinkMatrix:
+		if sink.URL == "" || sink.Token == "" || sink.RoomID == "" {
+			return nil, fmt.Errorf("matrix sink needs url, token and room_id")
+		}
+
+		return &MatrixNotifier{sinkClient: client, homeserver: sink.URL, token: sink.Token, roomID: sink.RoomID}, nil
+	case sinkNtfy:
+		if sink.Topic == "" {
+			return nil, fmt.Errorf("ntfy sink needs a topic")
+		}
+
+		server := sink.URL
+		if server == "" {
+			server = defaultNtfyServer
+		}
+
+		return &NtfyNotifier{sinkClient: client, server: server, topic: sink.Topic, token: sink.Token}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %q: use %q, %q, %q, %q or %q",
+			sink.Type, sinkSlack, sinkDiscord, sinkMatrix, sinkNtfy, sinkWebhook)
+	}
+}
+
+// sinkClient sends the JSON requests of the HTTP based sinks
+type sinkClient struct {
+	client  *http.Client
+	headers map[string]string
+}
+
+func (c sinkClient) send(ctx context.Context, method, rawURL, token string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	for name, value := range c.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxSinkErrorBodyLen))
+		if text := strings.TrimSpace(string(body)); text != "" {
+			return fmt.Errorf("non-2xx status code: %d: %s", resp.StatusCode, text)
+		}
+
+		return fmt.Errorf("non-2xx status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// SlackNotifier posts to a Slack incoming webhook using mrkdwn
+type SlackNotifier struct {
+	sinkClient
+	url string
+}
+
+var slackRenderer = markdownRenderer{
+	text: slackEscape,
+	bold: func(s string) string { return "*" + slackEscape(s) + "*" },
+	link: func(text, url string) string {
+		if text == "" {
+			return "<" + url + ">"
+		}
+
+		return "<" + url + "|" + slackEscape(text) + ">"
+	},
+}
+
+// slackEscape escapes the characters Slack treats as control sequences
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+func (s *SlackNotifier) Notify(ctx context.Context, n Notification) error {
+	text := slackRenderer.render(formatNotification(n))
+
+	return s.send(ctx, http.MethodPost, s.url, "", map[string]any{"text": text})
+}
+
+// DiscordNotifier posts to a Discord channel webhook
+type DiscordNotifier struct {
+	sinkClient
+	url string
+}
+
+// commonMarkRenderer writes standard Markdown, understood by Discord and ntfy
+var commonMarkRenderer = markdownRenderer{
+	text: func(s string) string { return s },
+	bold: func(s string) string { return "**" + s + "**" },
+	link: func(text, url string) string {
+		if text == "" {
+			return url
+		}
+
+		return "[" + text + "](" + url + ")"
+	},
+}
+
+func (d *DiscordNotifier) Notify(ctx context.Context, n Notification) error {
+	content := commonMarkRenderer.render(formatNotification(n))
+
+	payload := map[string]any{
+		"content": truncateRunes(content, maxDiscordContentLen),
+		// Emails must not ping @everyone or anyone else in the server
+		"allowed_mentions": map[string][]string{"parse": {}},
+	}
+
+	if n.Silent {
+		payload["flags"] = discordSuppressNotifications
+	}
+
+	return d.send(ctx, http.MethodPost, d.url, "", payload)
+}
+
+// MatrixNotifier sends m.room.message events through the client-server API
+type MatrixNotifier struct {
+	sinkClient
+	homeserver string
+	token      string
+	roomID     string
+}
+
+var matrixHTMLRenderer = markdownRenderer{
+	text: func(s string) string { return strings.ReplaceAll(html.EscapeString(s), "\n", "<br>") },
+	bold: func(s string) string { return "<b>" + html.EscapeString(s) + "</b>" },
+	link: func(text, url string) string {
+		if text == "" {
+			text = url
+		}
+
+		return `<a href="` + html.EscapeString(url) + `">` + html.EscapeString(text) + "</a>"
+	},
+}
+
+func (m *MatrixNotifier) Notify(ctx context.Context, n Notification) error {
+	markdown := formatNotification(n)
+
+	// The transaction ID makes retries of the same email idempotent on the homeserver. Digests
+	// have no email ID, so their posts are told apart by their text.
+	txnID := "mail-" + n.Message.ID
+	if n.Message.ID == "" {
+		txnID = "post-" + cacheKey(routeName(n.Message.Route), markdown)
+	}
+
+	rawURL := strings.TrimSuffix(m.homeserver, "/") + "/_matrix/client/v3/rooms/" + url.PathEscape(m.roomID) +
+		"/send/m.room.message/" + url.PathEscape(txnID)
+
+	return m.send(ctx, http.MethodPut, rawURL, m.token, map[string]any{
+		"msgtype":        "m.text",
+		"body":           plainRenderer.render(markdown),
+		"format":         "org.matrix.custom.html",
+		"formatted_body": matrixHTMLRenderer.render(markdown),
+	})
+}
+
+// NtfyNotifier publishes to an ntfy topic with Markdown formatting
+type NtfyNotifier struct {
+	sinkClient
+	server string
+	topic  string
+	token  string
+}
+
+func (n *NtfyNotifier) Notify(ctx context.Context, notification Notification) error {
+	msg := notification.Message
+
+	// JSON publishing keeps non-ASCII subjects intact, unlike the Title header
+	payload := map[string]any{
+		"topic":    n.topic,
+		"title":    msg.Subject,
+		"message":  commonMarkRenderer.render(formatBody(msg.Date, msg.From, notification.Content, notification.Original)),
+		"markdown": true,
+	}
+
+	// Low priority messages show up without sound or vibration
+	if notification.Silent {
+		payload["priority"] = ntfyPriorityLow
+	}
+
+	return n.send(ctx, http.MethodPost, strings.TrimSuffix(n.server, "/"), n.token, payload)
+}
+
+// WebhookNotifier posts the notification as JSON to any URL
+type WebhookNotifier struct {
+	sinkClient
+	url string
+}
+
+// webhookPayload is the JSON body of the generic webhook sink
+type webhookPayload struct {
+	ID        string `json:"id"`
+	ThreadID  string `json:"thread_id,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+	Route     string `json:"route"`
+	Subject   string `json:"subject"`
+	From      string `json:"from"`
+	To        string `json:"to,omitempty"`
+	Date      string `json:"date"`
+	Content   string `json:"content"`
+	Original  string `json:"original,omitempty"`
+	// Text is the formatted notification without markup
+	Text string `json:"text"`
+	// Silent is set during quiet hours
+	Silent bool `json:"silent,omitempty"`
+}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, n Notification) error {
+	msg := n.Message
+
+	return w.send(ctx, http.MethodPost, w.url, "", webhookPayload{
+		ID:        msg.ID,
+		ThreadID:  msg.ThreadID,
+		MessageID: msg.MessageID,
+		Route:     routeName(msg.Route),
+		Subject:   msg.Subject,
+		From:      msg.From,
+		To:        msg.To,
+		Date:      msg.Date,
+		Content:   n.Content,
+		Original:  n.Original,
+		Text:      plainRenderer.render(msg.Subject + "\n\n" + formatBody(msg.Date, msg.From, n.Content, n.Original)),
+		Silent:    n.Silent,
+	})
+}
+
+// truncateRunes cuts s to at most limit runes, marking the cut with an ellipsis
+func truncateRunes(s string, limit int) string {
+	if utf8.RuneCountInString(s) <= limit {
+		return s
+	}
+
+	return string([]rune(s)[:limit-1]) + "…"
+}
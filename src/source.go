@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// Mailbox providers messages can be read from, see Config.Source
+const (
+	sourceGmail = "gmail"
+	sourceIMAP  = "imap"
+	sourceGraph = "graph"
+)
+
+// MailSource is a mailbox the forwarder reads messages from
+type MailSource interface {
+	// GetNewMessages returns messages that were not forwarded yet and pass the filter
+	GetNewMessages(ctx context.Context) ([]Message, error)
+	// GetMessage fetches and parses a single message by its source ID
+	GetMessage(ctx context.Context, id string) (Message, error)
+	// MarkAsForwarded records that a message was delivered so it is not returned again
+	MarkAsForwarded(ctx context.Context, id string) error
+}
+
+// PushSource is a MailSource that announces new mail instead of waiting for the next poll
+type PushSource interface {
+	MailSource
+	// Watch signals on the returned channel whenever new mail may have arrived until ctx is done
+	Watch(ctx context.Context) <-chan struct{}
+}
+
+// sourceFilter returns the filter of the configured mailbox
+func sourceFilter(config *Config) FilterConfig {
+	switch config.Source {
+	case sourceIMAP:
+		return config.IMAP.Filter
+	case sourceGraph:
+		return config.Graph.Filter
+	}
+
+	return config.Gmail.Filter
+}
+
+// prepareMessage applies the source filter and routes to a parsed message and cleans its
+// body. It reports false when the message should not be forwarded.
+func prepareMessage(config *Config, filter FilterConfig, msg Message) (Message, bool) {
+	if !matchesFilter(filter, msg) {
+		return msg, false
+	}
+
+	route, ok := selectRoute(config, msg)
+	if !ok {
+		return msg, false
+	}
+
+	if msg.SMIME == smimeEncrypted {
+		log.Printf("Message %s is S/MIME encrypted, its body cannot be read", msg.ID)
+	}
+
+	msg.Route = route
+	msg.Content = cleanContent(msg.Content, routeCleanup(config, route))
+
+	return msg, true
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ForwardedMessage links a Telegram message back to the Gmail message it was created from
+type ForwardedMessage struct {
+	GmailID    string `json:"gmail_id"`
+	ThreadID   string `json:"thread_id"`
+	MessageID  string `json:"message_id"`
+	References string `json:"references,omitempty"`
+	Subject    string `json:"subject"`
+	From       string `json:"from"`
+	ReplyTo    string `json:"reply_to,omitempty"`
+	// Model names the models that translated the email
+	Model string `json:"model,omitempty"`
+}
+
+// PendingReply is a reply drafted in Telegram that is waiting for confirmation
+type PendingReply struct {
+	ForwardedKey string `json:"forwarded_key"`
+	Body         string `json:"body"`
+	UserID       int64  `json:"user_id"`
+}
+
+// TelegramThread records where the first email of a Gmail thread was posted
+type TelegramThread struct {
+	Destination string `json:"destination"`
+	ChatID      int64  `json:"chat_id"`
+	MessageID   int64  `json:"message_id"`
+	TopicID     int64  `json:"topic_id,omitempty"`
+}
+
+// DigestEntry is an email waiting in a route's digest queue
+type DigestEntry struct {
+	ID       string    `json:"id"`
+	Subject  string    `json:"subject"`
+	From     string    `json:"from"`
+	Date     string    `json:"date"`
+	Summary  string    `json:"summary"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+// FailedMessage counts the failed attempts to process an email
+type FailedMessage struct {
+	Subject     string    `json:"subject"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error"`
+	LastAttempt time.Time `json:"last_attempt"`
+}
+
+// DeadLetter is an email that was given up on after too many failed attempts
+type DeadLetter struct {
+	Subject  string    `json:"subject"`
+	From     string    `json:"from"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	At       time.Time `json:"at"`
+}
+
+type stateData struct {
+	Forwarded      map[string]ForwardedMessage `json:"forwarded"`
+	PendingReplies map[string]PendingReply     `json:"pending_replies"`
+	Threads        map[string]TelegramThread   `json:"threads"`
+	MessageThreads map[string]string           `json:"message_threads"`
+	Topics         map[string]int64            `json:"topics"`
+	Cursors        map[string]string           `json:"cursors"`
+	Pending        map[string][]string         `json:"pending"`
+	Digests        map[string][]DigestEntry    `json:"digests"`
+	DigestsSent    map[string]time.Time        `json:"digests_sent"`
+	Failures       map[string]FailedMessage    `json:"failures"`
+	DeadLetters    map[string]DeadLetter       `json:"dead_letters"`
+	UpdateOffset   int64                       `json:"update_offset"`
+}
+
+// StateStore keeps forwarder state in a JSON file so it survives restarts.
+// An empty path gives an in-memory store.
+type StateStore struct {
+	mu   sync.Mutex
+	path string
+	data stateData
+}
+
+func NewStateStore(path string) (*StateStore, error) {
+	s := &StateStore{path: path}
+
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("unable to read state file: %v", err)
+		}
+
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &s.data); err != nil {
+				return nil, fmt.Errorf("unable to parse state file: %v", err)
+			}
+		}
+	}
+
+	if s.data.Forwarded == nil {
+		s.data.Forwarded = make(map[string]ForwardedMessage)
+	}
+
+	if s.data.PendingReplies == nil {
+		s.data.PendingReplies = make(map[string]PendingReply)
+	}
+
+	if s.data.Threads == nil {
+		s.data.Threads = make(map[string]TelegramThread)
+	}
+
+	if s.data.MessageThreads == nil {
+		s.data.MessageThreads = make(map[string]string)
+	}
+
+	if s.data.Topics == nil {
+		s.data.Topics = make(map[string]int64)
+	}
+
+	if s.data.Cursors == nil {
+		s.data.Cursors = make(map[string]string)
+	}
+
+	if s.data.Pending == nil {
+		s.data.Pending = make(map[string][]string)
+	}
+
+	if s.data.Digests == nil {
+		s.data.Digests = make(map[string][]DigestEntry)
+	}
+
+	if s.data.DigestsSent == nil {
+		s.data.DigestsSent = make(map[string]time.Time)
+	}
+
+	if s.data.Failures == nil {
+		s.data.Failures = make(map[string]FailedMessage)
+	}
+
+	if s.data.DeadLetters == nil {
+		s.data.DeadLetters = make(map[string]DeadLetter)
+	}
+
+	return s, nil
+}
+
+// telegramKey builds the state key for a Telegram message
+func telegramKey(chatID, messageID int64) string {
+	return fmt.Sprintf("%d:%d", chatID, messageID)
+}
+
+func (s *StateStore) Forwarded(key string) (ForwardedMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fwd, ok := s.data.Forwarded[key]
+
+	return fwd, ok
+}
+
+func (s *StateStore) SaveForwarded(key string, fwd ForwardedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Forwarded[key] = fwd
+
+	return s.save()
+}
+
+func (s *StateStore) PendingReply(key string) (PendingReply, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending, ok := s.data.PendingReplies[key]
+
+	return pending, ok
+}
+
+func (s *StateStore) SavePendingReply(key string, pending PendingReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.PendingReplies[key] = pending
+
+	return s.save()
+}
+
+func (s *StateStore) DeletePendingReply(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data.PendingReplies, key)
+
+	return s.save()
+}
+
+// ThreadFor resolves the thread key of a message and the Telegram thread it belongs to.
+// Gmail's thread ID is preferred; In-Reply-To catches replies that Gmail split into a new
+// thread, e.g. after a subject change.
+func (s *StateStore) ThreadFor(msg Message) (string, TelegramThread, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if thread, ok := s.data.Threads[msg.ThreadID]; ok && msg.ThreadID != "" {
+		return msg.ThreadID, thread, true
+	}
+
+	if key, ok := s.data.MessageThreads[msg.InReplyTo]; ok && msg.InReplyTo != "" {
+		if thread, ok := s.data.Threads[key]; ok {
+			return key, thread, true
+		}
+	}
+
+	return msg.ThreadID, TelegramThread{}, false
+}
+
+// SaveThread stores the Telegram thread for key and indexes messageID under it
+func (s *StateStore) SaveThread(key, messageID string, thread TelegramThread) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key == "" {
+		return nil
+	}
+
+	s.data.Threads[key] = thread
+
+	if messageID != "" {
+		s.data.MessageThreads[messageID] = key
+	}
+
+	return s.save()
+}
+
+// Topic returns the forum topic created for key, see TelegramBot.autoTopic
+func (s *StateStore) Topic(key string) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.data.Topics[key]
+
+	return id, ok
+}
+
+func (s *StateStore) SaveTopic(key string, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Topics[key] = id
+
+	return s.save()
+}
+
+func (s *StateStore) DeleteTopic(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data.Topics, key)
+
+	return s.save()
+}
+
+// Cursor returns the sync position a mail source saved under key, e.g. a Graph delta link
+func (s *StateStore) Cursor(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.data.Cursors[key]
+}
+
+func (s *StateStore) SetCursor(key, cursor string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Cursors[key] = cursor
+
+	return s.save()
+}
+
+// Pending returns the IDs of the emails a source listed under key that are not forwarded yet
+func (s *StateStore) Pending(key string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.data.Pending[key])
+}
+
+func (s *StateStore) SetPending(key string, ids []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(ids) == 0 {
+		delete(s.data.Pending, key)
+	} else {
+		s.data.Pending[key] = ids
+	}
+
+	return s.save()
+}
+
+// QueueDigest adds an email to the digest queue of a route
+func (s *StateStore) QueueDigest(route string, entry DigestEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Digests[route] = append(s.data.Digests[route], entry)
+
+	return s.save()
+}
+
+// DigestQueued reports whether an email waits in any digest queue
+func (s *StateStore) DigestQueued(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, entries := range s.data.Digests {
+		for _, entry := range entries {
+			if entry.ID == id {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Digest returns the queued emails of a route, oldest first
+func (s *StateStore) Digest(route string) []DigestEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.data.Digests[route])
+}
+
+// CompleteDigest removes the sent emails from a route's queue and records when the digest went out
+func (s *StateStore) CompleteDigest(route string, ids []string, sentAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Digests[route] = slices.DeleteFunc(s.data.Digests[route], func(entry DigestEntry) bool {
+		return slices.Contains(ids, entry.ID)
+	})
+
+	if len(s.data.Digests[route]) == 0 {
+		delete(s.data.Digests, route)
+	}
+
+	s.data.DigestsSent[route] = sentAt
+
+	return s.save()
+}
+
+// DigestSent returns when the last digest of a route went out, zero if never
+func (s *StateStore) DigestSent(route string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.data.DigestsSent[route]
+}
+
+// RecordFailure counts a failed attempt to process an email and returns the attempts so far
+func (s *StateStore) RecordFailure(id, subject, reason string, at time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failure := s.data.Failures[id]
+	failure.Subject = subject
+	failure.Attempts++
+	failure.LastError = reason
+	failure.LastAttempt = at
+	s.data.Failures[id] = failure
+
+	return failure.Attempts, s.save()
+}
+
+// ClearFailure forgets the failed attempts of an email once it went through
+func (s *StateStore) ClearFailure(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.data.Failures[id]; !ok {
+		return nil
+	}
+
+	delete(s.data.Failures, id)
+
+	return s.save()
+}
+
+// SaveDeadLetter moves an email from the failures to the dead letters
+func (s *StateStore) SaveDeadLetter(id string, letter DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data.Failures, id)
+	s.data.DeadLetters[id] = letter
+
+	return s.save()
+}
+
+// DeadLetters returns the emails that were given up on
+func (s *StateStore) DeadLetters() map[string]DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return maps.Clone(s.data.DeadLetters)
+}
+
+func (s *StateStore) UpdateOffset() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.data.UpdateOffset
+}
+
+func (s *StateStore) SetUpdateOffset(offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.UpdateOffset = offset
+
+	return s.save()
+}
+
+// discardChanges keeps later changes in memory only, for dry runs
+func (s *StateStore) discardChanges() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.path = ""
+}
+
+// save writes the state to disk; callers must hold s.mu
+func (s *StateStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	raw, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode state: %v", err)
+	}
+
+	if err := writeFileAtomic(s.path, raw); err != nil {
+		return fmt.Errorf("unable to write state file: %v", err)
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes to a temporary file first so a crash never leaves a truncated file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
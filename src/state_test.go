@@ -0,0 +1,143 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	state, err := NewStateStore(path)
+	if err != nil {
+		t.Fatalf("NewStateStore failed: %v", err)
+	}
+
+	fwd := ForwardedMessage{GmailID: "gmail-1", ThreadID: "thread-1", Subject: "Test Subject"}
+	if err := state.SaveForwarded(telegramKey(-100, 42), fwd); err != nil {
+		t.Fatalf("SaveForwarded failed: %v", err)
+	}
+
+	if err := state.SetUpdateOffset(7); err != nil {
+		t.Fatalf("SetUpdateOffset failed: %v", err)
+	}
+
+	reloaded, err := NewStateStore(path)
+	if err != nil {
+		t.Fatalf("NewStateStore failed on reload: %v", err)
+	}
+
+	got, ok := reloaded.Forwarded(telegramKey(-100, 42))
+	if !ok || got != fwd {
+		t.Errorf("Forwarded() = %+v, %v, want %+v", got, ok, fwd)
+	}
+
+	if reloaded.UpdateOffset() != 7 {
+		t.Errorf("UpdateOffset() = %d, want 7", reloaded.UpdateOffset())
+	}
+}
+
+func TestStateStorePendingReplies(t *testing.T) {
+	state, err := NewStateStore("")
+	if err != nil {
+		t.Fatalf("NewStateStore failed: %v", err)
+	}
+
+	pending := PendingReply{ForwardedKey: "1:2", Body: "Thanks!", UserID: 5}
+	if err := state.SavePendingReply("1:3", pending); err != nil {
+		t.Fatalf("SavePendingReply failed: %v", err)
+	}
+
+	if got, ok := state.PendingReply("1:3"); !ok || got != pending {
+		t.Errorf("PendingReply() = %+v, %v, want %+v", got, ok, pending)
+	}
+
+	if err := state.DeletePendingReply("1:3"); err != nil {
+		t.Fatalf("DeletePendingReply failed: %v", err)
+	}
+
+	if _, ok := state.PendingReply("1:3"); ok {
+		t.Error("PendingReply() still present after delete")
+	}
+}
+
+func TestStateStoreThreadFor(t *testing.T) {
+	state, err := NewStateStore("")
+	if err != nil {
+		t.Fatalf("NewStateStore failed: %v", err)
+	}
+
+	first := Message{ThreadID: "thread-1", MessageID: "<a@example.com>"}
+
+	key, _, found := state.ThreadFor(first)
+	if found || key != "thread-1" {
+		t.Fatalf("ThreadFor() on empty store = %q, %v; want thread-1, false", key, found)
+	}
+
+	thread := TelegramThread{Destination: "chat", ChatID: -1, MessageID: 10}
+	if err := state.SaveThread(key, first.MessageID, thread); err != nil {
+		t.Fatalf("SaveThread failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		msg     Message
+		wantKey string
+		found   bool
+	}{
+		{"same gmail thread", Message{ThreadID: "thread-1"}, "thread-1", true},
+		{"split thread found by In-Reply-To", Message{ThreadID: "thread-2", InReplyTo: "<a@example.com>"}, "thread-1", true},
+		{"unrelated message", Message{ThreadID: "thread-3", InReplyTo: "<x@example.com>"}, "thread-3", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, got, found := state.ThreadFor(tt.msg)
+			if key != tt.wantKey || found != tt.found {
+				t.Errorf("ThreadFor() = %q, %v; want %q, %v", key, found, tt.wantKey, tt.found)
+			}
+
+			if found && got != thread {
+				t.Errorf("ThreadFor() thread = %+v, want %+v", got, thread)
+			}
+		})
+	}
+}
+
+func TestStateStoreDigests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	state, err := NewStateStore(path)
+	if err != nil {
+		t.Fatalf("NewStateStore failed: %v", err)
+	}
+
+	for _, id := range []string{"a", "b"} {
+		if err := state.QueueDigest("school", DigestEntry{ID: id, Subject: "Subject " + id}); err != nil {
+			t.Fatalf("QueueDigest failed: %v", err)
+		}
+	}
+
+	reloaded, err := NewStateStore(path)
+	if err != nil {
+		t.Fatalf("NewStateStore failed on reload: %v", err)
+	}
+
+	if !reloaded.DigestQueued("b") || reloaded.DigestQueued("c") {
+		t.Error("DigestQueued() does not match the queued emails")
+	}
+
+	sentAt := time.Date(2025, 3, 28, 8, 0, 0, 0, time.UTC)
+	if err := reloaded.CompleteDigest("school", []string{"a"}, sentAt); err != nil {
+		t.Fatalf("CompleteDigest failed: %v", err)
+	}
+
+	if got := reloaded.Digest("school"); len(got) != 1 || got[0].ID != "b" {
+		t.Errorf("Digest() = %+v, want only b left", got)
+	}
+
+	if got := reloaded.DigestSent("school"); !got.Equal(sentAt) {
+		t.Errorf("DigestSent() = %v, want %v", got, sentAt)
+	}
+}
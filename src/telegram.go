@@ -1,11 +1,30 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Threading modes for emails that belong to the same Gmail thread
+const (
+	threadingReply = "reply"
+	threadingTopic = "topic"
+	threadingOff   = "off"
+
+	maxTopicNameLength = 128
 )
 
 type TelegramBot struct {
@@ -14,83 +33,709 @@ type TelegramBot struct {
 	channelID string
 	chatID    string
 	baseURL   string
+	threading string
+	// Default forum topic settings for routes without their own
+	messageThreadID int64
+	topics          string
+	// via is the default of DestinationConfig.Via; user posts through the user client
+	via   string
+	user  *TelegramUserClient
+	state *StateStore
+	// Default message template and parse mode for routes without their own
+	template  string
+	parseMode string
+	templates telegramTemplates
+	dates     dateFormatter
+}
+
+// SentMessage identifies a message posted by the bot
+type SentMessage struct {
+	Destination string
+	ChatID      int64
+	MessageID   int64
+	TopicID     int64
+}
+
+type TelegramUser struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+type TelegramChat struct {
+	ID int64 `json:"id"`
+}
+
+type TelegramMessage struct {
+	MessageID      int64            `json:"message_id"`
+	From           *TelegramUser    `json:"from"`
+	Chat           TelegramChat     `json:"chat"`
+	Text           string           `json:"text"`
+	ReplyToMessage *TelegramMessage `json:"reply_to_message"`
+}
+
+type CallbackQuery struct {
+	ID      string           `json:"id"`
+	From    TelegramUser     `json:"from"`
+	Message *TelegramMessage `json:"message"`
+	Data    string           `json:"data"`
+}
+
+type Update struct {
+	UpdateID      int64            `json:"update_id"`
+	Message       *TelegramMessage `json:"message"`
+	CallbackQuery *CallbackQuery   `json:"callback_query"`
+}
+
+type ForumTopic struct {
+	MessageThreadID int64  `json:"message_thread_id"`
+	Name            string `json:"name"`
 }
 
-func NewTelegramBot(config *Config) (*TelegramBot, error) {
-	if config.Telegram.BotToken == "" {
+type InlineKeyboardButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data,omitempty"`
+	URL          string `json:"url,omitempty"`
+}
+
+type InlineKeyboardMarkup struct {
+	InlineKeyboard [][]InlineKeyboardButton `json:"inline_keyboard"`
+}
+
+type telegramResponse struct {
+	OK          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	Description string          `json:"description"`
+}
+
+func NewTelegramBot(config *Config, state *StateStore) (*TelegramBot, error) {
+	if err := validateTelegramVia(config); err != nil {
+		return nil, err
+	}
+
+	// Destinations that post as a user do not need a bot, replies always do
+	if config.Telegram.BotToken == "" && (usesTelegramVia(config, viaBot) || config.Reply.Enabled) {
 		return nil, fmt.Errorf("telegram bot token is required")
 	}
 
+	threading := config.Telegram.Threading
+	if threading == "" {
+		threading = threadingReply
+	}
+
+	if threading != threadingReply && threading != threadingTopic && threading != threadingOff {
+		return nil, fmt.Errorf("unknown telegram threading mode %q", threading)
+	}
+
+	if !validTopicsMode(config.Telegram.Topics) {
+		return nil, fmt.Errorf("unknown telegram topics mode %q", config.Telegram.Topics)
+	}
+
+	for _, route := range config.Routes {
+		if !validTopicsMode(route.Destination.Topics) {
+			return nil, fmt.Errorf("unknown topics mode %q in route %q", route.Destination.Topics, route.Name)
+		}
+	}
+
+	templates, err := parseTelegramTemplates(config)
+	if err != nil {
+		return nil, err
+	}
+
+	dates, err := newDateFormatter(config.Telegram.Date)
+	if err != nil {
+		return nil, err
+	}
+
 	return &TelegramBot{
-		client:    &http.Client{},
-		botToken:  config.Telegram.BotToken,
-		channelID: config.Telegram.ChannelID,
-		chatID:    config.Telegram.ChatID,
-		baseURL:   "https://api.telegram.org/bot" + config.Telegram.BotToken,
+		client:          &http.Client{},
+		botToken:        config.Telegram.BotToken,
+		channelID:       config.Telegram.ChannelID,
+		chatID:          config.Telegram.ChatID,
+		baseURL:         "https://api.telegram.org/bot" + config.Telegram.BotToken,
+		threading:       threading,
+		messageThreadID: config.Telegram.MessageThreadID,
+		topics:          config.Telegram.Topics,
+		via:             config.Telegram.Via,
+		state:           state,
+		template:        config.Telegram.Template,
+		parseMode:       config.Telegram.ParseMode,
+		templates:       templates,
+		dates:           dates,
 	}, nil
 }
 
-func (b *TelegramBot) SendMessage(
-	ctx context.Context,
-	subject, content, from, date string,
-	originalContent string,
-) error {
-	message := fmt.Sprintf("*%s*\n\n", subject)
-	message += fmt.Sprintf("📅 %s\n", date)
-	message += fmt.Sprintf("📧 From: %s\n\n", from)
+// telegramRoutes lists the routes that deliver to Telegram, nil standing for the default destination
+func telegramRoutes(config *Config) []*RouteConfig {
+	if len(config.Routes) == 0 {
+		return []*RouteConfig{nil}
+	}
+
+	var routes []*RouteConfig
+
+	for i := range config.Routes {
+		if slices.Contains(destinationSinks(&config.Routes[i]), sinkTelegram) {
+			routes = append(routes, &config.Routes[i])
+		}
+	}
+
+	return routes
+}
+
+// routeVia returns whether a route posts as the bot or as the user account
+func routeVia(defaultVia string, route *RouteConfig) string {
+	if route != nil && route.Destination.Via != "" {
+		return route.Destination.Via
+	}
+
+	if defaultVia != "" {
+		return defaultVia
+	}
+
+	return viaBot
+}
+
+// usesTelegramVia reports whether any Telegram destination posts via the given mode
+func usesTelegramVia(config *Config, via string) bool {
+	for _, route := range telegramRoutes(config) {
+		if routeVia(config.Telegram.Via, route) == via {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateTelegramVia checks the via settings; automatic forum topics need the Bot API
+func validateTelegramVia(config *Config) error {
+	if via := config.Telegram.Via; via != "" && via != viaBot && via != viaUser {
+		return fmt.Errorf("unknown telegram via %q: use %q or %q", via, viaBot, viaUser)
+	}
+
+	for _, route := range telegramRoutes(config) {
+		if route != nil && route.Destination.Via != "" && route.Destination.Via != viaBot && route.Destination.Via != viaUser {
+			return fmt.Errorf("unknown via %q in route %q: use %q or %q", route.Destination.Via, route.Name, viaBot, viaUser)
+		}
+
+		if routeVia(config.Telegram.Via, route) != viaUser {
+			continue
+		}
+
+		topics := config.Telegram.Topics
+		if route != nil && (route.Destination.MessageThreadID != 0 || route.Destination.Topics != "") {
+			topics = route.Destination.Topics
+		}
+
+		if topics != "" || config.Telegram.Threading == threadingTopic {
+			return fmt.Errorf("route %q posts as a user, which does not support automatic forum topics", routeName(route))
+		}
+	}
+
+	return nil
+}
+
+func validTopicsMode(mode string) bool {
+	return mode == "" || mode == topicsBySender || mode == topicsByRoute
+}
+
+// render lays out n with the message template of its route
+func (b *TelegramBot) render(n Notification) (string, error) {
+	text, parseMode := routeTelegramTemplate(b.template, b.parseMode, n.Message.Route)
+
+	tmpl, err := b.templates.get(text, parseMode)
+	if err != nil {
+		return "", err
+	}
+
+	return renderTelegramTemplate(tmpl, telegramTemplateData(n, parseMode, b.dates))
+}
+
+// sendTestNotification posts n as the bot to chatID instead of its destination, keeping the
+// route's layout but no forum topics
+func (b *TelegramBot) sendTestNotification(ctx context.Context, n Notification, chatID string) (SentMessage, error) {
+	test := *b
+	test.via, test.messageThreadID, test.topics = viaBot, 0, ""
+
+	route := RouteConfig{Name: defaultRouteName}
+	if n.Message.Route != nil {
+		route = *n.Message.Route
+	}
+
+	route.Destination = DestinationConfig{
+		ChatID:    chatID,
+		Template:  route.Destination.Template,
+		ParseMode: route.Destination.ParseMode,
+	}
+	n.Message.Route = &route
+
+	return test.sendNotification(ctx, n, TelegramThread{})
+}
+
+// sendNotification posts n laid out with the message template of its route
+func (b *TelegramBot) sendNotification(ctx context.Context, n Notification, thread TelegramThread) (SentMessage, error) {
+	route, subject, from, silent := n.Message.Route, n.Message.Subject, n.Message.From, n.Silent
+
+	message, err := b.render(n)
+	if err != nil {
+		return SentMessage{}, err
+	}
 
-	// TODO: remove flags
-	if originalContent != "" {
-		message += fmt.Sprintf("🇷🇺 Translation:\n%s\n\n", content)
-		message += fmt.Sprintf("🇬🇧 Original:\n%s", originalContent)
-	} else {
-		message += content
+	// Routes without their own chat use the telegram section
+	channelID, chatID := b.channelID, b.chatID
+	if route != nil && (route.Destination.ChannelID != "" || route.Destination.ChatID != "") {
+		channelID, chatID = route.Destination.ChannelID, route.Destination.ChatID
+	}
+
+	send := func(chatID string) (SentMessage, error) {
+		if routeVia(b.via, route) != viaUser {
+			return b.sendToChat(ctx, route, chatID, message, subject, from, thread, silent)
+		}
+
+		if b.user == nil {
+			return SentMessage{}, fmt.Errorf("telegram user client is not configured")
+		}
+
+		topicID, _ := b.routeTopics(route)
+
+		return b.user.sendToChat(ctx, chatID, message, topicID, thread, silent)
 	}
 
 	// Try to send to channel first
-	if b.channelID != "" {
-		if err := b.sendToChat(ctx, b.channelID, message); err == nil {
-			return nil
+	if channelID != "" {
+		if sent, err := send(channelID); err == nil {
+			return sent, nil
 		}
 	}
 
 	// Fallback to chat if channel fails or is not configured
-	if b.chatID != "" {
-		return b.sendToChat(ctx, b.chatID, message)
+	if chatID != "" {
+		return send(chatID)
 	}
 
-	return fmt.Errorf("neither channel_id nor chat_id is configured")
+	return SentMessage{}, fmt.Errorf("neither channel_id nor chat_id is configured")
 }
 
-func (b *TelegramBot) sendToChat(ctx context.Context, chatID, message string) error {
-	apiURL, err := url.Parse(b.baseURL)
+// Notify sends n with sendNotification, following up earlier emails of its thread, and remembers
+// where it went so later emails and replies from Telegram can find it
+func (b *TelegramBot) Notify(ctx context.Context, n Notification) error {
+	msg := n.Message
+
+	var (
+		threadKey   = msg.ThreadID
+		thread      TelegramThread
+		threadFound bool
+	)
+
+	if b.state != nil {
+		threadKey, thread, threadFound = b.state.ThreadFor(msg)
+	}
+
+	sent, err := b.sendNotification(ctx, n, thread)
 	if err != nil {
-		return fmt.Errorf("invalid base URL: %v", err)
+		return err
 	}
 
-	apiURL.Path = path.Join(apiURL.Path, "sendMessage")
+	// The email itself was delivered, a missing calendar file is only logged
+	if len(n.Events) > 0 {
+		if err := b.sendCalendar(ctx, msg.Route, sent, n.Events, n.Silent); err != nil {
+			log.Printf("Error sending calendar events: %v", err)
+		}
+	}
+
+	// Digests stand for several emails and cannot be threaded or replied to
+	if b.state == nil || msg.ID == "" {
+		return nil
+	}
+
+	// The first email of a thread anchors it; later ones only move it to a new chat or topic
+	if !threadFound || thread.Destination != sent.Destination || thread.TopicID != sent.TopicID {
+		thread = TelegramThread{
+			Destination: sent.Destination,
+			ChatID:      sent.ChatID,
+			MessageID:   sent.MessageID,
+			TopicID:     sent.TopicID,
+		}
+	}
+
+	if err := b.state.SaveThread(threadKey, msg.MessageID, thread); err != nil {
+		log.Printf("Error saving thread state: %v", err)
+	}
+
+	// Remember where the message went so replies in Telegram can be mapped back to Gmail
+	err = b.state.SaveForwarded(telegramKey(sent.ChatID, sent.MessageID), ForwardedMessage{
+		GmailID:    msg.ID,
+		ThreadID:   msg.ThreadID,
+		MessageID:  msg.MessageID,
+		References: msg.References,
+		Subject:    msg.originalSubject(),
+		From:       msg.originalFrom(),
+		ReplyTo:    msg.ReplyTo,
+		Model:      n.Model,
+	})
+	if err != nil {
+		log.Printf("Error saving forwarded message state: %v", err)
+	}
 
+	return nil
+}
+
+func (b *TelegramBot) sendToChat(
+	ctx context.Context,
+	route *RouteConfig,
+	chatID, message, subject, from string,
+	thread TelegramThread,
+	silent bool,
+) (SentMessage, error) {
 	params := url.Values{}
 	params.Add("chat_id", chatID)
 	params.Add("text", message)
+
+	_, parseMode := routeTelegramTemplate(b.template, b.parseMode, route)
+	params.Add("parse_mode", parseMode)
+
+	if silent {
+		params.Add("disable_notification", "true")
+	}
+
+	// Message IDs are only meaningful in the chat the thread was started in
+	if thread.Destination == chatID && b.threading == threadingReply && thread.MessageID != 0 {
+		params.Add("reply_parameters", fmt.Sprintf(
+			`{"message_id":%d,"allow_sending_without_reply":true}`, thread.MessageID))
+	}
+
+	// A fixed topic wins over an automatic per-sender or per-route topic,
+	// which wins over a per-thread topic
+	topicID, topics := b.routeTopics(route)
+
+	var topicKey, topicName string
+
+	if topicID == 0 {
+		switch topics {
+		case topicsBySender:
+			topicName = senderDomain(from)
+			topicKey = chatID + "|sender:" + topicName
+		case topicsByRoute:
+			topicName = routeName(route)
+			topicKey = chatID + "|route:" + topicName
+		}
+	}
+
+	var err error
+
+	switch {
+	case topicKey != "":
+		topicID, err = b.autoTopic(ctx, chatID, topicKey, topicName)
+	case topicID == 0 && b.threading == threadingTopic && thread.Destination == chatID:
+		topicID = thread.TopicID
+	}
+
+	if err != nil {
+		return SentMessage{}, err
+	}
+
+	if topicID == 0 && b.threading == threadingTopic {
+		topic, err := b.CreateForumTopic(ctx, chatID, subject)
+		if err != nil {
+			return SentMessage{}, err
+		}
+
+		topicID = topic.MessageThreadID
+	}
+
+	if topicID != 0 {
+		params.Set("message_thread_id", strconv.FormatInt(topicID, 10))
+	}
+
+	sent, err := b.send(ctx, params)
+	if err != nil && topicKey != "" && strings.Contains(err.Error(), "thread not found") {
+		// The remembered topic was deleted in Telegram; forget it and create a new one
+		if err := b.forgetTopic(topicKey); err != nil {
+			log.Printf("Error forgetting forum topic: %v", err)
+		}
+
+		if topicID, err = b.autoTopic(ctx, chatID, topicKey, topicName); err != nil {
+			return SentMessage{}, err
+		}
+
+		params.Set("message_thread_id", strconv.FormatInt(topicID, 10))
+		sent, err = b.send(ctx, params)
+	}
+
+	if err != nil {
+		return SentMessage{}, err
+	}
+
+	sent.Destination = chatID
+	sent.TopicID = topicID
+
+	return sent, nil
+}
+
+// sendCalendar replies to a post with an .ics file of its events and "Add to calendar" buttons
+func (b *TelegramBot) sendCalendar(
+	ctx context.Context,
+	route *RouteConfig,
+	sent SentMessage,
+	events []CalendarEvent,
+	silent bool,
+) error {
+	data := buildICS(events, time.Now())
+	name := calendarFileName(events)
+
+	if routeVia(b.via, route) == viaUser {
+		_, err := b.user.SendFile(ctx, sent.Destination, name, bytes.NewReader(data), int64(len(data)),
+			calendarCaption(events, true))
+
+		return err
+	}
+
+	markup, err := json.Marshal(calendarKeyboard(events))
+	if err != nil {
+		return fmt.Errorf("failed to encode reply markup: %v", err)
+	}
+
+	params := url.Values{}
+	params.Add("chat_id", strconv.FormatInt(sent.ChatID, 10))
+	params.Add("caption", calendarCaption(events, false))
 	params.Add("parse_mode", "Markdown")
+	params.Add("reply_markup", string(markup))
+	params.Add("reply_parameters", fmt.Sprintf(
+		`{"message_id":%d,"allow_sending_without_reply":true}`, sent.MessageID))
+
+	if sent.TopicID != 0 {
+		params.Add("message_thread_id", strconv.FormatInt(sent.TopicID, 10))
+	}
+
+	if silent {
+		params.Add("disable_notification", "true")
+	}
+
+	return b.callWithFile(ctx, "sendDocument", params, "document", name, data, nil)
+}
+
+// routeTopics returns the fixed forum topic and the automatic topics mode of a route,
+// falling back to the telegram section
+func (b *TelegramBot) routeTopics(route *RouteConfig) (int64, string) {
+	if route != nil && (route.Destination.MessageThreadID != 0 || route.Destination.Topics != "") {
+		return route.Destination.MessageThreadID, route.Destination.Topics
+	}
+
+	return b.messageThreadID, b.topics
+}
+
+// autoTopic returns the remembered forum topic for key, creating it on first use
+func (b *TelegramBot) autoTopic(ctx context.Context, chatID, key, name string) (int64, error) {
+	if b.state != nil {
+		if id, ok := b.state.Topic(key); ok {
+			return id, nil
+		}
+	}
+
+	topic, err := b.CreateForumTopic(ctx, chatID, name)
+	if err != nil {
+		return 0, err
+	}
+
+	if b.state != nil {
+		if err := b.state.SaveTopic(key, topic.MessageThreadID); err != nil {
+			log.Printf("Error saving forum topic: %v", err)
+		}
+	}
+
+	return topic.MessageThreadID, nil
+}
+
+func (b *TelegramBot) forgetTopic(key string) error {
+	if b.state == nil {
+		return nil
+	}
+
+	return b.state.DeleteTopic(key)
+}
+
+// CreateForumTopic creates a topic in a forum supergroup; the name is cut to Telegram's limit
+func (b *TelegramBot) CreateForumTopic(ctx context.Context, chatID, name string) (ForumTopic, error) {
+	if name == "" {
+		name = "(no subject)"
+	}
+
+	if utf8.RuneCountInString(name) > maxTopicNameLength {
+		name = string([]rune(name)[:maxTopicNameLength])
+	}
+
+	params := url.Values{}
+	params.Add("chat_id", chatID)
+	params.Add("name", name)
+
+	var topic ForumTopic
+	if err := b.call(ctx, "createForumTopic", params, &topic); err != nil {
+		return ForumTopic{}, fmt.Errorf("failed to create forum topic: %w", err)
+	}
 
+	return topic, nil
+}
+
+// SendPlainMessage sends unformatted text, optionally as a reply and with an inline keyboard
+func (b *TelegramBot) SendPlainMessage(
+	ctx context.Context,
+	chatID, replyToMessageID int64,
+	text string,
+	markup *InlineKeyboardMarkup,
+) (SentMessage, error) {
+	params := url.Values{}
+	params.Add("chat_id", strconv.FormatInt(chatID, 10))
+	params.Add("text", text)
+
+	if replyToMessageID != 0 {
+		params.Add("reply_parameters", fmt.Sprintf(
+			`{"message_id":%d,"allow_sending_without_reply":true}`, replyToMessageID))
+	}
+
+	if markup != nil {
+		data, err := json.Marshal(markup)
+		if err != nil {
+			return SentMessage{}, fmt.Errorf("failed to encode reply markup: %v", err)
+		}
+
+		params.Add("reply_markup", string(data))
+	}
+
+	return b.send(ctx, params)
+}
+
+func (b *TelegramBot) send(ctx context.Context, params url.Values) (SentMessage, error) {
+	var msg TelegramMessage
+	if err := b.call(ctx, "sendMessage", params, &msg); err != nil {
+		return SentMessage{}, err
+	}
+
+	return SentMessage{ChatID: msg.Chat.ID, MessageID: msg.MessageID}, nil
+}
+
+// EditMessageText replaces the text of a message and removes its inline keyboard
+func (b *TelegramBot) EditMessageText(ctx context.Context, chatID, messageID int64, text string) error {
+	params := url.Values{}
+	params.Add("chat_id", strconv.FormatInt(chatID, 10))
+	params.Add("message_id", strconv.FormatInt(messageID, 10))
+	params.Add("text", text)
+
+	return b.call(ctx, "editMessageText", params, nil)
+}
+
+func (b *TelegramBot) AnswerCallbackQuery(ctx context.Context, callbackQueryID, text string) error {
+	params := url.Values{}
+	params.Add("callback_query_id", callbackQueryID)
+
+	if text != "" {
+		params.Add("text", text)
+	}
+
+	return b.call(ctx, "answerCallbackQuery", params, nil)
+}
+
+// GetUpdates long-polls the Bot API for new updates starting at offset
+func (b *TelegramBot) GetUpdates(ctx context.Context, offset int64, timeout int) ([]Update, error) {
+	params := url.Values{}
+	params.Add("offset", strconv.FormatInt(offset, 10))
+	params.Add("timeout", strconv.Itoa(timeout))
+	params.Add("allowed_updates", `["message","callback_query"]`)
+
+	var updates []Update
+	if err := b.call(ctx, "getUpdates", params, &updates); err != nil {
+		return nil, err
+	}
+
+	return updates, nil
+}
+
+// call invokes a Bot API method and decodes its result into result when it is not nil
+func (b *TelegramBot) call(ctx context.Context, method string, params url.Values, result any) error {
+	return b.do(ctx, method, params, nil, "", result)
+}
+
+// callWithFile uploads data as the multipart field of a method such as sendDocument
+func (b *TelegramBot) callWithFile(
+	ctx context.Context,
+	method string,
+	params url.Values,
+	field, name string,
+	data []byte,
+	result any,
+) error {
+	var body bytes.Buffer
+
+	writer := multipart.NewWriter(&body)
+
+	part, err := writer.CreateFormFile(field, name)
+	if err != nil {
+		return fmt.Errorf("failed to create upload: %v", err)
+	}
+
+	if _, err := part.Write(data); err != nil {
+		return fmt.Errorf("failed to create upload: %v", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to create upload: %v", err)
+	}
+
+	return b.do(ctx, method, params, &body, writer.FormDataContentType(), result)
+}
+
+func (b *TelegramBot) do(
+	ctx context.Context,
+	method string,
+	params url.Values,
+	body io.Reader,
+	contentType string,
+	result any,
+) error {
+	apiURL, err := url.Parse(b.baseURL)
+	if err != nil {
+		return fmt.Errorf("invalid base URL: %v", err)
+	}
+
+	apiURL.Path = path.Join(apiURL.Path, method)
 	apiURL.RawQuery = params.Encode()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL.String(), body)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %v", err)
 	}
 
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
 	resp, err := b.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %v", err)
 	}
 	defer resp.Body.Close()
 
+	var apiResp telegramResponse
+	decodeErr := json.NewDecoder(resp.Body).Decode(&apiResp)
+
 	if resp.StatusCode != http.StatusOK {
+		if apiResp.Description != "" {
+			return fmt.Errorf("telegram API returned non-200 status code: %d: %s", resp.StatusCode, apiResp.Description)
+		}
+
 		return fmt.Errorf("telegram API returned non-200 status code: %d", resp.StatusCode)
 	}
 
+	if decodeErr != nil {
+		return fmt.Errorf("failed to decode response: %v", decodeErr)
+	}
+
+	if !apiResp.OK {
+		return fmt.Errorf("telegram API error: %s", apiResp.Description)
+	}
+
+	if result != nil {
+		if err := json.Unmarshal(apiResp.Result, result); err != nil {
+			return fmt.Errorf("failed to decode %s result: %v", method, err)
+		}
+	}
+
 	return nil
 }
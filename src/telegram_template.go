@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/mail"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Telegram parse modes a message template can be written in
+const (
+	parseModeMarkdown   = "Markdown"
+	parseModeMarkdownV2 = "MarkdownV2"
+	parseModeHTML       = "HTML"
+)
+
+// defaultTelegramTemplate is the layout of posts without a configured template
+const defaultTelegramTemplate = "{{bold .Subject}}\n\n" +
+	"📅 {{.Date}}\n" +
+	"{{if .From}}📧 From: {{escape .From}}\n{{end}}" +
+	"\n" +
+	"{{if .Original}}🇷🇺 Translation:\n{{.Content}}\n\n🇬🇧 Original:\n{{.Original}}{{else}}{{.Content}}{{end}}"
+
+// TelegramTemplateData holds the fields of telegram.template, e.g. {{.Subject}}. Content and
+// Original are already formatted for the parse mode; the other fields go through escape.
+type TelegramTemplateData struct {
+	Subject string
+	// OriginalSubject is the subject before translation, empty when it was not translated
+	OriginalSubject string
+	From            string
+	FromName        string
+	FromAddress     string
+	// Date is shown in telegram.date's timezone and locale; Time is the same moment for
+	// layouts of your own, such as {{.Time.Format "15:04"}}
+	Date   string
+	Time   time.Time
+	Labels []string
+	// Account is the address the email was delivered to
+	Account     string
+	Route       string
+	Attachments []string
+	// Link opens the email in Gmail or Outlook on the web, empty for IMAP
+	Link     string
+	Content  string
+	Original string
+	Model    string
+}
+
+// sampleTelegramTemplateData is used to try templates at startup
+var sampleTelegramTemplateData = TelegramTemplateData{
+	Subject:     "Aprīļa rēķins",
+	From:        "Rīgas Ūdens <info@example.com>",
+	FromName:    "Rīgas Ūdens",
+	FromAddress: "info@example.com",
+	Date:        "Tue, 1 Apr 2025 06:22:56 +0000",
+	Labels:      []string{"INBOX"},
+	Account:     "me@example.com",
+	Route:       defaultRouteName,
+	Attachments: []string{"rekins.pdf"},
+	Link:        "https://mail.google.com/mail/#all/195f0a",
+	Content:     "Hello!",
+	Model:       defaultModelName,
+}
+
+// markdownV2Escaper escapes the characters MarkdownV2 reserves outside of entities
+var markdownV2Escaper = strings.NewReplacer(
+	`\`, `\\`, "_", `\_`, "*", `\*`, "[", `\[`, "]", `\]`, "(", `\(`, ")", `\)`, "~", `\~`, "`", "\\`",
+	">", `\>`, "#", `\#`, "+", `\+`, "-", `\-`, "=", `\=`, "|", `\|`, "{", `\{`, "}", `\}`, ".", `\.`, "!", `\!`,
+)
+
+// markdownEscaper escapes the characters that start an entity in legacy Markdown
+var markdownEscaper = strings.NewReplacer("_", `\_`, "*", `\*`, "`", "\\`", "[", `\[`)
+
+// escapeFor returns the escape function of a parse mode
+func escapeFor(parseMode string) func(string) string {
+	switch parseMode {
+	case parseModeMarkdownV2:
+		return markdownV2Escaper.Replace
+	case parseModeHTML:
+		return html.EscapeString
+	}
+
+	return markdownEscaper.Replace
+}
+
+// rendererFor converts the Telegram Markdown the forwarder produces into a parse mode
+func rendererFor(parseMode string) markdownRenderer {
+	escape := escapeFor(parseMode)
+
+	switch parseMode {
+	case parseModeMarkdownV2:
+		return markdownRenderer{
+			text: escape,
+			bold: func(s string) string { return "*" + escape(s) + "*" },
+			link: func(text, url string) string {
+				if text == "" {
+					return escape(url)
+				}
+
+				return "[" + escape(text) + "](" + strings.NewReplacer(`\`, `\\`, ")", `\)`).Replace(url) + ")"
+			},
+		}
+	case parseModeHTML:
+		return markdownRenderer{
+			text: escape,
+			bold: func(s string) string { return "<b>" + escape(s) + "</b>" },
+			link: func(text, url string) string {
+				if text == "" {
+					text = url
+				}
+
+				return `<a href="` + escape(url) + `">` + escape(text) + "</a>"
+			},
+		}
+	}
+
+	// The content already is legacy Markdown. It cannot escape inside an entity, a star
+	// would end it early.
+	return markdownRenderer{
+		text: func(s string) string { return s },
+		bold: func(s string) string { return "*" + strings.ReplaceAll(s, "*", "") + "*" },
+		link: func(text, url string) string {
+			if text == "" {
+				return url
+			}
+
+			return "[" + text + "](" + url + ")"
+		},
+	}
+}
+
+func validParseMode(mode string) bool {
+	return mode == "" || mode == parseModeMarkdown || mode == parseModeMarkdownV2 || mode == parseModeHTML
+}
+
+// parseTelegramTemplate parses a message template with the helpers of its parse mode:
+// escape, bold, truncate and join
+func parseTelegramTemplate(text, parseMode string) (*template.Template, error) {
+	funcs := template.FuncMap{
+		"escape":   escapeFor(parseMode),
+		"bold":     rendererFor(parseMode).bold,
+		"truncate": func(limit int, s string) string { return truncateRunes(s, max(limit, 1)) },
+		"join":     func(items []string, separator string) string { return strings.Join(items, separator) },
+	}
+
+	tmpl, err := template.New("telegram").Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid telegram template: %v", err)
+	}
+
+	return tmpl, nil
+}
+
+// telegramTemplateKey identifies a parsed message template
+type telegramTemplateKey struct {
+	text      string
+	parseMode string
+}
+
+// telegramTemplates holds the message templates parsed at startup
+type telegramTemplates map[telegramTemplateKey]*template.Template
+
+// get returns the parsed template of text, parsing templates that were not known at startup
+func (t telegramTemplates) get(text, parseMode string) (*template.Template, error) {
+	if tmpl, ok := t[telegramTemplateKey{text, parseMode}]; ok {
+		return tmpl, nil
+	}
+
+	return parseTelegramTemplate(text, parseMode)
+}
+
+// renderTelegramTemplate fills in a parsed message template
+func renderTelegramTemplate(tmpl *template.Template, data TelegramTemplateData) (string, error) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render telegram template: %v", err)
+	}
+
+	return b.String(), nil
+}
+
+// telegramTemplateData collects the template fields of a notification, formatting its
+// content for the parse mode
+func telegramTemplateData(n Notification, parseMode string, dates dateFormatter) TelegramTemplateData {
+	msg := n.Message
+	renderer := rendererFor(parseMode)
+
+	data := TelegramTemplateData{
+		Subject:         msg.Subject,
+		OriginalSubject: msg.OriginalSubject,
+		From:            msg.From,
+		FromAddress:     msg.From,
+		Date:            dates.format(msg),
+		Time:            msg.Time,
+		Labels:          msg.Labels,
+		Account:         msg.Account,
+		Route:           routeName(msg.Route),
+		Attachments:     msg.Attachments,
+		Link:            msg.Link,
+		Content:         renderer.render(n.Content),
+		Model:           n.Model,
+	}
+
+	if addr, err := mail.ParseAddress(msg.From); err == nil {
+		data.FromName, data.FromAddress = addr.Name, addr.Address
+	}
+
+	if n.Original != "" {
+		data.Original = renderer.render(n.Original)
+	}
+
+	return data
+}
+
+// routeTelegramTemplate returns the message template and parse mode of a route
+func routeTelegramTemplate(defaultTemplate, defaultParseMode string, route *RouteConfig) (string, string) {
+	text, parseMode := defaultTemplate, defaultParseMode
+
+	if route != nil && route.Destination.Template != "" {
+		text = route.Destination.Template
+	}
+
+	if route != nil && route.Destination.ParseMode != "" {
+		parseMode = route.Destination.ParseMode
+	}
+
+	if text == "" {
+		text = defaultTelegramTemplate
+	}
+
+	if parseMode == "" {
+		parseMode = parseModeMarkdown
+	}
+
+	return text, parseMode
+}
+
+// parseTelegramTemplates checks the parse modes and parses the template of every route,
+// trying it with sample data, so a misspelt field fails at startup rather than on the first
+// email
+func parseTelegramTemplates(config *Config) (telegramTemplates, error) {
+	if !validParseMode(config.Telegram.ParseMode) {
+		return nil, fmt.Errorf("unknown telegram parse_mode %q: use %q, %q or %q",
+			config.Telegram.ParseMode, parseModeMarkdown, parseModeMarkdownV2, parseModeHTML)
+	}
+
+	templates := make(telegramTemplates)
+
+	for _, route := range telegramRoutes(config) {
+		if route != nil && !validParseMode(route.Destination.ParseMode) {
+			return nil, fmt.Errorf("unknown parse_mode %q in route %q", route.Destination.ParseMode, route.Name)
+		}
+
+		text, parseMode := routeTelegramTemplate(config.Telegram.Template, config.Telegram.ParseMode, route)
+
+		// MTProto messages are built from legacy Markdown
+		if parseMode != parseModeMarkdown && routeVia(config.Telegram.Via, route) == viaUser {
+			return nil, fmt.Errorf("route %q posts as a user, which only supports the %s parse mode",
+				routeName(route), parseModeMarkdown)
+		}
+
+		key := telegramTemplateKey{text, parseMode}
+		if templates[key] != nil {
+			continue
+		}
+
+		tmpl, err := parseTelegramTemplate(text, parseMode)
+		if err == nil {
+			_, err = renderTelegramTemplate(tmpl, sampleTelegramTemplateData)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", routeName(route), err)
+		}
+
+		templates[key] = tmpl
+	}
+
+	return templates, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenderTelegramTemplate(t *testing.T) {
+	n := Notification{
+		Message: Message{
+			Subject:     "Invoice *April*",
+			From:        "Rīgas Ūdens <info_desk@example.com>",
+			Date:        "Tue, 1 Apr 2025 06:22:56 +0000",
+			Labels:      []string{"INBOX", "Bills"},
+			Account:     "me@example.com",
+			Route:       &RouteConfig{Name: "bills"},
+			Attachments: []string{"rekins.pdf", "akts.pdf"},
+			Link:        "https://mail.google.com/mail/#all/195f0a",
+		},
+		Content: "Pay *12.50 EUR* at [the portal](https://example.com/pay) by May 1.",
+	}
+
+	tests := []struct {
+		name      string
+		text      string
+		parseMode string
+		want      string
+	}{
+		{
+			name:      "default template keeps the old layout",
+			text:      defaultTelegramTemplate,
+			parseMode: parseModeMarkdown,
+			want: "*Invoice April*\n\n📅 Tue, 1 Apr 2025 06:22:56 +0000\n📧 From: Rīgas Ūdens <info\\_desk@example.com>\n\n" +
+				"Pay *12.50 EUR* at [the portal](https://example.com/pay) by May 1.",
+		},
+		{
+			name:      "html",
+			text:      `{{bold .Subject}} from {{escape .FromName}}{{"\n"}}{{.Content}}{{"\n"}}<a href="{{.Link}}">Open</a>`,
+			parseMode: parseModeHTML,
+			want: "<b>Invoice *April*</b> from Rīgas Ūdens\n" +
+				`Pay <b>12.50 EUR</b> at <a href="https://example.com/pay">the portal</a> by May 1.` + "\n" +
+				`<a href="https://mail.google.com/mail/#all/195f0a">Open</a>`,
+		},
+		{
+			name:      "markdown v2",
+			text:      "{{bold .Subject}} {{escape .FromAddress}}\n{{.Content}}",
+			parseMode: parseModeMarkdownV2,
+			want: `*Invoice \*April\** info\_desk@example\.com` + "\n" +
+				`Pay *12\.50 EUR* at [the portal](https://example.com/pay) by May 1\.`,
+		},
+		{
+			name:      "labels, attachments and truncation",
+			text:      `{{.Route}} {{.Account}} [{{join .Labels ", "}}] {{join .Attachments " "}} {{truncate 8 .Subject}}`,
+			parseMode: parseModeMarkdown,
+			want:      "bills me@example.com [INBOX, Bills] rekins.pdf akts.pdf Invoice…",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := parseTelegramTemplate(tt.text, tt.parseMode)
+			if err != nil {
+				t.Fatalf("parseTelegramTemplate() error = %v", err)
+			}
+
+			got, err := renderTelegramTemplate(tmpl, telegramTemplateData(n, tt.parseMode, dateFormatter{}))
+			if err != nil {
+				t.Fatalf("renderTelegramTemplate() error = %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("renderTelegramTemplate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteTelegramTemplate(t *testing.T) {
+	tests := []struct {
+		name          string
+		route         *RouteConfig
+		wantTemplate  string
+		wantParseMode string
+	}{
+		{name: "no route", wantTemplate: "global", wantParseMode: parseModeHTML},
+		{name: "route without overrides", route: &RouteConfig{Name: "bills"}, wantTemplate: "global", wantParseMode: parseModeHTML},
+		{
+			name:          "route template keeps the global parse mode",
+			route:         &RouteConfig{Name: "school", Destination: DestinationConfig{Template: "school"}},
+			wantTemplate:  "school",
+			wantParseMode: parseModeHTML,
+		},
+		{
+			name:          "route parse mode",
+			route:         &RouteConfig{Name: "news", Destination: DestinationConfig{ParseMode: parseModeMarkdownV2}},
+			wantTemplate:  "global",
+			wantParseMode: parseModeMarkdownV2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, parseMode := routeTelegramTemplate("global", parseModeHTML, tt.route)
+			if text != tt.wantTemplate || parseMode != tt.wantParseMode {
+				t.Errorf("routeTelegramTemplate() = %q, %q; want %q, %q", text, parseMode, tt.wantTemplate, tt.wantParseMode)
+			}
+		})
+	}
+
+	if text, parseMode := routeTelegramTemplate("", "", nil); text != defaultTelegramTemplate || parseMode != parseModeMarkdown {
+		t.Errorf("routeTelegramTemplate() = %q, %q; want the default template in Markdown", text, parseMode)
+	}
+}
+
+func TestParseTelegramTemplates(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr string
+	}{
+		{name: "defaults", config: Config{}},
+		{
+			name: "misspelt field in a route",
+			config: Config{Routes: []RouteConfig{
+				{Name: "school", Destination: DestinationConfig{Template: "{{.Subjcet}}"}},
+			}},
+			wantErr: `route "school"`,
+		},
+		{
+			name:    "unknown parse mode",
+			config:  Config{Telegram: TelegramConfig{ParseMode: "html"}},
+			wantErr: "unknown telegram parse_mode",
+		},
+		{
+			name:    "html when posting as a user",
+			config:  Config{Telegram: TelegramConfig{ParseMode: parseModeHTML, Via: viaUser}},
+			wantErr: "only supports the Markdown parse mode",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			templates, err := parseTelegramTemplates(&tt.config)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("parseTelegramTemplates() error = %v", err)
+				}
+
+				// The default template is parsed once at startup
+				if templates[telegramTemplateKey{defaultTelegramTemplate, parseModeMarkdown}] == nil {
+					t.Errorf("parseTelegramTemplates() = %v, want the default template", templates)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseTelegramTemplates() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSendMessageTemplate(t *testing.T) {
+	var text, parseMode string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		text, parseMode = r.URL.Query().Get("text"), r.URL.Query().Get("parse_mode")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
+	}))
+	defer server.Close()
+
+	bot := &TelegramBot{
+		client:    server.Client(),
+		chatID:    "test-chat",
+		baseURL:   server.URL,
+		template:  "{{bold .Subject}}",
+		parseMode: parseModeHTML,
+	}
+	route := &RouteConfig{Name: "school", Destination: DestinationConfig{Template: "🏫 {{escape .Subject}}", ParseMode: parseModeMarkdownV2}}
+
+	for _, tt := range []struct {
+		route         *RouteConfig
+		wantText      string
+		wantParseMode string
+	}{
+		{wantText: "<b>Q&amp;A</b>", wantParseMode: parseModeHTML},
+		{route: route, wantText: "🏫 Q&A", wantParseMode: parseModeMarkdownV2},
+	} {
+		n := Notification{Message: Message{Subject: "Q&A", Route: tt.route}}
+		if _, err := bot.sendNotification(context.Background(), n, TelegramThread{}); err != nil {
+			t.Fatalf("sendNotification() error = %v", err)
+		}
+
+		if text != tt.wantText || parseMode != tt.wantParseMode {
+			t.Errorf("sent %q with parse_mode %q, want %q with %q", text, parseMode, tt.wantText, tt.wantParseMode)
+		}
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -16,11 +19,7 @@ func TestNewTelegramBot(t *testing.T) {
 		{
 			name: "valid config",
 			config: &Config{
-				Telegram: struct {
-					BotToken  string `yaml:"bot_token"`
-					ChannelID string `yaml:"channel_id"`
-					ChatID    string `yaml:"chat_id"`
-				}{
+				Telegram: TelegramConfig{
 					BotToken: "test-token",
 				},
 			},
@@ -29,11 +28,7 @@ func TestNewTelegramBot(t *testing.T) {
 		{
 			name: "missing bot token",
 			config: &Config{
-				Telegram: struct {
-					BotToken  string `yaml:"bot_token"`
-					ChannelID string `yaml:"channel_id"`
-					ChatID    string `yaml:"chat_id"`
-				}{},
+				Telegram: TelegramConfig{},
 			},
 			wantErr: true,
 		},
@@ -41,7 +36,7 @@ func TestNewTelegramBot(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			bot, err := NewTelegramBot(tt.config)
+			bot, err := NewTelegramBot(tt.config, nil)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("NewTelegramBot() error = %v, wantErr %v", err, tt.wantErr)
 
@@ -55,7 +50,7 @@ func TestNewTelegramBot(t *testing.T) {
 	}
 }
 
-func TestSendMessage(t *testing.T) {
+func TestSendNotification(t *testing.T) {
 	tests := []struct {
 		name            string
 		bot             *TelegramBot
@@ -82,6 +77,7 @@ func TestSendMessage(t *testing.T) {
 			originalContent: "",
 			serverResponse: func(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
 			},
 			wantErr: false,
 		},
@@ -104,6 +100,7 @@ func TestSendMessage(t *testing.T) {
 					w.WriteHeader(http.StatusInternalServerError)
 				} else {
 					w.WriteHeader(http.StatusOK)
+					_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
 				}
 			},
 			wantErr: false,
@@ -141,6 +138,7 @@ func TestSendMessage(t *testing.T) {
 			originalContent: "",
 			serverResponse: func(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
 			},
 			wantErr: true,
 		},
@@ -153,10 +151,185 @@ func TestSendMessage(t *testing.T) {
 
 			tt.bot.baseURL = server.URL
 
-			err := tt.bot.SendMessage(context.Background(), tt.subject, tt.content, tt.from, tt.date, tt.originalContent)
+			n := Notification{
+				Message:  Message{Subject: tt.subject, From: tt.from, Date: tt.date},
+				Content:  tt.content,
+				Original: tt.originalContent,
+			}
+
+			_, err := tt.bot.sendNotification(context.Background(), n, TelegramThread{})
 			if (err != nil) != tt.wantErr {
-				t.Errorf("SendMessage() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("sendNotification() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
+
+func TestSendMessageThreading(t *testing.T) {
+	tests := []struct {
+		name          string
+		threading     string
+		thread        TelegramThread
+		wantReplyTo   bool
+		wantNewTopic  bool
+		wantTopicID   string
+		wantSentTopic int64
+	}{
+		{
+			name:        "reply mode replies to first message of thread",
+			threading:   threadingReply,
+			thread:      TelegramThread{Destination: "test-chat", ChatID: 1, MessageID: 10},
+			wantReplyTo: true,
+		},
+		{
+			name:      "reply mode ignores thread from another destination",
+			threading: threadingReply,
+			thread:    TelegramThread{Destination: "other-chat", ChatID: 2, MessageID: 10},
+		},
+		{
+			name:          "topic mode creates topic for new thread",
+			threading:     threadingTopic,
+			wantNewTopic:  true,
+			wantTopicID:   "77",
+			wantSentTopic: 77,
+		},
+		{
+			name:          "topic mode reuses existing topic",
+			threading:     threadingTopic,
+			thread:        TelegramThread{Destination: "test-chat", ChatID: 1, MessageID: 10, TopicID: 55},
+			wantTopicID:   "55",
+			wantSentTopic: 55,
+		},
+		{
+			name:      "off mode ignores thread",
+			threading: threadingOff,
+			thread:    TelegramThread{Destination: "test-chat", ChatID: 1, MessageID: 10, TopicID: 55},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sendQuery, topicName string
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+
+				if strings.HasSuffix(r.URL.Path, "/createForumTopic") {
+					topicName = r.URL.Query().Get("name")
+					_, _ = w.Write([]byte(`{"ok":true,"result":{"message_thread_id":77,"name":"x"}}`))
+
+					return
+				}
+
+				sendQuery = r.URL.RawQuery
+				_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":11,"chat":{"id":1}}}`))
+			}))
+			defer server.Close()
+
+			bot := &TelegramBot{
+				client:    server.Client(),
+				chatID:    "test-chat",
+				baseURL:   server.URL,
+				threading: tt.threading,
+			}
+
+			n := Notification{Message: Message{Subject: "Subject", From: "from", Date: "date"}, Content: "Content"}
+
+			sent, err := bot.sendNotification(context.Background(), n, tt.thread)
+			if err != nil {
+				t.Fatalf("sendNotification() error = %v", err)
+			}
+
+			query, _ := url.ParseQuery(sendQuery)
+
+			if got := query.Get("reply_parameters") != ""; got != tt.wantReplyTo {
+				t.Errorf("reply_parameters set = %v, want %v", got, tt.wantReplyTo)
+			}
+
+			if got := topicName != ""; got != tt.wantNewTopic {
+				t.Errorf("topic created = %v, want %v", got, tt.wantNewTopic)
+			}
+
+			if got := query.Get("message_thread_id"); got != tt.wantTopicID {
+				t.Errorf("message_thread_id = %q, want %q", got, tt.wantTopicID)
+			}
+
+			if sent.Destination != "test-chat" || sent.TopicID != tt.wantSentTopic {
+				t.Errorf("sendNotification() = %+v", sent)
+			}
+		})
+	}
+}
+
+func TestSendMessageTopics(t *testing.T) {
+	var (
+		created    []string
+		threadIDs  []string
+		deleteOnce = true
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		if strings.HasSuffix(r.URL.Path, "/createForumTopic") {
+			created = append(created, query.Get("name"))
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(`{"ok":true,"result":{"message_thread_id":` + strconv.Itoa(100+len(created)) + `}}`))
+
+			return
+		}
+
+		// Simulate an admin deleting the first topic after it was remembered
+		if query.Get("message_thread_id") == "101" && len(threadIDs) > 0 && deleteOnce {
+			deleteOnce = false
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"ok":false,"description":"Bad Request: message thread not found"}`))
+
+			return
+		}
+
+		threadIDs = append(threadIDs, query.Get("message_thread_id"))
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
+	}))
+	defer server.Close()
+
+	state, _ := NewStateStore("")
+	bot := &TelegramBot{client: server.Client(), chatID: "group", baseURL: server.URL, topics: topicsBySender, state: state}
+	ctx := context.Background()
+
+	send := func(route *RouteConfig, from string) {
+		t.Helper()
+
+		n := Notification{Message: Message{Subject: "Subject", From: from, Date: "date", Route: route}, Content: "Content"}
+		if _, err := bot.sendNotification(ctx, n, TelegramThread{}); err != nil {
+			t.Fatalf("sendNotification() error = %v", err)
+		}
+	}
+
+	send(nil, "a@school.lv")
+	send(nil, "b@school.lv")
+	send(nil, "c@shop.com")
+
+	fixed := &RouteConfig{Name: "bank", Destination: DestinationConfig{MessageThreadID: 9}}
+	send(fixed, "bank@example.com")
+
+	byRoute := &RouteConfig{Name: "news", Destination: DestinationConfig{ChatID: "other", Topics: topicsByRoute}}
+	send(byRoute, "x@news.com")
+	send(byRoute, "y@news.com")
+
+	wantCreated := []string{"school.lv", "school.lv", "shop.com", "news"}
+	if strings.Join(created, ",") != strings.Join(wantCreated, ",") {
+		t.Errorf("created topics = %v, want %v", created, wantCreated)
+	}
+
+	// The second school.lv message hit the deleted topic 101 and was retried in the recreated topic 102
+	wantThreads := []string{"101", "102", "103", "9", "104", "104"}
+	if strings.Join(threadIDs, ",") != strings.Join(wantThreads, ",") {
+		t.Errorf("message_thread_id values = %v, want %v", threadIDs, wantThreads)
+	}
+
+	if id, ok := state.Topic("group|sender:school.lv"); !ok || id != 102 {
+		t.Errorf("remembered school.lv topic = %d, %v; want 102", id, ok)
+	}
+}
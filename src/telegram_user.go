@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gotd/td/session"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/telegram/auth"
+	"github.com/gotd/td/telegram/message/entity"
+	"github.com/gotd/td/telegram/message/unpack"
+	"github.com/gotd/td/telegram/query/dialogs"
+	"github.com/gotd/td/telegram/uploader"
+	"github.com/gotd/td/tg"
+)
+
+// How a destination is delivered to, see TelegramConfig.Via
+const (
+	viaBot  = "bot"
+	viaUser = "user"
+)
+
+const (
+	defaultTelegramSessionFile = "telegram_session.json"
+
+	// Bot API chat IDs of channels and supergroups are -100 followed by the channel ID
+	botAPIChannelOffset = 1000000000000
+)
+
+// TelegramUserConfig is the user account used for destinations with via: user
+type TelegramUserConfig struct {
+	// APIID and APIHash come from https://my.telegram.org
+	APIID   int    `yaml:"api_id"`
+	APIHash string `yaml:"api_hash"`
+	Phone   string `yaml:"phone"`
+	// Password is the two-step verification password, if the account has one
+	Password    string `yaml:"password"`
+	SessionFile string `yaml:"session_file"`
+}
+
+// TelegramUserClient posts as a Telegram user account over MTProto. Unlike a bot it can write
+// to any group the account is a member of and upload files of up to 2 GB.
+type TelegramUserClient struct {
+	api       *tg.Client
+	threading string
+
+	mu    sync.Mutex
+	peers map[string]tg.InputPeerClass
+}
+
+// NewTelegramUserClient connects with the session saved in the session file. Without a session
+// it signs in and asks for the login code on the terminal, so the first start must be interactive.
+func NewTelegramUserClient(ctx context.Context, config *Config) (*TelegramUserClient, error) {
+	userConfig := config.Telegram.User
+	if userConfig.APIID == 0 || userConfig.APIHash == "" || userConfig.Phone == "" {
+		return nil, fmt.Errorf("telegram user api_id, api_hash and phone are required")
+	}
+
+	sessionFile := userConfig.SessionFile
+	if sessionFile == "" {
+		sessionFile = defaultTelegramSessionFile
+	}
+
+	client := telegram.NewClient(userConfig.APIID, userConfig.APIHash, telegram.Options{
+		SessionStorage: &session.FileStorage{Path: sessionFile},
+	})
+
+	flow := auth.NewFlow(
+		auth.Constant(userConfig.Phone, userConfig.Password, auth.CodeAuthenticatorFunc(promptLoginCode)),
+		auth.SendCodeOptions{},
+	)
+
+	// The client only works inside Run, so it keeps running in the background
+	ready := make(chan error, 1)
+
+	go func() {
+		err := client.Run(ctx, func(ctx context.Context) error {
+			if err := client.Auth().IfNecessary(ctx, flow); err != nil {
+				return fmt.Errorf("sign-in failed: %v", err)
+			}
+
+			ready <- nil
+
+			<-ctx.Done()
+
+			return ctx.Err()
+		})
+
+		select {
+		case ready <- err:
+		default:
+			log.Printf("Telegram user client stopped: %v", err)
+		}
+	}()
+
+	if err := <-ready; err != nil {
+		return nil, fmt.Errorf("unable to connect to Telegram: %v", err)
+	}
+
+	return newTelegramUserClient(client.API(), config), nil
+}
+
+func newTelegramUserClient(api *tg.Client, config *Config) *TelegramUserClient {
+	threading := config.Telegram.Threading
+	if threading == "" {
+		threading = threadingReply
+	}
+
+	return &TelegramUserClient{
+		api:       api,
+		threading: threading,
+		peers:     make(map[string]tg.InputPeerClass),
+	}
+}
+
+func promptLoginCode(ctx context.Context, sentCode *tg.AuthSentCode) (string, error) {
+	fmt.Print("Enter the login code Telegram sent to your account: ")
+
+	code, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("unable to read login code: %v", err)
+	}
+
+	return strings.TrimSpace(code), nil
+}
+
+// sendToChat mirrors TelegramBot.sendToChat: follow-ups reply to the first email of their
+// thread and a fixed forum topic is honoured
+func (u *TelegramUserClient) sendToChat(
+	ctx context.Context,
+	chatID, message string,
+	topicID int64,
+	thread TelegramThread,
+	silent bool,
+) (SentMessage, error) {
+	peer, err := u.resolvePeer(ctx, chatID)
+	if err != nil {
+		return SentMessage{}, err
+	}
+
+	text, entities := markdownEntities(message)
+
+	request := &tg.MessagesSendMessageRequest{
+		Peer:     peer,
+		Message:  text,
+		Entities: entities,
+		RandomID: randomID(),
+		Silent:   silent,
+	}
+
+	replyTo := &tg.InputReplyToMessage{}
+	if thread.Destination == chatID && u.threading == threadingReply && thread.MessageID != 0 {
+		replyTo.ReplyToMsgID = int(thread.MessageID)
+	}
+
+	if topicID != 0 {
+		// A message is posted into a topic by replying to the topic's first message
+		if replyTo.ReplyToMsgID == 0 {
+			replyTo.ReplyToMsgID = int(topicID)
+		} else {
+			replyTo.SetTopMsgID(int(topicID))
+		}
+	}
+
+	if replyTo.ReplyToMsgID != 0 {
+		request.SetReplyTo(replyTo)
+	}
+
+	id, err := unpack.MessageID(u.api.MessagesSendMessage(ctx, request))
+	if err != nil {
+		return SentMessage{}, fmt.Errorf("failed to send message as user: %v", err)
+	}
+
+	return SentMessage{
+		Destination: chatID,
+		ChatID:      botAPIChatID(peer),
+		MessageID:   int64(id),
+		TopicID:     topicID,
+	}, nil
+}
+
+// SendFile uploads a document of up to 2 GB, far above the 50 MB a bot may send
+func (u *TelegramUserClient) SendFile(
+	ctx context.Context,
+	chatID, name string,
+	r io.Reader,
+	size int64,
+	caption string,
+) (SentMessage, error) {
+	peer, err := u.resolvePeer(ctx, chatID)
+	if err != nil {
+		return SentMessage{}, err
+	}
+
+	file, err := uploader.NewUploader(u.api).Upload(ctx, uploader.NewUpload(name, r, size))
+	if err != nil {
+		return SentMessage{}, fmt.Errorf("failed to upload %s: %v", name, err)
+	}
+
+	mimeType := mime.TypeByExtension(filepath.Ext(name))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	text, entities := markdownEntities(caption)
+
+	id, err := unpack.MessageID(u.api.MessagesSendMedia(ctx, &tg.MessagesSendMediaRequest{
+		Peer: peer,
+		Media: &tg.InputMediaUploadedDocument{
+			File:       file,
+			MimeType:   mimeType,
+			Attributes: []tg.DocumentAttributeClass{&tg.DocumentAttributeFilename{FileName: name}},
+		},
+		Message:  text,
+		Entities: entities,
+		RandomID: randomID(),
+	}))
+	if err != nil {
+		return SentMessage{}, fmt.Errorf("failed to send %s as user: %v", name, err)
+	}
+
+	return SentMessage{Destination: chatID, ChatID: botAPIChatID(peer), MessageID: int64(id)}, nil
+}
+
+// resolvePeer turns a destination into an MTProto peer. Destinations are "me", a @username or
+// t.me link, or a Bot API chat ID of a chat the account is in.
+func (u *TelegramUserClient) resolvePeer(ctx context.Context, chatID string) (tg.InputPeerClass, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if peer, ok := u.peers[chatID]; ok {
+		return peer, nil
+	}
+
+	peer, err := u.lookupPeer(ctx, chatID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find Telegram chat %s: %v", chatID, err)
+	}
+
+	u.peers[chatID] = peer
+
+	return peer, nil
+}
+
+func (u *TelegramUserClient) lookupPeer(ctx context.Context, chatID string) (tg.InputPeerClass, error) {
+	if chatID == "me" || chatID == "self" {
+		return &tg.InputPeerSelf{}, nil
+	}
+
+	id, err := strconv.ParseInt(chatID, 10, 64)
+	if err != nil {
+		username := strings.TrimPrefix(strings.TrimPrefix(chatID, "https://"), "t.me/")
+		username = strings.TrimPrefix(username, "@")
+
+		resolved, err := u.api.ContactsResolveUsername(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+
+		return resolvedPeer(resolved)
+	}
+
+	// Basic groups need no access hash
+	if id < 0 && id > -botAPIChannelOffset {
+		return &tg.InputPeerChat{ChatID: -id}, nil
+	}
+
+	// Users and channels are looked up in the dialog list, which carries their access hashes
+	iter := dialogs.NewQueryBuilder(u.api).GetDialogs().Iter()
+	for iter.Next(ctx) {
+		if peer := iter.Value().Peer; botAPIChatID(peer) == id {
+			return peer, nil
+		}
+	}
+
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("the account is not a member of this chat")
+}
+
+func resolvedPeer(resolved *tg.ContactsResolvedPeer) (tg.InputPeerClass, error) {
+	switch p := resolved.Peer.(type) {
+	case *tg.PeerUser:
+		for _, user := range resolved.Users {
+			if user, ok := user.(*tg.User); ok && user.ID == p.UserID {
+				return user.AsInputPeer(), nil
+			}
+		}
+	case *tg.PeerChannel:
+		for _, chat := range resolved.Chats {
+			if channel, ok := chat.(*tg.Channel); ok && channel.ID == p.ChannelID {
+				return channel.AsInputPeer(), nil
+			}
+		}
+	case *tg.PeerChat:
+		return &tg.InputPeerChat{ChatID: p.ChatID}, nil
+	}
+
+	return nil, fmt.Errorf("unexpected peer %v", resolved.Peer)
+}
+
+// botAPIChatID converts an MTProto peer to the chat ID the Bot API uses for it, so state
+// written by the user client and the bot share one key space
+func botAPIChatID(peer tg.InputPeerClass) int64 {
+	switch p := peer.(type) {
+	case *tg.InputPeerUser:
+		return p.UserID
+	case *tg.InputPeerChat:
+		return -p.ChatID
+	case *tg.InputPeerChannel:
+		return -botAPIChannelOffset - p.ChannelID
+	default:
+		return 0
+	}
+}
+
+// markdownUnescaper drops the backslashes legacy Markdown puts before entity characters
+var markdownUnescaper = strings.NewReplacer(`\_`, "_", `\*`, "*", "\\`", "`", `\[`, "[")
+
+// markdownEntities converts Telegram Markdown to plain text with MTProto formatting entities
+func markdownEntities(markdown string) (string, []tg.MessageEntityClass) {
+	var b entity.Builder
+
+	markdownRenderer{
+		text: func(s string) string {
+			b.Plain(markdownUnescaper.Replace(s))
+
+			return ""
+		},
+		bold: func(s string) string {
+			b.Bold(s)
+
+			return ""
+		},
+		link: func(text, url string) string {
+			if text == "" {
+				b.Plain(url)
+			} else {
+				b.TextURL(text, url)
+			}
+
+			return ""
+		},
+	}.render(markdown)
+
+	return b.Complete()
+}
+
+func randomID() int64 {
+	var buf [8]byte
+	_, _ = rand.Read(buf[:])
+
+	return int64(binary.LittleEndian.Uint64(buf[:]))
+}
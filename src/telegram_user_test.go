@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/tg"
+)
+
+// fakeMTProto stands in for the Telegram servers: it records requests and answers
+// them with handle's result, encoded the way the real server would
+type fakeMTProto struct {
+	requests []bin.Encoder
+	handle   func(request bin.Encoder) (bin.Encoder, error)
+}
+
+func (f *fakeMTProto) Invoke(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+	f.requests = append(f.requests, input)
+
+	result, err := f.handle(input)
+	if err != nil {
+		return err
+	}
+
+	var buf bin.Buffer
+	if err := result.Encode(&buf); err != nil {
+		return err
+	}
+
+	return output.Decode(&buf)
+}
+
+// newFakeMTProto answers username lookups with a channel and sent messages with increasing IDs
+func newFakeMTProto() *fakeMTProto {
+	nextID := 100
+
+	fake := &fakeMTProto{}
+	fake.handle = func(request bin.Encoder) (bin.Encoder, error) {
+		switch request.(type) {
+		case *tg.ContactsResolveUsernameRequest:
+			return &tg.ContactsResolvedPeer{
+				Peer:  &tg.PeerChannel{ChannelID: 42},
+				Chats: []tg.ChatClass{&tg.Channel{ID: 42, AccessHash: 4242, Title: "Family", Photo: &tg.ChatPhotoEmpty{}}},
+			}, nil
+		case *tg.MessagesSendMessageRequest, *tg.MessagesSendMediaRequest:
+			nextID++
+
+			return &tg.UpdateShortSentMessage{ID: nextID}, nil
+		case *tg.UploadSaveFilePartRequest:
+			return &tg.BoolTrue{}, nil
+		default:
+			return nil, fmt.Errorf("unexpected request %T", request)
+		}
+	}
+
+	return fake
+}
+
+func newTestUserBot(t *testing.T, fake *fakeMTProto, config *Config) *TelegramBot {
+	t.Helper()
+
+	bot, err := NewTelegramBot(config, nil)
+	if err != nil {
+		t.Fatalf("NewTelegramBot() error = %v", err)
+	}
+
+	bot.user = newTelegramUserClient(tg.NewClient(fake), config)
+
+	return bot
+}
+
+func TestTelegramUserSendMessage(t *testing.T) {
+	fake := newFakeMTProto()
+	config := &Config{
+		Telegram: TelegramConfig{Via: viaUser, ChatID: "@family_mail", MessageThreadID: 5},
+	}
+	bot := newTestUserBot(t, fake, config)
+	ctx := context.Background()
+
+	n := Notification{
+		Message: Message{Subject: "Trip", From: "office@school.example.com", Date: "today"},
+		Content: "See [plan](https://x.example)",
+	}
+
+	sent, err := bot.sendNotification(ctx, n, TelegramThread{})
+	if err != nil {
+		t.Fatalf("sendNotification() error = %v", err)
+	}
+
+	want := SentMessage{Destination: "@family_mail", ChatID: -1000000000042, MessageID: 101, TopicID: 5}
+	if sent != want {
+		t.Errorf("sendNotification() = %+v, want %+v", sent, want)
+	}
+
+	request := fake.requests[1].(*tg.MessagesSendMessageRequest)
+
+	if channel, ok := request.Peer.(*tg.InputPeerChannel); !ok || channel.AccessHash != 4242 {
+		t.Errorf("peer = %v", request.Peer)
+	}
+
+	if len(request.Entities) != 2 {
+		t.Fatalf("entities = %v, want bold subject and link", request.Entities)
+	}
+
+	if replyTo, _ := request.GetReplyTo(); replyTo.(*tg.InputReplyToMessage).ReplyToMsgID != 5 {
+		t.Errorf("reply_to = %+v, want the forum topic", replyTo)
+	}
+
+	// The follow-up replies to the first message inside the topic, the peer is cached
+	reply := Notification{
+		Message: Message{Subject: "Re: Trip", From: "office@school.example.com", Date: "today"},
+		Content: "ok",
+		Silent:  true,
+	}
+
+	_, err = bot.sendNotification(ctx, reply, TelegramThread{Destination: "@family_mail", MessageID: sent.MessageID, TopicID: 5})
+	if err != nil {
+		t.Fatalf("sendNotification() follow-up error = %v", err)
+	}
+
+	if len(fake.requests) != 3 {
+		t.Fatalf("sent %d requests, want the username resolved once", len(fake.requests))
+	}
+
+	followUp := fake.requests[2].(*tg.MessagesSendMessageRequest)
+	if !followUp.Silent {
+		t.Error("follow-up was not sent silently")
+	}
+
+	replyTo, _ := followUp.GetReplyTo()
+	if reply := replyTo.(*tg.InputReplyToMessage); reply.ReplyToMsgID != 101 || reply.TopMsgID != 5 {
+		t.Errorf("follow-up reply_to = %+v", reply)
+	}
+}
+
+func TestTelegramUserSendFile(t *testing.T) {
+	fake := newFakeMTProto()
+	client := newTelegramUserClient(tg.NewClient(fake), &Config{})
+
+	data := bytes.Repeat([]byte("x"), 1024)
+
+	sent, err := client.SendFile(context.Background(), "-123", "report.pdf", bytes.NewReader(data), int64(len(data)), "*Report*")
+	if err != nil {
+		t.Fatalf("SendFile() error = %v", err)
+	}
+
+	if sent.ChatID != -123 || sent.MessageID != 101 {
+		t.Errorf("SendFile() = %+v", sent)
+	}
+
+	request := fake.requests[len(fake.requests)-1].(*tg.MessagesSendMediaRequest)
+	media := request.Media.(*tg.InputMediaUploadedDocument)
+
+	if media.MimeType != "application/pdf" || request.Message != "Report" {
+		t.Errorf("media = %+v, message = %q", media, request.Message)
+	}
+
+	if _, ok := request.Peer.(*tg.InputPeerChat); !ok {
+		t.Errorf("peer = %v, want a basic group", request.Peer)
+	}
+}
+
+func TestMarkdownEntities(t *testing.T) {
+	text, entities := markdownEntities("📅 *Trip* [plan](https://x.example) [](https://y.example)")
+
+	if text != "📅 Trip plan https://y.example" {
+		t.Errorf("text = %q", text)
+	}
+
+	// Offsets count UTF-16 code units, the emoji takes two
+	bold, ok := entities[0].(*tg.MessageEntityBold)
+	if !ok || bold.Offset != 3 || bold.Length != 4 {
+		t.Errorf("bold entity = %+v", entities[0])
+	}
+
+	link, ok := entities[1].(*tg.MessageEntityTextURL)
+	if !ok || link.Offset != 8 || link.URL != "https://x.example" {
+		t.Errorf("link entity = %+v", entities[1])
+	}
+}
+
+func TestValidateTelegramVia(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *Config
+		wantErr bool
+	}{
+		{name: "bot", config: &Config{Telegram: TelegramConfig{BotToken: "t"}}},
+		{name: "user without bot token", config: &Config{Telegram: TelegramConfig{Via: viaUser}}},
+		{
+			name:    "user with replies needs a bot",
+			config:  &Config{Telegram: TelegramConfig{Via: viaUser}, Reply: ReplyConfig{Enabled: true}},
+			wantErr: true,
+		},
+		{
+			name: "one route as user",
+			config: &Config{
+				Telegram: TelegramConfig{BotToken: "t", Topics: topicsBySender},
+				Routes:   []RouteConfig{{Name: "big", Destination: DestinationConfig{Via: viaUser, MessageThreadID: 3}}},
+			},
+		},
+		{name: "unknown via", config: &Config{Telegram: TelegramConfig{BotToken: "t", Via: "userbot"}}, wantErr: true},
+		{
+			name:    "user with automatic topics",
+			config:  &Config{Telegram: TelegramConfig{Via: viaUser, Topics: topicsByRoute}},
+			wantErr: true,
+		},
+		{
+			name:    "user with topic threading",
+			config:  &Config{Telegram: TelegramConfig{Via: viaUser, Threading: threadingTopic}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewTelegramBot(tt.config, nil); (err != nil) != tt.wantErr {
+				t.Errorf("NewTelegramBot() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,35 +2,99 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
 	"strings"
+	"time"
 
 	"github.com/google/generative-ai-go/genai"
 	"google.golang.org/api/option"
 )
 
 const (
-	defaultModelName      = "gemini-2.0-flash"
-	defaultPromptTemplate = "Clean up and translate the following email to {target_language}.\n\nKeep ALL meaningful content.\nRemove only pure technical noise: email footer links (\"Unsubscribe\", \"Update settings\", \"Read more on ...\"), navigation menus, and system-generated metadata.\nTranslate every non-{target_language} word. Return ONLY the result, without any additional text, markers, or explanations:\n\n{text}"
+	defaultModelName            = "gemini-2.0-flash"
+	defaultPromptTemplate       = "Clean up and translate the following email to {target_language}.\n\nKeep ALL meaningful content.\nRemove only pure technical noise: email footer links (\"Unsubscribe\", \"Update settings\", \"Read more on ...\"), navigation menus, and system-generated metadata.\nTranslate every non-{target_language} word. Return ONLY the result, without any additional text, markers, or explanations:\n\n{text}"
+	defaultDigestPromptTemplate = "Summarize the following email in {target_language} in at most two sentences. Mention dates, amounts and anything the reader has to do. Return ONLY the summary, without any additional text, markers, or explanations:\n\n{text}"
+	defaultReplyPromptTemplate  = "Below is an email and a reply to it written in {target_language}. Detect the language the original email is written in and translate the reply into that language. If the email is already in {target_language}, return the reply unchanged. Keep the tone and line breaks. Return ONLY the translated reply, without any additional text, markers, or explanations.\n\nOriginal email:\n{original}\n\nReply:\n{text}"
 )
 
 type TranslationService struct {
-	client    *genai.Client
-	config    *Config
-	translate func(ctx context.Context, text string) (string, error)
+	// client is nil when no model of the chain runs on Gemini
+	client *genai.Client
+	config *Config
+	safety []*genai.SafetySetting
+	// models is the fallback chain, asked in order until one answers
+	models  []chainModel
+	prompts promptTemplates
+	// cache is nil unless translation.cache is enabled
+	cache          *TranslationCache
+	translate      func(ctx context.Context, msg Message) (Translation, error)
+	translateReply func(ctx context.Context, reply, original string) (string, error)
+	summarize      func(ctx context.Context, msg Message, promptTemplate string) (string, error)
+	extract        func(ctx context.Context, msg Message) (*Extraction, error)
+	extractEvents  func(ctx context.Context, msg Message, promptTemplate string, location *time.Location) ([]CalendarEvent, error)
+	countTokens    func(ctx context.Context, text string) (int, error)
+	generateText   func(ctx context.Context, prompt string) (string, error)
 }
 
 func NewTranslationService(config *Config) (*TranslationService, error) {
-	client, err := genai.NewClient(context.Background(), option.WithAPIKey(config.Translation.GeminiAPIKey))
+	if !validProcessing(config.Translation.Processing) {
+		return nil, fmt.Errorf("invalid processing %q: use %q or %q",
+			config.Translation.Processing, processingTranslate, processingExtract)
+	}
+
+	for _, route := range config.Routes {
+		if !validProcessing(route.Processing) {
+			return nil, fmt.Errorf("invalid processing %q in route %q: use %q or %q",
+				route.Processing, route.Name, processingTranslate, processingExtract)
+		}
+	}
+
+	if err := validateCalendar(config); err != nil {
+		return nil, err
+	}
+
+	if err := validatePrompts(config); err != nil {
+		return nil, err
+	}
+
+	safety, err := safetySettings(config.Translation.SafetySettings)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create Gemini client: %v", err)
+		return nil, err
 	}
 
 	service := &TranslationService{
-		client: client,
 		config: config,
+		safety: safety,
+	}
+
+	if usesGemini(config.Translation) {
+		service.client, err = genai.NewClient(context.Background(), option.WithAPIKey(config.Translation.GeminiAPIKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Gemini client: %v", err)
+		}
 	}
+
+	service.models, err = service.newModels()
+	if err != nil {
+		return nil, err
+	}
+
 	service.translate = service.defaultTranslate
+	service.translateReply = service.defaultTranslateReply
+	service.summarize = service.defaultSummarize
+	service.extract = service.defaultExtract
+	service.extractEvents = service.defaultExtractEvents
+	service.countTokens = service.defaultCountTokens
+	service.generateText = service.generate
+
+	if config.Translation.Cache.Enabled {
+		service.cache, err = NewTranslationCache(config.Translation.Cache)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return service, nil
 }
@@ -41,45 +105,189 @@ func (s *TranslationService) Close() {
 	}
 }
 
-func (s *TranslationService) Translate(ctx context.Context, text string) (string, error) {
-	return s.translate(ctx, text)
+// Translate translates an email body and the headers its route asks for, reusing the cached
+// translation of an identical prompt
+func (s *TranslationService) Translate(ctx context.Context, msg Message) (Translation, error) {
+	if s.cache == nil || msg.Content == "" {
+		return s.translate(ctx, msg)
+	}
+
+	// The whole prompt is the key, so a prompt that uses the subject or date is cached per email
+	prompt, err := s.prompts.render(routePromptTemplate(s.config, msg.Route), s.promptData(msg))
+	if err != nil {
+		return Translation{}, err
+	}
+
+	keyParts := []string{s.modelName(), prompt}
+	if request := s.headerRequest(msg); !request.empty() {
+		keyParts = append(keyParts, request.key())
+	}
+
+	key := cacheKey(keyParts...)
+
+	translated, model, ok := s.cache.Get(key)
+
+	hits, misses := s.cache.Stats()
+	if ok {
+		log.Printf("Translation cache hit (%d hits, %d misses)", hits, misses)
+		recordModel(ctx, model)
+
+		return translated, nil
+	}
+
+	log.Printf("Translation cache miss (%d hits, %d misses)", hits, misses)
+
+	// The models that answered are kept with the translation for later cache hits
+	translateCtx, usage := withModelUsage(ctx)
+
+	translated, err = s.translate(translateCtx, msg)
+	if err != nil {
+		return Translation{}, err
+	}
+
+	models := usage.Models()
+	recordModel(ctx, models...)
+
+	if err := s.cache.Put(key, translated, strings.Join(models, ", ")); err != nil {
+		log.Printf("Error caching translation: %v", err)
+	}
+
+	return translated, nil
+}
+
+// modelName returns the first model of the chain
+func (s *TranslationService) modelName() string {
+	return modelConfigs(s.config.Translation)[0].Name
 }
 
-// TODO:
-// 2025/04/01 06:22:56 Processing message 1/1: Aprīļa rēķins
-// 2025/04/01 06:22:56 Processing message: Aprīļa rēķins
-// 2025/04/01 06:22:56 Processing message content...
-// 2025/04/01 06:22:56 Error processing message: error processing message content: empty text provided for translation
-func (s *TranslationService) defaultTranslate(ctx context.Context, text string) (string, error) {
-	if text == "" {
-		return "", fmt.Errorf("empty text provided for translation")
+func (s *TranslationService) defaultTranslate(ctx context.Context, msg Message) (Translation, error) {
+	if msg.Content == "" {
+		return Translation{}, errEmptyContent
 	}
 
-	// Use the configured model name or fall back to a default
-	modelName := s.config.Translation.ModelName
-	if modelName == "" {
-		modelName = defaultModelName
+	tokens, err := s.countTokens(ctx, msg.Content)
+	if err != nil {
+		return Translation{}, err
 	}
 
-	// Use the configured prompt template or fall back to default
-	promptTemplate := s.config.Translation.PromptTemplate
-	if promptTemplate == "" {
-		promptTemplate = defaultPromptTemplate
+	// Long emails are translated in parts so neither the prompt nor the answer hits the model limits
+	chunks := splitChunks(msg.Content, tokens, s.maxChunkTokens())
+	if len(chunks) > 1 {
+		log.Printf("Translating %d tokens in %d chunks", tokens, len(chunks))
 	}
 
-	// Replace variables in the prompt template
-	prompt := strings.ReplaceAll(promptTemplate, "{target_language}", s.config.Translation.TargetLanguage)
-	prompt = strings.ReplaceAll(prompt, "{text}", text)
+	promptTemplate := routePromptTemplate(s.config, msg.Route)
+	data := s.promptData(msg)
+	request := s.headerRequest(msg)
 
-	model := s.client.GenerativeModel(modelName)
-	resp, err := model.GenerateContent(ctx, genai.Text(prompt))
+	// Only the first chunk writes the headers, the other chunks do not touch them
+	var result Translation
+
+	translated, err := translateChunks(ctx, chunks, s.chunkConcurrency(), func(ctx context.Context, i int, chunk string) (string, error) {
+		chunkData := data
+		chunkData.Text = chunk
+
+		prompt, err := s.prompts.render(promptTemplate, chunkData)
+		if err != nil {
+			return "", err
+		}
+
+		// The headers are translated together with the first chunk, in the same call
+		if i == 0 && !request.empty() {
+			headers, err := s.translateHeaders(ctx, prompt, request)
+			if err == nil {
+				result = headers
+
+				return headers.Content, nil
+			}
+
+			if !errors.Is(err, errInvalidHeaders) {
+				return "", err
+			}
+
+			log.Printf("Header translation failed, translating the body alone: %v", err)
+		}
+
+		return s.generateText(ctx, prompt)
+	})
+	if err != nil {
+		return Translation{}, err
+	}
+
+	result.Content = strings.Join(translated, "\n\n")
+
+	return result, nil
+}
+
+// translateHeaders asks for the body prompt and the headers of request in one JSON answer
+func (s *TranslationService) translateHeaders(ctx context.Context, bodyPrompt string, request headerRequest) (Translation, error) {
+	prompt, schema := request.prompt(bodyPrompt, s.config.Translation.TargetLanguage)
+
+	raw, err := s.generateJSON(ctx, prompt, schema)
+	if err != nil {
+		return Translation{}, err
+	}
+
+	return parseHeaderTranslation(raw, request)
+}
+
+// TranslateReply translates a reply written in the target language back into
+// the language of the original email
+func (s *TranslationService) TranslateReply(ctx context.Context, reply, original string) (string, error) {
+	return s.translateReply(ctx, reply, original)
+}
+
+func (s *TranslationService) defaultTranslateReply(ctx context.Context, reply, original string) (string, error) {
+	if reply == "" {
+		return "", fmt.Errorf("empty reply provided for translation")
+	}
+
+	promptTemplate := s.config.Reply.PromptTemplate
+	if promptTemplate == "" {
+		promptTemplate = defaultReplyPromptTemplate
+	}
+
+	prompt, err := s.prompts.render(promptTemplate, PromptData{
+		TargetLanguage: s.config.Translation.TargetLanguage,
+		Text:           reply,
+		Language:       detectLanguage(original),
+		Original:       original,
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to generate content: %v", err)
+		return "", err
+	}
+
+	return s.generate(ctx, prompt)
+}
+
+// Summarize condenses an email into a short summary in the target language for digests.
+// An empty promptTemplate uses the default summary prompt.
+func (s *TranslationService) Summarize(ctx context.Context, msg Message, promptTemplate string) (string, error) {
+	return s.summarize(ctx, msg, promptTemplate)
+}
+
+func (s *TranslationService) defaultSummarize(ctx context.Context, msg Message, promptTemplate string) (string, error) {
+	if msg.Content == "" {
+		return "", errEmptyContent
+	}
+
+	if promptTemplate == "" {
+		promptTemplate = defaultDigestPromptTemplate
 	}
 
-	if len(resp.Candidates) == 0 {
-		return "", fmt.Errorf("no response from model")
+	prompt, err := s.prompts.render(promptTemplate, s.promptData(msg))
+	if err != nil {
+		return "", err
 	}
 
-	return strings.TrimSpace(fmt.Sprint(resp.Candidates[0].Content.Parts[0])), nil
+	return s.generate(ctx, prompt)
+}
+
+func (s *TranslationService) generate(ctx context.Context, prompt string) (string, error) {
+	return s.generateWith(ctx, prompt, nil)
+}
+
+// generateJSON asks for an answer in the JSON shape of schema
+func (s *TranslationService) generateJSON(ctx context.Context, prompt string, schema *genai.Schema) (string, error) {
+	return s.generateWith(ctx, prompt, schema)
 }